@@ -0,0 +1,300 @@
+package tinydb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 增量备份，备份目录的结构为
+//
+//	shared/   所有备份共用的sstable文件，已经存在的文件不会被重复复制
+//	<id>/     每个备份自己的日志文件、列族清单以及记录备份内容的meta.json
+//
+// sstable文件写入之后不会再被修改，相同的文件只需要备份一次
+type BackupEngine struct {
+	dir  string
+	lock sync.Mutex
+}
+
+// 一个备份的信息
+type BackupInfo struct {
+	ID        int
+	Timestamp time.Time
+	//备份中所有文件的总大小
+	Size int64
+	//备份中的文件数量，以及本次备份新复制的sstable文件数量
+	Files    int
+	NewFiles int
+}
+
+// 备份中的一个文件
+type backupFile struct {
+	//相对于数据目录的路径
+	Name string
+	//保存在shared目录中的文件名，为空表示保存在备份自己的目录中
+	Shared  string `json:",omitempty"`
+	Size    int64
+	ModTime time.Time
+}
+
+// 保存在每个备份目录中的meta.json
+type backupMeta struct {
+	BackupInfo
+	Contents []backupFile
+}
+
+const (
+	sharedDir      = "shared"
+	backupMetaName = "meta.json"
+)
+
+// 打开或者创建一个备份目录
+func OpenBackupEngine(dir string) (*BackupEngine, error) {
+	if err := os.MkdirAll(filepath.Join(dir, sharedDir), 0755); err != nil {
+		return nil, err
+	}
+	return &BackupEngine{dir: dir}, nil
+}
+
+// 备份数据库当前的状态，只复制备份目录中还没有的sstable文件
+func (e *BackupEngine) CreateBackup(db *Database) (BackupInfo, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	metas, err := e.metas()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	meta := backupMeta{BackupInfo: BackupInfo{ID: 1, Timestamp: time.Now()}}
+	if len(metas) > 0 {
+		meta.ID = metas[len(metas)-1].ID + 1
+	}
+	files, release, err := db.liveFiles()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	defer release()
+
+	//备份自己的目录在meta.json写入之后才重命名为最终的名称，中途失败的备份不会被读取
+	tmp := filepath.Join(e.dir, strconv.Itoa(meta.ID)+".tmp")
+	os.RemoveAll(tmp)
+	for _, file := range files {
+		entry := backupFile{Name: file.name, Size: int64(len(file.data)), ModTime: file.modTime}
+		if file.path == "" {
+			if err = writeLiveFile(filepath.Join(tmp, file.name), file, false); err != nil {
+				break
+			}
+		} else {
+			var added bool
+			if entry.Shared, entry.Size, added, err = e.addShared(file); err != nil {
+				break
+			}
+			if added {
+				meta.NewFiles++
+			}
+		}
+		meta.Size += entry.Size
+		meta.Contents = append(meta.Contents, entry)
+	}
+	meta.Files = len(meta.Contents)
+	if err == nil {
+		err = writeJSON(filepath.Join(tmp, backupMetaName), meta)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(e.dir, strconv.Itoa(meta.ID)))
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return BackupInfo{}, err
+	}
+	return meta.BackupInfo, nil
+}
+
+// 将sstable文件复制到shared目录中，文件已经存在时跳过
+// 文件名由原来的路径、大小以及文件尾的校验和组成，文件标号被重新使用时不会冲突
+func (e *BackupEngine) addShared(file liveFile) (string, int64, bool, error) {
+	info, err := os.Stat(file.path)
+	if err != nil {
+		return "", 0, false, err
+	}
+	sum, err := tailChecksum(file.path, info.Size())
+	if err != nil {
+		return "", 0, false, err
+	}
+	name := fmt.Sprintf("%s-%d-%08x.db", strings.TrimSuffix(strings.ReplaceAll(file.name, "/", "-"), ".db"), info.Size(), sum)
+	dst := filepath.Join(e.dir, sharedDir, name)
+	if _, err := os.Stat(dst); err == nil {
+		return name, info.Size(), false, nil
+	}
+	if err := copyFile(file.path, dst+".tmp"); err != nil {
+		os.Remove(dst + ".tmp")
+		return "", 0, false, err
+	}
+	return name, info.Size(), true, os.Rename(dst+".tmp", dst)
+}
+
+// 计算文件最后64字节的校验和，包括sstable的文件尾
+func tailChecksum(path string, size int64) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	tail := make([]byte, min(size, 64))
+	if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil && err != io.EOF {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(tail), nil
+}
+
+// 获取所有备份的信息，按照编号从小到大排列
+func (e *BackupEngine) Backups() ([]BackupInfo, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	metas, err := e.metas()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]BackupInfo, 0, len(metas))
+	for _, meta := range metas {
+		infos = append(infos, meta.BackupInfo)
+	}
+	return infos, nil
+}
+
+// 将备份恢复到dir中，dir不能已经存在，恢复之后可以作为数据库打开
+func (e *BackupEngine) Restore(id int, dir string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("restore directory %s already exists", dir)
+	}
+	meta, err := e.meta(id)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Clean(dir) + ".tmp"
+	os.RemoveAll(tmp)
+	for _, file := range meta.Contents {
+		dst := filepath.Join(tmp, file.Name)
+		if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			break
+		}
+		src := filepath.Join(e.dir, strconv.Itoa(id), file.Name)
+		if file.Shared != "" {
+			src = filepath.Join(e.dir, sharedDir, file.Shared)
+		}
+		if err = copyFile(src, dst); err != nil {
+			break
+		}
+		if file.Shared == "" {
+			if err = os.Chtimes(dst, file.ModTime, file.ModTime); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, dir)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
+
+// 删除一个备份，并删除不再被任何备份使用的sstable文件
+func (e *BackupEngine) DeleteBackup(id int) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if _, err := e.meta(id); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(e.dir, strconv.Itoa(id))); err != nil {
+		return err
+	}
+	metas, err := e.metas()
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, meta := range metas {
+		for _, file := range meta.Contents {
+			used[file.Shared] = true
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(e.dir, sharedDir))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !used[entry.Name()] {
+			if err := os.Remove(filepath.Join(e.dir, sharedDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 读取一个备份的meta.json
+func (e *BackupEngine) meta(id int) (backupMeta, error) {
+	var meta backupMeta
+	data, err := os.ReadFile(filepath.Join(e.dir, strconv.Itoa(id), backupMetaName))
+	if errors.Is(err, os.ErrNotExist) {
+		return meta, fmt.Errorf("backup %d does not exist", id)
+	} else if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// 读取所有完整的备份，按照编号从小到大排列
+func (e *BackupEngine) metas() ([]backupMeta, error) {
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]backupMeta, 0)
+	for _, entry := range entries {
+		id, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		meta, err := e.meta(id)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].ID < metas[j].ID
+	})
+	return metas, nil
+}
+
+// 将v编码成json写入文件
+func writeJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return writeFileSync(name, data)
+}
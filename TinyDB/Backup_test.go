@@ -0,0 +1,143 @@
+package tinydb_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"tinydb"
+	"tinydb/config"
+)
+
+// 写入key为prefix000到prefix(n-1)的n个值
+func setKeys(cf *tinydb.ColumnFamily, prefix string, n int, value string) {
+	for i := 0; i < n; i++ {
+		tinydb.SetCF(cf, fmt.Sprintf("%s%03d", prefix, i), value)
+	}
+}
+
+func expectKeys(t *testing.T, cf *tinydb.ColumnFamily, prefix string, n int, value string) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		expectValue(t, cf, fmt.Sprintf("%s%03d", prefix, i), value)
+	}
+}
+
+func sharedFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(dir, "shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// 检查点包含sstable文件、日志中还没有持久化的数据以及所有列族，之后的写入不会影响检查点
+func TestCheckpointOpen(t *testing.T) {
+	db := openDB(t, t.TempDir(), config.Config{})
+	users := createFamily(t, db, "users")
+	setKeys(db.ColumnFamily, "k", 50, "table")
+	db.Flush()
+	tinydb.SetCF(db.ColumnFamily, "mem", "wal")
+	tinydb.SetCF(users, "u", "alice")
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	if err := db.Checkpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(dir); err == nil {
+		t.Errorf("Checkpoint into an existing directory succeeded")
+	}
+	tinydb.SetCF(db.ColumnFamily, "after", "v")
+	tinydb.SetCF(db.ColumnFamily, "k000", "changed")
+
+	cp := openDB(t, dir, config.Config{})
+	expectKeys(t, cp.ColumnFamily, "k", 50, "table")
+	expectValue(t, cp.ColumnFamily, "mem", "wal")
+	expectValue(t, cp.ColumnFamily, "after", "")
+	expectValue(t, getFamily(t, cp, "users"), "u", "alice")
+}
+
+// 增量备份复用shared目录中已有的sstable文件，删除备份时只删除不再被使用的文件
+func TestBackupRestore(t *testing.T) {
+	db := openDB(t, t.TempDir(), config.Config{})
+	backupDir := t.TempDir()
+	engine, err := tinydb.OpenBackupEngine(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := func(newFiles int) tinydb.BackupInfo {
+		t.Helper()
+		info, err := engine.CreateBackup(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.NewFiles != newFiles {
+			t.Errorf("backup %d copied %d sstables, want %d", info.ID, info.NewFiles, newFiles)
+		}
+		return info
+	}
+	restore := func(id int) *tinydb.Database {
+		t.Helper()
+		dir := filepath.Join(t.TempDir(), "restore")
+		if err := engine.Restore(id, dir); err != nil {
+			t.Fatal(err)
+		}
+		return openDB(t, dir, config.Config{})
+	}
+
+	//第一个备份包含一个sstable文件以及日志中的数据
+	setKeys(db.ColumnFamily, "a", 50, "1")
+	db.Flush()
+	tinydb.SetCF(db.ColumnFamily, "mem", "wal")
+	first := backup(1)
+
+	//第二个备份复用第一个sstable文件，只复制新的文件
+	setKeys(db.ColumnFamily, "b", 50, "2")
+	db.Flush()
+	second := backup(1)
+	if n := sharedFiles(t, backupDir); n != 2 {
+		t.Errorf("shared has %d files, want 2", n)
+	}
+
+	//压缩之后的文件都是新的
+	db.CompactRange("", "")
+	third := backup(1)
+	if n := sharedFiles(t, backupDir); n != 3 {
+		t.Errorf("shared has %d files, want 3", n)
+	}
+
+	restored := restore(first.ID)
+	expectKeys(t, restored.ColumnFamily, "a", 50, "1")
+	expectKeys(t, restored.ColumnFamily, "b", 50, "")
+	expectValue(t, restored.ColumnFamily, "mem", "wal")
+
+	//第一个sstable文件仍然被第二个备份使用
+	if err := engine.DeleteBackup(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := sharedFiles(t, backupDir); n != 3 {
+		t.Errorf("shared has %d files after deleting backup %d, want 3", n, first.ID)
+	}
+	if err := engine.DeleteBackup(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n := sharedFiles(t, backupDir); n != 1 {
+		t.Errorf("shared has %d files after deleting backup %d, want 1", n, second.ID)
+	}
+	backups, err := engine.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].ID != third.ID {
+		t.Errorf("Backups() = %+v, want only backup %d", backups, third.ID)
+	}
+	if err := engine.Restore(first.ID, filepath.Join(t.TempDir(), "deleted")); err == nil {
+		t.Errorf("restoring a deleted backup succeeded")
+	}
+
+	restored = restore(third.ID)
+	expectKeys(t, restored.ColumnFamily, "a", 50, "1")
+	expectKeys(t, restored.ColumnFamily, "b", 50, "2")
+	expectValue(t, restored.ColumnFamily, "mem", "wal")
+}
@@ -0,0 +1,335 @@
+package tinydb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"tinydb/kv"
+	"tinydb/wal"
+)
+
+// 保留的日志文件所在的目录
+const archiveDir = "archive"
+
+// 保存最后一个序列号的文件，日志被清空之后重新启动时从这里恢复序列号
+const sequenceName = "sequence"
+
+// 内存中保留的最近写入的变更数量，订阅者落后更多时从日志文件中读取
+const changeBufferSize = 4096
+
+// 订阅者的通道中缓冲的变更数量，订阅者处理不及时的时候从日志中读取，不会阻塞写入
+const subscriptionBuffer = 256
+
+// 需要读取的变更已经不在保留的日志中
+var ErrChangesUnavailable = errors.New("tinydb: changes are no longer retained")
+
+// 数据库已经被关闭
+var ErrClosed = errors.New("tinydb: database closed")
+
+// 一次已经写入日志的修改
+type Mutation struct {
+	//序列号，从1开始递增，重新启动之后继续递增
+	Seq uint64
+	//修改的列族的名称
+	Family string
+	//Delete为true表示删除，Merge为true表示合并操作数
+	kv.Value
+}
+
+// 订阅者，按照序列号的顺序从C中接收变更
+// C被关闭之后，Err返回关闭的原因，调用Close关闭时返回nil，数据库被关闭时返回ErrClosed
+type Subscription struct {
+	C    <-chan Mutation
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// 停止订阅，C会被关闭
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// 订阅结束的原因，只有在C被关闭之后才可以调用
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// 最后一个已经写入日志的变更的序列号
+func (db *Database) LatestSequence() uint64 {
+	return db.changes.latest()
+}
+
+// 从序列号fromSeq开始订阅所有列族的变更，fromSeq为0时从保留的最早的变更开始
+// 订阅者记录处理过的最后一个序列号，重新启动之后从下一个序列号继续订阅
+// 日志被清空之后就不能再读取其中的变更，需要通过WALRetentionSize保留已经持久化的日志
+func (db *Database) Subscribe(fromSeq uint64) (*Subscription, error) {
+	select {
+	case <-db.closing:
+		return nil, ErrClosed
+	default:
+	}
+	if fromSeq > 0 {
+		oldest, err := db.oldestSequence()
+		if err != nil {
+			return nil, err
+		}
+		if fromSeq < oldest {
+			return nil, fmt.Errorf("%w: sequence %d, oldest retained %d", ErrChangesUnavailable, fromSeq, oldest)
+		}
+	}
+	c := make(chan Mutation, subscriptionBuffer)
+	s := &Subscription{C: c, done: make(chan struct{})}
+	go db.follow(s, c, fromSeq)
+	return s, nil
+}
+
+// 持续读取变更发送给订阅者，订阅者处理不及时的时候阻塞在发送上，数据库被关闭时结束
+func (db *Database) follow(s *Subscription, c chan<- Mutation, next uint64) {
+	defer close(c)
+	for {
+		records, ok, wait := db.changes.since(next)
+		if !ok {
+			var err error
+			if records, err = db.readChanges(next); err != nil {
+				s.err = err
+				return
+			}
+		}
+		if len(records) == 0 {
+			select {
+			case <-wait:
+				continue
+			case <-s.done:
+				return
+			case <-db.closing:
+				s.err = ErrClosed
+				return
+			}
+		}
+		for _, record := range records {
+			if record.Seq < next {
+				continue
+			}
+			//序列号是连续的，中间缺少的变更所在的日志已经被清空
+			if next > 0 && record.Seq > next {
+				s.err = fmt.Errorf("%w: sequence %d, next retained %d", ErrChangesUnavailable, next, record.Seq)
+				return
+			}
+			next = record.Seq + 1
+			//已经被删除的列族的变更不再发送
+			cf := db.familyByID(record.Family)
+			if cf == nil {
+				continue
+			}
+			select {
+			case c <- Mutation{Seq: record.Seq, Family: cf.name, Value: record.Value}:
+			case <-s.done:
+				return
+			case <-db.closing:
+				s.err = ErrClosed
+				return
+			}
+		}
+	}
+}
+
+// 从保留的日志和当前的两个日志文件中读取序列号不小于next的所有记录
+// 读取期间持有flushLock，日志文件不会被清空或者移动
+func (db *Database) readChanges(next uint64) ([]wal.Record, error) {
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+
+	segments, err := wal.Segments(path.Join(db.dir, archiveDir))
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(segments)+2)
+	for _, segment := range segments {
+		if segment.Last >= next {
+			paths = append(paths, segment.Path)
+		}
+	}
+	paths = append(paths, db.Wal1.Pathname, db.Wal2.Pathname)
+	records := make([]wal.Record, 0)
+	for _, name := range paths {
+		//正在写入的日志末尾可能有不完整的记录，只读取完整的部分
+		salvaged, _ := wal.Salvage(name)
+		for _, record := range salvaged {
+			if record.Seq != 0 && record.Seq >= next {
+				records = append(records, record)
+			}
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+	//需要的变更所在的日志已经被清空或者删除
+	oldest := db.changes.latest() + 1
+	if len(segments) > 0 {
+		oldest = segments[0].First
+	} else if len(records) > 0 {
+		oldest = records[0].Seq
+	}
+	if next > 0 && next < oldest {
+		return nil, fmt.Errorf("%w: sequence %d, oldest retained %d", ErrChangesUnavailable, next, oldest)
+	}
+	return records, nil
+}
+
+// 仍然可以读取的最早的序列号
+func (db *Database) oldestSequence() (uint64, error) {
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+
+	segments, err := wal.Segments(path.Join(db.dir, archiveDir))
+	if err != nil {
+		return 0, err
+	}
+	if len(segments) > 0 {
+		return segments[0].First, nil
+	}
+	oldest := db.changes.latest() + 1
+	for _, w := range []*wal.Wal{db.Wal1, db.Wal2} {
+		salvaged, _ := wal.Salvage(w.Pathname)
+		for _, record := range salvaged {
+			if record.Seq != 0 && record.Seq < oldest {
+				oldest = record.Seq
+			}
+		}
+	}
+	return oldest, nil
+}
+
+// 清空已经持久化的日志文件，配置了WALRetentionSize时移动到archive目录中保留
+func (db *Database) resetWal(w *wal.Wal) {
+	db.saveSequence()
+	if db.con.WALRetentionSize <= 0 {
+		w.Reset()
+		return
+	}
+	dir := path.Join(db.dir, archiveDir)
+	w.Archive(dir)
+	//从最旧的文件开始删除，直到总大小不超过阈值
+	segments, err := wal.Segments(dir)
+	if err != nil {
+		db.logger().Error("failed to list the wal archive", "file", dir, "error", err)
+		return
+	}
+	var size int64
+	for _, segment := range segments {
+		size += segment.Size
+	}
+	limit := int64(db.con.WALRetentionSize) * 1024 * 1024
+	for _, segment := range segments {
+		if size <= limit {
+			break
+		}
+		if err := os.Remove(segment.Path); err != nil {
+			db.logger().Error("failed to remove the archived wal", "file", segment.Path, "error", err)
+			return
+		}
+		size -= segment.Size
+	}
+}
+
+// 将最后一个序列号写入sequence文件
+func (db *Database) saveSequence() {
+	name := path.Join(db.dir, sequenceName)
+	data := []byte(strconv.FormatUint(db.seq.Load(), 10))
+	if err := os.WriteFile(name+".tmp", data, 0644); err != nil {
+		db.logger().Error("failed to save the sequence", "file", name, "error", err)
+		return
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		db.logger().Error("failed to save the sequence", "file", name, "error", err)
+	}
+}
+
+// 读取sequence文件中的序列号，文件不存在时返回0
+func (db *Database) loadSequence() uint64 {
+	data, err := os.ReadFile(path.Join(db.dir, sequenceName))
+	if err != nil {
+		return 0
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		db.logger().Warn("the sequence file is corrupted", "error", err)
+		return 0
+	}
+	return seq
+}
+
+// 保留的日志中最后一个序列号
+func (db *Database) archivedSequence() uint64 {
+	segments, _ := wal.Segments(path.Join(db.dir, archiveDir))
+	if len(segments) == 0 {
+		return 0
+	}
+	return segments[len(segments)-1].Last
+}
+
+// 最近写入的变更，订阅者追上之后直接从这里读取，不需要读取日志文件
+type changeHub struct {
+	lock sync.Mutex
+	//按照序列号从小到大排列
+	records []wal.Record
+	//最后一个已经写入的序列号
+	last uint64
+	//有新的变更写入时被关闭
+	notify chan struct{}
+}
+
+func (h *changeHub) init(last uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.last = last
+	h.notify = make(chan struct{})
+}
+
+// 日志写入成功之后调用，调用者持有日志的锁，保证按照序列号的顺序调用
+func (h *changeHub) append(records []wal.Record) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.records = append(h.records, records...)
+	if len(h.records) > 2*changeBufferSize {
+		h.records = append([]wal.Record(nil), h.records[len(h.records)-changeBufferSize:]...)
+	}
+	h.last = h.records[len(h.records)-1].Seq
+	close(h.notify)
+	h.notify = make(chan struct{})
+}
+
+func (h *changeHub) latest() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.last
+}
+
+// 获取内存中序列号不小于next的变更，ok为false表示需要从日志文件中读取
+// 没有新的变更时返回的通道会在下一次写入时被关闭
+func (h *changeHub) since(next uint64) ([]wal.Record, bool, chan struct{}) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if next > h.last {
+		return nil, true, h.notify
+	}
+	if len(h.records) == 0 || h.records[0].Seq > next {
+		return nil, false, h.notify
+	}
+	index := sort.Search(len(h.records), func(i int) bool {
+		return h.records[i].Seq >= next
+	})
+	return h.records[index:], true, h.notify
+}
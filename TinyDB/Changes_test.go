@@ -0,0 +1,112 @@
+package tinydb_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"tinydb"
+	"tinydb/config"
+)
+
+// 从订阅中依次接收n个变更，检查序列号连续并且从from开始
+func receive(t *testing.T, s *tinydb.Subscription, from uint64, n int) []tinydb.Mutation {
+	t.Helper()
+	mutations := make([]tinydb.Mutation, 0, n)
+	for len(mutations) < n {
+		select {
+		case m, ok := <-s.C:
+			if !ok {
+				t.Fatalf("the subscription ended after %d mutations: %v", len(mutations), s.Err())
+			}
+			if want := from + uint64(len(mutations)); m.Seq != want {
+				t.Fatalf("received sequence %d, want %d", m.Seq, want)
+			}
+			mutations = append(mutations, m)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d mutations", len(mutations))
+		}
+	}
+	return mutations
+}
+
+// 已经持久化的日志被保留在archive目录中，重新启动之后可以从之前处理过的序列号继续订阅
+func TestSubscribeFromArchivedWal(t *testing.T) {
+	con := config.Config{DataDir: t.TempDir(), WALRetentionSize: 1 << 20}
+	db := openDB(t, con.DataDir, con)
+	for i := 0; i < 10; i++ {
+		tinydb.SetCF(db.ColumnFamily, fmt.Sprintf("k%d", i), i)
+	}
+	db.Flush()
+	for i := 10; i < 15; i++ {
+		tinydb.SetCF(db.ColumnFamily, fmt.Sprintf("k%d", i), i)
+	}
+
+	s, err := db.Subscribe(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range receive(t, s, 5, 11) {
+		if want := fmt.Sprintf("k%d", i+4); m.Key != want || m.Family != tinydb.DefaultColumnFamily {
+			t.Errorf("sequence %d: %s/%s, want %s/%s", m.Seq, m.Family, m.Key, tinydb.DefaultColumnFamily, want)
+		}
+	}
+	s.Close()
+
+	//重新打开时日志被回放并持久化，所有的变更都在保留的日志中
+	db = reopen(t, db, con)
+	if seq := db.LatestSequence(); seq != 15 {
+		t.Fatalf("LatestSequence() = %d after reopen, want 15", seq)
+	}
+	s, err = db.Subscribe(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	receive(t, s, 12, 4)
+	tinydb.SetCF(db.ColumnFamily, "k15", 15)
+	if m := receive(t, s, 16, 1); m[0].Key != "k15" {
+		t.Errorf("sequence 16: %s, want k15", m[0].Key)
+	}
+}
+
+// 没有保留的日志被清空之后不能再读取其中的变更
+func TestSubscribeUnavailable(t *testing.T) {
+	db := openDB(t, t.TempDir(), config.Config{})
+	for i := 0; i < 10; i++ {
+		tinydb.SetCF(db.ColumnFamily, fmt.Sprintf("k%d", i), i)
+	}
+	db.Flush()
+	if _, err := db.Subscribe(5); !errors.Is(err, tinydb.ErrChangesUnavailable) {
+		t.Errorf("Subscribe(5) = %v, want ErrChangesUnavailable", err)
+	}
+}
+
+// 数据库被关闭时订阅结束并返回ErrClosed，之后不能再订阅
+func TestSubscriptionEndsOnClose(t *testing.T) {
+	db := openDB(t, t.TempDir(), config.Config{})
+	tinydb.SetCF(db.ColumnFamily, "k", 1)
+	s, err := db.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, s, 1, 1)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, ok := <-s.C:
+		if ok {
+			t.Fatal("received a mutation after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the subscription did not end after Close")
+	}
+	if !errors.Is(s.Err(), tinydb.ErrClosed) {
+		t.Errorf("Err() = %v, want ErrClosed", s.Err())
+	}
+	if _, err := db.Subscribe(0); !errors.Is(err, tinydb.ErrClosed) {
+		t.Errorf("Subscribe after Close = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,162 @@
+package tinydb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// 数据库某一时刻需要的一个文件
+type liveFile struct {
+	//相对于数据目录的路径
+	name string
+	//sstable文件的路径，日志和清单文件为空
+	path string
+	//日志和清单文件在持有锁的时候读取到内存中
+	data    []byte
+	modTime time.Time
+}
+
+// 获取数据库当前状态需要的所有文件，包括所有列族的sstable文件、两个日志文件、列族清单以及序列号
+// 获取期间持有写锁，sstable文件和日志中的数据正好组成一个一致的状态
+// 在调用release之前，sstable文件不会被删除，列族也不会被删除
+func (db *Database) liveFiles() ([]liveFile, func(), error) {
+	//不能在持久化的中途获取，否则同一份数据可能同时存在于sstable和日志中
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	db.familyLock.RLock()
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	files := make([]liveFile, 0)
+	releases := make([]func(), 0)
+	release := func() {
+		for _, fn := range releases {
+			fn()
+		}
+		db.familyLock.RUnlock()
+	}
+	families := []*ColumnFamily{db.ColumnFamily}
+	for _, cf := range db.families {
+		families = append(families, cf)
+	}
+	for _, cf := range families {
+		paths, fn := cf.TableTree.LiveFiles()
+		releases = append(releases, fn)
+		for _, path := range paths {
+			name, err := filepath.Rel(db.dir, path)
+			if err != nil {
+				release()
+				return nil, nil, err
+			}
+			files = append(files, liveFile{name: filepath.ToSlash(name), path: path})
+		}
+	}
+	for _, path := range []string{db.Wal1.Pathname, db.Wal2.Pathname, filepath.Join(db.dir, manifestName)} {
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		files = append(files, liveFile{name: filepath.Base(path), data: data, modTime: info.ModTime()})
+	}
+	//sequence文件只在清空日志时更新，直接写入当前的序列号，打开检查点之后的序列号与获取时相同
+	files = append(files, liveFile{name: sequenceName, data: []byte(strconv.FormatUint(db.seq.Load(), 10)), modTime: time.Now()})
+	return files, release, nil
+}
+
+// 在dir中创建数据库当前状态的检查点，dir不能已经存在
+// sstable文件不会再被修改，优先使用硬链接，不能硬链接时复制，日志和清单文件总是复制
+// 检查点可以作为一个独立的数据库打开
+func (db *Database) Checkpoint(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("checkpoint directory %s already exists", dir)
+	}
+	files, release, err := db.liveFiles()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	//先写入临时目录，全部完成之后再重命名，中途失败不会留下不完整的检查点
+	tmp := filepath.Clean(dir) + ".tmp"
+	os.RemoveAll(tmp)
+	for _, file := range files {
+		if err = writeLiveFile(filepath.Join(tmp, file.name), file, true); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, dir)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
+
+// 将文件写入到dst，link为true时sstable文件优先使用硬链接
+func writeLiveFile(dst string, file liveFile, link bool) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if file.path == "" {
+		if err := writeFileSync(dst, file.data); err != nil {
+			return err
+		}
+		//日志按照修改时间的先后回放，需要保留原来的修改时间
+		return os.Chtimes(dst, file.modTime, file.modTime)
+	}
+	if link && os.Link(file.path, dst) == nil {
+		return nil
+	}
+	return copyFile(file.path, dst)
+}
+
+// 写入文件并刷到磁盘
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// 复制文件并刷到磁盘
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
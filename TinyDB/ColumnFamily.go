@@ -0,0 +1,438 @@
+package tinydb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"tinydb/config"
+	"tinydb/kv"
+	"tinydb/memtable"
+	"tinydb/sstable"
+	"tinydb/wal"
+)
+
+// 默认列族的名称，默认列族的sstable文件直接保存在数据目录中
+const DefaultColumnFamily = "default"
+
+// 记录所有列族的清单文件，位于数据目录中
+const manifestName = "families.json"
+
+// 其余列族的sstable文件保存在数据目录的cf/<编号>目录中
+const familyDir = "cf"
+
+// 写入已经被删除的列族
+var ErrFamilyDropped = errors.New("tinydb: column family has been dropped")
+
+// 列族，每个列族有自己的内存表、sstable文件和压缩配置，所有列族共用同一组日志文件
+type ColumnFamily struct {
+	//列族的编号和名称，编号记录在日志中，用于回放时找到对应的列族
+	id   int
+	name string
+	//创建时指定的配置，以及与数据库配置合并之后实际使用的配置
+	options config.Config
+	con     config.Config
+	//当前内存中可读可写的内存表
+	MemoryTree *memtable.Tree
+	//不可继续写的内存表,只能读
+	ImmutableMem *memtable.Tree
+	//sstable
+	TableTree *sstable.TableTree
+	db        *Database
+	//列族是否已经被删除
+	dropped atomic.Bool
+}
+
+// 列族的名称
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// 列族实际使用的配置
+func (cf *ColumnFamily) Options() config.Config {
+	return cf.con
+}
+
+// 创建一个列族，opts中为零值的字段使用数据库的配置，DataDir会被忽略
+// 数据库中开启的bool选项不能在列族中关闭，见config.Inherit
+func (db *Database) CreateColumnFamily(name string, opts config.Config) (*ColumnFamily, error) {
+	if name == "" || name == DefaultColumnFamily {
+		return nil, fmt.Errorf("invalid column family name %q", name)
+	}
+	if opts.MergeOperator != "" && kv.GetMergeOperator(opts.MergeOperator) == nil {
+		return nil, fmt.Errorf("merge operator %q is not registered", opts.MergeOperator)
+	}
+	db.familyLock.Lock()
+	defer db.familyLock.Unlock()
+
+	if _, ok := db.families[name]; ok {
+		return nil, fmt.Errorf("column family %q already exists", name)
+	}
+	cf := db.openFamily(db.nextFamily, name, opts)
+	db.families[name] = cf
+	db.nextFamily++
+	if err := db.saveManifest(); err != nil {
+		delete(db.families, name)
+		cf.TableTree.Close()
+		return nil, err
+	}
+	db.logger().Info("created the column family", "family", name)
+	return cf, nil
+}
+
+// 删除一个列族以及它的所有数据
+// 列族的目录被重命名之后在后台删除，不需要逐个删除sstable文件
+// 日志中属于这个列族的记录在回放时会被忽略
+func (db *Database) DropColumnFamily(name string) error {
+	db.familyLock.Lock()
+	cf, ok := db.families[name]
+	if !ok {
+		db.familyLock.Unlock()
+		return fmt.Errorf("column family %q does not exist", name)
+	}
+	delete(db.families, name)
+	if err := db.saveManifest(); err != nil {
+		db.families[name] = cf
+		db.familyLock.Unlock()
+		return err
+	}
+	db.familyLock.Unlock()
+
+	//之后的写入都会失败
+	db.writeLock.Lock()
+	cf.dropped.Store(true)
+	db.writeLock.Unlock()
+
+	//等待正在执行的持久化和后台压缩完成，之后不会再有任务访问这个列族的文件
+	db.PauseBackgroundWork()
+	defer db.ContinueBackgroundWork()
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+
+	cf.TableTree.Close()
+	dir := cf.con.DataDir
+	trash := dir + ".dropped"
+	if err := os.Rename(dir, trash); err != nil {
+		return err
+	}
+	go func() {
+		if err := os.RemoveAll(trash); err != nil {
+			db.logger().Error("failed to remove the dropped column family", "file", trash, "error", err)
+		}
+	}()
+	db.logger().Info("dropped the column family", "family", name)
+	return nil
+}
+
+// 根据名称获取列族
+func (db *Database) GetColumnFamily(name string) (*ColumnFamily, bool) {
+	if name == DefaultColumnFamily {
+		return db.ColumnFamily, true
+	}
+	db.familyLock.RLock()
+	defer db.familyLock.RUnlock()
+
+	cf, ok := db.families[name]
+	return cf, ok
+}
+
+// 获取所有列族的名称，默认列族排在第一个
+func (db *Database) ColumnFamilies() []string {
+	db.familyLock.RLock()
+	defer db.familyLock.RUnlock()
+
+	names := make([]string, 0, len(db.families))
+	for name := range db.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{DefaultColumnFamily}, names...)
+}
+
+// 获取包括默认列族在内的所有列族
+func (db *Database) allFamilies() []*ColumnFamily {
+	db.familyLock.RLock()
+	defer db.familyLock.RUnlock()
+
+	families := []*ColumnFamily{db.ColumnFamily}
+	for _, cf := range db.families {
+		families = append(families, cf)
+	}
+	return families
+}
+
+// 打开一个列族的目录并加载其中的sstable文件
+func (db *Database) openFamily(id int, name string, opts config.Config) *ColumnFamily {
+	con := config.Inherit(db.con, opts)
+	if con.MergeOperator != "" && kv.GetMergeOperator(con.MergeOperator) == nil {
+		db.logger().Error("the merge operator is not registered", "family", name, "operator", con.MergeOperator)
+		panic("unknown merge operator " + con.MergeOperator)
+	}
+	con.DataDir = db.dir
+	if id != 0 {
+		con.DataDir = path.Join(db.dir, familyDir, strconv.Itoa(id))
+		if err := os.MkdirAll(con.DataDir, 0755); err != nil {
+			db.logger().Error("failed to create the column family directory", "file", con.DataDir, "error", err)
+			panic(err)
+		}
+	}
+	memoryTree := &memtable.Tree{}
+	memoryTree.Init()
+	cf := &ColumnFamily{
+		id:         id,
+		name:       name,
+		options:    opts,
+		con:        con,
+		MemoryTree: memoryTree,
+		TableTree:  &sstable.TableTree{},
+		db:         db,
+	}
+	cf.TableTree.Open(con.DataDir, con)
+	return cf
+}
+
+// 清单文件中记录的一个列族
+type familyMeta struct {
+	ID      int
+	Name    string
+	Options config.Config
+}
+
+type manifest struct {
+	NextID   int
+	Families []familyMeta
+}
+
+// 将所有列族写入清单文件，调用者需要持有familyLock
+func (db *Database) saveManifest() error {
+	m := manifest{NextID: db.nextFamily, Families: make([]familyMeta, 0, len(db.families))}
+	for _, cf := range db.families {
+		m.Families = append(m.Families, familyMeta{ID: cf.id, Name: cf.name, Options: cf.options})
+	}
+	sort.Slice(m.Families, func(i, j int) bool {
+		return m.Families[i].ID < m.Families[j].ID
+	})
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	//先写入临时文件再重命名，保证清单文件总是完整的
+	name := path.Join(db.dir, manifestName)
+	if err := os.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// 根据清单文件打开所有列族，并删除不在清单中的列族目录
+func (db *Database) loadFamilies() {
+	db.families = make(map[string]*ColumnFamily)
+	db.nextFamily = 1
+	data, err := os.ReadFile(path.Join(db.dir, manifestName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		db.logger().Error("failed to read the column family manifest", "error", err)
+		panic(err)
+	}
+	live := make(map[string]bool)
+	if err == nil {
+		var m manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			db.logger().Error("the column family manifest is corrupted", "error", err)
+			panic(err)
+		}
+		db.nextFamily = max(m.NextID, 1)
+		for _, meta := range m.Families {
+			db.families[meta.Name] = db.openFamily(meta.ID, meta.Name, meta.Options)
+			live[strconv.Itoa(meta.ID)] = true
+		}
+	}
+
+	//删除之前被删除但没有清理完的列族目录
+	entries, _ := os.ReadDir(path.Join(db.dir, familyDir))
+	for _, entry := range entries {
+		if !live[entry.Name()] {
+			db.logger().Info("removing the dropped column family", "file", entry.Name())
+			os.RemoveAll(path.Join(db.dir, familyDir, entry.Name()))
+		}
+	}
+}
+
+// 根据编号获取列族，日志回放时使用
+func (db *Database) familyByID(id int) *ColumnFamily {
+	for _, cf := range db.allFamilies() {
+		if cf.id == id {
+			return cf
+		}
+	}
+	return nil
+}
+
+// 从指定列族中获取元素
+func GetCF[T any](cf *ColumnFamily, key string) (T, bool) {
+	value, ok, _ := GetCFContext[T](context.Background(), cf, key)
+	return value, ok
+}
+
+// 与GetCF相同，查找每一个sstable文件之前检查ctx，ctx结束时返回ctx.Err()
+// sstable文件损坏时返回ErrCorruption
+func GetCFContext[T any](ctx context.Context, cf *ColumnFamily, key string) (T, bool, error) {
+	data, ok, err := cf.getContext(ctx, key)
+	if ok {
+		value, ok := getInstance[T](data)
+		return value, ok, nil
+	}
+	var nil T
+	return nil, false, err
+}
+
+// 向指定列族中插入元素
+func SetCF[T any](cf *ColumnFamily, key string, value T) bool {
+	return SetCFContext(context.Background(), cf, key, value) == nil
+}
+
+// 与SetCF相同，失败时返回错误，ctx已经结束时不会写入并返回ctx.Err()
+func SetCFContext[T any](ctx context.Context, cf *ColumnFamily, key string, value T) error {
+	data, err := convert[T](value)
+	if err != nil {
+		cf.db.logger().Warn("failed to encode the value", "family", cf.name, "key", key, "error", err)
+		return err
+	}
+	return cf.writeContext(ctx, kv.Value{Key: key, Value: data})
+}
+
+// 将操作数合并到指定列族中key对应的值上
+func MergeCF[T any](cf *ColumnFamily, key string, operand T) bool {
+	return MergeCFContext(context.Background(), cf, key, operand) == nil
+}
+
+// 与MergeCF相同，失败时返回错误，ctx已经结束时不会写入并返回ctx.Err()
+func MergeCFContext[T any](ctx context.Context, cf *ColumnFamily, key string, operand T) error {
+	if cf.mergeOperator() == nil {
+		cf.db.logger().Warn("the column family has no merge operator", "family", cf.name, "key", key)
+		return fmt.Errorf("column family %q has no merge operator", cf.name)
+	}
+	data, err := convert[T](operand)
+	if err != nil {
+		cf.db.logger().Warn("failed to encode the operand", "family", cf.name, "key", key, "error", err)
+		return err
+	}
+	return cf.writeContext(ctx, kv.Value{Key: key, Merge: true, Operands: [][]byte{data}})
+}
+
+// 列族配置中的合并算子，没有配置或者没有注册时返回nil
+func (cf *ColumnFamily) mergeOperator() kv.MergeOperator {
+	return kv.GetMergeOperator(cf.con.MergeOperator)
+}
+
+// 从指定列族中删除元素，返回删除之前元素是否存在
+// 只存在于sstable文件中的元素同样会被删除，返回的是否存在见ColumnFamily.delete
+func DeleteCF[T any](cf *ColumnFamily, key string) bool {
+	_, res := cf.delete(key)
+	return res
+}
+
+// 与DeleteCF相同，失败时返回错误，ctx结束时返回ctx.Err()
+func DeleteCFContext[T any](ctx context.Context, cf *ColumnFamily, key string) (bool, error) {
+	_, res, err := cf.deleteContext(ctx, key)
+	return res && err == nil, err
+}
+
+// 一组可以跨列族的写入操作，通过Database.Write原子地写入
+type WriteBatch struct {
+	records  []wal.Record
+	families []*ColumnFamily
+}
+
+// 向批量写入中添加一个插入操作
+func (b *WriteBatch) Set(cf *ColumnFamily, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	b.records = append(b.records, wal.Record{Family: cf.id, Value: kv.Value{Key: key, Value: data}})
+	b.families = append(b.families, cf)
+	return nil
+}
+
+// 向批量写入中添加一个删除操作
+func (b *WriteBatch) Delete(cf *ColumnFamily, key string) {
+	b.records = append(b.records, wal.Record{Family: cf.id, Value: kv.Value{Key: key, Delete: true}})
+	b.families = append(b.families, cf)
+}
+
+// 向批量写入中添加一个合并操作
+func (b *WriteBatch) Merge(cf *ColumnFamily, key string, operand any) error {
+	if cf.mergeOperator() == nil {
+		return fmt.Errorf("column family %q has no merge operator", cf.name)
+	}
+	data, err := json.Marshal(operand)
+	if err != nil {
+		return err
+	}
+	b.records = append(b.records, wal.Record{Family: cf.id, Value: kv.Value{Key: key, Merge: true, Operands: [][]byte{data}}})
+	b.families = append(b.families, cf)
+	return nil
+}
+
+// 批量写入中操作的数量
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+// 将批量写入作为一条日志记录写入，崩溃恢复时所有操作要么全部生效要么全部丢弃
+// 写入内存表的过程中，并发的读取可能看到部分操作的结果
+func (db *Database) Write(b *WriteBatch) error {
+	return db.WriteContext(context.Background(), b)
+}
+
+// 与Write相同，开始写入之前以及等待写锁之后检查ctx，ctx已经结束时不会写入任何操作
+func (db *Database) WriteContext(ctx context.Context, b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer db.stats.writeLatency.Since(time.Now())
+	db.writeLock.RLock()
+	defer db.writeLock.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	dropped := make([]string, 0)
+	for _, cf := range b.families {
+		if cf.db != db {
+			return fmt.Errorf("column family %q belongs to another database", cf.name)
+		}
+		if cf.dropped.Load() {
+			dropped = append(dropped, cf.name)
+		}
+	}
+	if len(dropped) > 0 {
+		return fmt.Errorf("%w: %s", ErrFamilyDropped, strings.Join(dropped, ", "))
+	}
+	err := db.Wal.WriteFunc(b.records, func(records []wal.Record) {
+		for i, record := range records {
+			wal.Replay(b.families[i].MemoryTree, record.Value, b.families[i].mergeOperator())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, record := range b.records {
+		db.stats.recordWrite(record.Value)
+	}
+	db.stats.batches.Add(1)
+	return nil
+}
@@ -0,0 +1,174 @@
+package tinydb_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"tinydb"
+	"tinydb/config"
+)
+
+func createFamily(t *testing.T, db *tinydb.Database, name string) *tinydb.ColumnFamily {
+	t.Helper()
+	cf, err := db.CreateColumnFamily(name, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cf
+}
+
+func getFamily(t *testing.T, db *tinydb.Database, name string) *tinydb.ColumnFamily {
+	t.Helper()
+	cf, ok := db.GetColumnFamily(name)
+	if !ok {
+		t.Fatalf("column family %q does not exist", name)
+	}
+	return cf
+}
+
+// 检查列族中key的值，want为空表示key不存在
+func expectValue(t *testing.T, cf *tinydb.ColumnFamily, key string, want string) {
+	t.Helper()
+	got, ok, err := tinydb.GetCFContext[string](context.Background(), cf, key)
+	if err != nil {
+		t.Fatalf("%s: Get(%s): %v", cf.Name(), key, err)
+	}
+	if want == "" && ok {
+		t.Errorf("%s: Get(%s) = %q, want not found", cf.Name(), key, got)
+	} else if want != "" && (!ok || got != want) {
+		t.Errorf("%s: Get(%s) = %q, %v, want %q", cf.Name(), key, got, ok, want)
+	}
+}
+
+// 删除之后重新创建的同名列族是一个新的列族，日志中旧列族的记录在回放时被忽略
+func TestDropAndRecreateFamily(t *testing.T) {
+	con := config.Config{DataDir: t.TempDir()}
+	db := openDB(t, con.DataDir, con)
+	old := createFamily(t, db, "users")
+	tinydb.SetCF(old, "a", "old")
+	tinydb.SetCF(old, "b", "old")
+	if err := db.DropColumnFamily("users"); err != nil {
+		t.Fatal(err)
+	}
+
+	cf := createFamily(t, db, "users")
+	expectValue(t, cf, "a", "")
+	tinydb.SetCF(cf, "b", "new")
+
+	db = reopen(t, db, con)
+	if names := db.ColumnFamilies(); len(names) != 2 {
+		t.Errorf("ColumnFamilies() = %v, want default and users", names)
+	}
+	cf = getFamily(t, db, "users")
+	expectValue(t, cf, "a", "")
+	expectValue(t, cf, "b", "new")
+}
+
+// 已经被删除的列族不能再写入，包含它的批量写入中的所有操作都不会生效
+func TestWriteToDroppedFamily(t *testing.T) {
+	db := openDB(t, t.TempDir(), config.Config{})
+	live := createFamily(t, db, "live")
+	dropped := createFamily(t, db, "dropped")
+	if err := db.DropColumnFamily("dropped"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tinydb.SetCFContext(context.Background(), dropped, "k", "v"); !errors.Is(err, tinydb.ErrFamilyDropped) {
+		t.Errorf("Set on a dropped family: %v, want ErrFamilyDropped", err)
+	}
+	if _, err := tinydb.DeleteCFContext[string](context.Background(), dropped, "k"); !errors.Is(err, tinydb.ErrFamilyDropped) {
+		t.Errorf("Delete on a dropped family: %v, want ErrFamilyDropped", err)
+	}
+	b := &tinydb.WriteBatch{}
+	b.Set(live, "k", "v")
+	b.Set(dropped, "k", "v")
+	if err := db.Write(b); !errors.Is(err, tinydb.ErrFamilyDropped) {
+		t.Errorf("Write with a dropped family: %v, want ErrFamilyDropped", err)
+	}
+	expectValue(t, live, "k", "")
+}
+
+// 跨列族的批量写入作为一条日志记录写入，日志末尾损坏时整个批量写入都被丢弃
+func TestWriteBatchAcrossFamilies(t *testing.T) {
+	con := config.Config{DataDir: t.TempDir()}
+	db := openDB(t, con.DataDir, con)
+	users := createFamily(t, db, "users")
+	orders := createFamily(t, db, "orders")
+	tinydb.SetCF(db.ColumnFamily, "gone", "v")
+
+	b := &tinydb.WriteBatch{}
+	b.Set(users, "u1", "alice")
+	b.Set(orders, "o1", "book")
+	b.Delete(db.ColumnFamily, "gone")
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen(t, db, con)
+	expectValue(t, getFamily(t, db, "users"), "u1", "alice")
+	expectValue(t, getFamily(t, db, "orders"), "o1", "book")
+	expectValue(t, db.ColumnFamily, "gone", "")
+
+	//第二个批量写入只有一部分写入了日志文件
+	b = &tinydb.WriteBatch{}
+	b.Set(getFamily(t, db, "users"), "u2", "bob")
+	b.Set(getFamily(t, db, "orders"), "o2", "pen")
+	if err := db.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(con.DataDir, "wal1.log")
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(name, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tinydb.RepairDir(con.DataDir); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openDB(t, con.DataDir, con)
+	users = getFamily(t, db, "users")
+	orders = getFamily(t, db, "orders")
+	expectValue(t, users, "u1", "alice")
+	expectValue(t, orders, "o1", "book")
+	expectValue(t, users, "u2", "")
+	expectValue(t, orders, "o2", "")
+}
+
+// 删除只存在于sstable文件中的key时写入删除标记，返回的是否存在包括sstable中的数据
+func TestDeleteFromTables(t *testing.T) {
+	con := config.Config{DataDir: t.TempDir()}
+	db := openDB(t, con.DataDir, con)
+	tinydb.SetCF(db.ColumnFamily, "table", "v")
+	tinydb.SetCF(db.ColumnFamily, "mem", "v")
+	db.Flush()
+	tinydb.SetCF(db.ColumnFamily, "mem", "v")
+
+	cases := []struct {
+		key   string
+		found bool
+	}{
+		{"table", true},
+		{"mem", true},
+		{"missing", false},
+		{"table", false},
+	}
+	for _, c := range cases {
+		if found := tinydb.DeleteCF[string](db.ColumnFamily, c.key); found != c.found {
+			t.Errorf("Delete(%s) = %v, want %v", c.key, found, c.found)
+		}
+	}
+	expectValue(t, db.ColumnFamily, "table", "")
+	expectValue(t, db.ColumnFamily, "mem", "")
+
+	//删除标记写入了日志，重新打开之后sstable中的旧值仍然被覆盖
+	db = reopen(t, db, con)
+	expectValue(t, db.ColumnFamily, "table", "")
+	expectValue(t, db.ColumnFamily, "mem", "")
+}
@@ -1,62 +1,158 @@
 package tinydb
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tinydb/config"
 	"tinydb/kv"
 	"tinydb/memtable"
 	"tinydb/sstable"
 	"tinydb/wal"
 )
 
+// 读取时发现sstable文件已经损坏，返回的错误中包含文件名，可以使用errors.Is判断
+var ErrCorruption = sstable.ErrCorruption
+
 type Database struct {
-	//当前内存中可读可写的内存表
-	MemoryTree *memtable.Tree
-	//不可继续写的内存表,只能读
-	ImmutableMem *memtable.Tree
-	//sstable
-	TableTree *sstable.TableTree
-	//日志文件句柄
+	//默认列族，MemoryTree、ImmutableMem以及TableTree都属于默认列族
+	*ColumnFamily
+	//日志文件句柄，所有列族共用
 	Wal *wal.Wal
 	//两个日志文件，保证平稳过渡
 	Wal1 *wal.Wal
 	Wal2 *wal.Wal
+	//数据目录以及数据库的配置
+	dir string
+	con config.Config
+	//除默认列族之外的所有列族，以及下一个列族的编号
+	families   map[string]*ColumnFamily
+	nextFamily int
+	familyLock sync.RWMutex
+	//写入日志和内存表时持有读锁，持久化时持有写锁切换内存表和日志
+	writeLock sync.RWMutex
+	//最后一个分配给日志记录的序列号，以及最近写入的变更
+	seq     atomic.Uint64
+	changes changeHub
+	//作为从节点时只能通过Apply写入复制的变更，applyLock保证变更按照顺序写入
+	readOnly  atomic.Bool
+	applyLock sync.Mutex
+	//保证同一时间只有一个memtable在持久化
+	flushLock sync.Mutex
+	//读取之后再写入的操作使用的锁，见UpdateLock
+	updateLock sync.Mutex
+	//后台任务的暂停次数以及正在执行的后台任务数量
+	paused    int
+	bgRunning int
+	bgLock    sync.Mutex
+	bgCond    *sync.Cond
+	//关闭时通知后台检查退出，并等待其结束
+	closing   chan struct{}
+	bgWait    sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+	//运行期间的统计数据
+	stats dbStats
 }
 
-// 全局唯一的数据库
+// Start返回的全局数据库，包级别的Get、Set等函数使用这个数据库
 var database *Database
 
+// 数据库配置中的Logger
+func (db *Database) logger() config.Logger {
+	return db.con.GetLogger()
+}
+
 // 整个数据库对外提供的接口
 // get获取元素
 func Get[T any](key string) (T, bool) {
-	log.Print("Get: ", key)
-	//首先在可读可写的内存表中查询memtable中有无数据
-	value, res := database.MemoryTree.Search(key)
-	if res == kv.Success {
-		return getInstance[T](value.Kv.Value)
+	database.logger().Debug("get", "key", key)
+	data, ok := database.get(key)
+	if ok {
+		return getInstance[T](data)
+	}
+	//数据不存在
+	var nil T
+	return nil, false
+}
+
+// 与Get相同，查找每一个sstable文件之前检查ctx，ctx结束时返回ctx.Err()
+// sstable文件损坏时返回ErrCorruption
+func GetContext[T any](ctx context.Context, key string) (T, bool, error) {
+	database.logger().Debug("get", "key", key)
+	return GetCFContext[T](ctx, database.ColumnFamily, key)
+}
+
+// 依次从memtable、immutableMem以及sstable文件中查找key对应的数据
+// 找到合并记录时继续查找更旧的数据，再使用合并算子得到最终的值
+func (cf *ColumnFamily) lookup(key string) ([]byte, bool) {
+	data, ok, _ := cf.lookupContext(context.Background(), key)
+	return data, ok
+}
+
+// 与lookup相同，ctx结束时返回ctx.Err()
+// 查找期间持有写锁的读锁，持久化不能同时切换内存表或者插入新的sstable
+func (cf *ColumnFamily) lookupContext(ctx context.Context, key string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	cf.db.writeLock.RLock()
+	defer cf.db.writeLock.RUnlock()
+
+	if cf.dropped.Load() {
+		return nil, false, nil
+	}
+	operator := cf.mergeOperator()
+	var pending *kv.Value
+	//将更旧的数据与之前找到的合并记录合并，返回是否已经得到最终的结果
+	resolve := func(value kv.Value) bool {
+		if pending != nil {
+			value = kv.Fold(operator, *pending, &value)
+		}
+		pending = &value
+		return !value.Merge
 	}
-	//从immutableMem中寻找对应数据
-	value, res = database.ImmutableMem.Search(key)
-	if res == kv.Success {
-		return getInstance[T](value.Kv.Value)
+	//首先在可读可写的内存表中查询memtable中有无数据
+	//然后从immutableMem中寻找对应数据
+	for _, tree := range []*memtable.Tree{cf.MemoryTree, cf.ImmutableMem} {
+		node, res := tree.Search(key)
+		if res == kv.Success && resolve(node.Kv) {
+			return result(pending)
+		} else if res == kv.Deleted && resolve(kv.Value{Key: key, Delete: true}) {
+			return result(pending)
+		}
 	}
 	//两个内存表中都没有找到相应的数据
 	//开始从其余的sstable文件中查找
-	log.Print("Get from sstable file")
-
-	if database.TableTree != nil {
-		value, res := database.TableTree.SearchTree(key)
-		if res == kv.Success {
-			return getInstance[T](value.Value)
-		} else if res == kv.Deleted {
-			//如果数据已经被删除
-			var nil T
-			return nil, false
+
+	if cf.TableTree != nil {
+		value, res, err := cf.TableTree.SearchTreeContext(ctx, key)
+		if err != nil {
+			return nil, false, err
+		}
+		if res == kv.Success && resolve(value) {
+			return result(pending)
+		} else if res == kv.Deleted && resolve(kv.Value{Key: key, Delete: true}) {
+			return result(pending)
 		}
 	}
-	//数据不存在
-	var nil T
-	return nil, false
+	//只有合并记录，在没有旧值的情况下合并
+	if pending != nil {
+		value := kv.Fold(operator, *pending, nil)
+		return result(&value)
+	}
+	//数据不存在或者已经被删除
+	return nil, false, nil
+}
+
+// 查找的最终结果，删除标记以及无法合并的合并记录都表示数据不存在
+func result(value *kv.Value) ([]byte, bool, error) {
+	if value.Delete || value.Merge {
+		return nil, false, nil
+	}
+	return value.Value, true, nil
 }
 
 // 将字节数组转化为类型对象
@@ -64,30 +160,69 @@ func getInstance[T any](data []byte) (T, bool) {
 	var value T
 	err := json.Unmarshal(data, &value)
 	if err != nil {
-		log.Print(err)
+		config.GetConfig().GetLogger().Warn("failed to decode the value", "error", err)
 	}
 	return value, true
 }
 
 // set插入任意元素
 func Set[T any](key string, value T) bool {
-	log.Print("Set: ", key)
-	//首先将数据转化为二进制序列
-	data, err := convert[T](value)
-	if err != nil {
-		log.Println(err)
-		return false
+	return SetContext(context.Background(), key, value) == nil
+}
+
+// 与Set相同，失败时返回错误，ctx已经结束时不会写入并返回ctx.Err()
+func SetContext[T any](ctx context.Context, key string, value T) error {
+	database.logger().Debug("set", "key", key)
+	return SetCFContext(ctx, database.ColumnFamily, key, value)
+}
+
+// 先写入日志，再在持有日志的锁的时候写入内存表，已经被删除的列族以及只读的数据库不能写入
+func (cf *ColumnFamily) write(value kv.Value) bool {
+	return cf.writeContext(context.Background(), value) == nil
+}
+
+// 与write相同，开始写入之前以及等待写锁之后检查ctx，ctx已经结束时不会写入
+// 写锁只在持久化切换内存表以及插入新的sstable的时候短暂持有，等待写锁的过程不能被取消
+func (cf *ColumnFamily) writeContext(ctx context.Context, value kv.Value) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	//在内存表中写入相关值
-	_, _ = database.MemoryTree.Set(key, data)
+	db := cf.db
+	defer db.stats.writeLatency.Since(time.Now())
+	db.writeLock.RLock()
+	defer db.writeLock.RUnlock()
 
-	//写入wal日志
-	database.Wal.Writer(kv.Value{
-		Key:    key,
-		Value:  data,
-		Delete: false,
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if db.readOnly.Load() {
+		db.logger().Warn("the database is read only", "key", value.Key)
+		return ErrReadOnly
+	}
+	if cf.dropped.Load() {
+		db.logger().Warn("the column family has been dropped", "family", cf.name, "key", value.Key)
+		return ErrFamilyDropped
+	}
+	err := db.Wal.WriteFunc([]wal.Record{{Family: cf.id, Value: value}}, func([]wal.Record) {
+		wal.Replay(cf.MemoryTree, value, cf.mergeOperator())
 	})
-	return true
+	if err != nil {
+		return err
+	}
+	db.stats.recordWrite(value)
+	return nil
+}
+
+// merge将操作数合并到key对应的值上，不需要先读取旧值
+// 列族的配置中需要指定合并算子，例如使用Int64AddOperator时Merge("count", 1)将计数加一
+func Merge[T any](key string, operand T) bool {
+	return MergeContext(context.Background(), key, operand) == nil
+}
+
+// 与Merge相同，失败时返回错误，ctx已经结束时不会写入并返回ctx.Err()
+func MergeContext[T any](ctx context.Context, key string, operand T) error {
+	database.logger().Debug("merge", "key", key)
+	return MergeCFContext(ctx, database.ColumnFamily, key, operand)
 }
 
 // 将任意元素值转化为二进制
@@ -95,38 +230,137 @@ func convert[T any](value T) ([]byte, error) {
 	return json.Marshal(value)
 }
 
-// delete删除元素
+// delete删除元素，返回删除之前元素是否存在
+// 只存在于sstable文件中的元素同样会被删除，返回的是否存在见ColumnFamily.delete
 func Delete[T any](key string) bool {
-	log.Print("Delete: ", key)
-	_, res := database.MemoryTree.Delete(key)
-	//数据不存在的情况下直接返回
-	if res == false {
-		log.Print("this key not exsit")
-		return false
+	res, _ := DeleteContext[T](context.Background(), key)
+	return res
+}
+
+// 与Delete相同，失败时返回错误，ctx结束时返回ctx.Err()
+func DeleteContext[T any](ctx context.Context, key string) (bool, error) {
+	database.logger().Debug("delete", "key", key)
+	res, err := DeleteCFContext[T](ctx, database.ColumnFamily, key)
+	if err == nil && !res {
+		database.logger().Debug("the key does not exist", "key", key)
 	}
-	//数据存在的情况下,写入日志处理
-	database.Wal.Writer(kv.Value{
-		Key:    key,
-		Value:  nil,
-		Delete: true,
-	})
-	return true
+	return res, err
 }
 
 // 删除元素并且获得旧值,bool表示有无旧值
 func DeleteAndGet[T any](key string) (T, bool) {
-	log.Print("Delete: ", key)
-	value, res := database.MemoryTree.Delete(key)
+	database.logger().Debug("delete", "key", key)
+	data, res := database.delete(key)
 	if res {
-		//找到了旧值将操作写入日志处理
-		database.Wal.Writer(kv.Value{
-			Key:    key,
-			Value:  nil,
-			Delete: true,
-		})
-		return getInstance[T](value.Value)
+		return getInstance[T](data)
 	}
 	//不存在旧值
 	var nil T
 	return nil, false
 }
+
+// 删除元素并返回旧值
+// 元素可能只存在于sstable文件中，所以无论内存表中有无数据都需要写入删除标记，
+// 旧值在写入删除标记之前从内存表和所有的sstable文件中查找
+// 查找和写入不是原子的，同时写入同一个key时返回的旧值可能已经过时，但是key总会被删除，
+// 需要准确的旧值时由调用者将这个key的读写串行执行，例如server中的UpdateLock
+func (cf *ColumnFamily) delete(key string) ([]byte, bool) {
+	old, res, err := cf.deleteContext(context.Background(), key)
+	return old, res && err == nil
+}
+
+// 与delete相同，ctx结束时返回ctx.Err()
+func (cf *ColumnFamily) deleteContext(ctx context.Context, key string) ([]byte, bool, error) {
+	old, res, err := cf.lookupContext(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	//写入日志处理
+	err = cf.writeContext(ctx, kv.Value{
+		Key:    key,
+		Value:  nil,
+		Delete: true,
+	})
+	return old, res, err
+}
+
+// 读取之后再写入的操作（例如server中的SET NX、INCR以及批量操作）需要持有的锁
+// 同一个数据库的所有前端共用这个锁，这些操作之间以及与其他前端的写入互斥执行
+// 数据库本身的读写不会获取这个锁
+func (db *Database) UpdateLock() *sync.Mutex {
+	return &db.updateLock
+}
+
+// 将所有列族内存表中的数据持久化到sstable中
+func (db *Database) Flush() {
+	db.flushMem()
+}
+
+// 手动压缩key范围[start,end]内的数据，end为空表示没有上界
+// 内存表中的数据会先被持久化，压缩到最后一层的删除标记以及被覆盖的旧值会被清理
+func (cf *ColumnFamily) CompactRange(start, end string) {
+	cf.CompactRangeContext(context.Background(), start, end)
+}
+
+// 与CompactRange相同，ctx结束时停止压缩并返回ctx.Err()，已经写入的部分输出文件会被删除
+// 持久化内存表的过程不能被取消
+func (cf *ColumnFamily) CompactRangeContext(ctx context.Context, start, end string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cf.db.flushMem()
+	return cf.TableTree.CompactRangeContext(ctx, start, end)
+}
+
+// 手动将指定层的所有文件压缩到下一层
+func (cf *ColumnFamily) CompactLevel(level int) {
+	cf.TableTree.CompactLevel(level)
+}
+
+// 与CompactLevel相同，ctx结束时停止压缩并返回ctx.Err()
+func (cf *ColumnFamily) CompactLevelContext(ctx context.Context, level int) error {
+	return cf.TableTree.CompactLevelContext(ctx, level)
+}
+
+// 暂停后台的持久化和压缩任务，等待正在执行的后台任务完成之后返回
+// 可以多次调用，需要调用相同次数的ContinueBackgroundWork才会恢复
+func (db *Database) PauseBackgroundWork() {
+	db.bgLock.Lock()
+	defer db.bgLock.Unlock()
+
+	db.paused++
+	for db.bgRunning > 0 {
+		db.bgCond.Wait()
+	}
+}
+
+// 恢复被暂停的后台任务
+func (db *Database) ContinueBackgroundWork() {
+	db.bgLock.Lock()
+	defer db.bgLock.Unlock()
+
+	if db.paused > 0 {
+		db.paused--
+	}
+}
+
+// 开始执行一次后台任务，后台任务被暂停时返回false
+func (db *Database) beginBackgroundWork() bool {
+	db.bgLock.Lock()
+	defer db.bgLock.Unlock()
+
+	if db.paused > 0 {
+		return false
+	}
+	db.bgRunning++
+	return true
+}
+
+// 后台任务执行完成
+func (db *Database) endBackgroundWork() {
+	db.bgLock.Lock()
+	defer db.bgLock.Unlock()
+
+	db.bgRunning--
+	db.bgCond.Broadcast()
+}
@@ -0,0 +1,163 @@
+package tinydb
+
+import (
+	"context"
+	"tinydb/kv"
+)
+
+// 数据库迭代器，按照key的顺序遍历[start,end)范围内所有未被删除的数据
+// 遍历的数据来自memtable、immutableMem以及所有的sstable文件，相同的key以最新的数据为准
+// 使用完之后需要调用Close，否则被压缩的sstable文件不会被删除
+type Iterator struct {
+	iter     *kv.MergeIterator
+	operator kv.MergeOperator
+	end      string
+	release  func()
+	current  kv.Value
+	valid    bool
+	//ctx结束之后迭代器失效，Err返回ctx.Err()
+	ctx context.Context
+	err error
+}
+
+// 创建一个遍历列族中[start,end)的迭代器，end为空表示没有上界
+func (cf *ColumnFamily) NewIterator(start, end string) *Iterator {
+	return cf.NewIteratorContext(context.Background(), start, end)
+}
+
+// 与NewIterator相同，每移动一次检查ctx，ctx结束之后迭代器失效，Err返回ctx.Err()
+// 跳过大量删除标记的时候也会检查ctx
+func (cf *ColumnFamily) NewIteratorContext(ctx context.Context, start, end string) *Iterator {
+	//持有读锁时获取sstable和内存表，遍历的是同一时刻的数据
+	cf.db.writeLock.RLock()
+	iters, release := cf.TableTree.Iterators(start)
+	//内存表中的数据比所有sstable都新，排在最后
+	iters = append(iters, cf.ImmutableMem.NewIterator(start), cf.MemoryTree.NewIterator(start))
+	cf.db.writeLock.RUnlock()
+	operator := cf.mergeOperator()
+	it := &Iterator{
+		iter:     kv.NewMergeIteratorWithOperator(iters, operator),
+		operator: operator,
+		end:      end,
+		release:  release,
+		ctx:      ctx,
+	}
+	it.skip()
+	return it
+}
+
+// 创建一个遍历所有以prefix开头的key的迭代器
+func (cf *ColumnFamily) NewPrefixIterator(prefix string) *Iterator {
+	return cf.NewIterator(prefix, prefixEnd(prefix))
+}
+
+// 与NewPrefixIterator相同，ctx结束之后迭代器失效
+func (cf *ColumnFamily) NewPrefixIteratorContext(ctx context.Context, prefix string) *Iterator {
+	return cf.NewIteratorContext(ctx, prefix, prefixEnd(prefix))
+}
+
+// 获取大于所有以prefix开头的key的最小字符串，prefix为空或者全为0xff时返回空
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// 跳过被删除的数据，并检查是否超出范围
+// 没有找到旧值的合并记录在没有旧值的情况下合并
+func (it *Iterator) skip() {
+	for ; it.iter.Valid(); it.iter.Next() {
+		select {
+		case <-it.ctx.Done():
+			it.err = it.ctx.Err()
+			it.valid = false
+			return
+		default:
+		}
+		it.current = kv.Fold(it.operator, it.iter.Value(), nil)
+		if !it.current.Delete && !it.current.Merge {
+			break
+		}
+	}
+	it.valid = it.iter.Valid() && (it.end == "" || it.current.Key < it.end)
+}
+
+// 迭代器是否指向一个有效的元素
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// 移动到下一个元素
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+	it.iter.Next()
+	it.skip()
+}
+
+// 当前元素的key
+func (it *Iterator) Key() string {
+	return it.current.Key
+}
+
+// 当前元素序列化之后的值
+func (it *Iterator) Value() []byte {
+	return it.current.Value
+}
+
+// 遍历过程中遇到的错误，ctx结束时返回ctx.Err()
+func (it *Iterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.iter.Err()
+}
+
+// 释放迭代器引用的sstable文件
+func (it *Iterator) Close() {
+	if it.release != nil {
+		it.release()
+		it.release = nil
+	}
+	it.valid = false
+}
+
+// 将迭代器当前的值转化为类型对象
+func IteratorValue[T any](it *Iterator) (T, bool) {
+	return getInstance[T](it.Value())
+}
+
+// 按照key的顺序遍历所有以prefix开头的数据，fn返回false时停止遍历
+func Scan[T any](prefix string, fn func(key string, value T) bool) error {
+	return ScanCF(database.ColumnFamily, prefix, fn)
+}
+
+// 与Scan相同，ctx结束时停止遍历并返回ctx.Err()
+func ScanContext[T any](ctx context.Context, prefix string, fn func(key string, value T) bool) error {
+	return ScanCFContext(ctx, database.ColumnFamily, prefix, fn)
+}
+
+// 遍历指定列族中所有以prefix开头的数据
+func ScanCF[T any](cf *ColumnFamily, prefix string, fn func(key string, value T) bool) error {
+	return ScanCFContext(context.Background(), cf, prefix, fn)
+}
+
+// 与ScanCF相同，ctx结束时停止遍历并返回ctx.Err()
+func ScanCFContext[T any](ctx context.Context, cf *ColumnFamily, prefix string, fn func(key string, value T) bool) error {
+	it := cf.NewPrefixIteratorContext(ctx, prefix)
+	defer it.Close()
+
+	for ; it.Valid(); it.Next() {
+		value, _ := getInstance[T](it.Value())
+		if !fn(it.Key(), value) {
+			break
+		}
+	}
+	return it.Err()
+}
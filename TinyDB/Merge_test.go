@@ -0,0 +1,139 @@
+package tinydb_test
+
+import (
+	"testing"
+	"tinydb"
+	"tinydb/config"
+	"tinydb/kv"
+	"tinydb/sstable"
+)
+
+// 持久化开始时调用hook，此时内存表已经切换为immutable，新的sstable还没有插入
+type flushHook struct {
+	config.NopEventListener
+	hook func()
+}
+
+func (l *flushHook) OnFlushBegin(config.FlushInfo) {
+	if l.hook != nil {
+		l.hook()
+		l.hook = nil
+	}
+}
+
+// 第level层中key对应的所有记录
+func levelRecords(t *testing.T, cf *tinydb.ColumnFamily, level int, key string) []kv.Value {
+	t.Helper()
+	records := make([]kv.Value, 0)
+	for _, table := range cf.Levels()[level].Tables {
+		info, err := sstable.InspectTable(table.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range info.Entries {
+			if entry.Key == key && entry.Record != nil {
+				records = append(records, *entry.Record)
+			}
+		}
+	}
+	return records
+}
+
+func expectString(t *testing.T, cf *tinydb.ColumnFamily, key string, want string) {
+	t.Helper()
+	if got, ok := tinydb.GetCF[string](cf, key); !ok || got != want {
+		t.Errorf("Get(%s) = %q, %v, want %q", key, got, ok, want)
+	}
+}
+
+// 一个key的合并操作数分布在内存表、immutable、第0层以及更深的层中，读取时按照写入的顺序合并
+func TestMergeChainAcrossLevels(t *testing.T) {
+	listener := &flushHook{}
+	con := config.Config{
+		DataDir:       t.TempDir(),
+		MaxLevels:     3,
+		MergeOperator: config.StringAppendOperator,
+		EventListener: listener,
+	}
+	db := openDB(t, con.DataDir, con)
+	cf := db.ColumnFamily
+
+	//基础值在第2层，第一个操作数在第1层，第二个操作数在第0层
+	tinydb.SetCF(cf, "k", "a")
+	db.Flush()
+	cf.CompactLevel(0)
+	cf.CompactLevel(1)
+	tinydb.MergeCF(cf, "k", "b")
+	db.Flush()
+	cf.CompactLevel(0)
+	tinydb.MergeCF(cf, "k", "c")
+	db.Flush()
+	for level, want := range []int{1, 1, 1} {
+		if n := len(levelRecords(t, cf, level, "k")); n != want {
+			t.Fatalf("level %d has %d records of k, want %d", level, n, want)
+		}
+	}
+
+	//持久化的过程中，第三个操作数在immutable中，第四个操作数在新的内存表中
+	tinydb.MergeCF(cf, "k", "d")
+	listener.hook = func() {
+		tinydb.MergeCF(cf, "k", "e")
+		expectString(t, cf, "k", "abcde")
+	}
+	db.Flush()
+	if listener.hook != nil {
+		t.Fatal("the flush hook was not called")
+	}
+	expectString(t, cf, "k", "abcde")
+
+	tinydb.MergeCF(cf, "k", "f")
+	db = reopen(t, db, con)
+	expectString(t, db.ColumnFamily, "k", "abcdef")
+}
+
+// 压缩时只有输出层是这个key的最底层时才将合并记录与基础值合并，否则保留合并记录
+func TestMergeFoldedAtBaseLevel(t *testing.T) {
+	con := config.Config{
+		DataDir:       t.TempDir(),
+		MaxLevels:     3,
+		MergeOperator: config.StringAppendOperator,
+	}
+	db := openDB(t, con.DataDir, con)
+	cf := db.ColumnFamily
+
+	tinydb.SetCF(cf, "k", "a")
+	db.Flush()
+	cf.CompactLevel(0)
+	cf.CompactLevel(1)
+	tinydb.MergeCF(cf, "k", "b")
+	tinydb.MergeCF(cf, "k", "c")
+	db.Flush()
+
+	//第2层中还有基础值，压缩到第1层之后仍然是一条合并记录
+	cf.CompactLevel(0)
+	records := levelRecords(t, cf, 1, "k")
+	if len(records) != 1 || !records[0].Merge || len(records[0].Operands) != 2 {
+		t.Fatalf("level 1 has %+v, want one merge record with 2 operands", records)
+	}
+	expectString(t, cf, "k", "abc")
+
+	//压缩到第2层之后与基础值合并为一个普通的值
+	cf.CompactLevel(1)
+	if records := levelRecords(t, cf, 1, "k"); len(records) != 0 {
+		t.Errorf("level 1 still has %+v", records)
+	}
+	records = levelRecords(t, cf, 2, "k")
+	if len(records) != 1 || records[0].Merge || string(records[0].Value) != `"abc"` {
+		t.Errorf("level 2 has %+v, want the folded value \"abc\"", records)
+	}
+	expectString(t, cf, "k", "abc")
+
+	//没有更旧的数据时，第一次压缩就可以合并
+	tinydb.MergeCF(cf, "n", "x")
+	db.Flush()
+	cf.CompactLevel(0)
+	records = levelRecords(t, cf, 1, "n")
+	if len(records) != 1 || records[0].Merge || string(records[0].Value) != `"x"` {
+		t.Errorf("level 1 has %+v, want the folded value \"x\"", records)
+	}
+}
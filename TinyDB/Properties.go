@@ -0,0 +1,102 @@
+package tinydb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"tinydb/sstable"
+)
+
+// GetProperty支持的属性，数据库上调用时返回默认列族的属性
+const (
+	//某一层的文件数量，属性名后面加上层数，例如tinydb.num-files-at-level0
+	PropertyNumFilesAtLevel = "tinydb.num-files-at-level"
+	//每一层的文件数量、大小、key数量、删除标记数量以及key范围，每层一行
+	PropertyLevelStats = "tinydb.levelstats"
+	//所有sstable文件的信息，每个文件一行
+	PropertySSTables = "tinydb.sstables"
+	//估算的key数量
+	PropertyEstimateNumKeys = "tinydb.estimate-num-keys"
+	//所有sstable文件的总大小
+	PropertyTotalSSTFilesSize = "tinydb.total-sst-files-size"
+	//可写的内存表中kv的数量
+	PropertyNumEntriesActiveMemTable = "tinydb.num-entries-active-mem-table"
+)
+
+// 获取属性name的值，属性不存在或者列族已经被删除时返回false
+func (cf *ColumnFamily) GetProperty(name string) (string, bool) {
+	if cf.dropped.Load() {
+		return "", false
+	}
+	switch name {
+	case PropertyLevelStats:
+		var b strings.Builder
+		fmt.Fprintf(&b, "%-6s %6s %12s %10s %10s  %s\n", "Level", "Files", "Size", "Keys", "Deletes", "Range")
+		for _, l := range cf.Levels() {
+			fmt.Fprintf(&b, "%-6d %6d %12d %10d %10d", l.Level, l.Files, l.Size, l.Keys, l.Tombstones)
+			if l.Keys > 0 {
+				fmt.Fprintf(&b, "  %q-%q", l.MinKey, l.MaxKey)
+			}
+			b.WriteByte('\n')
+		}
+		return b.String(), true
+	case PropertySSTables:
+		var b strings.Builder
+		for _, l := range cf.Levels() {
+			for _, table := range l.Tables {
+				fmt.Fprintf(&b, "%s level=%d size=%d keys=%d deletes=%d range=%q-%q\n",
+					table.Path, table.Level, table.Size, table.Keys, table.Tombstones, table.MinKey, table.MaxKey)
+			}
+		}
+		return b.String(), true
+	case PropertyEstimateNumKeys:
+		return strconv.Itoa(cf.ApproximateKeys()), true
+	case PropertyTotalSSTFilesSize:
+		var size int64
+		for _, l := range cf.Levels() {
+			size += l.Size
+		}
+		return strconv.FormatInt(size, 10), true
+	case PropertyNumEntriesActiveMemTable:
+		return strconv.Itoa(cf.MemoryTree.Getcount()), true
+	}
+	if level, ok := strings.CutPrefix(name, PropertyNumFilesAtLevel); ok {
+		n, err := strconv.Atoi(level)
+		levels := cf.Levels()
+		if err != nil || n < 0 || n >= len(levels) {
+			return "", false
+		}
+		return strconv.Itoa(levels[n].Files), true
+	}
+	return "", false
+}
+
+// 获取每一层sstable的详细信息，下标为层数
+func (cf *ColumnFamily) Levels() []sstable.LevelInfo {
+	if cf.dropped.Load() {
+		return nil
+	}
+	return cf.TableTree.Levels()
+}
+
+// 估算key范围[start,end)的数据在sstable中占用的字节数，end为空表示没有上界
+// 内存表中的数据不计入，被覆盖但还没有压缩掉的旧数据会被计入
+func (cf *ColumnFamily) ApproximateSize(start, end string) int64 {
+	if cf.dropped.Load() {
+		return 0
+	}
+	return cf.TableTree.ApproximateSize(start, end)
+}
+
+// 估算列族中key的数量，sstable中的key减去删除标记，再加上内存表中的kv
+// 不同层以及内存表中相同的key会被重复计入
+func (cf *ColumnFamily) ApproximateKeys() int {
+	if cf.dropped.Load() {
+		return 0
+	}
+	keys := cf.MemoryTree.Getcount()
+	for _, l := range cf.TableTree.Levels() {
+		keys += l.Keys - l.Tombstones
+	}
+	return max(keys, 0)
+}
@@ -0,0 +1,146 @@
+package tinydb_test
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"tinydb"
+	"tinydb/config"
+)
+
+// 第1层有a000到a049，第0层有b000到b019以及a000的删除标记，内存表中有两个kv
+func openLevelsDB(t *testing.T) *tinydb.Database {
+	t.Helper()
+	db := openDB(t, t.TempDir(), config.Config{MaxLevels: 3})
+	setKeys(db.ColumnFamily, "a", 50, "1")
+	db.Flush()
+	db.CompactLevel(0)
+	setKeys(db.ColumnFamily, "b", 20, "2")
+	tinydb.DeleteCF[string](db.ColumnFamily, "a000")
+	db.Flush()
+	tinydb.SetCF(db.ColumnFamily, "m1", "3")
+	tinydb.SetCF(db.ColumnFamily, "m2", "3")
+	return db
+}
+
+func TestLevels(t *testing.T) {
+	db := openLevelsDB(t)
+	levels := db.Levels()
+	if len(levels) != 3 {
+		t.Fatalf("Levels() has %d levels, want 3", len(levels))
+	}
+	cases := []struct {
+		files, keys, tombstones int
+		minKey, maxKey          string
+	}{
+		{1, 21, 1, "a000", "b019"},
+		{1, 50, 0, "a000", "a049"},
+		{0, 0, 0, "", ""},
+	}
+	for i, c := range cases {
+		l := levels[i]
+		if l.Level != i || l.Files != c.files || l.Keys != c.keys || l.Tombstones != c.tombstones ||
+			l.MinKey != c.minKey || l.MaxKey != c.maxKey || len(l.Tables) != c.files {
+			t.Errorf("level %d = %+v, want %+v", i, l, c)
+		}
+		var size int64
+		for _, table := range l.Tables {
+			info, err := os.Stat(table.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if table.Level != i || table.Size != info.Size() {
+				t.Errorf("level %d: table %s at level %d with size %d, want size %d",
+					i, table.Path, table.Level, table.Size, info.Size())
+			}
+			size += table.Size
+		}
+		if l.Size != size {
+			t.Errorf("level %d has size %d, want %d", i, l.Size, size)
+		}
+	}
+}
+
+func TestGetProperty(t *testing.T) {
+	db := openLevelsDB(t)
+	levels := db.Levels()
+	total := strconv.FormatInt(levels[0].Size+levels[1].Size, 10)
+	cases := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{tinydb.PropertyNumFilesAtLevel + "0", "1", true},
+		{tinydb.PropertyNumFilesAtLevel + "1", "1", true},
+		{tinydb.PropertyNumFilesAtLevel + "2", "0", true},
+		{tinydb.PropertyNumFilesAtLevel + "3", "", false},
+		{tinydb.PropertyNumFilesAtLevel + "x", "", false},
+		//50 + 21 - 1个删除标记 + 内存表中的2个
+		{tinydb.PropertyEstimateNumKeys, "72", true},
+		{tinydb.PropertyTotalSSTFilesSize, total, true},
+		{tinydb.PropertyNumEntriesActiveMemTable, "2", true},
+		{"tinydb.unknown", "", false},
+	}
+	for _, c := range cases {
+		if value, ok := db.GetProperty(c.name); value != c.value || ok != c.ok {
+			t.Errorf("GetProperty(%s) = %q, %v, want %q, %v", c.name, value, ok, c.value, c.ok)
+		}
+	}
+
+	stats, ok := db.GetProperty(tinydb.PropertyLevelStats)
+	lines := strings.Split(strings.TrimSpace(stats), "\n")
+	if !ok || len(lines) != 4 {
+		t.Fatalf("GetProperty(%s) = %q, want a header and 3 levels", tinydb.PropertyLevelStats, stats)
+	}
+	for i, want := range [][]string{
+		{"0", "1", strconv.FormatInt(levels[0].Size, 10), "21", "1", `"a000"-"b019"`},
+		{"1", "1", strconv.FormatInt(levels[1].Size, 10), "50", "0", `"a000"-"a049"`},
+		{"2", "0", "0", "0", "0"},
+	} {
+		if fields := strings.Fields(lines[i+1]); strings.Join(fields, " ") != strings.Join(want, " ") {
+			t.Errorf("level stats line %d = %q, want %v", i, lines[i+1], want)
+		}
+	}
+
+	tables, ok := db.GetProperty(tinydb.PropertySSTables)
+	lines = strings.Split(strings.TrimSpace(tables), "\n")
+	if !ok || len(lines) != 2 || !strings.Contains(lines[0], "level=0") || !strings.Contains(lines[0], "keys=21 deletes=1") ||
+		!strings.Contains(lines[1], "level=1") || !strings.Contains(lines[1], "keys=50 deletes=0") {
+		t.Errorf("GetProperty(%s) = %q", tinydb.PropertySSTables, tables)
+	}
+}
+
+func TestApproximateSize(t *testing.T) {
+	db := openLevelsDB(t)
+	all := db.ApproximateSize("", "")
+	a := db.ApproximateSize("a", "b")
+	b := db.ApproximateSize("b", "")
+	cases := []struct {
+		name string
+		ok   bool
+	}{
+		{"all data is counted", all > 0},
+		{"the a range is in both levels", a > 0 && a < all},
+		{"the b range is only in level 0", b > 0 && b < all},
+		{"the ranges add up to at most the total", a+b <= all},
+		{"an empty range has no data", db.ApproximateSize("c", "d") == 0},
+		{"the memtable is not counted", db.ApproximateSize("m", "n") == 0},
+	}
+	for _, c := range cases {
+		if !c.ok {
+			t.Errorf("%s: all=%d a=%d b=%d", c.name, all, a, b)
+		}
+	}
+
+	//已经被删除的列族没有任何数据
+	cf := createFamily(t, db, "dropped")
+	setKeys(cf, "k", 10, "v")
+	db.Flush()
+	if err := db.DropColumnFamily("dropped"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cf.GetProperty(tinydb.PropertyEstimateNumKeys); ok || cf.Levels() != nil || cf.ApproximateSize("", "") != 0 {
+		t.Errorf("a dropped family still reports its data")
+	}
+}
@@ -0,0 +1,244 @@
+package tinydb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"tinydb/config"
+	"tinydb/kv"
+	"tinydb/memtable"
+	"tinydb/sstable"
+	"tinydb/wal"
+)
+
+// 一个数据目录的检查结果
+type CheckReport struct {
+	Tables []sstable.TableCheck
+	Logs   []wal.LogCheck
+}
+
+// 数据目录是否完好
+func (r *CheckReport) OK() bool {
+	for i := range r.Tables {
+		if !r.Tables[i].OK() {
+			return false
+		}
+	}
+	for i := range r.Logs {
+		if !r.Logs[i].OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// 离线检查一个数据目录中所有列族的sstable文件和两个日志文件
+// 检查时数据库不能处于运行状态
+func CheckDir(dir string) (CheckReport, error) {
+	report := CheckReport{}
+	for _, tableDir := range tableDirs(dir) {
+		names, err := dirNames(tableDir)
+		if err != nil {
+			return report, err
+		}
+		for _, name := range names {
+			if path.Ext(name) == ".db" {
+				report.Tables = append(report.Tables, sstable.CheckTable(path.Join(tableDir, name)))
+			}
+		}
+	}
+	for _, name := range []string{"wal1.log", "wal2.log"} {
+		if _, err := os.Stat(path.Join(dir, name)); err == nil {
+			report.Logs = append(report.Logs, wal.CheckFile(path.Join(dir, name)))
+		}
+	}
+	return report, nil
+}
+
+// 一个数据目录的修复结果
+type RepairReport struct {
+	//被修复的sstable文件
+	Tables []sstable.TableCheck
+	//被修复的日志文件
+	Logs []wal.LogCheck
+	//日志中可以读取的记录被保存到的新sstable文件，每个列族一个
+	SalvagedLogs []string
+}
+
+// 离线修复一个数据目录
+// 损坏的sstable文件（包括之前被隔离的.corrupt文件）中可以读取的元素会被写入到同名的新文件中，
+// 损坏的日志文件中可以读取的记录会按照列族分别写入到第0层一个新的sstable文件中，之后清空日志文件
+// 合并记录使用列族的合并算子，默认列族使用数据库配置中的合并算子
+func RepairDir(dir string) (RepairReport, error) {
+	report := RepairReport{}
+	for _, tableDir := range tableDirs(dir) {
+		if err := repairTables(tableDir, &report); err != nil {
+			return report, err
+		}
+	}
+
+	//两个日志文件按照修改时间从旧到新回放
+	logs := make([]string, 0)
+	for _, name := range []string{"wal1.log", "wal2.log"} {
+		if _, err := os.Stat(path.Join(dir, name)); err == nil {
+			logs = append(logs, path.Join(dir, name))
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		a, _ := os.Stat(logs[i])
+		b, _ := os.Stat(logs[j])
+		return a.ModTime().Before(b.ModTime())
+	})
+	damaged := false
+	records := make([]wal.Record, 0)
+	for _, name := range logs {
+		salvaged, check := wal.Salvage(name)
+		records = append(records, salvaged...)
+		if !check.OK() {
+			damaged = true
+			report.Logs = append(report.Logs, check)
+		}
+	}
+	if !damaged {
+		return report, nil
+	}
+
+	//与启动时相同，按照顺序将记录回放到每个列族的内存表中，同一个key的合并操作数不会丢失
+	operators, err := familyOperators(dir)
+	if err != nil {
+		return report, err
+	}
+	trees := make(map[int]*memtable.Tree)
+	for _, record := range records {
+		tree := trees[record.Family]
+		if tree == nil {
+			tree = &memtable.Tree{}
+			tree.Init()
+			trees[record.Family] = tree
+		}
+		wal.Replay(tree, record.Value, operators[record.Family])
+	}
+	//每个列族的内存表写入到第0层最新的sstable文件中
+	families := make([]int, 0, len(trees))
+	for family := range trees {
+		families = append(families, family)
+	}
+	sort.Ints(families)
+	for _, family := range families {
+		tableDir := dir
+		if family != 0 {
+			tableDir = path.Join(dir, familyDir, strconv.Itoa(family))
+			//列族已经被删除，它的记录直接丢弃
+			if _, err := os.Stat(tableDir); err != nil {
+				continue
+			}
+		}
+		values := trees[family].GetValue()
+		names, err := dirNames(tableDir)
+		if err != nil {
+			return report, err
+		}
+		salvaged := path.Join(tableDir, fmt.Sprintf("0.%d.db", nextTableIndex(names, 0)))
+		if err := sstable.WriteTable(salvaged, 0, values); err != nil {
+			return report, err
+		}
+		report.SalvagedLogs = append(report.SalvagedLogs, salvaged)
+	}
+	for _, name := range logs {
+		if err := os.Truncate(name, 0); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// 离线读取清单文件，获取每个列族的合并算子，没有合并算子的列族为nil
+func familyOperators(dir string) (map[int]kv.MergeOperator, error) {
+	base := config.GetConfig()
+	operators := map[int]kv.MergeOperator{0: kv.GetMergeOperator(base.MergeOperator)}
+	data, err := os.ReadFile(path.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return operators, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("the column family manifest is corrupted: %w", err)
+	}
+	for _, meta := range m.Families {
+		operators[meta.ID] = kv.GetMergeOperator(config.Inherit(base, meta.Options).MergeOperator)
+	}
+	return operators, nil
+}
+
+// 修复一个目录中损坏的sstable文件
+func repairTables(dir string, report *RepairReport) error {
+	names, err := dirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if path.Ext(name) != ".db" && !strings.HasSuffix(name, ".db.corrupt") {
+			continue
+		}
+		//被隔离的文件已经修复过，同名的新文件已经存在
+		if path.Ext(name) == ".corrupt" {
+			if _, err := os.Stat(path.Join(dir, strings.TrimSuffix(name, ".corrupt"))); err == nil {
+				continue
+			}
+		}
+		check, err := sstable.RepairTable(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if !check.OK() {
+			report.Tables = append(report.Tables, check)
+		}
+	}
+	return nil
+}
+
+// 数据目录以及所有列族保存sstable文件的目录
+func tableDirs(dir string) []string {
+	dirs := []string{dir}
+	entries, _ := os.ReadDir(path.Join(dir, familyDir))
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			dirs = append(dirs, path.Join(dir, familyDir, entry.Name()))
+		}
+	}
+	return dirs
+}
+
+// 读取目录中的所有文件名
+func dirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// 获取指定层下一个可用的文件标号
+func nextTableIndex(names []string, level int) int {
+	next := 0
+	for _, name := range names {
+		var l, index int
+		if n, _ := fmt.Sscanf(name, "%d.%d.db", &l, &index); n == 2 && l == level && index >= next {
+			next = index + 1
+		}
+	}
+	return next
+}
@@ -0,0 +1,87 @@
+package tinydb_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"tinydb"
+	"tinydb/config"
+)
+
+// 修改文件name中offset处的一个字节
+func flipByte(t *testing.T, name string, offset int) {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0xff
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 损坏的sstable文件和日志末尾被修复之后，可以读取的数据都被保留，无法读取的key出现在报告中
+func TestRepairDir(t *testing.T) {
+	con := config.Config{DataDir: t.TempDir(), BlockSize: 256}
+	db := openDB(t, con.DataDir, con)
+	setKeys(db.ColumnFamily, "t", 100, "table")
+	db.Flush()
+	setKeys(db.ColumnFamily, "w", 5, "wal")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//第一个数据块损坏，最后一条日志记录不完整
+	flipByte(t, filepath.Join(con.DataDir, "0.0.db"), 10)
+	var walName string
+	for _, name := range []string{"wal1.log", "wal2.log"} {
+		if info, err := os.Stat(filepath.Join(con.DataDir, name)); err == nil && info.Size() > 0 {
+			walName = filepath.Join(con.DataDir, name)
+			if err := os.Truncate(walName, info.Size()-1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if walName == "" {
+		t.Fatal("no wal has any records")
+	}
+
+	report, err := tinydb.RepairDir(con.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Tables) != 1 {
+		t.Fatalf("repaired %d tables, want 1", len(report.Tables))
+	}
+	lost := make(map[string]bool)
+	for _, key := range report.Tables[0].LostKeys {
+		lost[key] = true
+	}
+	if len(lost) == 0 || len(lost) == 100 || report.Tables[0].Readable != 100-len(lost) {
+		t.Fatalf("lost %d of 100 keys with %d readable, want only the first block lost",
+			len(lost), report.Tables[0].Readable)
+	}
+	if len(report.Logs) != 1 || report.Logs[0].Path != walName || report.Logs[0].Records != 4 {
+		t.Fatalf("repaired logs %+v, want 4 records salvaged from %s", report.Logs, walName)
+	}
+	if len(report.SalvagedLogs) != 1 {
+		t.Fatalf("salvaged logs into %v, want one table", report.SalvagedLogs)
+	}
+	if check, err := tinydb.CheckDir(con.DataDir); err != nil || !check.OK() {
+		t.Fatalf("CheckDir after repair: %+v, %v", check, err)
+	}
+
+	db = openDB(t, con.DataDir, con)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("t%03d", i)
+		if lost[key] {
+			expectValue(t, db.ColumnFamily, key, "")
+		} else {
+			expectValue(t, db.ColumnFamily, key, "table")
+		}
+	}
+	expectKeys(t, db.ColumnFamily, "w", 4, "wal")
+	expectValue(t, db.ColumnFamily, "w004", "")
+}
@@ -0,0 +1,71 @@
+package tinydb
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"tinydb/wal"
+)
+
+// 数据库是只读的，只能通过Apply写入从主节点复制的变更
+var ErrReadOnly = errors.New("tinydb: database is read only")
+
+// 设置数据库是否只读，作为从节点时需要设置为只读，Set、Delete、Merge以及Write都会失败
+func (db *Database) SetReadOnly(readOnly bool) {
+	db.readOnly.Store(readOnly)
+}
+
+// 数据库是否只读
+func (db *Database) ReadOnly() bool {
+	return db.readOnly.Load()
+}
+
+// 写入从主节点复制的变更，保留主节点分配的序列号，只能在只读的数据库上调用
+// 变更需要按照序列号的顺序写入，主节点上已经被删除的列族的变更不会被发送，序列号可以不连续
+func (db *Database) Apply(m Mutation) error {
+	if !db.readOnly.Load() {
+		return errors.New("tinydb: mutations can only be applied to a read only database")
+	}
+	cf, ok := db.GetColumnFamily(m.Family)
+	if !ok {
+		return fmt.Errorf("column family %q does not exist", m.Family)
+	}
+	db.applyLock.Lock()
+	defer db.applyLock.Unlock()
+	db.writeLock.RLock()
+	defer db.writeLock.RUnlock()
+
+	if cf.dropped.Load() {
+		return fmt.Errorf("column family %q has been dropped", m.Family)
+	}
+	last := db.seq.Load()
+	if m.Seq <= last {
+		return fmt.Errorf("sequence %d has already been applied, last applied %d", m.Seq, last)
+	}
+	//日志分配的下一个序列号正好是主节点的序列号
+	db.seq.Store(m.Seq - 1)
+	if err := db.Wal.Write([]wal.Record{{Family: cf.id, Value: m.Value}}); err != nil {
+		db.seq.Store(last)
+		return fmt.Errorf("failed to write sequence %d to the wal: %w", m.Seq, err)
+	}
+	if db.seq.Load() != m.Seq {
+		db.seq.Store(last)
+		return fmt.Errorf("failed to write sequence %d to the wal", m.Seq)
+	}
+	wal.Replay(cf.MemoryTree, m.Value, cf.mergeOperator())
+	return nil
+}
+
+// 读取没有打开的数据目录dir中最后一个序列号，目录不存在时返回0
+// 从节点在启动数据库之前据此判断是否需要从主节点下载检查点
+func ReadSequence(dir string) uint64 {
+	db := &Database{dir: dir}
+	seq := max(db.loadSequence(), db.archivedSequence())
+	for _, name := range []string{"wal1.log", "wal2.log"} {
+		records, _ := wal.Salvage(path.Join(dir, name))
+		for _, record := range records {
+			seq = max(seq, record.Seq)
+		}
+	}
+	return seq
+}
@@ -0,0 +1,213 @@
+package tinydb
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"tinydb/kv"
+	"tinydb/metrics"
+	"tinydb/sstable"
+)
+
+// 数据库运行期间累计的统计数据，重新启动之后从0开始
+type dbStats struct {
+	gets    atomic.Uint64
+	getHits atomic.Uint64
+	sets    atomic.Uint64
+	deletes atomic.Uint64
+	merges  atomic.Uint64
+	batches atomic.Uint64
+	//用户写入的key和值的字节数
+	bytesWritten atomic.Int64
+	flushes      atomic.Uint64
+	getLatency   metrics.Histogram
+	writeLatency metrics.Histogram
+	flushLatency metrics.Histogram
+}
+
+// 数据库的统计信息，sstable相关的数据是所有列族的总和
+type Stats struct {
+	//读取的次数以及找到数据的次数
+	Gets    uint64
+	GetHits uint64
+	//各类写入的次数，批量写入中的操作分别计入，Batches为批量写入的次数
+	Sets    uint64
+	Deletes uint64
+	Merges  uint64
+	Batches uint64
+	//用户写入的key和值的字节数，以及写入日志的字节数
+	BytesWritten int64
+	WALBytes     int64
+	//读取以及每一次写入（包括批量写入）的耗时
+	GetLatency   metrics.HistogramSnapshot
+	WriteLatency metrics.HistogramSnapshot
+	//内存表持久化的次数、耗时以及写入的字节数
+	Flushes      uint64
+	FlushLatency metrics.HistogramSnapshot
+	FlushBytes   int64
+	//压缩任务的次数、耗时以及读写的字节数
+	Compactions            uint64
+	CompactionLatency      metrics.HistogramSnapshot
+	CompactionBytesRead    int64
+	CompactionBytesWritten int64
+	//写放大，写入日志和sstable的总字节数 / 用户写入的字节数，没有写入时为0
+	WriteAmplification float64
+	//所有列族可写的内存表中的key数量
+	MemtableKeys int
+	//每一层的文件数量、大小以及累计写入的字节数
+	Levels []sstable.LevelStats
+	//查找时检查的sstable数量，以及在key索引中找到的次数
+	//每个sstable的key索引都常驻内存，没有找到的检查不读取磁盘，相当于布隆过滤器的过滤；
+	//sstable的数据块没有缓存，因此没有缓存命中率
+	IndexProbes  uint64
+	IndexHits    uint64
+	IndexHitRate float64
+}
+
+// 获取数据库的统计信息
+func (db *Database) Stats() Stats {
+	s := &db.stats
+	stats := Stats{
+		Gets:         s.gets.Load(),
+		GetHits:      s.getHits.Load(),
+		Sets:         s.sets.Load(),
+		Deletes:      s.deletes.Load(),
+		Merges:       s.merges.Load(),
+		Batches:      s.batches.Load(),
+		BytesWritten: s.bytesWritten.Load(),
+		WALBytes:     db.Wal1.BytesWritten() + db.Wal2.BytesWritten(),
+		GetLatency:   s.getLatency.Snapshot(),
+		WriteLatency: s.writeLatency.Snapshot(),
+		Flushes:      s.flushes.Load(),
+		FlushLatency: s.flushLatency.Snapshot(),
+	}
+	for _, cf := range db.allFamilies() {
+		if cf.dropped.Load() {
+			continue
+		}
+		stats.MemtableKeys += cf.MemoryTree.Getcount()
+		tree := cf.TableTree.Stats()
+		stats.FlushBytes += tree.FlushBytes
+		stats.Compactions += tree.Compactions
+		stats.CompactionLatency = stats.CompactionLatency.Add(tree.CompactionLatency)
+		stats.CompactionBytesRead += tree.CompactionBytesRead
+		stats.CompactionBytesWritten += tree.CompactionBytesWritten
+		stats.IndexProbes += tree.IndexProbes
+		stats.IndexHits += tree.IndexHits
+		for level, l := range tree.Levels {
+			if level == len(stats.Levels) {
+				stats.Levels = append(stats.Levels, sstable.LevelStats{})
+			}
+			stats.Levels[level].Files += l.Files
+			stats.Levels[level].Size += l.Size
+			stats.Levels[level].BytesWritten += l.BytesWritten
+		}
+	}
+	if stats.BytesWritten > 0 {
+		written := stats.WALBytes + stats.FlushBytes + stats.CompactionBytesWritten
+		stats.WriteAmplification = float64(written) / float64(stats.BytesWritten)
+	}
+	if stats.IndexProbes > 0 {
+		stats.IndexHitRate = float64(stats.IndexHits) / float64(stats.IndexProbes)
+	}
+	return stats
+}
+
+// 读取key并记录次数和耗时
+func (cf *ColumnFamily) get(key string) ([]byte, bool) {
+	data, ok, _ := cf.getContext(context.Background(), key)
+	return data, ok
+}
+
+// 与get相同，ctx结束时返回ctx.Err()
+func (cf *ColumnFamily) getContext(ctx context.Context, key string) ([]byte, bool, error) {
+	s := &cf.db.stats
+	defer s.getLatency.Since(time.Now())
+
+	data, ok, err := cf.lookupContext(ctx, key)
+	s.gets.Add(1)
+	if ok {
+		s.getHits.Add(1)
+	}
+	return data, ok, err
+}
+
+// 记录一次写入的操作
+func (s *dbStats) recordWrite(value kv.Value) {
+	switch {
+	case value.Delete:
+		s.deletes.Add(1)
+	case value.Merge:
+		s.merges.Add(1)
+	default:
+		s.sets.Add(1)
+	}
+	size := len(value.Key) + len(value.Value)
+	for _, operand := range value.Operands {
+		size += len(operand)
+	}
+	s.bytesWritten.Add(int64(size))
+}
+
+// 返回以Prometheus文本格式输出统计信息的handler，通常挂载在/metrics
+func (db *Database) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := db.Stats()
+		var e metrics.Exposition
+		counter := func(name, help string, value float64) {
+			e.Header(name, metrics.CounterType, help)
+			e.Sample(name, value)
+		}
+		gauge := func(name, help string, value float64) {
+			e.Header(name, metrics.GaugeType, help)
+			e.Sample(name, value)
+		}
+		histogram := func(name, help string, s metrics.HistogramSnapshot) {
+			e.Header(name, metrics.HistogramType, help)
+			e.Histogram(name, s)
+		}
+
+		counter("tinydb_gets_total", "Number of reads.", float64(stats.Gets))
+		counter("tinydb_get_hits_total", "Number of reads that found the key.", float64(stats.GetHits))
+		e.Header("tinydb_writes_total", metrics.CounterType, "Number of write operations, including the ones in batches.")
+		e.Sample("tinydb_writes_total", float64(stats.Sets), "op", "set")
+		e.Sample("tinydb_writes_total", float64(stats.Deletes), "op", "delete")
+		e.Sample("tinydb_writes_total", float64(stats.Merges), "op", "merge")
+		counter("tinydb_batches_total", "Number of write batches.", float64(stats.Batches))
+		counter("tinydb_user_written_bytes_total", "Bytes of keys and values written by users.", float64(stats.BytesWritten))
+		counter("tinydb_wal_written_bytes_total", "Bytes written to the write-ahead log.", float64(stats.WALBytes))
+		histogram("tinydb_get_duration_seconds", "Latency of reads.", stats.GetLatency)
+		histogram("tinydb_write_duration_seconds", "Latency of writes and write batches.", stats.WriteLatency)
+		counter("tinydb_flushes_total", "Number of memtable flushes.", float64(stats.Flushes))
+		histogram("tinydb_flush_duration_seconds", "Latency of memtable flushes.", stats.FlushLatency)
+		counter("tinydb_flush_written_bytes_total", "Bytes of sstables written by memtable flushes.", float64(stats.FlushBytes))
+		counter("tinydb_compactions_total", "Number of compactions.", float64(stats.Compactions))
+		histogram("tinydb_compaction_duration_seconds", "Latency of compactions.", stats.CompactionLatency)
+		counter("tinydb_compaction_read_bytes_total", "Bytes of sstables read by compactions.", float64(stats.CompactionBytesRead))
+		counter("tinydb_compaction_written_bytes_total", "Bytes of sstables written by compactions.", float64(stats.CompactionBytesWritten))
+		gauge("tinydb_write_amplification", "Bytes written to the log and sstables per byte written by users.", stats.WriteAmplification)
+		gauge("tinydb_memtable_keys", "Number of keys in the memtables.", float64(stats.MemtableKeys))
+
+		levels := []struct {
+			name, typ, help string
+			value           func(sstable.LevelStats) float64
+		}{
+			{"tinydb_level_files", metrics.GaugeType, "Number of sstables in the level.", func(l sstable.LevelStats) float64 { return float64(l.Files) }},
+			{"tinydb_level_bytes", metrics.GaugeType, "Size of the sstables in the level.", func(l sstable.LevelStats) float64 { return float64(l.Size) }},
+			{"tinydb_level_written_bytes_total", metrics.CounterType, "Bytes written to the level by flushes and compactions.", func(l sstable.LevelStats) float64 { return float64(l.BytesWritten) }},
+		}
+		for _, m := range levels {
+			e.Header(m.name, m.typ, m.help)
+			for level, l := range stats.Levels {
+				e.Sample(m.name, m.value(l), "level", strconv.Itoa(level))
+			}
+		}
+		counter("tinydb_index_probes_total", "Number of sstables checked by reads.", float64(stats.IndexProbes))
+		counter("tinydb_index_hits_total", "Number of sstable checks that found the key in the in-memory index.", float64(stats.IndexHits))
+
+		w.Header().Set("Content-Type", metrics.ContentType)
+		e.WriteTo(w)
+	})
+}
@@ -0,0 +1,240 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"tinydb/server"
+)
+
+// 客户端配置
+type Options struct {
+	//每个请求的超时时间，ctx中已经有截止时间时不生效，为0时使用5秒
+	Timeout time.Duration
+	//连接池中保持的空闲连接数量，为0时使用16
+	MaxIdleConns int
+	//同时建立的最大连接数量，为0表示不限制
+	MaxConns int
+	//幂等请求失败之后的重试次数，为0时使用2，小于0表示不重试
+	//删除以及包含写入操作的批量请求不会重试
+	Retries int
+	//第一次重试之前等待的时间，之后每次加倍，为0时使用50毫秒
+	RetryBackoff time.Duration
+	//遍历时每次请求获取的元素数量，为0时使用100
+	PageSize int
+}
+
+// 服务器返回的错误
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tinydb: server returned %d: %s", e.Status, e.Message)
+}
+
+// 通过HTTP JSON接口访问tinydb-server的客户端，可以被多个goroutine同时使用
+// 底层的连接会被复用
+type Client struct {
+	base string
+	http *http.Client
+	opts Options
+}
+
+// 创建连接到addr的客户端，addr可以是host:port或者http://host:port
+func New(addr string, opts Options) *Client {
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.MaxIdleConns == 0 {
+		opts.MaxIdleConns = 16
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 2
+	}
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = 50 * time.Millisecond
+	}
+	if opts.PageSize == 0 {
+		opts.PageSize = 100
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	transport := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: opts.Timeout, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:        opts.MaxIdleConns,
+		MaxIdleConnsPerHost: opts.MaxIdleConns,
+		MaxConnsPerHost:     opts.MaxConns,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &Client{
+		base: strings.TrimSuffix(addr, "/"),
+		http: &http.Client{Transport: transport},
+		opts: opts,
+	}
+}
+
+// 关闭连接池中的空闲连接
+func (c *Client) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+// 获取key对应的json值
+func (c *Client) GetRaw(ctx context.Context, key string) (json.RawMessage, bool, error) {
+	body, status, err := c.do(ctx, http.MethodGet, "/kv/"+url.PathEscape(key), nil, true)
+	if err != nil {
+		return nil, false, err
+	}
+	if status == http.StatusNotFound {
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+// 写入key对应的json值
+func (c *Client) SetRaw(ctx context.Context, key string, value json.RawMessage) error {
+	_, _, err := c.do(ctx, http.MethodPut, "/kv/"+url.PathEscape(key), value, true)
+	return err
+}
+
+// 删除key，返回删除之前是否存在
+// 删除请求失败之后不会重试，第一次请求可能已经生效，重试得到的是否存在并不可靠
+// 返回错误时key可能已经被删除，需要由调用者决定是否重新删除
+func (c *Client) Delete(ctx context.Context, key string) (bool, error) {
+	_, status, err := c.do(ctx, http.MethodDelete, "/kv/"+url.PathEscape(key), nil, false)
+	if err != nil {
+		return false, err
+	}
+	return status != http.StatusNotFound, nil
+}
+
+// 在服务器上按照顺序执行一组操作
+// 包含写入操作的批量请求不是幂等的，失败之后不会重试
+func (c *Client) Apply(ctx context.Context, b *Batch) ([]server.BatchResult, error) {
+	data, err := json.Marshal(server.BatchRequest{Ops: b.Ops})
+	if err != nil {
+		return nil, err
+	}
+	idempotent := true
+	for _, op := range b.Ops {
+		if op.Op != "get" {
+			idempotent = false
+		}
+	}
+	body, _, err := c.do(ctx, http.MethodPost, "/batch", data, idempotent)
+	if err != nil {
+		return nil, err
+	}
+	var resp server.BatchResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
+
+// 获取一页遍历结果
+func (c *Client) scanPage(ctx context.Context, prefix, start string, limit int) (server.ScanResult, error) {
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	query.Set("start", start)
+	query.Set("limit", strconv.Itoa(limit))
+	var result server.ScanResult
+	body, _, err := c.do(ctx, http.MethodGet, "/kv?"+query.Encode(), nil, true)
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(body, &result)
+	return result, err
+}
+
+// 按照key的顺序遍历以prefix开头的所有数据，fn返回false时停止
+func (c *Client) Scan(ctx context.Context, prefix string, fn func(key string, value json.RawMessage) bool) error {
+	it := c.NewIterator(ctx, prefix)
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// 发送一个请求，返回回复的内容和状态码，404不作为错误返回
+// 网络错误以及5xx错误时，幂等的请求会在退避之后重试
+func (c *Client) do(ctx context.Context, method, path string, body []byte, idempotent bool) ([]byte, int, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+	}
+	retries := c.opts.Retries
+	if !idempotent || retries < 0 {
+		retries = 0
+	}
+	backoff := c.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		data, status, err := c.roundTrip(ctx, method, path, body)
+		if err == nil || attempt >= retries || !retryable(err) || ctx.Err() != nil {
+			return data, status, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) roundTrip(ctx context.Context, method, path string, body []byte) ([]byte, int, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &msg) != nil || msg.Error == "" {
+			msg.Error = strings.TrimSpace(string(data))
+		}
+		return nil, resp.StatusCode, &Error{Status: resp.StatusCode, Message: msg.Error}
+	}
+	return data, resp.StatusCode, nil
+}
+
+// 网络错误和服务器内部错误可以重试，请求本身的错误不重试
+func retryable(err error) bool {
+	var serverErr *Error
+	if errors.As(err, &serverErr) {
+		return serverErr.Status >= 500
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
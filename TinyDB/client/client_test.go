@@ -0,0 +1,166 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"tinydb"
+	"tinydb/client"
+	"tinydb/config"
+	"tinydb/server"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// 每个测试使用一个新的数据库，测试结束时关闭
+func openDB(t *testing.T) *tinydb.Database {
+	db, err := tinydb.Open(config.Config{
+		DataDir:    t.TempDir(),
+		Level0Size: 10,
+		PerSize:    10,
+		Threshold:  10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+type user struct {
+	Name string
+	Age  int
+}
+
+// 嵌入式和远程模式的行为应该完全相同
+func TestKV(t *testing.T) {
+	db := openDB(t)
+	ts := client.NewTestServer(db)
+	defer ts.Close()
+
+	for name, kv := range map[string]client.KV{"embedded": client.NewEmbedded(db), "remote": ts.Client} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			p := name + "/user/"
+			if err := client.Set(ctx, kv, p+"1", user{"a", 1}); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Set(ctx, kv, p+"2", user{"b", 2}); err != nil {
+				t.Fatal(err)
+			}
+			u, ok, err := client.Get[user](ctx, kv, p+"2")
+			if err != nil || !ok || u.Name != "b" {
+				t.Fatalf("get: %v %v %v", u, ok, err)
+			}
+			if _, ok, _ := client.Get[user](ctx, kv, p+"3"); ok {
+				t.Fatal("missing key should not be found")
+			}
+
+			b := &client.Batch{}
+			b.Set(p+"3", user{"c", 3})
+			b.Delete(p + "1")
+			b.Get(p + "1")
+			results, err := kv.Apply(ctx, b)
+			if err != nil || len(results) != 3 || !results[1].Found || results[2].Found {
+				t.Fatalf("batch: %v %v", results, err)
+			}
+
+			names := make([]string, 0)
+			err = client.Scan(ctx, kv, p, func(key string, u user) bool {
+				names = append(names, strings.TrimPrefix(key, p)+"="+u.Name)
+				return true
+			})
+			if err != nil || strings.Join(names, ",") != "2=b,3=c" {
+				t.Fatalf("scan: %v %v", names, err)
+			}
+			if found, err := kv.Delete(ctx, p+"2"); err != nil || !found {
+				t.Fatalf("delete: %v %v", found, err)
+			}
+		})
+	}
+}
+
+// 服务器返回5xx时，幂等请求会被重试，批量写入不会被重试
+func TestRetry(t *testing.T) {
+	var calls atomic.Int32
+	handler := server.NewHTTPHandler(openDB(t), 0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1)%2 == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	c := client.New(ts.URL, client.Options{PageSize: 1})
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := client.Set(ctx, c, "retry/a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected one retry, got %d calls", calls.Load())
+	}
+	b := &client.Batch{}
+	b.Set("retry/b", 2)
+	if _, err := c.Apply(ctx, b); err == nil {
+		t.Fatal("batch with writes should not be retried")
+	}
+	//重试的删除无法知道第一次请求是否已经生效，返回错误而不是不可靠的结果
+	calls.Store(0)
+	if _, err := c.Delete(ctx, "retry/a"); err == nil {
+		t.Fatal("delete should not be retried")
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected no retry for delete, got %d calls", calls.Load())
+	}
+}
+
+// 嵌入式模式在ctx结束之后不再读写，返回ctx.Err()
+func TestEmbeddedCanceled(t *testing.T) {
+	kv := client.NewEmbedded(openDB(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, key := range []string{"canceled/1", "canceled/2", "canceled/3"} {
+		if err := client.Set(ctx, kv, key, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := 0
+	err := kv.Scan(ctx, "canceled/", func(key string, value json.RawMessage) bool {
+		count++
+		cancel()
+		return true
+	})
+	if err != context.Canceled || count != 1 {
+		t.Fatalf("scan: expected to stop after the first key, got %d keys and %v", count, err)
+	}
+	if err := kv.SetRaw(ctx, "canceled/4", json.RawMessage("1")); err != context.Canceled {
+		t.Fatalf("set: expected context.Canceled, got %v", err)
+	}
+	if _, _, err := kv.GetRaw(ctx, "canceled/1"); err != context.Canceled {
+		t.Fatalf("get: expected context.Canceled, got %v", err)
+	}
+	if _, ok, _ := kv.GetRaw(context.Background(), "canceled/4"); ok {
+		t.Fatal("a canceled set should not be written")
+	}
+	b := &client.Batch{}
+	b.Set("canceled/5", 1)
+	b.Delete("canceled/1")
+	if _, err := kv.Apply(ctx, b); err != context.Canceled {
+		t.Fatalf("apply: expected context.Canceled, got %v", err)
+	}
+	if _, ok, _ := kv.GetRaw(context.Background(), "canceled/1"); !ok {
+		t.Fatal("a canceled batch should not be written")
+	}
+}
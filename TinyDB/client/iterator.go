@@ -0,0 +1,66 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"tinydb/server"
+)
+
+// 遍历服务器中数据的迭代器，每次从服务器获取一页数据
+//
+//	it := c.NewIterator(ctx, "user:")
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	err := it.Err()
+type Iterator struct {
+	client *Client
+	ctx    context.Context
+	prefix string
+	//下一页开始的key
+	next  string
+	items []server.Item
+	index int
+	done  bool
+	err   error
+}
+
+// 创建一个按照key的顺序遍历以prefix开头的数据的迭代器
+func (c *Client) NewIterator(ctx context.Context, prefix string) *Iterator {
+	return &Iterator{client: c, ctx: ctx, prefix: prefix, next: prefix, index: -1}
+}
+
+// 移动到下一个元素，没有更多的元素或者出错时返回false
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.index++
+	for it.index >= len(it.items) {
+		if it.done {
+			return false
+		}
+		page, err := it.client.scanPage(it.ctx, it.prefix, it.next, it.client.opts.PageSize)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.items, it.index = page.Items, 0
+		it.next = page.Next
+		it.done = page.Next == ""
+	}
+	return true
+}
+
+func (it *Iterator) Key() string {
+	return it.items[it.index].Key
+}
+
+func (it *Iterator) Value() json.RawMessage {
+	return it.items[it.index].Value
+}
+
+// 遍历过程中遇到的错误
+func (it *Iterator) Err() error {
+	return it.err
+}
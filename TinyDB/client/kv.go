@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"tinydb"
+	"tinydb/server"
+)
+
+// 嵌入式和远程模式共用的接口，值统一使用json编码
+// 业务代码依赖这个接口，就可以在嵌入式数据库和tinydb-server之间切换
+type KV interface {
+	GetRaw(ctx context.Context, key string) (json.RawMessage, bool, error)
+	SetRaw(ctx context.Context, key string, value json.RawMessage) error
+	Delete(ctx context.Context, key string) (bool, error)
+	Apply(ctx context.Context, b *Batch) ([]server.BatchResult, error)
+	Scan(ctx context.Context, prefix string, fn func(key string, value json.RawMessage) bool) error
+}
+
+var (
+	_ KV = (*Client)(nil)
+	_ KV = (*Embedded)(nil)
+)
+
+// 获取key对应的值，与嵌入式接口tinydb.Get相同
+func Get[T any](ctx context.Context, kv KV, key string) (T, bool, error) {
+	var value T
+	data, ok, err := kv.GetRaw(ctx, key)
+	if err != nil || !ok {
+		return value, false, err
+	}
+	err = json.Unmarshal(data, &value)
+	return value, err == nil, err
+}
+
+// 写入任意可以被json编码的值，与嵌入式接口tinydb.Set相同
+func Set[T any](ctx context.Context, kv KV, key string, value T) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return kv.SetRaw(ctx, key, data)
+}
+
+// 按照key的顺序遍历以prefix开头的数据，与嵌入式接口tinydb.Scan相同
+func Scan[T any](ctx context.Context, kv KV, prefix string, fn func(key string, value T) bool) error {
+	var decodeErr error
+	err := kv.Scan(ctx, prefix, func(key string, data json.RawMessage) bool {
+		var value T
+		if decodeErr = json.Unmarshal(data, &value); decodeErr != nil {
+			return false
+		}
+		return fn(key, value)
+	})
+	if err != nil {
+		return err
+	}
+	return decodeErr
+}
+
+// 一组按照顺序执行的操作，其中的写入作为一个整体原子地生效
+type Batch struct {
+	Ops []server.BatchOp
+}
+
+// 获取key对应的值，结果中的Value为json
+func (b *Batch) Get(key string) {
+	b.Ops = append(b.Ops, server.BatchOp{Op: "get", Key: key})
+}
+
+// 写入任意可以被json编码的值
+func (b *Batch) Set(key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	b.Ops = append(b.Ops, server.BatchOp{Op: "put", Key: key, Value: data})
+	return nil
+}
+
+func (b *Batch) Delete(key string) {
+	b.Ops = append(b.Ops, server.BatchOp{Op: "delete", Key: key})
+}
+
+// 直接调用进程内数据库的KV实现
+type Embedded struct {
+	db *tinydb.Database
+}
+
+func NewEmbedded(db *tinydb.Database) *Embedded {
+	return &Embedded{db: db}
+}
+
+func (e *Embedded) GetRaw(ctx context.Context, key string) (json.RawMessage, bool, error) {
+	return server.GetValue(ctx, e.db, key)
+}
+
+func (e *Embedded) SetRaw(ctx context.Context, key string, value json.RawMessage) error {
+	return server.SetValue(ctx, e.db, key, value)
+}
+
+func (e *Embedded) Delete(ctx context.Context, key string) (bool, error) {
+	return server.DeleteValue(ctx, e.db, key)
+}
+
+func (e *Embedded) Apply(ctx context.Context, b *Batch) ([]server.BatchResult, error) {
+	for _, op := range b.Ops {
+		if err := op.Check(); err != nil {
+			return nil, err
+		}
+	}
+	return server.ApplyBatch(ctx, e.db, b.Ops)
+}
+
+func (e *Embedded) Scan(ctx context.Context, prefix string, fn func(key string, value json.RawMessage) bool) error {
+	it := e.db.NewPrefixIteratorContext(ctx, prefix)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		value, live := server.LiveValue(it.Value())
+		if !live {
+			continue
+		}
+		if !fn(it.Key(), value) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// 进程内的测试服务器
+type TestServer struct {
+	//服务器地址
+	URL string
+	//连接到服务器的客户端
+	Client *Client
+	server *httptest.Server
+}
+
+// 启动一个基于db的http服务器，用于在测试中使用远程模式
+func NewTestServer(db *tinydb.Database) *TestServer {
+	ts := httptest.NewServer(server.NewHTTPHandler(db, 0))
+	return &TestServer{
+		URL:    ts.URL,
+		Client: New(ts.URL, Options{}),
+		server: ts,
+	}
+}
+
+func (s *TestServer) Close() {
+	s.Client.Close()
+	s.server.Close()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"tinydb"
+	"tinydb/config"
+	"tinydb/replication"
+	"tinydb/server"
+
+	"google.golang.org/grpc"
+)
+
+func main() {
+	dir := flag.String("dir", "data", "data directory")
+	addr := flag.String("addr", "127.0.0.1:6379", "address to listen on for the RESP protocol, empty to disable")
+	httpAddr := flag.String("http", "", "address to listen on for the HTTP JSON API, empty to disable")
+	grpcAddr := flag.String("grpc", "", "address to listen on for the gRPC API, empty to disable")
+	timeout := flag.Duration("timeout", 10*time.Second, "maximum time to handle one HTTP or gRPC request")
+	threshold := flag.Int("threshold", 10000, "number of keys in the memtable before it is flushed to an sstable")
+	interval := flag.Int("check-interval", 3, "seconds between background flush and compaction checks")
+	verbose := flag.Bool("v", false, "log at the debug level, including every operation of the database")
+	replAddr := flag.String("replication", "", "address to listen on for followers, empty to disable")
+	replicaOf := flag.String("replicaof", "", "address of the primary to replicate from, the database is read only")
+	retention := flag.Int("wal-retention", 0, "megabytes of flushed wal kept for followers and subscribers that fall behind")
+	metricsAddr := flag.String("metrics", "", "address to serve Prometheus metrics on at /metrics, empty to disable")
+	flag.Parse()
+
+	if *addr == "" && *httpAddr == "" && *grpcAddr == "" {
+		fmt.Fprintln(os.Stderr, "tinydb-server: at least one of -addr, -http and -grpc is required")
+		os.Exit(2)
+	}
+	//默认只输出警告和错误
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(logger)
+	//从节点落后太多时，在打开数据库之前用主节点的检查点替换数据目录
+	if *replicaOf != "" {
+		replaced, err := replication.Bootstrap(*replicaOf, *dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "tinydb-server: bootstrap:", err)
+			os.Exit(1)
+		}
+		if replaced {
+			fmt.Fprintf(os.Stderr, "tinydb-server: bootstrapped %s from the checkpoint of %s\n", *dir, *replicaOf)
+		}
+	}
+	db := tinydb.Start(config.Config{
+		DataDir:          *dir,
+		Level0Size:       10,
+		PerSize:          10,
+		Threshold:        *threshold,
+		CheckInterval:    *interval,
+		WALRetentionSize: *retention,
+		Logger:           logger,
+	})
+
+	//每一种协议在一个goroutine中运行，任何一个出错时整个进程退出
+	errs := make(chan error, 6)
+	var shutdown []func(ctx context.Context)
+	var wg sync.WaitGroup
+	serve := func(name, addr string, fn func() error) {
+		fmt.Fprintf(os.Stderr, "tinydb-server: serving %s over %s on %s\n", *dir, name, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(); err != nil {
+				errs <- fmt.Errorf("%s: %w", name, err)
+			}
+		}()
+	}
+
+	if *addr != "" {
+		srv := server.New(db)
+		shutdown = append(shutdown, func(context.Context) { srv.Close() })
+		serve("RESP", *addr, func() error {
+			if err := srv.ListenAndServe(*addr); !errors.Is(err, server.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+	if *httpAddr != "" {
+		srv := &http.Server{
+			Addr:              *httpAddr,
+			Handler:           server.NewHTTPHandler(db, *timeout),
+			ReadHeaderTimeout: *timeout,
+		}
+		shutdown = append(shutdown, func(ctx context.Context) { srv.Shutdown(ctx) })
+		serve("HTTP", *httpAddr, func() error {
+			if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+	if *grpcAddr != "" {
+		l, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "tinydb-server:", err)
+			os.Exit(1)
+		}
+		srv := grpc.NewServer(grpc.UnaryInterceptor(server.TimeoutInterceptor(*timeout)))
+		server.RegisterGRPC(srv, db)
+		shutdown = append(shutdown, func(ctx context.Context) {
+			//等待正在执行的请求完成，超时之后强制关闭
+			stopped := make(chan struct{})
+			go func() {
+				srv.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				srv.Stop()
+			}
+		})
+		serve("gRPC", *grpcAddr, func() error { return srv.Serve(l) })
+	}
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", db.MetricsHandler())
+		srv := &http.Server{
+			Addr:              *metricsAddr,
+			Handler:           mux,
+			ReadHeaderTimeout: *timeout,
+		}
+		shutdown = append(shutdown, func(ctx context.Context) { srv.Shutdown(ctx) })
+		serve("metrics", *metricsAddr, func() error {
+			if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+	if *replAddr != "" {
+		primary := replication.NewPrimary(db)
+		shutdown = append(shutdown, func(context.Context) { primary.Close() })
+		serve("replication", *replAddr, func() error {
+			if err := primary.ListenAndServe(*replAddr); !errors.Is(err, replication.ErrPrimaryClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+	if *replicaOf != "" {
+		follower := replication.NewFollower(*replicaOf, db)
+		shutdown = append(shutdown, func(context.Context) { follower.Close() })
+		fmt.Fprintf(os.Stderr, "tinydb-server: replicating %s from %s\n", *dir, *replicaOf)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := follower.Run(); !errors.Is(err, replication.ErrFollowerClosed) {
+				errs <- err
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	code := 0
+	resync := false
+	select {
+	case <-signals:
+	case err := <-errs:
+		fmt.Fprintln(os.Stderr, "tinydb-server:", err)
+		code = 1
+		resync = errors.Is(err, replication.ErrResyncRequired)
+	}
+
+	//停止接收新的请求，等待正在执行的请求完成之后将内存表中的数据持久化
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	for _, fn := range shutdown {
+		fn(ctx)
+	}
+	wg.Wait()
+	db.Flush()
+	//数据库只能打开一次，重新执行自己，在打开数据库之前下载主节点的检查点
+	if resync {
+		if exe, err := os.Executable(); err == nil {
+			fmt.Fprintln(os.Stderr, "tinydb-server: restarting to bootstrap from the primary")
+			err = syscall.Exec(exe, os.Args, os.Environ())
+			fmt.Fprintln(os.Stderr, "tinydb-server:", err)
+		}
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"tinydb"
+)
+
+// tinydb checkpoint <dir> <dst>
+func runCheckpoint(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: tinydb checkpoint <dir> <dst>")
+	}
+	db := openDB(args[0])
+	if err := db.Checkpoint(args[1]); err != nil {
+		return err
+	}
+	fmt.Println("checkpoint created in", args[1])
+	return nil
+}
+
+// tinydb backup <dir> <backup dir>
+func runBackup(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: tinydb backup <dir> <backup dir>")
+	}
+	engine, err := tinydb.OpenBackupEngine(args[1])
+	if err != nil {
+		return err
+	}
+	db := openDB(args[0])
+	info, err := engine.CreateBackup(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("backup %d created: %d files (%d new), %d bytes\n", info.ID, info.Files, info.NewFiles, info.Size)
+	return nil
+}
+
+// tinydb backups <backup dir>
+func runBackups(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tinydb backups <backup dir>")
+	}
+	engine, err := tinydb.OpenBackupEngine(args[0])
+	if err != nil {
+		return err
+	}
+	infos, err := engine.Backups()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-6s %-25s %-6s %s\n", "id", "time", "files", "size")
+	for _, info := range infos {
+		fmt.Printf("%-6d %-25s %-6d %d\n", info.ID, info.Timestamp.Format("2006-01-02 15:04:05"), info.Files, info.Size)
+	}
+	return nil
+}
+
+// tinydb restore <backup dir> <id> <dst>
+func runRestore(args []string) error {
+	if len(args) != 3 {
+		return errors.New("usage: tinydb restore <backup dir> <id> <dst>")
+	}
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid backup id %q", args[1])
+	}
+	engine, err := tinydb.OpenBackupEngine(args[0])
+	if err != nil {
+		return err
+	}
+	if err := engine.Restore(id, args[2]); err != nil {
+		return err
+	}
+	fmt.Printf("backup %d restored to %s\n", id, args[2])
+	return nil
+}
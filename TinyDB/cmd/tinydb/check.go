@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"tinydb"
+)
+
+// tinydb check <dir>
+func runCheck(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tinydb check <dir>")
+	}
+	report, err := tinydb.CheckDir(args[0])
+	if err != nil {
+		return err
+	}
+	for _, table := range report.Tables {
+		if table.OK() {
+			fmt.Printf("ok      %s: %d keys\n", table.Path, table.Keys)
+			continue
+		}
+		fmt.Printf("CORRUPT %s: %d/%d keys readable\n", table.Path, table.Readable, table.Keys)
+		for _, msg := range table.Errors {
+			fmt.Println("        ", msg)
+		}
+	}
+	for _, log := range report.Logs {
+		if log.OK() {
+			fmt.Printf("ok      %s: %d records\n", log.Path, log.Records)
+			continue
+		}
+		fmt.Printf("CORRUPT %s: %d records readable, %d of %d bytes lost\n",
+			log.Path, log.Records, log.Size-log.ValidSize, log.Size)
+		fmt.Println("        ", log.Error)
+	}
+	if !report.OK() {
+		return errors.New("the data directory is damaged, run `tinydb repair` to salvage it")
+	}
+	return nil
+}
+
+// tinydb repair <dir>
+func runRepair(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tinydb repair <dir>")
+	}
+	report, err := tinydb.RepairDir(args[0])
+	if err != nil {
+		return err
+	}
+	for _, table := range report.Tables {
+		fmt.Printf("repaired %s: salvaged %d keys, lost %d keys\n",
+			table.Path, table.Readable, table.Keys-table.Readable)
+		for _, key := range table.LostKeys {
+			fmt.Println("         lost key:", key)
+		}
+		if table.Keys == 0 {
+			fmt.Println("         the index is unreadable, every key in this table is lost")
+		}
+	}
+	for _, log := range report.Logs {
+		fmt.Printf("repaired %s: salvaged %d records, lost %d bytes after offset %d\n",
+			log.Path, log.Records, log.Size-log.ValidSize, log.ValidSize)
+	}
+	for _, name := range report.SalvagedLogs {
+		fmt.Println("salvaged wal records written to", name)
+	}
+	if len(report.Tables) == 0 && len(report.Logs) == 0 {
+		fmt.Println("nothing to repair")
+	}
+	return nil
+}
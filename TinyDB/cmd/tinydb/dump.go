@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"tinydb/sstable"
+	"tinydb/wal"
+)
+
+// tinydb sst dump [--meta] <file>
+func runSST(args []string) error {
+	if len(args) < 1 || args[0] != "dump" {
+		return errors.New("usage: tinydb sst dump [--meta] <file>")
+	}
+	flags := flag.NewFlagSet("sst dump", flag.ContinueOnError)
+	metaOnly := flags.Bool("meta", false, "only print the footer and statistics")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: tinydb sst dump [--meta] <file>")
+	}
+	info, err := sstable.InspectTable(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	info.Dump(os.Stdout, !*metaOnly)
+	return nil
+}
+
+// tinydb wal dump <file>
+func runWAL(args []string) error {
+	if len(args) != 2 || args[0] != "dump" {
+		return errors.New("usage: tinydb wal dump <file>")
+	}
+	return wal.Dump(args[1], os.Stdout)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// 命令行工具的用法
+const usage = `Usage: tinydb <command> [arguments]
+
+Commands:
+  get <dir> <key>                 print the value of key
+  set <dir> <key> <value>         set key to value, value is stored as json if it is valid json, otherwise as a string
+  del <dir> <key>                 delete key
+  scan <dir> [--prefix p] [--limit n]
+                                  print every key with the prefix in order
+  stats <dir>                     print the files, sizes and compression ratio of every level
+  compact <dir> [start [end]]     compact the key range [start,end], empty end means no upper bound
+  compact <dir> --level n         compact every file in level n into the next level
+  shell <dir>                     start an interactive shell with history
+  sst dump [--meta] <file>        print the footer, index entries, records and statistics of an sstable file
+  wal dump <file>                 print every record of a wal file with its offset
+  check <dir>                     check the integrity of every sstable and wal file in dir
+  repair <dir>                    salvage readable records from damaged sstable and wal files in dir
+  checkpoint <dir> <dst>          create a checkpoint of dir in dst that can be opened as a database
+  backup <dir> <backup dir>       back up dir, sstable files already in the backup dir are not copied again
+  backups <backup dir>            list the backups in the backup dir
+  restore <backup dir> <id> <dst> restore a backup into dst
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "get", "set", "del", "scan", "stats", "compact":
+		err = runCommand(os.Args[1], args)
+	case "shell":
+		err = runShell(args)
+	case "sst":
+		err = runSST(args)
+	case "wal":
+		err = runWAL(args)
+	case "check":
+		err = runCheck(args)
+	case "repair":
+		err = runRepair(args)
+	case "checkpoint":
+		err = runCheckpoint(args)
+	case "backup":
+		err = runBackup(args)
+	case "backups":
+		err = runBackups(args)
+	case "restore":
+		err = runRestore(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tinydb:", err)
+		os.Exit(1)
+	}
+}
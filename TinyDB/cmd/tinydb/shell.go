@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"tinydb"
+	"tinydb/config"
+
+	"golang.org/x/term"
+)
+
+// 打开一个数据目录，命令行工具不需要后台检查，关闭时由close持久化内存表
+// 默认只输出警告和错误，设置了TINYDB_DEBUG时输出所有日志
+func openDB(dir string) *tinydb.Database {
+	level := slog.LevelWarn
+	if os.Getenv("TINYDB_DEBUG") != "" {
+		level = slog.LevelDebug
+	}
+	return tinydb.Start(config.Config{
+		DataDir:    dir,
+		Level0Size: 10,
+		PerSize:    10,
+		Threshold:  10000,
+		Logger:     slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})),
+	})
+}
+
+// 将内存表中的数据持久化，保证下次打开时不依赖日志回放
+func closeDB(db *tinydb.Database) {
+	db.Flush()
+}
+
+// 执行一条对数据库的命令，get、set、del、scan、stats、compact共用
+func execute(db *tinydb.Database, out io.Writer, cmd string, args []string) error {
+	switch cmd {
+	case "get":
+		if len(args) != 1 {
+			return errors.New("usage: get <key>")
+		}
+		value, ok := tinydb.Get[json.RawMessage](args[0])
+		if !ok {
+			return fmt.Errorf("key %q not found", args[0])
+		}
+		fmt.Fprintln(out, string(value))
+	case "set":
+		if len(args) != 2 {
+			return errors.New("usage: set <key> <value>")
+		}
+		//合法的json按原样保存，其余的值保存为字符串
+		var ok bool
+		if json.Valid([]byte(args[1])) {
+			ok = tinydb.Set(args[0], json.RawMessage(args[1]))
+		} else {
+			ok = tinydb.Set(args[0], args[1])
+		}
+		if !ok {
+			return fmt.Errorf("failed to set %q", args[0])
+		}
+	case "del":
+		if len(args) != 1 {
+			return errors.New("usage: del <key>")
+		}
+		if !tinydb.Delete[json.RawMessage](args[0]) {
+			return fmt.Errorf("key %q not found", args[0])
+		}
+	case "scan":
+		return scan(out, args)
+	case "stats":
+		if len(args) != 0 {
+			return errors.New("usage: stats")
+		}
+		stats(db, out)
+	case "compact":
+		return compact(db, out, args)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}
+
+// scan [--prefix p] [--limit n]
+func scan(out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flags.SetOutput(out)
+	prefix := flags.String("prefix", "", "only print keys with this prefix")
+	limit := flags.Int("limit", 0, "print at most n keys, 0 means no limit")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("usage: scan [--prefix p] [--limit n]")
+	}
+	count := 0
+	err := tinydb.Scan(*prefix, func(key string, value json.RawMessage) bool {
+		fmt.Fprintf(out, "%s\t%s\n", key, value)
+		count++
+		return *limit <= 0 || count < *limit
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "(%d keys)\n", count)
+	return nil
+}
+
+// 打印每一层的文件数量、大小以及压缩率
+func stats(db *tinydb.Database, out io.Writer) {
+	fmt.Fprintf(out, "memtable: %d keys\n", db.MemoryTree.Getcount())
+	fmt.Fprintf(out, "%-6s %6s %10s %12s %12s %6s\n", "level", "files", "keys", "raw bytes", "disk bytes", "ratio")
+	for level := 0; level < db.TableTree.LevelCount(); level++ {
+		tables := db.TableTree.LevelTables(level)
+		if len(tables) == 0 {
+			continue
+		}
+		var keys int
+		var raw, size int64
+		for _, table := range tables {
+			s := table.Stats()
+			keys += s.Keys
+			raw += s.RawDataSize
+			size += s.DataSize
+		}
+		ratio := 1.0
+		if raw > 0 {
+			ratio = float64(size) / float64(raw)
+		}
+		fmt.Fprintf(out, "%-6d %6d %10d %12d %12d %6.2f\n", level, len(tables), keys, raw, size, ratio)
+	}
+}
+
+// compact [start [end]] 或者 compact --level n
+func compact(db *tinydb.Database, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	flags.SetOutput(out)
+	level := flags.Int("level", -1, "compact every file in this level into the next level")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *level >= 0 {
+		if flags.NArg() != 0 {
+			return errors.New("usage: compact --level n")
+		}
+		if *level >= db.TableTree.LevelCount() {
+			return fmt.Errorf("level %d out of range [0,%d)", *level, db.TableTree.LevelCount())
+		}
+		db.CompactLevel(*level)
+		return nil
+	}
+	if flags.NArg() > 2 {
+		return errors.New("usage: compact [start [end]]")
+	}
+	var start, end string
+	if flags.NArg() > 0 {
+		start = flags.Arg(0)
+	}
+	if flags.NArg() > 1 {
+		end = flags.Arg(1)
+	}
+	db.CompactRange(start, end)
+	return nil
+}
+
+// tinydb <get|set|del|scan|stats|compact> <dir> [arguments]
+func runCommand(cmd string, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: tinydb %s <dir> [arguments]", cmd)
+	}
+	db := openDB(args[0])
+	defer closeDB(db)
+	return execute(db, os.Stdout, cmd, args[1:])
+}
+
+// 交互式命令的帮助信息
+const shellHelp = `Commands:
+  get <key>
+  set <key> <value>
+  del <key>
+  scan [--prefix p] [--limit n]
+  stats
+  compact [start [end]] | compact --level n
+  help
+  exit
+`
+
+// tinydb shell <dir>
+func runShell(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tinydb shell <dir>")
+	}
+	db := openDB(args[0])
+	defer closeDB(db)
+
+	//标准输入是终端时支持行编辑和历史记录，否则逐行读取命令
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		return repl(db, os.Stdout, func() (string, error) {
+			if scanner.Scan() {
+				return scanner.Text(), nil
+			}
+			if err := scanner.Err(); err != nil {
+				return "", err
+			}
+			return "", io.EOF
+		})
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "tinydb> ")
+	terminal.History = loadHistory()
+	return repl(db, terminal, terminal.ReadLine)
+}
+
+// 逐行读取并执行命令，直到输入结束或者exit
+func repl(db *tinydb.Database, out io.Writer, readLine func() (string, error)) error {
+	for {
+		line, err := readLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fields, err := splitLine(line)
+		if err != nil {
+			fmt.Fprintln(out, "error:", err)
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "exit", "quit":
+			return nil
+		case "help":
+			fmt.Fprint(out, shellHelp)
+			continue
+		}
+		if err := execute(db, out, fields[0], fields[1:]); err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+}
+
+// 按照空白切分命令行，支持用双引号包含空格，引号内可以使用Go的转义字符
+func splitLine(line string) ([]string, error) {
+	fields := make([]string, 0)
+	line = strings.TrimSpace(line)
+	for len(line) > 0 {
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, fmt.Errorf("unterminated quote in %s", line)
+			}
+			field, _ := strconv.Unquote(quoted)
+			fields = append(fields, field)
+			line = strings.TrimSpace(line[len(quoted):])
+			continue
+		}
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		fields = append(fields, line[:end])
+		line = strings.TrimSpace(line[end:])
+	}
+	return fields, nil
+}
+
+// 历史记录文件中最多保存的命令数量
+const maxHistory = 1000
+
+// 保存在文件中的命令历史，实现term.History
+type fileHistory struct {
+	path  string
+	lines []string
+}
+
+// 从~/.tinydb_history中加载历史记录，无法获取用户目录时只保存在内存中
+func loadHistory() *fileHistory {
+	h := &fileHistory{}
+	if home, err := os.UserHomeDir(); err == nil {
+		h.path = filepath.Join(home, ".tinydb_history")
+		if data, err := os.ReadFile(h.path); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if line != "" {
+					h.lines = append(h.lines, line)
+				}
+			}
+		}
+	}
+	return h
+}
+
+func (h *fileHistory) Add(entry string) {
+	if entry == "" || (len(h.lines) > 0 && h.lines[len(h.lines)-1] == entry) {
+		return
+	}
+	h.lines = append(h.lines, entry)
+	if len(h.lines) > maxHistory {
+		h.lines = h.lines[len(h.lines)-maxHistory:]
+	}
+	if h.path == "" {
+		return
+	}
+	//历史记录只是辅助功能，写入失败时忽略
+	_ = os.WriteFile(h.path, []byte(strings.Join(h.lines, "\n")+"\n"), 0600)
+}
+
+func (h *fileHistory) Len() int {
+	return len(h.lines)
+}
+
+// 下标0为最近一次的命令
+func (h *fileHistory) At(idx int) string {
+	return h.lines[len(h.lines)-1-idx]
+}
@@ -1,6 +1,10 @@
 package config
 
-import "sync"
+import (
+	"log/slog"
+	"reflect"
+	"sync"
+)
 
 // k-v数据库启动配置
 type Config struct {
@@ -9,14 +13,96 @@ type Config struct {
 	//0层所有sstable文件大小总和的最大值，为Mb
 	//超过此阈值，该层sstable会被压缩到下一层
 	Level0Size int
+	//sstable的最大层数，为0时使用10
+	MaxLevels int
+	//相邻两层文件总大小阈值的倍数，为0时使用10
+	LevelSizeMultiplier int
+	//根据最后一层的实际大小动态计算每一层的大小阈值
+	//最后一层的阈值为其实际大小，往上每一层依次除以LevelSizeMultiplier
+	//这样无论数据量多少，大部分数据都位于最后一层，空间放大有上限
+	DynamicLevelSize bool
 	//每层中sstable数量的阈值
 	PerSize int
 	//memtable中kv的最大数量，超出阈值会被保存到sstable中
 	Threshold int
 	//做一次检查工作的时间间隔
 	CheckInterval int
+	//sstable的压缩策略，可选TieringCompaction和LeveledCompaction
+	//为空时使用TieringCompaction
+	CompactionStrategy string
+	//leveled策略下单个sstable文件的目标大小，为Mb
+	//压缩输出的文件超过此大小会被切分，为0时使用默认值2Mb
+	TargetFileSize int
+	//每一层sstable文件的目标大小，为Mb，下标为层数
+	//未设置或者为0的层使用TargetFileSize
+	TargetFileSizes []int
+	//sstable数据块的压缩算法，可选NoCompression、SnappyCompression、ZstdCompression和FlateCompression
+	//为空时不压缩
+	Compression string
+	//每一层使用的压缩算法，下标为层数，未设置或者为空的层使用Compression
+	//例如第0层不压缩以减少写入的开销，最后一层使用zstd以节省空间
+	LevelCompression []string
+	//sstable中每个数据块压缩之前的大小，为字节，为0时使用4096
+	BlockSize int
+	//打开sstable文件时校验所有数据块的校验和，默认只校验文件尾和索引区
+	//数据块在每一次读取时都会被校验
+	ParanoidChecks bool
+	//同时执行压缩任务的最大数量，为0时使用1
+	CompactionWorkers int
+	//压缩时每秒写入磁盘的最大数据量，为Mb，为0表示不限速
+	CompactionRateLimit int
+	//Merge使用的合并算子的名称，为空时不能使用Merge
+	//可选Int64AddOperator、StringAppendOperator和JSONMergePatchOperator，
+	//自定义的合并算子需要先通过kv.RegisterMergeOperator注册
+	MergeOperator string
+	//已经持久化的日志文件保留的总大小，为Mb，为0时不保留
+	//订阅者可以从保留的日志中最早的位置开始读取变更
+	WALRetentionSize int
+	//数据库输出日志使用的Logger，为空时使用slog.Default()
+	//每一次读写只输出Debug级别的日志，默认不会输出；持久化、压缩等后台任务输出Info级别的日志
+	//Logger不会被保存到列族清单中，也不会发送给从节点
+	Logger Logger `json:"-"`
+	//接收持久化、压缩等内部事件的回调，为空时忽略所有事件
+	//与Logger一样不会被保存，列族继承数据库的EventListener
+	EventListener EventListener `json:"-"`
 }
 
+// 分级的结构化日志，args为交替出现的字段名和值，*slog.Logger实现了这个接口
+// 常用的字段有file（文件路径）、level（sstable的层数）和duration（耗时）
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// 可选的数据块压缩算法
+const (
+	NoCompression     = "none"
+	SnappyCompression = "snappy"
+	ZstdCompression   = "zstd"
+	//纯Go实现的deflate压缩，不依赖第三方库
+	FlateCompression = "flate"
+)
+
+// 可选的压缩策略
+const (
+	//每一层的文件整体合并之后追加到下一层
+	TieringCompaction = "tiering"
+	//第1层及以下每层的文件key范围互不重叠，每次只合并一个文件和下一层中与之重叠的文件
+	LeveledCompaction = "leveled"
+)
+
+// 内置的合并算子，值和操作数都是json
+const (
+	//将整数操作数累加到旧值上，没有旧值时从0开始
+	Int64AddOperator = "int64add"
+	//将字符串操作数追加到旧值的后面
+	StringAppendOperator = "stringappend"
+	//按照RFC 7386将对象操作数合并到旧值中
+	JSONMergePatchOperator = "jsonmergepatch"
+)
+
 // 常驻内存
 var config Config
 
@@ -34,3 +120,33 @@ func Init(con Config) {
 func GetConfig() Config {
 	return config
 }
+
+// 配置中的Logger，没有设置时返回slog.Default()
+func (con Config) GetLogger() Logger {
+	if con.Logger == nil {
+		return slog.Default()
+	}
+	return con.Logger
+}
+
+// 配置中的EventListener，没有设置时返回NopEventListener
+func (con Config) GetEventListener() EventListener {
+	if con.EventListener == nil {
+		return NopEventListener{}
+	}
+	return con.EventListener
+}
+
+// 使用base中的值补全con中为零值的字段，用于列族继承数据库的配置
+// 零值表示没有设置，因此列族不能把数据库中为true的bool字段（DynamicLevelSize、ParanoidChecks）
+// 改回false，也不能把数值字段设置为0，这些字段只能在数据库中为零值时由列族单独开启
+func Inherit(base, con Config) Config {
+	dst := reflect.ValueOf(&con).Elem()
+	src := reflect.ValueOf(base)
+	for i := 0; i < dst.NumField(); i++ {
+		if dst.Field(i).IsZero() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return con
+}
@@ -0,0 +1,89 @@
+package config
+
+import "time"
+
+// 数据库内部事件的回调，可以用于监控持久化、压缩等后台任务
+// 回调在执行任务的goroutine中同步调用，不应该长时间阻塞，也不能在回调中写入数据库或者调用Flush
+// 只关心部分事件时可以嵌入NopEventListener
+type EventListener interface {
+	//内存表开始持久化以及持久化完成
+	OnFlushBegin(info FlushInfo)
+	OnFlushEnd(info FlushInfo)
+	//压缩任务开始以及结束，压缩失败时Err不为空
+	OnCompactionBegin(info CompactionInfo)
+	OnCompactionEnd(info CompactionInfo)
+	//sstable文件写入完成以及被删除
+	OnTableCreated(info TableInfo)
+	OnTableDeleted(info TableInfo)
+	//持久化时切换到另一个日志文件
+	OnWALRotated(info WALInfo)
+	//后台任务失败，任务会在下一次检查时重试
+	OnBackgroundError(info BackgroundErrorInfo)
+}
+
+// 一次内存表持久化
+type FlushInfo struct {
+	//参与持久化的列族数量，以及所有内存表中kv的数量
+	Families int
+	Keys     int
+	//持久化的耗时，只在OnFlushEnd中设置
+	Duration time.Duration
+}
+
+// 一次压缩任务
+type CompactionInfo struct {
+	//sstable所在的目录，每个列族有自己的目录
+	Dir         string
+	Level       int
+	OutputLevel int
+	Inputs      []TableInfo
+	//以下字段只在OnCompactionEnd中设置
+	Outputs      []TableInfo
+	BytesRead    int64
+	BytesWritten int64
+	Duration     time.Duration
+	Err          error
+}
+
+// sstable文件被创建或者删除的原因
+const (
+	FlushReason      = "flush"
+	CompactionReason = "compaction"
+)
+
+// 一个sstable文件
+type TableInfo struct {
+	Path  string
+	Level int
+	Size  int64
+	//FlushReason或者CompactionReason
+	Reason string
+}
+
+// 一次日志文件的切换
+type WALInfo struct {
+	//之前使用的日志文件，其中的记录已经全部持久化
+	Path string
+	//之后使用的日志文件
+	NewPath string
+}
+
+// 一次后台任务的错误
+type BackgroundErrorInfo struct {
+	//失败的任务，例如CompactionReason
+	Job string
+	Dir string
+	Err error
+}
+
+// 忽略所有事件的EventListener
+type NopEventListener struct{}
+
+func (NopEventListener) OnFlushBegin(FlushInfo)                {}
+func (NopEventListener) OnFlushEnd(FlushInfo)                  {}
+func (NopEventListener) OnCompactionBegin(CompactionInfo)      {}
+func (NopEventListener) OnCompactionEnd(CompactionInfo)        {}
+func (NopEventListener) OnTableCreated(TableInfo)              {}
+func (NopEventListener) OnTableDeleted(TableInfo)              {}
+func (NopEventListener) OnWALRotated(WALInfo)                  {}
+func (NopEventListener) OnBackgroundError(BackgroundErrorInfo) {}
@@ -0,0 +1,34 @@
+package config_test
+
+import (
+	"testing"
+	"tinydb/config"
+)
+
+func TestInherit(t *testing.T) {
+	base := config.Config{
+		DataDir:          "base",
+		Threshold:        100,
+		Compression:      config.SnappyCompression,
+		LevelCompression: []string{config.NoCompression},
+		ParanoidChecks:   true,
+	}
+	got := config.Inherit(base, config.Config{Threshold: 10, DynamicLevelSize: true})
+
+	cases := []struct {
+		name      string
+		got, want any
+	}{
+		{"set field", got.Threshold, 10},
+		{"inherited field", got.Compression, config.SnappyCompression},
+		{"inherited slice", len(got.LevelCompression), 1},
+		{"bool enabled by the family", got.DynamicLevelSize, true},
+		//零值表示没有设置，列族不能关闭数据库中开启的bool选项
+		{"bool disabled by the family", got.ParanoidChecks, true},
+	}
+	for _, c := range cases {
+		if c.got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package kv
+
+import "container/heap"
+
+// 按照key从小到大的顺序遍历数据的迭代器
+type Iterator interface {
+	//迭代器是否指向一个有效的元素
+	Valid() bool
+	//当前指向的元素，只有在Valid时才可以调用
+	Value() Value
+	//移动到下一个元素
+	Next()
+	//遍历过程中遇到的错误
+	Err() error
+}
+
+// 多路归并迭代器，将多个有序迭代器合并成一个有序迭代器
+// 相同的key只返回一次，以优先级最高（在输入中排在最后）的迭代器中的数据为准
+// 设置了合并算子时，合并记录会与更旧的数据合并
+type MergeIterator struct {
+	items    mergeHeap
+	current  Value
+	valid    bool
+	err      error
+	operator MergeOperator
+}
+
+// 堆中的一个元素
+type mergeItem struct {
+	iter Iterator
+	//优先级，数值越大表示数据越新
+	priority int
+}
+
+// 按照key从小到大排列，key相同的时候优先级高的排在前面
+type mergeHeap []*mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	ki, kj := h[i].iter.Value().Key, h[j].iter.Value().Key
+	if ki != kj {
+		return ki < kj
+	}
+	return h[i].priority > h[j].priority
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(*mergeItem)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// 创建归并迭代器，iters按照从旧到新的顺序排列
+func NewMergeIterator(iters []Iterator) *MergeIterator {
+	return NewMergeIteratorWithOperator(iters, nil)
+}
+
+// 创建使用合并算子op的归并迭代器
+// 没有找到基础值的合并记录会把所有操作数连接成一条合并记录返回
+func NewMergeIteratorWithOperator(iters []Iterator, op MergeOperator) *MergeIterator {
+	m := &MergeIterator{
+		items:    make(mergeHeap, 0, len(iters)),
+		operator: op,
+	}
+	for i, iter := range iters {
+		m.push(&mergeItem{iter: iter, priority: i})
+	}
+	heap.Init(&m.items)
+	m.Next()
+	return m
+}
+
+// 将仍然有效的迭代器放回堆中，并记录遇到的错误
+func (m *MergeIterator) push(item *mergeItem) {
+	if item.iter.Valid() {
+		m.items = append(m.items, item)
+		return
+	}
+	if err := item.iter.Err(); err != nil && m.err == nil {
+		m.err = err
+	}
+}
+
+func (m *MergeIterator) Valid() bool {
+	return m.valid
+}
+
+func (m *MergeIterator) Value() Value {
+	return m.current
+}
+
+func (m *MergeIterator) Err() error {
+	return m.err
+}
+
+// 取出堆顶最新版本的数据，并跳过其他迭代器中相同key的旧版本
+func (m *MergeIterator) Next() {
+	if m.err != nil || len(m.items) == 0 {
+		m.valid = false
+		return
+	}
+	top := heap.Pop(&m.items).(*mergeItem)
+	m.current = top.iter.Value()
+	m.valid = true
+	m.advance(top)
+
+	for len(m.items) > 0 && m.items[0].iter.Value().Key == m.current.Key {
+		item := heap.Pop(&m.items).(*mergeItem)
+		//最新的数据是合并记录时，依次与更旧的版本合并
+		if m.current.Merge && m.operator != nil {
+			older := item.iter.Value()
+			m.current = Fold(m.operator, m.current, &older)
+		}
+		m.advance(item)
+	}
+	if m.err != nil {
+		m.valid = false
+	}
+}
+
+// 将迭代器移动到下一个元素之后重新放回堆中
+func (m *MergeIterator) advance(item *mergeItem) {
+	item.iter.Next()
+	if item.iter.Valid() {
+		heap.Push(&m.items, item)
+		return
+	}
+	if err := item.iter.Err(); err != nil && m.err == nil {
+		m.err = err
+	}
+}
+
+// 基于有序切片的迭代器
+type SliceIterator struct {
+	values []Value
+	index  int
+}
+
+func NewSliceIterator(values []Value) *SliceIterator {
+	return &SliceIterator{values: values}
+}
+
+func (s *SliceIterator) Valid() bool {
+	return s.index < len(s.values)
+}
+
+func (s *SliceIterator) Value() Value {
+	return s.values[s.index]
+}
+
+func (s *SliceIterator) Next() {
+	s.index++
+}
+
+func (s *SliceIterator) Err() error {
+	return nil
+}
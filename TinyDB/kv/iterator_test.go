@@ -0,0 +1,46 @@
+package kv_test
+
+import (
+	"testing"
+	"tinydb/kv"
+)
+
+func TestMergeIterator(t *testing.T) {
+	// 旧数据
+	older := kv.NewSliceIterator([]kv.Value{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Value: []byte("1")},
+		{Key: "d", Value: []byte("1")},
+	})
+	// 新数据，b被删除，d被覆盖
+	newer := kv.NewSliceIterator([]kv.Value{
+		{Key: "b", Delete: true},
+		{Key: "c", Value: []byte("2")},
+		{Key: "d", Value: []byte("2")},
+	})
+
+	iter := kv.NewMergeIterator([]kv.Iterator{older, newer})
+	expected := []kv.Value{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Delete: true},
+		{Key: "c", Value: []byte("2")},
+		{Key: "d", Value: []byte("2")},
+	}
+	i := 0
+	for ; iter.Valid(); iter.Next() {
+		if i >= len(expected) {
+			t.Fatalf("Unexpected extra key %s", iter.Value().Key)
+		}
+		v := iter.Value()
+		if v.Key != expected[i].Key || v.Delete != expected[i].Delete || string(v.Value) != string(expected[i].Value) {
+			t.Errorf("Expected %v, got %v", expected[i], v)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("Expected %d keys, got %d", len(expected), i)
+	}
+	if iter.Err() != nil {
+		t.Errorf("Unexpected error %v", iter.Err())
+	}
+}
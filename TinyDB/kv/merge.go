@@ -0,0 +1,161 @@
+package kv
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"tinydb/config"
+)
+
+// 合并算子，定义如何将一个操作数应用到旧值上
+// 合并记录在读取和压缩时才会与旧值合并，同一组操作数无论何时合并都必须得到相同的结果
+type MergeOperator interface {
+	//算子的名称，保存在配置中
+	Name() string
+	//将operand应用到existing上并返回新值，existing为nil表示没有旧值
+	//返回错误时这个操作数被忽略
+	Merge(key string, existing, operand []byte) ([]byte, error)
+}
+
+// 已经注册的合并算子
+var (
+	operators    = make(map[string]MergeOperator)
+	operatorLock sync.RWMutex
+)
+
+func init() {
+	RegisterMergeOperator(int64Add{})
+	RegisterMergeOperator(stringAppend{})
+	RegisterMergeOperator(jsonMergePatch{})
+}
+
+// 注册一个合并算子，同名的算子会被替换
+// 需要在打开使用这个算子的数据库之前注册
+func RegisterMergeOperator(op MergeOperator) {
+	operatorLock.Lock()
+	defer operatorLock.Unlock()
+
+	operators[op.Name()] = op
+}
+
+// 根据名称获取合并算子，没有注册时返回nil
+func GetMergeOperator(name string) MergeOperator {
+	operatorLock.RLock()
+	defer operatorLock.RUnlock()
+
+	return operators[name]
+}
+
+// 将合并记录value应用到更旧的数据older上，older为nil表示没有更旧的数据
+// older同样是合并记录时，两者的操作数连接成一条合并记录，否则得到一个普通的值
+// 所有操作数都被忽略并且没有旧值时，得到一个删除标记
+func Fold(op MergeOperator, value Value, older *Value) Value {
+	if !value.Merge {
+		return value
+	}
+	if older != nil && older.Merge {
+		operands := make([][]byte, 0, len(older.Operands)+len(value.Operands))
+		operands = append(operands, older.Operands...)
+		return Value{Key: value.Key, Merge: true, Operands: append(operands, value.Operands...)}
+	}
+	if op == nil {
+		config.GetConfig().GetLogger().Warn("no merge operator for the merge record", "key", value.Key)
+		return value
+	}
+	var existing []byte
+	if older != nil && !older.Delete {
+		existing = older.Value
+	}
+	for _, operand := range value.Operands {
+		result, err := op.Merge(value.Key, existing, operand)
+		if err != nil {
+			config.GetConfig().GetLogger().Warn("ignoring the merge operand", "key", value.Key, "error", err)
+			continue
+		}
+		existing = result
+	}
+	if existing == nil {
+		return Value{Key: value.Key, Delete: true}
+	}
+	return Value{Key: value.Key, Value: existing}
+}
+
+// 整数累加
+type int64Add struct{}
+
+func (int64Add) Name() string {
+	return config.Int64AddOperator
+}
+
+func (int64Add) Merge(key string, existing, operand []byte) ([]byte, error) {
+	var base, delta int64
+	if err := json.Unmarshal(operand, &delta); err != nil {
+		return nil, fmt.Errorf("operand is not an integer: %w", err)
+	}
+	if existing != nil {
+		if err := json.Unmarshal(existing, &base); err != nil {
+			return nil, fmt.Errorf("value is not an integer: %w", err)
+		}
+	}
+	return json.Marshal(base + delta)
+}
+
+// 字符串追加
+type stringAppend struct{}
+
+func (stringAppend) Name() string {
+	return config.StringAppendOperator
+}
+
+func (stringAppend) Merge(key string, existing, operand []byte) ([]byte, error) {
+	var base, suffix string
+	if err := json.Unmarshal(operand, &suffix); err != nil {
+		return nil, fmt.Errorf("operand is not a string: %w", err)
+	}
+	if existing != nil {
+		if err := json.Unmarshal(existing, &base); err != nil {
+			return nil, fmt.Errorf("value is not a string: %w", err)
+		}
+	}
+	return json.Marshal(base + suffix)
+}
+
+// RFC 7386 JSON Merge Patch
+type jsonMergePatch struct{}
+
+func (jsonMergePatch) Name() string {
+	return config.JSONMergePatchOperator
+}
+
+func (jsonMergePatch) Merge(key string, existing, operand []byte) ([]byte, error) {
+	var patch any
+	if err := json.Unmarshal(operand, &patch); err != nil {
+		return nil, fmt.Errorf("operand is not json: %w", err)
+	}
+	//旧值不是json时当作没有旧值
+	var target any
+	if existing != nil {
+		json.Unmarshal(existing, &target)
+	}
+	return json.Marshal(mergePatch(target, patch))
+}
+
+// 将patch合并到target中，patch中值为null的字段被删除
+func mergePatch(target, patch any) any {
+	fields, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	object, ok := target.(map[string]any)
+	if !ok {
+		object = make(map[string]any)
+	}
+	for name, value := range fields {
+		if value == nil {
+			delete(object, name)
+		} else {
+			object[name] = mergePatch(object[name], value)
+		}
+	}
+	return object
+}
@@ -0,0 +1,71 @@
+package kv_test
+
+import (
+	"testing"
+	"tinydb/config"
+	"tinydb/kv"
+)
+
+func TestMergeOperators(t *testing.T) {
+	cases := []struct {
+		operator string
+		existing string
+		operands []string
+		expected string
+	}{
+		{config.Int64AddOperator, "", []string{"1", "2"}, "3"},
+		{config.Int64AddOperator, "10", []string{"-3", `"x"`}, "7"},
+		{config.StringAppendOperator, `"a"`, []string{`"b"`, `"c"`}, `"abc"`},
+		{config.JSONMergePatchOperator, `{"a":1,"b":{"c":2}}`, []string{`{"b":{"c":null,"d":3}}`}, `{"a":1,"b":{"d":3}}`},
+		{config.JSONMergePatchOperator, `[1]`, []string{`{"a":1}`}, `{"a":1}`},
+	}
+	for _, c := range cases {
+		op := kv.GetMergeOperator(c.operator)
+		value := kv.Value{Key: "k", Merge: true}
+		for _, operand := range c.operands {
+			value.Operands = append(value.Operands, []byte(operand))
+		}
+		var older *kv.Value
+		if c.existing != "" {
+			older = &kv.Value{Key: "k", Value: []byte(c.existing)}
+		}
+		result := kv.Fold(op, value, older)
+		if result.Merge || result.Delete || string(result.Value) != c.expected {
+			t.Errorf("%s %s %v: expected %s, got %+v", c.operator, c.existing, c.operands, c.expected, result)
+		}
+	}
+}
+
+func TestMergeIteratorWithOperator(t *testing.T) {
+	op := kv.GetMergeOperator(config.Int64AddOperator)
+	oldest := kv.NewSliceIterator([]kv.Value{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Merge: true, Operands: [][]byte{[]byte("1")}},
+	})
+	older := kv.NewSliceIterator([]kv.Value{
+		{Key: "a", Merge: true, Operands: [][]byte{[]byte("2")}},
+		{Key: "b", Merge: true, Operands: [][]byte{[]byte("2")}},
+		{Key: "c", Delete: true},
+	})
+	newer := kv.NewSliceIterator([]kv.Value{
+		{Key: "a", Merge: true, Operands: [][]byte{[]byte("3")}},
+		{Key: "c", Merge: true, Operands: [][]byte{[]byte("5")}},
+	})
+
+	iter := kv.NewMergeIteratorWithOperator([]kv.Iterator{oldest, older, newer}, op)
+	results := make(map[string]kv.Value)
+	for ; iter.Valid(); iter.Next() {
+		results[iter.Value().Key] = iter.Value()
+	}
+	// a合并到基础值上，c合并到删除标记上
+	if v := results["a"]; v.Merge || string(v.Value) != "6" {
+		t.Errorf("a: expected 6, got %+v", v)
+	}
+	if v := results["c"]; v.Merge || string(v.Value) != "5" {
+		t.Errorf("c: expected 5, got %+v", v)
+	}
+	// b没有基础值，操作数按照从旧到新的顺序连接成一条合并记录
+	if v := results["b"]; !v.Merge || len(v.Operands) != 2 || string(v.Operands[0]) != "1" {
+		t.Errorf("b: expected a merge record with 2 operands, got %+v", v)
+	}
+}
@@ -14,13 +14,18 @@ const (
 	Deleted
 	//表示查找成功
 	Success
+	//表示数据所在的文件已经损坏
+	Corrupted
 )
 
 // Value表示一个kv，作为k-v数据库，必须可以存储任何数据
+// Merge为true时表示这是一条合并记录，Operands中的操作数需要按照顺序应用到更旧的数据上
 type Value struct {
-	Key    string
-	Value  []byte
-	Delete bool
+	Key      string
+	Value    []byte
+	Delete   bool
+	Merge    bool     `json:",omitempty"`
+	Operands [][]byte `json:",omitempty"`
 }
 
 // 二进制数据反序列化成Value
@@ -38,8 +43,10 @@ func Encode(v Value) ([]byte, error) {
 // 拷贝一份值
 func (v *Value) Copy() *Value {
 	return &Value{
-		Key:    v.Key,
-		Value:  v.Value,
-		Delete: v.Delete,
+		Key:      v.Key,
+		Value:    v.Value,
+		Delete:   v.Delete,
+		Merge:    v.Merge,
+		Operands: v.Operands,
 	}
 }
@@ -1,9 +1,8 @@
 package memtable
 
 import (
-	"fmt"
-	"log"
 	"sync"
+	"tinydb/config"
 	"tinydb/kv"
 )
 
@@ -29,28 +28,39 @@ func (tree *Tree) Init() {
 }
 
 func (tree *Tree) Getcount() int {
+	tree.rwlock.RLock()
+	defer tree.rwlock.RUnlock()
+
 	return tree.count
 }
 
 // 查找key值
 func (tree *Tree) Search(key string) (*treeNode, int) {
+	if tree == nil {
+		return nil, kv.None
+	}
 	tree.rwlock.RLock()
 	defer tree.rwlock.RUnlock()
 
-	if tree == nil {
-		log.Fatal("The tree is nil")
+	currentNode := tree.find(key)
+	if currentNode == nil {
+		//没有找到
 		return nil, kv.None
 	}
+	if currentNode.Kv.Delete {
+		//找到的元素是删除的
+		return nil, kv.Deleted
+	}
+	return currentNode, kv.Success
+}
+
+// 查找key对应的节点，被标记为删除的节点同样返回
+// 调用者需要持有锁
+func (tree *Tree) find(key string) *treeNode {
 	currentNode := tree.root
-	//开始查找元素
 	for currentNode != nil {
 		if key == currentNode.Kv.Key {
-			if currentNode.Kv.Delete == false {
-				return currentNode, kv.Success
-			} else {
-				//找到的元素是删除的
-				return nil, kv.Deleted
-			}
+			return currentNode
 		}
 		//分别循环左右子树查找
 		if key < currentNode.Kv.Key {
@@ -59,14 +69,11 @@ func (tree *Tree) Search(key string) (*treeNode, int) {
 			currentNode = currentNode.Right
 		}
 	}
-	//没有找到
-	return nil, kv.None
+	return nil
 }
 
+// 插入一个新的节点，调用者需要持有写锁
 func (tree *Tree) insert(key string, v []byte, flag int) bool {
-	tree.rwlock.Lock()
-	defer tree.rwlock.Unlock()
-
 	tmp := &treeNode{}
 	tmp.Kv.Key = key
 	tmp.Kv.Value = v
@@ -103,87 +110,102 @@ func (tree *Tree) insert(key string, v []byte, flag int) bool {
 				return true
 			}
 			currentNode = currentNode.Right
+		} else {
+			break
 		}
 	}
-	log.Fatal("The tree fail to insert value")
-	return false
+	config.GetConfig().GetLogger().Error("failed to insert into the memtable", "key", key)
+	panic("memtable: failed to insert " + key)
 }
 
 // 设置key值并且返回旧值
 // 设置新的key值不用在外部函数search
 func (tree *Tree) Set(key string, v []byte) (oldvalue kv.Value, hasold bool) {
 	if tree == nil {
-		log.Fatal("The tree is nil")
+		panic("memtable: the tree is nil")
 	}
+	tree.rwlock.Lock()
+	defer tree.rwlock.Unlock()
 
-	node, res := tree.Search(key)
-	var oldkv kv.Value
-	var flag bool
-	//数据不存在分两种情况：内存中标记为删除；内存中确实没有数据
+	node := tree.find(key)
+	//内存表中并没有此数据，插入新数据即可
 	if node == nil {
-		//此时的数据已经被标记为删除，替换数据就好
-		if res == kv.Deleted {
-			oldkv = *node.Kv.Copy()
-			flag = true
-			node.Kv.Key = key
-			node.Kv.Value = v
-			node.Kv.Delete = false
-		} else if res == kv.None {
-			//内存表中并没有此数据，插入新数据即可
-			oldkv = kv.Value{}
-			flag = false
-			//这里的0表示插入的是普通的数据
-			suc := tree.insert(key, v, 0)
-			if suc {
-				log.Println("set success")
-			}
-		}
-	} else {
-		//数据存在于内存中
-		oldkv = *node.Kv.Copy()
-		flag = true
-		node.Kv.Key = key
+		//这里的0表示插入的是普通的数据
+		tree.insert(key, v, 0)
+		return kv.Value{}, false
+	}
+	//此时的数据已经被标记为删除，替换数据就好
+	if node.Kv.Delete {
 		node.Kv.Value = v
+		node.Kv.Delete = false
+		tree.count++
+		return kv.Value{}, false
 	}
-	return oldkv, flag
+	//数据存在于内存中，合并记录直接被新值覆盖
+	oldkv := *node.Kv.Copy()
+	node.Kv.Value = v
+	node.Kv.Merge = false
+	node.Kv.Operands = nil
+	return oldkv, true
 }
 
 // 删除key并且返回旧值
 // 在调用删除函数之前不用在外部函数search
 func (tree *Tree) Delete(key string) (oldvalue kv.Value, hasold bool) {
 	if tree == nil {
-		log.Fatal("The tree is nil")
+		panic("memtable: the tree is nil")
 	}
+	tree.rwlock.Lock()
+	defer tree.rwlock.Unlock()
 
-	node, res := tree.Search(key)
-	var oldkv kv.Value
-	var flag bool
+	node := tree.find(key)
+	//内存中没有数据，插入一个删除标记
 	if node == nil {
-		//数据不存在分为两种情况：内存中标记为删除；内存中确实没有数据
-		if res == kv.Deleted {
-			//此时的数据已经被标记为删除了
-			oldkv = *node.Kv.Copy()
-			flag = true
-		} else if res == kv.None {
-			//内存中没有数据
-			oldkv = kv.Value{}
-			flag = false
-			flag := tree.insert(key, nil, 1)
-			if flag == true {
-				fmt.Println("Delete insert success")
-			} else {
-				fmt.Println("Delete insert failed")
-			}
-		}
-	} else {
-		//数据存在于内存中
-		oldkv = *node.Kv.Copy()
-		flag = true
-		node.Kv.Delete = true
-		node.Kv.Value = nil
+		tree.insert(key, nil, 1)
+		return kv.Value{}, false
+	}
+	//此时的数据已经被标记为删除了
+	if node.Kv.Delete {
+		return kv.Value{}, false
+	}
+	//数据存在于内存中
+	oldkv := *node.Kv.Copy()
+	node.Kv.Delete = true
+	node.Kv.Value = nil
+	node.Kv.Merge = false
+	node.Kv.Operands = nil
+	tree.count--
+	return oldkv, true
+}
+
+// 将合并操作数写入内存表
+// 内存表中已经有这个key的值或者删除标记时，使用合并算子op直接得到新值
+// 否则操作数追加到合并记录中，读取和压缩时再与更旧的数据合并
+func (tree *Tree) Merge(key string, operand []byte, op kv.MergeOperator) {
+	if tree == nil {
+		panic("memtable: the tree is nil")
+	}
+	tree.rwlock.Lock()
+	defer tree.rwlock.Unlock()
+
+	value := kv.Value{Key: key, Merge: true, Operands: [][]byte{operand}}
+	node := tree.find(key)
+	if node == nil {
+		tree.insert(key, nil, 0)
+		tree.find(key).Kv = value
+		return
+	}
+	if op == nil && !node.Kv.Merge {
+		config.GetConfig().GetLogger().Warn("no merge operator, ignoring the merge operand", "key", key)
+		return
+	}
+	deleted := node.Kv.Delete
+	node.Kv = kv.Fold(op, value, &node.Kv)
+	if deleted && !node.Kv.Delete {
+		tree.count++
+	} else if !deleted && node.Kv.Delete {
 		tree.count--
 	}
-	return oldkv, flag
 }
 
 // 遍历获取此memtable中的所有元素
@@ -191,7 +213,23 @@ func (tree *Tree) GetValue() []kv.Value {
 	tree.rwlock.RLock()
 	defer tree.rwlock.RUnlock()
 
-	fmt.Println(tree.count)
+	return tree.inorder("")
+}
+
+// 创建一个从start开始按照key的顺序遍历的迭代器
+// 迭代器遍历的是创建时刻的数据副本
+func (tree *Tree) NewIterator(start string) kv.Iterator {
+	if tree == nil {
+		return kv.NewSliceIterator(nil)
+	}
+	tree.rwlock.RLock()
+	defer tree.rwlock.RUnlock()
+
+	return kv.NewSliceIterator(tree.inorder(start))
+}
+
+// 中序遍历获取所有key大于等于start的元素，调用者需要持有读锁
+func (tree *Tree) inorder(start string) []kv.Value {
 	stack := Initstack(tree.count / 2)
 	//将遍历结果存放到切片中
 	values := make([]kv.Value, 0)
@@ -206,7 +244,9 @@ func (tree *Tree) GetValue() []kv.Value {
 			if !success {
 				break
 			}
-			values = append(values, popNode.Kv)
+			if popNode.Kv.Key >= start {
+				values = append(values, popNode.Kv)
+			}
 			//应该是弹出的节点的右子树
 			currentNode = popNode.Right
 		}
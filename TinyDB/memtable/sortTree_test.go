@@ -52,3 +52,24 @@ func TestSortedTree(t *testing.T) {
 	count := tree.Getcount()
 	fmt.Printf("Number of elements in tree: %d\n", count)
 }
+
+func TestTreeIterator(t *testing.T) {
+	tree := &memtable.Tree{}
+	tree.Init()
+	for _, key := range []string{"b", "d", "a", "c"} {
+		tree.Set(key, []byte(key))
+	}
+	tree.Delete("c")
+
+	// 从c开始遍历，删除标记也会被返回
+	keys := make([]string, 0)
+	for it := tree.NewIterator("c"); it.Valid(); it.Next() {
+		keys = append(keys, it.Value().Key)
+	}
+	if fmt.Sprint(keys) != "[c d]" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if (*memtable.Tree)(nil).NewIterator("").Valid() {
+		t.Fatal("iterator of nil tree should be empty")
+	}
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// 延迟直方图的桶数量，第i个桶的上界为10微秒乘以2的i次方，最大约5秒，超过的落在最后一个没有上界的桶中
+const bucketCount = 20
+
+// 第一个桶的上界
+const firstBucket = 10 * time.Microsecond
+
+// 记录耗时分布的直方图，零值可以直接使用，并发安全
+type Histogram struct {
+	buckets [bucketCount + 1]atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Int64
+}
+
+// 直方图某一时刻的数据
+type HistogramSnapshot struct {
+	Count uint64
+	Sum   time.Duration
+	//每个桶中的次数，不是累计的
+	Buckets []Bucket
+}
+
+// 直方图中的一个桶，UpperBound为0表示没有上界
+type Bucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// 第i个桶的上界，最后一个桶返回0
+func upperBound(i int) time.Duration {
+	if i >= bucketCount {
+		return 0
+	}
+	return firstBucket << i
+}
+
+// 记录一次耗时
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < bucketCount && d > upperBound(i) {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// 记录从start开始到现在的耗时，用于defer
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+// 获取当前的数据，并发记录时各个字段之间可能有很小的误差
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Count:   h.count.Load(),
+		Sum:     time.Duration(h.sum.Load()),
+		Buckets: make([]Bucket, bucketCount+1),
+	}
+	for i := range s.Buckets {
+		s.Buckets[i] = Bucket{UpperBound: upperBound(i), Count: h.buckets[i].Load()}
+	}
+	return s
+}
+
+// 平均耗时
+func (s HistogramSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// 分位数q的估计值，返回所在桶的上界，落在最后一个桶时返回倒数第二个桶的上界
+func (s HistogramSnapshot) Quantile(q float64) time.Duration {
+	var total uint64
+	for _, b := range s.Buckets {
+		total += b.Count
+	}
+	if total == 0 {
+		return 0
+	}
+	target := uint64(q * float64(total))
+	var seen uint64
+	for i, b := range s.Buckets {
+		seen += b.Count
+		if seen > target || seen == total {
+			if b.UpperBound == 0 {
+				return upperBound(i - 1)
+			}
+			return b.UpperBound
+		}
+	}
+	return 0
+}
+
+// 合并两个直方图的数据，用于汇总多个列族
+func (s HistogramSnapshot) Add(other HistogramSnapshot) HistogramSnapshot {
+	if len(s.Buckets) == 0 {
+		return other
+	}
+	if len(other.Buckets) == 0 {
+		return s
+	}
+	sum := HistogramSnapshot{Count: s.Count + other.Count, Sum: s.Sum + other.Sum, Buckets: make([]Bucket, len(s.Buckets))}
+	for i := range s.Buckets {
+		sum.Buckets[i] = Bucket{UpperBound: s.Buckets[i].UpperBound, Count: s.Buckets[i].Count + other.Buckets[i].Count}
+	}
+	return sum
+}
@@ -0,0 +1,61 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"tinydb/metrics"
+)
+
+func TestHistogram(t *testing.T) {
+	var h metrics.Histogram
+	for i := 0; i < 90; i++ {
+		h.Observe(5 * time.Microsecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(time.Millisecond)
+	}
+	h.Observe(time.Minute)
+	s := h.Snapshot()
+	if s.Count != 101 {
+		t.Fatalf("expected 101 observations, got %d", s.Count)
+	}
+	if q := s.Quantile(0.5); q != 10*time.Microsecond {
+		t.Fatalf("p50: expected 10µs, got %v", q)
+	}
+	if q := s.Quantile(0.95); q != 1280*time.Microsecond {
+		t.Fatalf("p95: expected 1.28ms, got %v", q)
+	}
+	if q := s.Quantile(1); q != s.Buckets[len(s.Buckets)-2].UpperBound {
+		t.Fatalf("p100 should be the largest finite bound, got %v", q)
+	}
+	if sum := s.Add(s); sum.Count != 202 || sum.Buckets[0].Count != 180 {
+		t.Fatalf("unexpected sum %+v", sum)
+	}
+}
+
+func TestExposition(t *testing.T) {
+	var h metrics.Histogram
+	h.Observe(time.Millisecond)
+	var e metrics.Exposition
+	e.Header("ops_total", metrics.CounterType, "Number of ops.")
+	e.Sample("ops_total", 3, "op", `se"t`)
+	e.Header("latency_seconds", metrics.HistogramType, "Latency.")
+	e.Histogram("latency_seconds", h.Snapshot(), "op", "get")
+	var b strings.Builder
+	e.WriteTo(&b)
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE ops_total counter\n",
+		`ops_total{op="se\"t"} 3` + "\n",
+		`latency_seconds_bucket{op="get",le="0.00064"} 0` + "\n",
+		`latency_seconds_bucket{op="get",le="0.00128"} 1` + "\n",
+		`latency_seconds_bucket{op="get",le="+Inf"} 1` + "\n",
+		`latency_seconds_sum{op="get"} 0.001` + "\n",
+		`latency_seconds_count{op="get"} 1` + "\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("missing %q in\n%s", line, out)
+		}
+	}
+}
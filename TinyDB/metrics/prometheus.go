@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Prometheus文本格式的Content-Type
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// 指标的类型
+const (
+	CounterType   = "counter"
+	GaugeType     = "gauge"
+	HistogramType = "histogram"
+)
+
+// 按照Prometheus文本格式输出指标
+// 同一个指标先调用Header，再调用一次或多次Sample或者Histogram，labels依次为标签名和标签值
+type Exposition struct {
+	b strings.Builder
+}
+
+// 写入指标的说明和类型
+func (e *Exposition) Header(name, typ, help string) {
+	fmt.Fprintf(&e.b, "# HELP %s %s\n", name, escapeHelp(help))
+	fmt.Fprintf(&e.b, "# TYPE %s %s\n", name, typ)
+}
+
+// 写入一个计数器或者仪表的值
+func (e *Exposition) Sample(name string, value float64, labels ...string) {
+	e.b.WriteString(name)
+	e.labels(labels, "", "")
+	e.b.WriteByte(' ')
+	e.b.WriteString(formatFloat(value))
+	e.b.WriteByte('\n')
+}
+
+// 写入直方图的累计桶、总和以及次数，耗时以秒为单位
+func (e *Exposition) Histogram(name string, s HistogramSnapshot, labels ...string) {
+	var cumulative uint64
+	for _, b := range s.Buckets {
+		cumulative += b.Count
+		le := "+Inf"
+		if b.UpperBound > 0 {
+			le = formatFloat(b.UpperBound.Seconds())
+		}
+		e.b.WriteString(name + "_bucket")
+		e.labels(labels, "le", le)
+		fmt.Fprintf(&e.b, " %d\n", cumulative)
+	}
+	e.b.WriteString(name + "_sum")
+	e.labels(labels, "", "")
+	fmt.Fprintf(&e.b, " %s\n", formatFloat(s.Sum.Seconds()))
+	e.b.WriteString(name + "_count")
+	e.labels(labels, "", "")
+	fmt.Fprintf(&e.b, " %d\n", s.Count)
+}
+
+// 写入标签，extra不为空时追加在最后
+func (e *Exposition) labels(labels []string, extra, value string) {
+	if extra != "" {
+		labels = append(labels[:len(labels):len(labels)], extra, value)
+	}
+	if len(labels) == 0 {
+		return
+	}
+	e.b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			e.b.WriteByte(',')
+		}
+		fmt.Fprintf(&e.b, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	e.b.WriteByte('}')
+}
+
+// 将所有指标写入w
+func (e *Exposition) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, e.b.String())
+	return int64(n), err
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// 说明中的反斜杠和换行需要转义，标签值中的双引号也需要转义
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
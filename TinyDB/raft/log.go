@@ -0,0 +1,226 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"tinydb/config"
+	"tinydb/kv"
+	"tinydb/wal"
+)
+
+// 日志的类型
+type EntryType int
+
+const (
+	//对状态机的修改
+	EntryNormal EntryType = iota
+	//新的主节点在自己的任期内追加的空日志
+	EntryNoop
+	//成员变更，Data为变更之后的所有成员
+	EntryConfig
+)
+
+// 一条raft日志
+type Entry struct {
+	Term  uint64
+	Index uint64
+	Type  EntryType
+	Data  []byte `json:",omitempty"`
+}
+
+// 需要持久化的节点状态
+type hardState struct {
+	Term     uint64
+	VotedFor string
+}
+
+// 日志文件中记录的类型，保存在kv.Value的Key中
+const (
+	recordEntry = "entry"
+	recordState = "state"
+)
+
+// 保存在tinydb日志文件中的raft日志
+// 日志只追加写入，编号为i的日志会覆盖之前写入的编号不小于i的所有日志
+// 压缩时将保留的日志写入另一个文件，再清空当前的文件，与数据库切换日志文件的方式相同
+type raftLog struct {
+	wal        *wal.Wal
+	wal1, wal2 *wal.Wal
+	//检查点中最后一条日志的编号和任期，之前的日志已经被删除
+	snapIndex uint64
+	snapTerm  uint64
+	//检查点之后的所有日志，entries[i]的编号为snapIndex+i+1
+	entries []Entry
+}
+
+// 打开目录dir中的日志文件，跳过检查点之前的日志，返回保存的节点状态
+func openLog(dir string, snapIndex, snapTerm uint64, logger config.Logger) (*raftLog, hardState) {
+	l := &raftLog{wal1: &wal.Wal{Logger: logger}, wal2: &wal.Wal{Logger: logger}, snapIndex: snapIndex, snapTerm: snapTerm}
+	l.wal1.Init(dir, 1)
+	l.wal2.Init(dir, 2)
+	//按照修改时间从旧到新读取，压缩时新文件写入完成之后才清空旧文件
+	logs := []*wal.Wal{l.wal1, l.wal2}
+	sort.SliceStable(logs, func(i, j int) bool {
+		a, _ := os.Stat(logs[i].Pathname)
+		b, _ := os.Stat(logs[j].Pathname)
+		return a.ModTime().Before(b.ModTime())
+	})
+	var hs hardState
+	for _, w := range logs {
+		for _, record := range w.Load() {
+			switch record.Value.Key {
+			case recordState:
+				if err := json.Unmarshal(record.Value.Value, &hs); err != nil {
+					panic(fmt.Errorf("raft: decode the state in %s: %w", w.Pathname, err))
+				}
+			case recordEntry:
+				var e Entry
+				if err := json.Unmarshal(record.Value.Value, &e); err != nil {
+					panic(fmt.Errorf("raft: decode the entry in %s: %w", w.Pathname, err))
+				}
+				if e.Index <= l.snapIndex {
+					continue
+				}
+				l.truncate(e.Index)
+				if e.Index == l.lastIndex()+1 {
+					l.entries = append(l.entries, e)
+				}
+			}
+		}
+	}
+	//继续写入最新的文件
+	l.wal = logs[1]
+	return l, hs
+}
+
+// 最后一条日志的编号
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapIndex + uint64(len(l.entries))
+}
+
+// 最后一条日志的任期
+func (l *raftLog) lastTerm() uint64 {
+	term, _ := l.term(l.lastIndex())
+	return term
+}
+
+// 编号为index的日志的任期，日志已经被压缩或者不存在时返回false
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	if index == l.snapIndex {
+		return l.snapTerm, true
+	}
+	if index < l.snapIndex || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[index-l.snapIndex-1].Term, true
+}
+
+// 编号为index的日志，日志必须存在
+func (l *raftLog) entry(index uint64) Entry {
+	return l.entries[index-l.snapIndex-1]
+}
+
+// 编号从from开始的最多max条日志
+func (l *raftLog) slice(from uint64, max int) []Entry {
+	if from <= l.snapIndex || from > l.lastIndex() {
+		return nil
+	}
+	entries := l.entries[from-l.snapIndex-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+// 删除编号不小于index的所有日志，只修改内存中的日志
+func (l *raftLog) truncate(index uint64) {
+	if index <= l.lastIndex() {
+		l.entries = l.entries[:index-l.snapIndex-1]
+	}
+}
+
+// 追加日志并写入文件，日志的编号必须紧接着最后一条日志或者覆盖已有的日志
+// 返回时日志已经刷到磁盘上，返回错误之后内存中的日志与文件可能不一致，节点需要停止
+func (l *raftLog) append(entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	l.truncate(entries[0].Index)
+	l.entries = append(l.entries, entries...)
+	records := make([]wal.Record, 0, len(entries))
+	for _, e := range entries {
+		records = append(records, entryRecord(e))
+	}
+	return l.write(records)
+}
+
+// 写入节点状态，返回时已经刷到磁盘上
+func (l *raftLog) saveState(hs hardState) error {
+	return l.write([]wal.Record{stateRecord(hs)})
+}
+
+// 写入当前的日志文件并刷到磁盘上，回复投票或者追加日志之前写入的内容必须已经持久化
+func (l *raftLog) write(records []wal.Record) error {
+	if err := l.wal.Write(records); err != nil {
+		return err
+	}
+	return l.wal.Sync()
+}
+
+// 删除编号不大于index的日志，index之后的日志与节点状态写入另一个文件之后再清空当前文件
+// 安装检查点时index可以超过最后一条日志，此时删除所有日志
+func (l *raftLog) compact(index, term uint64, hs hardState) error {
+	if index >= l.lastIndex() {
+		l.entries = nil
+	} else if index > l.snapIndex {
+		l.entries = append([]Entry(nil), l.entries[index-l.snapIndex:]...)
+	}
+	l.snapIndex, l.snapTerm = index, term
+
+	old := l.wal
+	if old == l.wal1 {
+		l.wal = l.wal2
+	} else {
+		l.wal = l.wal1
+	}
+	l.wal.Reset()
+	records := []wal.Record{stateRecord(hs)}
+	for _, e := range l.entries {
+		records = append(records, entryRecord(e))
+	}
+	//新文件写入失败时保留旧文件，重启之后仍然可以从中恢复
+	if err := l.write(records); err != nil {
+		return err
+	}
+	old.Reset()
+	return nil
+}
+
+// 关闭日志文件
+func (l *raftLog) close() {
+	l.wal1.Close()
+	l.wal2.Close()
+}
+
+// 日志文件是否为空，新的节点没有任何日志
+func logExists(dir string) bool {
+	for _, name := range []string{"wal1.log", "wal2.log"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && info.Size() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func entryRecord(e Entry) wal.Record {
+	data, _ := json.Marshal(e)
+	return wal.Record{Seq: e.Index, Value: kv.Value{Key: recordEntry, Value: data}}
+}
+
+func stateRecord(hs hardState) wal.Record {
+	data, _ := json.Marshal(hs)
+	return wal.Record{Value: kv.Value{Key: recordState, Value: data}}
+}
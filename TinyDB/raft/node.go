@@ -0,0 +1,524 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+	"tinydb/config"
+)
+
+// 节点的配置
+type Options struct {
+	//节点的编号，在集群中唯一
+	ID string
+	//保存日志、sstable以及检查点的目录
+	Dir string
+	//集群最初的所有成员，只在第一次启动时使用，之后通过AddNode加入的节点为空
+	Peers []string
+	//节点之间的传输层
+	Transport Transport
+	//时钟的间隔，为0时使用10毫秒
+	TickInterval time.Duration
+	//多少个时钟没有收到主节点的消息之后发起选举，实际的超时在[ElectionTicks,2*ElectionTicks)之间随机，为0时使用10
+	ElectionTicks int
+	//主节点发送心跳的时钟间隔，为0时使用1
+	HeartbeatTicks int
+	//应用了多少条日志之后创建检查点并删除之前的日志，为0时使用10000
+	SnapshotEntries int
+	//状态机数据库使用的配置，DataDir会被忽略，其中的Logger同时用于节点自身的日志
+	Storage config.Config
+}
+
+// 节点的角色
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+// 节点的状态
+type Status struct {
+	ID     string
+	State  State
+	Term   uint64
+	Leader string
+	//已经提交和已经应用到状态机的最后一条日志
+	Commit  uint64
+	Applied uint64
+	//集群当前的所有成员
+	Peers []string
+}
+
+var (
+	//当前节点不是主节点，错误信息中包含已知的主节点
+	ErrNotLeader = errors.New("raft: not the leader")
+	//节点已经停止
+	ErrStopped = errors.New("raft: node stopped")
+	//提议的日志在提交之前被新的主节点覆盖，不确定是否生效时不会返回这个错误
+	ErrProposalDropped = errors.New("raft: proposal dropped")
+	//上一次成员变更还没有提交
+	ErrConfigChangeInProgress = errors.New("raft: another membership change is in progress")
+)
+
+// 集群中的一个节点，Set和Delete通过共识写入，Get通过read index保证线性一致
+// 所有的状态只在run所在的goroutine中修改，外部的调用通过通道传递给它
+type Node struct {
+	id        string
+	opts      Options
+	transport Transport
+	log       *raftLog
+	state     *stateMachine
+
+	role   State
+	term   uint64
+	vote   string
+	leader string
+	//集群当前的成员，使用日志中最后一条成员变更，不论是否已经提交
+	peers []string
+	//已经提交和已经应用的最后一条日志
+	commit  uint64
+	applied uint64
+
+	//距离上一次收到主节点消息或者发送心跳的时钟数
+	elapsed int
+	timeout int
+	//候选者收到的投票
+	votes map[string]bool
+	//主节点记录的每个从节点下一条要发送的日志以及已经一致的最后一条日志
+	next  map[string]uint64
+	match map[string]uint64
+	//主节点向从节点发送检查点之后等待的时钟数，期间不再发送日志
+	snapshotWait map[string]int
+
+	//等待提交的提议，以日志的编号为key
+	waiters map[uint64]waiter
+	//日志写入失败的错误，之后节点不再发送任何消息并停止
+	failed error
+	//等待确认的线性一致读
+	readSeq uint64
+	reads   []*readRequest
+
+	proposals chan proposal
+	readCh    chan *readRequest
+	queries   chan func()
+	stop      chan struct{}
+	done      chan struct{}
+	stopOnce  sync.Once
+}
+
+// 一条等待提交的提议
+type proposal struct {
+	entry Entry
+	//成员变更根据当前的成员计算新的成员，不需要变更时返回nil
+	change func(peers []string) []string
+	result chan result
+}
+
+type waiter struct {
+	term   uint64
+	result chan result
+}
+
+// 提议应用之后的结果
+type result struct {
+	found bool
+	err   error
+}
+
+// 一次线性一致读，主节点确认自己仍然是主节点并且状态机应用到index之后返回
+type readRequest struct {
+	index uint64
+	seq   uint64
+	acks  map[string]bool
+	//主节点在当前任期内还没有提交任何日志时为false，暂时不能确定index
+	ready  bool
+	result chan error
+}
+
+// 创建并启动一个节点
+// 目录中已经有日志或者检查点时从中恢复，否则使用Peers作为集群最初的成员
+func NewNode(opts Options) (*Node, error) {
+	if opts.ID == "" || opts.Dir == "" || opts.Transport == nil {
+		return nil, errors.New("raft: ID, Dir and Transport are required")
+	}
+	if opts.TickInterval <= 0 {
+		opts.TickInterval = 10 * time.Millisecond
+	}
+	if opts.ElectionTicks <= 0 {
+		opts.ElectionTicks = 10
+	}
+	if opts.HeartbeatTicks <= 0 {
+		opts.HeartbeatTicks = 1
+	}
+	if opts.SnapshotEntries <= 0 {
+		opts.SnapshotEntries = 10000
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	fresh := !logExists(opts.Dir)
+	state, err := openStateMachine(opts.Dir, opts.Storage)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := state.snapshot
+	l, hs := openLog(opts.Dir, snapshot.Index, snapshot.Term, opts.Storage.GetLogger())
+	n := &Node{
+		id:           opts.ID,
+		opts:         opts,
+		transport:    opts.Transport,
+		log:          l,
+		state:        state,
+		term:         hs.Term,
+		vote:         hs.VotedFor,
+		commit:       snapshot.Index,
+		applied:      snapshot.Index,
+		next:         make(map[string]uint64),
+		match:        make(map[string]uint64),
+		snapshotWait: make(map[string]int),
+		waiters:      make(map[uint64]waiter),
+		proposals:    make(chan proposal),
+		readCh:       make(chan *readRequest),
+		queries:      make(chan func()),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	//第一次启动时所有最初的成员写入同样的第一条日志，作为已经提交的成员配置
+	if fresh && snapshot.Index == 0 && len(opts.Peers) > 0 {
+		n.term = 1
+		err := n.log.saveState(n.hardState())
+		if err == nil {
+			err = n.log.append(Entry{Term: 1, Index: 1, Type: EntryConfig, Data: encodePeers(opts.Peers)})
+		}
+		if err != nil {
+			state.close()
+			l.close()
+			return nil, err
+		}
+		n.commit = 1
+	}
+	n.peers = n.configAt(n.log.lastIndex())
+	n.resetTimeout()
+	go n.run()
+	return n, nil
+}
+
+// 停止节点，等待中的请求返回ErrStopped
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stop)
+		<-n.done
+	})
+}
+
+// 节点当前的状态
+func (n *Node) Status() Status {
+	var status Status
+	if n.query(func() {
+		status = Status{
+			ID:      n.id,
+			State:   n.role,
+			Term:    n.term,
+			Leader:  n.leader,
+			Commit:  n.commit,
+			Applied: n.applied,
+			Peers:   slices.Clone(n.peers),
+		}
+	}) != nil {
+		status.ID = n.id
+	}
+	return status
+}
+
+// 在run所在的goroutine中执行fn
+func (n *Node) query(fn func()) error {
+	done := make(chan struct{})
+	select {
+	case n.queries <- func() { fn(); close(done) }:
+		<-done
+		return nil
+	case <-n.done:
+		return ErrStopped
+	}
+}
+
+// 通过共识写入key，返回时已经应用到主节点的状态机
+func (n *Node) Set(ctx context.Context, key string, value json.RawMessage) error {
+	data, err := json.Marshal(command{Op: opSet, Key: key, Value: value})
+	if err != nil {
+		return err
+	}
+	_, err = n.propose(ctx, Entry{Type: EntryNormal, Data: data})
+	return err
+}
+
+// 通过共识删除key，返回删除之前是否存在
+func (n *Node) Delete(ctx context.Context, key string) (bool, error) {
+	data, err := json.Marshal(command{Op: opDelete, Key: key})
+	if err != nil {
+		return false, err
+	}
+	return n.propose(ctx, Entry{Type: EntryNormal, Data: data})
+}
+
+// 线性一致地读取key，只能在主节点上调用
+// 主节点记录当前的提交位置，通过一轮心跳确认自己仍然是主节点，等待状态机应用到这个位置之后再读取
+func (n *Node) Get(ctx context.Context, key string) (json.RawMessage, bool, error) {
+	r := &readRequest{result: make(chan error, 1)}
+	select {
+	case n.readCh <- r:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case <-n.done:
+		return nil, false, ErrStopped
+	}
+	select {
+	case err := <-r.result:
+		if err != nil {
+			return nil, false, err
+		}
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	value, ok := n.state.Get(key)
+	return value, ok, nil
+}
+
+// 直接读取本地状态机中的值，可以在任意节点上调用，但可能读到旧的数据
+func (n *Node) GetLocal(key string) (json.RawMessage, bool) {
+	return n.state.Get(key)
+}
+
+// 将节点id加入集群，新节点使用空的Peers启动，之后从主节点接收日志或者检查点
+func (n *Node) AddNode(ctx context.Context, id string) error {
+	return n.changeConfig(ctx, func(peers []string) []string {
+		if slices.Contains(peers, id) {
+			return nil
+		}
+		return append(peers, id)
+	})
+}
+
+// 将节点id移出集群，移除主节点自己时，提交之后主节点退位
+func (n *Node) RemoveNode(ctx context.Context, id string) error {
+	return n.changeConfig(ctx, func(peers []string) []string {
+		if !slices.Contains(peers, id) {
+			return nil
+		}
+		return slices.DeleteFunc(peers, func(peer string) bool { return peer == id })
+	})
+}
+
+// 每次只变更一个成员，新的配置在追加到日志时就开始生效
+func (n *Node) changeConfig(ctx context.Context, change func([]string) []string) error {
+	_, err := n.submit(ctx, proposal{entry: Entry{Type: EntryConfig}, change: change})
+	return err
+}
+
+// 提交一条日志并等待应用
+func (n *Node) propose(ctx context.Context, e Entry) (bool, error) {
+	return n.submit(ctx, proposal{entry: e})
+}
+
+func (n *Node) submit(ctx context.Context, p proposal) (bool, error) {
+	p.result = make(chan result, 1)
+	select {
+	case n.proposals <- p:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-n.done:
+		return false, ErrStopped
+	}
+	select {
+	case r := <-p.result:
+		return r.found, r.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// 处理时钟、消息以及外部请求的主循环
+func (n *Node) run() {
+	defer close(n.done)
+	ticker := time.NewTicker(n.opts.TickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.tick()
+		case m := <-n.transport.Receive():
+			n.step(m)
+		case p := <-n.proposals:
+			n.handleProposal(p)
+		case r := <-n.readCh:
+			n.handleRead(r)
+		case fn := <-n.queries:
+			fn()
+		case <-n.stop:
+			n.shutdown()
+			return
+		}
+		if n.failed == nil {
+			n.applyCommitted()
+		}
+		if n.failed != nil {
+			n.shutdown()
+			return
+		}
+	}
+}
+
+// 检查日志写入的结果，失败时记录错误，主循环随后停止节点
+// 日志没有持久化时不能再回复投票或者追加日志，否则重启之后可能投出两票或者丢失已经确认的日志
+func (n *Node) persisted(err error) bool {
+	if err == nil {
+		return true
+	}
+	if n.failed == nil {
+		n.logger().Error("raft: failed to write the log, stopping the node", "id", n.id, "error", err)
+		n.failed = err
+	}
+	return false
+}
+
+// 停止时通知所有等待的请求，并关闭文件
+func (n *Node) shutdown() {
+	for index, w := range n.waiters {
+		w.result <- result{err: ErrStopped}
+		delete(n.waiters, index)
+	}
+	n.failReads(ErrStopped)
+	n.transport.Close()
+	n.state.close()
+	n.log.close()
+}
+
+func (n *Node) hardState() hardState {
+	return hardState{Term: n.term, VotedFor: n.vote}
+}
+
+// 编号不大于index的日志中最后一个成员配置
+func (n *Node) configAt(index uint64) []string {
+	for i := min(index, n.log.lastIndex()); i > n.log.snapIndex; i-- {
+		if e := n.log.entry(i); e.Type == EntryConfig {
+			return decodePeers(e.Data)
+		}
+	}
+	return slices.Clone(n.state.snapshot.Peers)
+}
+
+// 多数派的数量
+func (n *Node) quorum() int {
+	return len(n.peers)/2 + 1
+}
+
+// 节点是否是集群的成员，不是成员的节点不会发起选举，也不计入多数派
+func (n *Node) isMember(id string) bool {
+	return slices.Contains(n.peers, id)
+}
+
+// 重新随机选举超时
+func (n *Node) resetTimeout() {
+	n.elapsed = 0
+	n.timeout = n.opts.ElectionTicks + randomTicks(n.opts.ElectionTicks)
+}
+
+// 应用已经提交的日志，通知等待的提议和线性一致读，必要时创建检查点
+func (n *Node) applyCommitted() {
+	for n.applied < n.commit {
+		index := n.applied + 1
+		e := n.log.entry(index)
+		var r result
+		switch e.Type {
+		case EntryNormal:
+			r.found, r.err = n.state.apply(e.Data)
+		case EntryConfig:
+			//主节点被移出集群之后退位，由剩下的节点选出新的主节点
+			if n.role == Leader && !slices.Contains(decodePeers(e.Data), n.id) && index == n.lastConfigIndex() {
+				n.logger().Info("raft: the leader has been removed from the cluster", "id", n.id, "term", n.term)
+				n.becomeFollower(n.term, "")
+			}
+		}
+		n.applied = index
+		if w, ok := n.waiters[index]; ok {
+			if w.term != e.Term {
+				r = result{err: ErrProposalDropped}
+			}
+			w.result <- r
+			delete(n.waiters, index)
+		}
+	}
+	n.finishReads()
+	if n.applied-n.state.snapshot.Index >= uint64(n.opts.SnapshotEntries) {
+		n.snapshot()
+	}
+}
+
+// 最后一条成员变更日志的编号
+func (n *Node) lastConfigIndex() uint64 {
+	for i := n.log.lastIndex(); i > n.log.snapIndex; i-- {
+		if n.log.entry(i).Type == EntryConfig {
+			return i
+		}
+	}
+	return n.log.snapIndex
+}
+
+// 将状态机持久化为sstable检查点，删除已经应用的日志
+// 主节点保留从节点还没有复制的日志，避免正在追赶的从节点只能通过检查点追上，
+// 但最多保留SnapshotEntries条，落后更多的从节点仍然使用检查点
+func (n *Node) snapshot() {
+	term, _ := n.log.term(n.applied)
+	if err := n.state.save(n.applied, term, n.configAt(n.applied)); err != nil {
+		n.logger().Error("raft: failed to save the snapshot", "id", n.id, "index", n.applied, "error", err)
+		return
+	}
+	index := n.applied
+	if n.role == Leader {
+		for _, peer := range n.peers {
+			if peer != n.id {
+				index = min(index, n.match[peer])
+			}
+		}
+		index = max(index, n.applied-min(n.applied, uint64(n.opts.SnapshotEntries)), n.log.snapIndex)
+	}
+	term, _ = n.log.term(index)
+	n.persisted(n.log.compact(index, term, n.hardState()))
+}
+
+func encodePeers(peers []string) []byte {
+	data, _ := json.Marshal(peers)
+	return data
+}
+
+func decodePeers(data []byte) []string {
+	var peers []string
+	if err := json.Unmarshal(data, &peers); err != nil {
+		panic(fmt.Errorf("raft: decode the membership: %w", err))
+	}
+	return peers
+}
+
+// 节点使用的Logger
+func (n *Node) logger() config.Logger {
+	return n.opts.Storage.GetLogger()
+}
@@ -0,0 +1,471 @@
+package raft
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+)
+
+// 一次最多发送的日志数量
+const maxAppendEntries = 256
+
+// 在[0,n)之间随机选取时钟数，避免多个节点同时发起选举
+func randomTicks(n int) int {
+	return rand.Intn(n)
+}
+
+// 时钟前进一次
+func (n *Node) tick() {
+	n.elapsed++
+	if n.role == Leader {
+		for peer, wait := range n.snapshotWait {
+			if wait <= 1 {
+				delete(n.snapshotWait, peer)
+			} else {
+				n.snapshotWait[peer] = wait - 1
+			}
+		}
+		if n.elapsed >= n.opts.HeartbeatTicks {
+			n.elapsed = 0
+			n.broadcast()
+		}
+		return
+	}
+	if n.elapsed >= n.timeout && n.isMember(n.id) {
+		n.campaign()
+	}
+}
+
+// 增加任期并请求其它节点投票
+func (n *Node) campaign() {
+	n.role = Candidate
+	n.term++
+	n.vote = n.id
+	n.leader = ""
+	if !n.persisted(n.log.saveState(n.hardState())) {
+		return
+	}
+	n.resetTimeout()
+	n.failReads(ErrNotLeader)
+	n.votes = map[string]bool{n.id: true}
+	n.logger().Info("raft: starting an election", "id", n.id, "term", n.term)
+	if len(n.votes) >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.peers {
+		if peer != n.id {
+			n.send(Message{Type: MsgVote, To: peer, LastIndex: n.log.lastIndex(), LastTerm: n.log.lastTerm()})
+		}
+	}
+}
+
+// 成为term任期的从节点，leader为空表示还不知道主节点
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if n.role == Leader {
+		n.failReads(ErrNotLeader)
+	}
+	if term != n.term {
+		n.term = term
+		n.vote = ""
+		n.persisted(n.log.saveState(n.hardState()))
+	}
+	n.role = Follower
+	n.leader = leader
+	n.resetTimeout()
+}
+
+// 成为主节点，追加一条当前任期的空日志，提交之后才能确定线性一致读的位置
+func (n *Node) becomeLeader() {
+	n.logger().Info("raft: became the leader", "id", n.id, "term", n.term)
+	n.role = Leader
+	n.leader = n.id
+	n.elapsed = 0
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.snapshotWait = make(map[string]int)
+	for _, peer := range n.peers {
+		n.next[peer] = n.log.lastIndex() + 1
+	}
+	n.appendEntry(Entry{Type: EntryNoop})
+	n.broadcast()
+	n.maybeCommit()
+}
+
+// 主节点向日志中追加一条当前任期的日志
+func (n *Node) appendEntry(e Entry) Entry {
+	e.Term = n.term
+	e.Index = n.log.lastIndex() + 1
+	n.persisted(n.log.append(e))
+	n.match[n.id] = e.Index
+	if e.Type == EntryConfig {
+		n.setPeers(decodePeers(e.Data))
+	}
+	return e
+}
+
+// 使用新的成员配置，主节点为新加入的节点初始化复制的进度
+func (n *Node) setPeers(peers []string) {
+	n.peers = peers
+	if n.role != Leader {
+		return
+	}
+	for _, peer := range peers {
+		if _, ok := n.next[peer]; !ok {
+			n.next[peer] = n.log.lastIndex() + 1
+			n.match[peer] = 0
+		}
+	}
+}
+
+// 发送消息，填写发送者和任期，日志写入失败之后不再发送
+func (n *Node) send(m Message) {
+	if n.failed != nil {
+		return
+	}
+	m.From = n.id
+	m.Term = n.term
+	n.transport.Send(m)
+}
+
+// 向所有其它成员发送日志，没有新日志时作为心跳
+func (n *Node) broadcast() {
+	for _, peer := range n.peers {
+		if peer != n.id {
+			n.sendAppend(peer)
+		}
+	}
+}
+
+// 向一个从节点发送它缺少的日志，日志已经被压缩时发送检查点
+func (n *Node) sendAppend(peer string) {
+	if n.snapshotWait[peer] > 0 {
+		return
+	}
+	next := max(n.next[peer], 1)
+	prevTerm, ok := n.log.term(next - 1)
+	if !ok {
+		n.sendSnapshot(peer)
+		return
+	}
+	n.send(Message{
+		Type:      MsgAppend,
+		To:        peer,
+		PrevIndex: next - 1,
+		PrevTerm:  prevTerm,
+		Entries:   n.log.slice(next, maxAppendEntries),
+		Commit:    n.commit,
+		Context:   n.readSeq,
+	})
+}
+
+// 向从节点发送状态机在已经应用的最后一条日志处的检查点
+func (n *Node) sendSnapshot(peer string) {
+	term, _ := n.log.term(n.applied)
+	snapshot, err := n.state.files(n.applied, term, n.configAt(n.applied))
+	if err != nil {
+		n.logger().Error("raft: failed to read the snapshot", "id", n.id, "error", err)
+		return
+	}
+	n.logger().Info("raft: sending the snapshot", "id", n.id, "index", snapshot.Index, "to", peer)
+	n.send(Message{Type: MsgSnapshot, To: peer, Snapshot: &snapshot, Context: n.readSeq})
+	n.snapshotWait[peer] = n.opts.ElectionTicks
+}
+
+// 处理收到的消息
+func (n *Node) step(m Message) {
+	if m.Term > n.term {
+		//只有追加日志和检查点来自新任期的主节点，其它消息说明还不知道主节点是谁
+		leader := ""
+		if m.Type == MsgAppend || m.Type == MsgSnapshot {
+			leader = m.From
+		}
+		n.becomeFollower(m.Term, leader)
+	} else if m.Term < n.term {
+		//让旧的主节点知道新的任期
+		switch m.Type {
+		case MsgAppend, MsgSnapshot:
+			n.send(Message{Type: MsgAppendResp, To: m.From})
+		case MsgVote:
+			n.send(Message{Type: MsgVoteResp, To: m.From})
+		}
+		return
+	}
+
+	switch m.Type {
+	case MsgVote:
+		n.handleVote(m)
+	case MsgVoteResp:
+		if n.role == Candidate && m.Granted {
+			n.votes[m.From] = true
+			if len(n.votes) >= n.quorum() {
+				n.becomeLeader()
+			}
+		}
+	case MsgAppend:
+		n.acceptLeader(m.From)
+		n.handleAppend(m)
+	case MsgSnapshot:
+		n.acceptLeader(m.From)
+		n.handleSnapshot(m)
+	case MsgAppendResp:
+		if n.role == Leader {
+			n.handleAppendResp(m)
+		}
+	}
+}
+
+// 收到当前任期主节点的消息
+func (n *Node) acceptLeader(leader string) {
+	if n.role != Follower || n.leader != leader {
+		n.becomeFollower(n.term, leader)
+	}
+	n.elapsed = 0
+}
+
+// 只投票给日志至少和自己一样新的候选者，每个任期只投一票
+func (n *Node) handleVote(m Message) {
+	upToDate := m.LastTerm > n.log.lastTerm() || (m.LastTerm == n.log.lastTerm() && m.LastIndex >= n.log.lastIndex())
+	granted := (n.vote == "" || n.vote == m.From) && n.leader == "" && upToDate
+	if granted {
+		n.vote = m.From
+		if !n.persisted(n.log.saveState(n.hardState())) {
+			return
+		}
+		n.resetTimeout()
+	}
+	n.send(Message{Type: MsgVoteResp, To: m.From, Granted: granted})
+}
+
+// 从节点检查前一条日志是否一致，一致时追加日志并更新提交位置
+func (n *Node) handleAppend(m Message) {
+	reply := Message{Type: MsgAppendResp, To: m.From, Context: m.Context}
+	if m.PrevIndex > n.log.lastIndex() {
+		reply.Match = n.log.lastIndex() + 1
+		n.send(reply)
+		return
+	}
+	//检查点之前的日志一定已经提交，与主节点一致
+	if term, ok := n.log.term(m.PrevIndex); ok && term != m.PrevTerm {
+		reply.Match = max(m.PrevIndex, n.commit+1)
+		n.send(reply)
+		return
+	}
+	changed := false
+	for i, e := range m.Entries {
+		if e.Index <= n.log.snapIndex {
+			continue
+		}
+		if term, ok := n.log.term(e.Index); ok && term == e.Term {
+			continue
+		}
+		if e.Index <= n.commit {
+			panic(fmt.Errorf("raft: %s overwrites the committed entry %d", n.id, e.Index))
+		}
+		if !n.persisted(n.log.append(m.Entries[i:]...)) {
+			return
+		}
+		changed = true
+		break
+	}
+	if changed {
+		n.peers = n.configAt(n.log.lastIndex())
+	}
+	last := m.PrevIndex + uint64(len(m.Entries))
+	if commit := min(m.Commit, last); commit > n.commit {
+		n.commit = commit
+	}
+	reply.Success = true
+	reply.Match = last
+	n.send(reply)
+}
+
+// 从节点安装主节点发送的检查点，删除检查点之前的所有日志
+func (n *Node) handleSnapshot(m Message) {
+	snapshot := m.Snapshot
+	reply := Message{Type: MsgAppendResp, To: m.From, Context: m.Context, Success: true}
+	if snapshot == nil {
+		return
+	}
+	//已经提交的日志覆盖了检查点，不需要安装
+	if snapshot.Index <= n.commit {
+		reply.Match = n.commit
+		n.send(reply)
+		return
+	}
+	n.logger().Info("raft: installing the snapshot", "id", n.id, "index", snapshot.Index, "from", m.From)
+	if err := n.state.install(*snapshot); err != nil {
+		n.logger().Error("raft: failed to install the snapshot", "id", n.id, "index", snapshot.Index, "error", err)
+		return
+	}
+	//检查点之后与检查点一致的日志可以保留
+	if term, ok := n.log.term(snapshot.Index); !ok || term != snapshot.Term {
+		n.log.entries = nil
+	}
+	if !n.persisted(n.log.compact(snapshot.Index, snapshot.Term, n.hardState())) {
+		return
+	}
+	n.commit = snapshot.Index
+	n.applied = snapshot.Index
+	n.peers = n.configAt(n.log.lastIndex())
+	reply.Match = snapshot.Index
+	n.send(reply)
+}
+
+// 主节点根据从节点的回复更新复制的进度
+func (n *Node) handleAppendResp(m Message) {
+	if _, ok := n.next[m.From]; !ok {
+		return
+	}
+	//同一任期的回复说明从节点仍然认可自己是主节点
+	n.ackReads(m.From, m.Context)
+	if !m.Success {
+		//从节点在这个任期内不再认可主节点，Match为0的回复来自更高任期，已经在step中处理
+		if m.Match == 0 {
+			return
+		}
+		n.next[m.From] = max(1, min(n.next[m.From]-1, m.Match))
+		n.sendAppend(m.From)
+		return
+	}
+	if m.Match > n.match[m.From] {
+		n.match[m.From] = m.Match
+	}
+	if m.Match+1 > n.next[m.From] {
+		n.next[m.From] = m.Match + 1
+	}
+	if m.Match >= n.log.snapIndex {
+		delete(n.snapshotWait, m.From)
+	}
+	if n.maybeCommit() {
+		n.broadcast()
+	} else if n.next[m.From] <= n.log.lastIndex() {
+		n.sendAppend(m.From)
+	}
+}
+
+// 多数成员已经复制的当前任期的日志可以提交，返回提交位置是否前进
+func (n *Node) maybeCommit() bool {
+	matches := make([]uint64, 0, len(n.peers))
+	for _, peer := range n.peers {
+		if peer == n.id {
+			matches = append(matches, n.log.lastIndex())
+		} else {
+			matches = append(matches, n.match[peer])
+		}
+	}
+	if len(matches) == 0 {
+		return false
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	index := matches[n.quorum()-1]
+	//只能直接提交当前任期的日志，之前任期的日志随之提交
+	if term, ok := n.log.term(index); index > n.commit && ok && term == n.term {
+		n.commit = index
+		n.startReads()
+		return true
+	}
+	return false
+}
+
+// 主节点处理一条提议
+func (n *Node) handleProposal(p proposal) {
+	if n.role != Leader {
+		p.result <- result{err: fmt.Errorf("%w, the leader is %q", ErrNotLeader, n.leader)}
+		return
+	}
+	if p.change != nil {
+		if n.lastConfigIndex() > n.commit {
+			p.result <- result{err: ErrConfigChangeInProgress}
+			return
+		}
+		peers := p.change(slices.Clone(n.peers))
+		if peers == nil {
+			p.result <- result{}
+			return
+		}
+		p.entry.Data = encodePeers(peers)
+	}
+	e := n.appendEntry(p.entry)
+	n.waiters[e.Index] = waiter{term: e.Term, result: p.result}
+	n.broadcast()
+	n.maybeCommit()
+}
+
+// 主节点处理一次线性一致读
+func (n *Node) handleRead(r *readRequest) {
+	if n.role != Leader {
+		r.result <- fmt.Errorf("%w, the leader is %q", ErrNotLeader, n.leader)
+		return
+	}
+	r.acks = map[string]bool{n.id: true}
+	n.reads = append(n.reads, r)
+	n.startReads()
+	n.finishReads()
+}
+
+// 在当前任期已经提交日志之后，为还没有确定位置的读取记录提交位置，并发送一轮心跳确认主节点的身份
+func (n *Node) startReads() {
+	if term, _ := n.log.term(n.commit); term != n.term {
+		return
+	}
+	started := false
+	for _, r := range n.reads {
+		if !r.ready {
+			if !started {
+				n.readSeq++
+				started = true
+			}
+			r.ready = true
+			r.index = n.commit
+			r.seq = n.readSeq
+		}
+	}
+	if started {
+		n.broadcast()
+	}
+}
+
+// 从节点的回复中带有它收到的最新的读取编号，确认之前的所有读取
+func (n *Node) ackReads(peer string, seq uint64) {
+	for _, r := range n.reads {
+		if r.ready && r.seq <= seq {
+			r.acks[peer] = true
+		}
+	}
+	n.finishReads()
+}
+
+// 完成已经被多数成员确认并且状态机已经应用到提交位置的读取
+func (n *Node) finishReads() {
+	remaining := n.reads[:0]
+	for _, r := range n.reads {
+		if r.ready && n.confirmed(r) && n.applied >= r.index {
+			r.result <- nil
+		} else {
+			remaining = append(remaining, r)
+		}
+	}
+	clear(n.reads[len(remaining):])
+	n.reads = remaining
+}
+
+// 读取是否被多数成员确认
+func (n *Node) confirmed(r *readRequest) bool {
+	acks := 0
+	for _, peer := range n.peers {
+		if r.acks[peer] {
+			acks++
+		}
+	}
+	return acks >= n.quorum()
+}
+
+// 失去主节点身份时所有等待的读取失败
+func (n *Node) failReads(err error) {
+	for _, r := range n.reads {
+		r.result <- err
+	}
+	n.reads = nil
+}
@@ -0,0 +1,218 @@
+package raft_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tinydb/config"
+	"tinydb/raft"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// 同一个进程中通过内存网络通信的集群
+type cluster struct {
+	t       *testing.T
+	dir     string
+	network *raft.MemoryNetwork
+	nodes   map[string]*raft.Node
+}
+
+func newCluster(t *testing.T, ids ...string) *cluster {
+	c := &cluster{t: t, dir: t.TempDir(), network: raft.NewMemoryNetwork(), nodes: make(map[string]*raft.Node)}
+	for _, id := range ids {
+		c.start(id, ids)
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	})
+	return c
+}
+
+// 启动节点id，peers为空表示加入已有的集群
+func (c *cluster) start(id string, peers []string) *raft.Node {
+	n, err := raft.NewNode(raft.Options{
+		ID:              id,
+		Dir:             filepath.Join(c.dir, id),
+		Peers:           peers,
+		Transport:       c.network.Transport(id),
+		TickInterval:    5 * time.Millisecond,
+		SnapshotEntries: 50,
+		Storage:         config.Config{Level0Size: 10, PerSize: 10},
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id] = n
+	return n
+}
+
+// 等待除了except之外的节点中选出主节点
+func (c *cluster) leader(except ...string) *raft.Node {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for id, n := range c.nodes {
+			if status := n.Status(); status.State == raft.Leader && !contains(except, id) {
+				return n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return nil
+}
+
+func contains(ids []string, id string) bool {
+	for _, s := range ids {
+		if s == id {
+			return true
+		}
+	}
+	return false
+}
+
+// 等待节点n应用的日志追上主节点
+func (c *cluster) waitApplied(n *raft.Node, leader *raft.Node) {
+	target := leader.Status().Commit
+	deadline := time.Now().Add(5 * time.Second)
+	for n.Status().Applied < target {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("%s did not catch up: %+v, leader %+v", n.Status().ID, n.Status(), leader.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func set(t *testing.T, n *raft.Node, key string, value int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, _ := json.Marshal(value)
+	if err := n.Set(ctx, key, data); err != nil {
+		t.Fatalf("set %s: %v", key, err)
+	}
+}
+
+func get(t *testing.T, n *raft.Node, key string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	value, ok, err := n.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("get %s: %v", key, err)
+	}
+	if !ok {
+		return ""
+	}
+	return string(value)
+}
+
+func TestReplicationAndFailover(t *testing.T) {
+	c := newCluster(t, "n1", "n2", "n3")
+	leader := c.leader()
+	set(t, leader, "a", 1)
+	if v := get(t, leader, "a"); v != "1" {
+		t.Fatalf("a: expected 1, got %q", v)
+	}
+	ctx := context.Background()
+	for id, n := range c.nodes {
+		if n == leader {
+			continue
+		}
+		if _, _, err := n.Get(ctx, "a"); !errors.Is(err, raft.ErrNotLeader) {
+			t.Fatalf("read from follower %s: expected ErrNotLeader, got %v", id, err)
+		}
+	}
+
+	// 隔离主节点之后，剩下的两个节点选出新的主节点
+	old := leader
+	oldID := old.Status().ID
+	c.network.Isolate(oldID)
+	leader = c.leader(oldID)
+	set(t, leader, "a", 2)
+	if found, err := leader.Delete(ctx, "b"); err != nil || found {
+		t.Fatalf("delete missing key: %v %v", found, err)
+	}
+
+	// 被隔离的旧主节点无法确认自己的身份，线性一致读不会返回旧值
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if value, _, err := old.Get(short, "a"); err == nil {
+		t.Fatalf("isolated leader served a read: %s", value)
+	}
+
+	// 恢复之后旧主节点成为从节点并追上新的日志
+	c.network.Heal(oldID)
+	c.waitApplied(old, leader)
+	if status := old.Status(); status.State != raft.Follower || status.Leader != leader.Status().ID {
+		t.Fatalf("old leader should follow the new leader: %+v", status)
+	}
+	if value, _ := old.GetLocal("a"); string(value) != "2" {
+		t.Fatalf("old leader: expected 2, got %s", value)
+	}
+}
+
+func TestSnapshotAndMembership(t *testing.T) {
+	c := newCluster(t, "n1", "n2", "n3")
+	leader := c.leader()
+	// 超过SnapshotEntries之后日志被压缩，新节点只能通过sstable检查点追上
+	for i := 0; i < 120; i++ {
+		set(t, leader, fmt.Sprintf("k%03d", i), i)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n4 := c.start("n4", nil)
+	if err := leader.AddNode(ctx, "n4"); err != nil {
+		t.Fatal(err)
+	}
+	set(t, leader, "after", 1)
+	c.waitApplied(n4, leader)
+	for _, key := range []string{"k000", "k119", "after"} {
+		if _, ok := n4.GetLocal(key); !ok {
+			t.Fatalf("n4 is missing %s", key)
+		}
+	}
+
+	// 移除主节点之后剩下的节点选出新的主节点，集群继续工作
+	oldID := leader.Status().ID
+	if err := leader.RemoveNode(ctx, oldID); err != nil {
+		t.Fatal(err)
+	}
+	leader = c.leader(oldID)
+	if peers := leader.Status().Peers; len(peers) != 3 || contains(peers, oldID) {
+		t.Fatalf("unexpected peers %v", peers)
+	}
+	set(t, leader, "k000", 1000)
+	if v := get(t, leader, "k000"); v != "1000" {
+		t.Fatalf("k000: expected 1000, got %q", v)
+	}
+
+	// 重新启动的节点从自己的检查点和日志中恢复
+	var follower string
+	for _, id := range leader.Status().Peers {
+		if id != leader.Status().ID {
+			follower = id
+			break
+		}
+	}
+	c.nodes[follower].Stop()
+	n := c.start(follower, nil)
+	set(t, leader, "restart", 1)
+	c.waitApplied(n, leader)
+	if value, _ := n.GetLocal("k000"); string(value) != "1000" {
+		t.Fatalf("%s after restart: expected 1000, got %s", follower, value)
+	}
+	if value, _ := n.GetLocal("k050"); string(value) != "50" {
+		t.Fatalf("%s after restart: expected 50, got %s", follower, value)
+	}
+}
@@ -0,0 +1,237 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"tinydb"
+	"tinydb/config"
+)
+
+// 状态机的数据库所在的目录，以及记录检查点的文件
+const (
+	stateDir     = "state"
+	snapshotName = "snapshot.json"
+)
+
+// 一个sstable检查点，状态机在Index处的所有数据
+type Snapshot struct {
+	//检查点包含的最后一条日志的编号和任期
+	Index uint64
+	Term  uint64
+	//此时集群的所有成员
+	Peers []string
+	//状态机数据库的检查点中的所有文件，名称为相对于数据库目录的路径
+	Files []SnapshotFile `json:",omitempty"`
+}
+
+// 检查点中的一个文件
+type SnapshotFile struct {
+	Name string
+	Data []byte
+}
+
+// 对状态机的一次修改，保存在EntryNormal日志的Data中
+type command struct {
+	Op    string
+	Key   string
+	Value json.RawMessage `json:",omitempty"`
+}
+
+const (
+	opSet    = "set"
+	opDelete = "delete"
+)
+
+// 使用tinydb数据库保存的状态机，数据库有自己的日志，已经应用的日志在重新启动之后不会丢失
+// 创建检查点时数据库的内存表被持久化，检查点之后的日志在重新启动之后会被再次应用，
+// 写入和删除重复执行的结果不变，因此数据库中的数据可以比检查点更新
+type stateMachine struct {
+	//保护db，安装检查点时会替换数据库
+	lock sync.RWMutex
+	dir  string
+	con  config.Config
+	db   *tinydb.Database
+	//最后一个检查点，不包含文件
+	snapshot Snapshot
+}
+
+// 打开目录dir中的状态机
+func openStateMachine(dir string, con config.Config) (*stateMachine, error) {
+	s := &stateMachine{dir: dir, con: con}
+	data, err := os.ReadFile(filepath.Join(dir, snapshotName))
+	if err == nil {
+		err = json.Unmarshal(data, &s.snapshot)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("raft: read %s: %w", snapshotName, err)
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 打开状态机目录中的数据库
+func (s *stateMachine) open() error {
+	con := s.con
+	con.DataDir = filepath.Join(s.dir, stateDir)
+	db, err := tinydb.Open(con)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+// 执行一条命令，删除时返回之前是否存在
+func (s *stateMachine) apply(data []byte) (bool, error) {
+	var cmd command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return false, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	switch cmd.Op {
+	case opSet:
+		return false, tinydb.SetCFContext(context.Background(), s.db.ColumnFamily, cmd.Key, cmd.Value)
+	case opDelete:
+		return tinydb.DeleteCFContext[json.RawMessage](context.Background(), s.db.ColumnFamily, cmd.Key)
+	}
+	return false, fmt.Errorf("raft: unknown command %q", cmd.Op)
+}
+
+// 读取key对应的值
+func (s *stateMachine) Get(key string) ([]byte, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return tinydb.GetCF[json.RawMessage](s.db.ColumnFamily, key)
+}
+
+// 将内存表持久化为sstable，并记录新的检查点
+// 数据库的日志没有刷到磁盘上，必须先持久化，之后才能删除检查点之前的raft日志
+func (s *stateMachine) save(index, term uint64, peers []string) error {
+	s.lock.Lock()
+	s.db.Flush()
+	snapshot := Snapshot{Index: index, Term: term, Peers: peers}
+	err := s.writeSnapshot(snapshot)
+	if err == nil {
+		s.snapshot = snapshot
+	}
+	s.lock.Unlock()
+	//压缩已经持久化的sstable，压缩期间仍然可以读取
+	s.lock.RLock()
+	s.db.TableTree.Check()
+	s.lock.RUnlock()
+	return err
+}
+
+// 写入snapshot.json
+func (s *stateMachine) writeSnapshot(snapshot Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(s.dir, snapshotName)
+	if err := os.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// 创建状态机当前数据的检查点，调用者保证状态机正好应用到index
+// 检查点中的文件包括数据库的sstable、日志以及清单，名称为相对于数据库目录的路径
+func (s *stateMachine) files(index, term uint64, peers []string) (Snapshot, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	snapshot := Snapshot{Index: index, Term: term, Peers: peers}
+	tmp := filepath.Join(s.dir, stateDir+".checkpoint")
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	if err := s.db.Checkpoint(tmp); err != nil {
+		return Snapshot{}, err
+	}
+	err := filepath.WalkDir(tmp, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(tmp, path)
+		if err != nil {
+			return err
+		}
+		snapshot.Files = append(snapshot.Files, SnapshotFile{Name: filepath.ToSlash(name), Data: data})
+		return nil
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// 使用主节点发送的检查点替换状态机中的所有数据
+func (s *stateMachine) install(snapshot Snapshot) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	//先写入临时目录，再替换原来的数据库目录
+	dir := filepath.Join(s.dir, stateDir)
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	for _, file := range snapshot.Files {
+		name := filepath.FromSlash(file.Name)
+		if !filepath.IsLocal(name) {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("raft: unexpected file %q in the snapshot", file.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmp, name)), 0755); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(tmp, name), file.Data, 0644); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	if err := s.db.Close(); err != nil {
+		s.con.GetLogger().Error("raft: failed to close the state machine", "file", dir, "error", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return err
+	}
+	snapshot.Files = nil
+	if err := s.writeSnapshot(snapshot); err != nil {
+		return err
+	}
+	s.snapshot = snapshot
+	return s.open()
+}
+
+// 关闭状态机的数据库
+func (s *stateMachine) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.db.Close(); err != nil {
+		s.con.GetLogger().Error("raft: failed to close the state machine", "file", s.dir, "error", err)
+	}
+}
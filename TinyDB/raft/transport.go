@@ -0,0 +1,138 @@
+package raft
+
+import "sync"
+
+// 节点之间的消息类型
+type MessageType int
+
+const (
+	//请求投票以及投票的结果
+	MsgVote MessageType = iota
+	MsgVoteResp
+	//追加日志，没有日志时作为心跳
+	MsgAppend
+	MsgAppendResp
+	//发送sstable检查点，从节点安装之后以MsgAppendResp回复
+	MsgSnapshot
+)
+
+// 节点之间传递的消息
+type Message struct {
+	Type MessageType
+	From string
+	To   string
+	Term uint64
+	//请求投票的节点最后一条日志的编号和任期
+	LastIndex uint64
+	LastTerm  uint64
+	Granted   bool
+	//追加日志时前一条日志的编号和任期，以及主节点已经提交的编号
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []Entry
+	Commit    uint64
+	//追加成功时Match为从节点与主节点一致的最后一条日志，失败时为主节点下一次尝试的编号
+	Success bool
+	Match   uint64
+	//线性一致读的编号，从节点原样返回，主节点据此确认自己仍然是主节点
+	Context uint64
+	//MsgSnapshot携带的检查点
+	Snapshot *Snapshot
+}
+
+// 节点之间的传输层，消息可以丢失、重复或者乱序，但不能被修改
+type Transport interface {
+	//发送消息，不需要等待对方收到
+	Send(msg Message)
+	//接收发送给本节点的消息
+	Receive() <-chan Message
+	//停止接收消息
+	Close()
+}
+
+// 每个节点接收消息的缓冲区大小，缓冲区满时丢弃消息
+const inboxSize = 1024
+
+// 在同一个进程中传递消息的网络，用于测试
+// 可以隔离某个节点，模拟网络分区
+type MemoryNetwork struct {
+	lock     sync.Mutex
+	inboxes  map[string]chan Message
+	isolated map[string]bool
+}
+
+// 创建一个内存中的网络
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		inboxes:  make(map[string]chan Message),
+		isolated: make(map[string]bool),
+	}
+}
+
+// 获取节点id使用的传输层，同一个id重新获取时使用新的接收缓冲区
+func (n *MemoryNetwork) Transport(id string) Transport {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	inbox := make(chan Message, inboxSize)
+	n.inboxes[id] = inbox
+	return &memoryTransport{network: n, id: id, inbox: inbox}
+}
+
+// 隔离节点id，发送给它以及它发送的消息都会被丢弃
+func (n *MemoryNetwork) Isolate(id string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.isolated[id] = true
+}
+
+// 恢复节点id与其它节点的通信
+func (n *MemoryNetwork) Heal(id string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	delete(n.isolated, id)
+}
+
+// 将消息放入接收者的缓冲区
+func (n *MemoryNetwork) deliver(msg Message) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.isolated[msg.From] || n.isolated[msg.To] {
+		return
+	}
+	inbox, ok := n.inboxes[msg.To]
+	if !ok {
+		return
+	}
+	select {
+	case inbox <- msg:
+	default:
+	}
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	id      string
+	inbox   chan Message
+}
+
+func (t *memoryTransport) Send(msg Message) {
+	t.network.deliver(msg)
+}
+
+func (t *memoryTransport) Receive() <-chan Message {
+	return t.inbox
+}
+
+// 从网络中移除，之后发送给这个节点的消息都会被丢弃
+func (t *memoryTransport) Close() {
+	t.network.lock.Lock()
+	defer t.network.lock.Unlock()
+
+	if t.network.inboxes[t.id] == t.inbox {
+		delete(t.network.inboxes, t.id)
+	}
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// 令牌桶限速器，限制每秒钟写入的字节数
+// 最多可以积攒一秒钟的令牌，超出的请求需要等待令牌补充
+type Limiter struct {
+	//每秒产生的令牌数量，也就是每秒允许写入的字节数
+	rate float64
+	//当前剩余的令牌数量，可以为负数，表示已经预支的令牌
+	tokens float64
+	//上一次补充令牌的时间
+	last time.Time
+	mu   sync.Mutex
+}
+
+// 创建一个每秒允许写入bytesPerSecond字节的限速器
+// bytesPerSecond小于等于0时返回nil，表示不限速
+func New(bytesPerSecond int) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// 获取n个令牌，令牌不足时阻塞等待
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	//根据流逝的时间补充令牌
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	//先预支令牌，再等待令牌补充回来
+	l.tokens -= float64(n)
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,32 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+	"tinydb/ratelimit"
+)
+
+func TestLimiter(t *testing.T) {
+	// 每秒1000字节，初始可以直接写入1000字节
+	limiter := ratelimit.New(1000)
+	start := time.Now()
+	limiter.Wait(1000)
+	if elapse := time.Since(start); elapse > 50*time.Millisecond {
+		t.Errorf("The first write should not wait, waited %v", elapse)
+	}
+
+	// 令牌已经用完，再写入100字节大约需要等待100ms
+	start = time.Now()
+	limiter.Wait(100)
+	if elapse := time.Since(start); elapse < 80*time.Millisecond {
+		t.Errorf("Expected to wait about 100ms, waited %v", elapse)
+	}
+
+	// 不限速的情况
+	var unlimited *ratelimit.Limiter = ratelimit.New(0)
+	start = time.Now()
+	unlimited.Wait(1 << 30)
+	if elapse := time.Since(start); elapse > 50*time.Millisecond {
+		t.Errorf("Unlimited limiter should not wait, waited %v", elapse)
+	}
+}
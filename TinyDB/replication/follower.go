@@ -0,0 +1,217 @@
+package replication
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"tinydb"
+)
+
+// 从节点落后太多，需要的变更已经不在主节点保留的日志中
+// 需要关闭数据库，通过Bootstrap重新下载主节点的检查点之后再启动
+var ErrResyncRequired = errors.New("replication: follower is too far behind, bootstrap it again from a checkpoint")
+
+// 从节点已经被关闭
+var ErrFollowerClosed = errors.New("replication: follower closed")
+
+// 在启动数据库之前调用，dir中的数据已经无法通过主节点保留的日志追上时，
+// 下载主节点的检查点替换dir中的所有数据，返回是否进行了替换
+func Bootstrap(addr, dir string) (bool, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	w := newMessageWriter(conn)
+	w.send(hello{From: tinydb.ReadSequence(dir) + 1, Bootstrap: true})
+	if err := w.flush(); err != nil {
+		return false, err
+	}
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	var m message
+	conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	if err := dec.Decode(&m); err != nil {
+		return false, err
+	}
+	switch m.Type {
+	case msgDone:
+		return false, nil
+	case msgSnapshot:
+	default:
+		return false, fmt.Errorf("replication: unexpected message %q", m.Type)
+	}
+
+	//先写入临时目录，全部接收完成之后再替换原来的数据目录
+	tmp := filepath.Clean(dir) + ".bootstrap"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return false, err
+	}
+	for {
+		var m message
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if err := dec.Decode(&m); err != nil {
+			return false, err
+		}
+		if m.Type == msgDone {
+			break
+		}
+		if m.Type != msgFile || !filepath.IsLocal(m.Name) {
+			return false, fmt.Errorf("replication: unexpected file %q in the snapshot", m.Name)
+		}
+		if err := writeFile(filepath.Join(tmp, m.Name), m.Data, time.Unix(0, m.ModTime)); err != nil {
+			return false, err
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return false, err
+	}
+	logger().Info("replication: bootstrapped from the checkpoint of the primary", "file", dir, "primary", addr, "seq", m.Seq)
+	return true, nil
+}
+
+// 写入检查点中的一个文件，日志按照修改时间的先后回放，需要保留原来的修改时间
+func writeFile(name string, data []byte, modTime time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		return err
+	}
+	return os.Chtimes(name, modTime, modTime)
+}
+
+// 从节点，从主节点接收变更写入只读的数据库
+type Follower struct {
+	addr string
+	db   *tinydb.Database
+
+	lock   sync.Mutex
+	conn   net.Conn
+	closed bool
+	done   chan struct{}
+}
+
+// 创建一个从addr上的主节点复制变更到db的从节点，db需要先通过Bootstrap准备好数据目录
+func NewFollower(addr string, db *tinydb.Database) *Follower {
+	return &Follower{addr: addr, db: db, done: make(chan struct{})}
+}
+
+// 将数据库设置为只读，持续从主节点接收变更，与主节点断开之后等待一段时间重新连接
+// 需要重新下载检查点时返回ErrResyncRequired，被关闭之后返回ErrFollowerClosed
+func (f *Follower) Run() error {
+	f.db.SetReadOnly(true)
+	for {
+		err := f.follow()
+		if errors.Is(err, ErrResyncRequired) {
+			return err
+		}
+		select {
+		case <-f.done:
+			return ErrFollowerClosed
+		default:
+		}
+		logger().Warn("replication: lost the connection to the primary", "primary", f.addr, "error", err)
+		select {
+		case <-f.done:
+			return ErrFollowerClosed
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// 停止复制，Run返回ErrFollowerClosed，数据库仍然是只读的
+func (f *Follower) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !f.closed {
+		f.closed = true
+		close(f.done)
+		if f.conn != nil {
+			f.conn.Close()
+		}
+	}
+	return nil
+}
+
+// 建立一次连接并写入收到的变更，直到连接断开
+func (f *Follower) follow() error {
+	conn, err := net.DialTimeout("tcp", f.addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		conn.Close()
+		return ErrFollowerClosed
+	}
+	f.conn = conn
+	f.lock.Unlock()
+	defer conn.Close()
+
+	w := newMessageWriter(conn)
+	w.send(hello{From: f.db.LatestSequence() + 1})
+	if err := w.flush(); err != nil {
+		return err
+	}
+	//定期发送确认，同时作为从节点的心跳
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.send(ack{Applied: f.db.LatestSequence()})
+				if w.flush() != nil {
+					conn.Close()
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var m message
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if err := dec.Decode(&m); err != nil {
+			return err
+		}
+		switch m.Type {
+		case msgPing:
+		case msgFamily:
+			if _, ok := f.db.GetColumnFamily(m.Family); !ok && m.Options != nil {
+				if _, err := f.db.CreateColumnFamily(m.Family, *m.Options); err != nil {
+					return err
+				}
+			}
+		case msgMutation:
+			if m.Mutation == nil {
+				return errors.New("replication: empty mutation")
+			}
+			if err := f.db.Apply(*m.Mutation); err != nil {
+				return err
+			}
+		case msgResync:
+			return fmt.Errorf("%w: %s", ErrResyncRequired, m.Error)
+		default:
+			return fmt.Errorf("replication: unexpected message %q", m.Type)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package replication
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tinydb"
+)
+
+// 主节点，将写入日志的每一条记录发送给连接上来的从节点
+//
+// 从节点连接之后发送需要的第一个序列号，主节点通过Database.Subscribe发送之后的所有变更，
+// 从节点通过Database.Apply写入自己的日志和内存表，并以只读的方式对外提供读取。
+// 需要的变更已经不在保留的日志中时，从节点在启动数据库之前下载主节点的检查点替换自己的数据目录。
+// 主节点需要设置WALRetentionSize保留已经持久化的日志，否则从节点断开之后，
+// 只要主节点持久化过一次内存表，重新连接时就需要重新下载检查点。
+// 列族的创建会随第一条变更一起复制，列族的删除不会被复制
+type Primary struct {
+	db *tinydb.Database
+
+	lock      sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]*follower
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// 一个连接上来的从节点
+type follower struct {
+	addr string
+	//从节点确认已经写入的最后一个序列号
+	applied atomic.Uint64
+}
+
+// 从节点的复制状态
+type FollowerInfo struct {
+	Addr string
+	//从节点已经写入的最后一个序列号，以及落后于主节点的变更数量
+	Applied uint64
+	Lag     uint64
+}
+
+// 主节点已经被关闭
+var ErrPrimaryClosed = errors.New("replication: primary closed")
+
+// 创建一个将db的变更复制给从节点的主节点
+func NewPrimary(db *tinydb.Database) *Primary {
+	return &Primary{
+		db:        db,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]*follower),
+	}
+}
+
+// 监听addr并接收从节点的连接，直到主节点被关闭
+func (p *Primary) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return p.Serve(l)
+}
+
+// 在l上接收从节点的连接，每一个从节点使用一个goroutine
+// 主节点关闭之后返回ErrPrimaryClosed
+func (p *Primary) Serve(l net.Listener) error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		l.Close()
+		return ErrPrimaryClosed
+	}
+	p.listeners[l] = struct{}{}
+	p.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			p.lock.Lock()
+			closed := p.closed
+			delete(p.listeners, l)
+			p.lock.Unlock()
+			if closed {
+				return ErrPrimaryClosed
+			}
+			return err
+		}
+		f := &follower{addr: conn.RemoteAddr().String()}
+		if !p.track(conn, f) {
+			conn.Close()
+			return ErrPrimaryClosed
+		}
+		go p.serveConn(conn, f)
+	}
+}
+
+// 记录新的连接，主节点已经关闭时返回false
+func (p *Primary) track(conn net.Conn, f *follower) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = f
+	p.wg.Add(1)
+	return true
+}
+
+// 关闭所有监听和连接，等待所有连接的goroutine退出之后返回
+func (p *Primary) Close() error {
+	p.lock.Lock()
+	p.closed = true
+	for l := range p.listeners {
+		l.Close()
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.lock.Unlock()
+
+	p.wg.Wait()
+	return nil
+}
+
+// 所有正在复制的从节点
+func (p *Primary) Followers() []FollowerInfo {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	latest := p.db.LatestSequence()
+	infos := make([]FollowerInfo, 0, len(p.conns))
+	for _, f := range p.conns {
+		info := FollowerInfo{Addr: f.addr, Applied: f.applied.Load()}
+		if latest > info.Applied {
+			info.Lag = latest - info.Applied
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// 处理一个从节点的连接
+func (p *Primary) serveConn(conn net.Conn, f *follower) {
+	defer func() {
+		p.lock.Lock()
+		delete(p.conns, conn)
+		p.lock.Unlock()
+		conn.Close()
+		p.wg.Done()
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	w := newMessageWriter(conn)
+	var h hello
+	conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	if err := dec.Decode(&h); err != nil {
+		logger().Warn("replication: failed to read the hello", "follower", f.addr, "error", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if h.From > 0 {
+		f.applied.Store(h.From - 1)
+	}
+
+	sub, err := p.subscribe(h.From)
+	if errors.Is(err, tinydb.ErrChangesUnavailable) {
+		if !h.Bootstrap {
+			w.send(message{Type: msgResync, Error: err.Error()})
+			w.flush()
+			return
+		}
+		if err := p.sendSnapshot(w); err != nil {
+			logger().Warn("replication: failed to send the snapshot", "follower", f.addr, "error", err)
+		}
+		return
+	} else if err != nil {
+		logger().Warn("replication: failed to subscribe", "follower", f.addr, "error", err)
+		return
+	}
+	defer sub.Close()
+	if h.Bootstrap {
+		w.send(message{Type: msgDone})
+		w.flush()
+		return
+	}
+
+	//从节点定期发送确认，读取失败说明从节点已经断开
+	go func() {
+		defer sub.Close()
+		for {
+			var a ack
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+			if err := dec.Decode(&a); err != nil {
+				return
+			}
+			f.applied.Store(a.Applied)
+		}
+	}()
+	if err := p.stream(w, sub); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger().Warn("replication: stopped streaming", "follower", f.addr, "error", err)
+	}
+}
+
+// 从序列号from开始订阅变更，from超过了主节点最后一个序列号时从节点的数据与主节点不一致，同样需要重新下载检查点
+func (p *Primary) subscribe(from uint64) (*tinydb.Subscription, error) {
+	if latest := p.db.LatestSequence(); from == 0 || from > latest+1 {
+		return nil, fmt.Errorf("%w: sequence %d, latest %d", tinydb.ErrChangesUnavailable, from, latest)
+	}
+	return p.db.Subscribe(from)
+}
+
+// 持续发送变更，没有变更时发送心跳，订阅被关闭之后返回
+func (p *Primary) stream(w *messageWriter, sub *tinydb.Subscription) error {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	//已经发送过配置的列族
+	families := make(map[string]bool)
+	for {
+		select {
+		case m, ok := <-sub.C:
+			if !ok {
+				if errors.Is(sub.Err(), tinydb.ErrChangesUnavailable) {
+					w.send(message{Type: msgResync, Error: sub.Err().Error()})
+					return w.flush()
+				}
+				return sub.Err()
+			}
+			if !families[m.Family] {
+				if cf, ok := p.db.GetColumnFamily(m.Family); ok {
+					opts := cf.Options()
+					w.send(message{Type: msgFamily, Family: m.Family, Options: &opts})
+				}
+				families[m.Family] = true
+			}
+			w.send(message{Type: msgMutation, Mutation: &m})
+			//通道中没有更多的变更时才发送，减少系统调用
+			if len(sub.C) > 0 {
+				continue
+			}
+		case <-ticker.C:
+			w.send(message{Type: msgPing})
+		}
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// 创建检查点并发送其中的所有文件，最后发送msgDone
+func (p *Primary) sendSnapshot(w *messageWriter) error {
+	tmp, err := os.MkdirTemp("", "tinydb-snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "checkpoint")
+	if err := p.db.Checkpoint(dir); err != nil {
+		return err
+	}
+	w.send(message{Type: msgSnapshot, Seq: tinydb.ReadSequence(dir)})
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		w.send(message{Type: msgFile, Name: filepath.ToSlash(name), Data: data, ModTime: info.ModTime().UnixNano()})
+		return w.flush()
+	})
+	if err != nil {
+		return err
+	}
+	w.send(message{Type: msgDone})
+	return w.flush()
+}
+
+// 带缓冲的消息编码，第一次出错之后的发送都会被忽略，由flush返回错误
+type messageWriter struct {
+	conn net.Conn
+	w    *bufio.Writer
+	enc  *json.Encoder
+	err  error
+}
+
+func newMessageWriter(conn net.Conn) *messageWriter {
+	w := bufio.NewWriter(conn)
+	return &messageWriter{conn: conn, w: w, enc: json.NewEncoder(w)}
+}
+
+// 编码一条消息，缓冲区满的时候会直接发送，对方长时间不读取时出错
+func (w *messageWriter) send(v any) {
+	if w.err == nil {
+		w.conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+		w.err = w.enc.Encode(v)
+	}
+}
+
+// 发送缓冲区中的消息
+func (w *messageWriter) flush() error {
+	if w.err == nil {
+		w.conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
@@ -0,0 +1,69 @@
+package replication
+
+import (
+	"time"
+	"tinydb"
+	"tinydb/config"
+)
+
+const (
+	//建立连接以及等待握手消息的超时时间
+	dialTimeout = 5 * time.Second
+	//没有变更时主节点发送心跳的间隔，以及从节点发送确认的间隔
+	heartbeatInterval = time.Second
+	//超过这个时间没有收到任何消息时认为对方已经断开
+	idleTimeout = 10 * time.Second
+	//从节点断开之后重新连接的等待时间
+	retryInterval = time.Second
+)
+
+// 从节点连接之后发送的第一条消息
+type hello struct {
+	//需要的第一个序列号
+	From uint64
+	//为true时只在启动数据库之前检查是否需要下载检查点，主节点不会继续发送变更
+	Bootstrap bool
+}
+
+// 主节点发送的消息类型
+const (
+	//一条变更
+	msgMutation = "mutation"
+	//变更所在列族的配置，每个连接上在列族的第一条变更之前发送
+	msgFamily = "family"
+	//检查点的开始，之后是检查点中的每一个文件，最后是msgDone
+	msgSnapshot = "snapshot"
+	msgFile     = "file"
+	//启动之前的检查结束
+	msgDone = "done"
+	//需要的变更已经不在保留的日志中，从节点需要重新下载检查点
+	msgResync = "resync"
+	//心跳
+	msgPing = "ping"
+)
+
+// 主节点发送的消息
+type message struct {
+	Type     string
+	Mutation *tinydb.Mutation `json:",omitempty"`
+	//列族的名称和配置
+	Family  string         `json:",omitempty"`
+	Options *config.Config `json:",omitempty"`
+	//检查点对应的最后一个序列号
+	Seq uint64 `json:",omitempty"`
+	//检查点中的文件，名称为相对于数据目录的路径，修改时间为Unix纳秒
+	Name    string `json:",omitempty"`
+	Data    []byte `json:",omitempty"`
+	ModTime int64  `json:",omitempty"`
+	Error   string `json:",omitempty"`
+}
+
+// 从节点定期发送的确认，主节点据此计算复制的延迟
+type ack struct {
+	Applied uint64
+}
+
+// 数据库配置中的Logger
+func logger() config.Logger {
+	return config.GetConfig().GetLogger()
+}
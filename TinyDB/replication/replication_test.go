@@ -0,0 +1,170 @@
+package replication_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"tinydb"
+	"tinydb/client"
+	"tinydb/config"
+	"tinydb/replication"
+)
+
+// 设置了这两个环境变量时，测试程序作为从节点运行
+const (
+	primaryEnv = "TINYDB_TEST_PRIMARY"
+	dirEnv     = "TINYDB_TEST_DIR"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	if addr := os.Getenv(primaryEnv); addr != "" {
+		runFollower(addr, os.Getenv(dirEnv))
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// 从节点进程，启动之后输出是否下载了检查点以及http服务器的地址，直到被杀死
+func runFollower(addr, dir string) {
+	bootstrapped, err := replication.Bootstrap(addr, dir)
+	if err != nil {
+		fmt.Println("error", err)
+		os.Exit(1)
+	}
+	follower := tinydb.Start(config.Config{
+		DataDir:       dir,
+		Level0Size:    10,
+		PerSize:       10,
+		Threshold:     10000,
+		MergeOperator: config.Int64AddOperator,
+	})
+	go replication.NewFollower(addr, follower).Run()
+	ts := client.NewTestServer(follower)
+	fmt.Println(bootstrapped, ts.URL)
+	select {}
+}
+
+// 启动从节点进程，返回是否下载了检查点、连接到从节点的客户端以及停止从节点的函数
+func startFollower(t *testing.T, addr, dir string) (bool, *client.Client, func()) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), primaryEnv+"="+addr, dirEnv+"="+dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	t.Cleanup(stop)
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 2 || fields[0] == "error" {
+		t.Fatalf("start follower: %q %v", line, err)
+	}
+	c := client.New(fields[1], client.Options{})
+	t.Cleanup(func() { c.Close() })
+	return fields[0] == "true", c, stop
+}
+
+// 等待从节点上key的值变为expected，expected为0表示key不存在
+func waitFor(t *testing.T, c *client.Client, key string, expected int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		value, ok, err := client.Get[int](context.Background(), c, key)
+		if err == nil && (ok && value == expected || !ok && expected == 0) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: expected %d, got %d %v %v", key, expected, value, ok, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := tinydb.Open(config.Config{
+		DataDir:       t.TempDir(),
+		Level0Size:    10,
+		PerSize:       10,
+		Threshold:     10000,
+		MergeOperator: config.Int64AddOperator,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	primary := replication.NewPrimary(db)
+	go primary.Serve(l)
+	defer primary.Close()
+	addr := l.Addr().String()
+	dir := filepath.Join(t.TempDir(), "follower")
+
+	// 主节点的日志已经被清空，新的从节点从检查点开始
+	tinydb.SetCF(db.ColumnFamily, "a", 1)
+	tinydb.MergeCF(db.ColumnFamily, "n", 1)
+	db.Flush()
+	bootstrapped, c, stop := startFollower(t, addr, dir)
+	if !bootstrapped {
+		t.Fatal("a new follower should bootstrap from a checkpoint")
+	}
+	waitFor(t, c, "a", 1)
+	waitFor(t, c, "n", 1)
+
+	// 之后的变更通过日志复制
+	tinydb.SetCF(db.ColumnFamily, "b", 2)
+	tinydb.MergeCF(db.ColumnFamily, "n", 2)
+	tinydb.DeleteCF[int](db.ColumnFamily, "a")
+	waitFor(t, c, "b", 2)
+	waitFor(t, c, "n", 3)
+	waitFor(t, c, "a", 0)
+	if err := client.Set(context.Background(), c, "b", 3); err == nil {
+		t.Fatal("writes to a follower should fail")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if followers := primary.Followers(); len(followers) == 1 && followers[0].Lag == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("follower did not catch up: %+v", primary.Followers())
+		}
+	}
+
+	// 重新启动之后从自己的最后一个序列号继续复制
+	stop()
+	tinydb.SetCF(db.ColumnFamily, "c", 3)
+	bootstrapped, c, stop = startFollower(t, addr, dir)
+	if bootstrapped {
+		t.Fatal("a follower within the retained wal should not bootstrap")
+	}
+	waitFor(t, c, "c", 3)
+	waitFor(t, c, "b", 2)
+
+	// 落后超过主节点保留的日志之后重新下载检查点
+	stop()
+	tinydb.SetCF(db.ColumnFamily, "d", 4)
+	db.Flush()
+	bootstrapped, c, _ = startFollower(t, addr, dir)
+	if !bootstrapped {
+		t.Fatal("a follower behind the retained wal should bootstrap from a checkpoint")
+	}
+	waitFor(t, c, "d", 4)
+	waitFor(t, c, "n", 3)
+}
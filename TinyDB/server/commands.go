@@ -0,0 +1,521 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tinydb"
+)
+
+// 一条命令的处理函数以及参数数量
+type command struct {
+	handler func(s *Server, w respWriter, args [][]byte)
+	//参数数量，包括命令名称，负数表示至少需要的参数数量
+	arity int
+}
+
+// 支持的所有命令，命令名称为小写
+var commands = map[string]command{
+	"get":     {getCommand, 2},
+	"set":     {setCommand, -3},
+	"del":     {delCommand, -2},
+	"exists":  {existsCommand, -2},
+	"mget":    {mgetCommand, -2},
+	"mset":    {msetCommand, -3},
+	"incr":    {incrCommand, 2},
+	"scan":    {scanCommand, -2},
+	"ping":    {pingCommand, -1},
+	"echo":    {echoCommand, 2},
+	"info":    {infoCommand, -1},
+	"select":  {selectCommand, 2},
+	"command": {commandCommand, -1},
+	"quit":    {nil, -1},
+}
+
+// 会修改数据的命令，数据库只读时拒绝执行
+var writeCommands = map[string]bool{
+	"set":  true,
+	"del":  true,
+	"mset": true,
+	"incr": true,
+}
+
+// 读取key对应的值，found表示tinydb中存在这个key，live表示它没有过期
+func (s *Server) load(key []byte) (e entry, found bool, live bool) {
+	raw, ok := tinydb.GetCF[json.RawMessage](s.db.ColumnFamily, string(key))
+	if !ok {
+		return e, false, false
+	}
+	e = decodeEntry(raw)
+	return e, true, !e.expired(time.Now())
+}
+
+// 读取一个没有过期的值，已经过期的值会被删除
+// 只读的数据库（例如从节点）不会删除，过期的值由主节点删除之后复制过来
+func (s *Server) get(key []byte) ([]byte, bool) {
+	e, found, live := s.load(key)
+	if live {
+		return toRESP(e.Value), true
+	}
+	if found && !s.db.ReadOnly() {
+		s.writeLock.Lock()
+		//加锁之后重新检查，期间可能被重新写入
+		if _, found, live := s.load(key); found && !live {
+			tinydb.DeleteCF[json.RawMessage](s.db.ColumnFamily, string(key))
+		}
+		s.writeLock.Unlock()
+	}
+	return nil, false
+}
+
+// 写入一个已经转换为json的值，调用者需要持有writeLock
+func (s *Server) store(w respWriter, key []byte, value json.RawMessage, expireAt int64) bool {
+	e := entry{Value: value, ExpireAt: expireAt}
+	if err := tinydb.SetCFContext(context.Background(), s.db.ColumnFamily, string(key), e.encode()); err != nil {
+		w.error("ERR " + err.Error())
+		return false
+	}
+	return true
+}
+
+// GET key
+func getCommand(s *Server, w respWriter, args [][]byte) {
+	value, _ := s.get(args[0])
+	w.bulk(value)
+}
+
+// SET key value [EX seconds|PX milliseconds] [NX|XX]
+func setCommand(s *Server, w respWriter, args [][]byte) {
+	var expireAt int64
+	nx, xx := false, false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ex", "px":
+			if expireAt != 0 || i+1 >= len(args) {
+				w.error("ERR syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				w.error("ERR value is not an integer or out of range")
+				return
+			}
+			unit := time.Millisecond
+			if strings.ToLower(string(args[i])) == "ex" {
+				unit = time.Second
+			}
+			if n <= 0 || n > math.MaxInt64/int64(unit) {
+				w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			expireAt = time.Now().Add(time.Duration(n) * unit).UnixMilli()
+			i++
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		w.error("ERR syntax error")
+		return
+	}
+	value, err := fromRESP(args[1])
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if nx || xx {
+		_, _, live := s.load(args[0])
+		if (nx && live) || (xx && !live) {
+			w.bulk(nil)
+			return
+		}
+	}
+	if s.store(w, args[0], value, expireAt) {
+		w.simpleString("OK")
+	}
+}
+
+// DEL key [key ...]
+func delCommand(s *Server, w respWriter, args [][]byte) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	var count int64
+	for _, key := range args {
+		_, found, live := s.load(key)
+		if !found {
+			continue
+		}
+		if live {
+			count++
+		}
+		tinydb.DeleteCF[json.RawMessage](s.db.ColumnFamily, string(key))
+	}
+	w.integer(count)
+}
+
+// EXISTS key [key ...]，重复的key会被重复计数
+func existsCommand(s *Server, w respWriter, args [][]byte) {
+	var count int64
+	for _, key := range args {
+		if _, ok := s.get(key); ok {
+			count++
+		}
+	}
+	w.integer(count)
+}
+
+// MGET key [key ...]
+func mgetCommand(s *Server, w respWriter, args [][]byte) {
+	w.array(len(args))
+	for _, key := range args {
+		value, _ := s.get(key)
+		w.bulk(value)
+	}
+}
+
+// MSET key value [key value ...]，所有的值作为一次批量写入，要么全部写入要么都不写入
+func msetCommand(s *Server, w respWriter, args [][]byte) {
+	if len(args)%2 != 0 {
+		w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	batch := &tinydb.WriteBatch{}
+	for i := 0; i < len(args); i += 2 {
+		value, err := fromRESP(args[i+1])
+		if err == nil {
+			err = batch.Set(s.db.ColumnFamily, string(args[i]), entry{Value: value}.encode())
+		}
+		if err != nil {
+			w.error("ERR " + err.Error())
+			return
+		}
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if err := s.db.Write(batch); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.simpleString("OK")
+}
+
+// INCR key，不存在的key从0开始，保留原来的过期时间
+func incrCommand(s *Server, w respWriter, args [][]byte) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	e, _, live := s.load(args[0])
+	var n int64
+	if live {
+		var err error
+		n, err = strconv.ParseInt(string(toRESP(e.Value)), 10, 64)
+		if err != nil {
+			w.error("ERR value is not an integer or out of range")
+			return
+		}
+	} else {
+		e = entry{}
+	}
+	if n == math.MaxInt64 {
+		w.error("ERR increment or decrement would overflow")
+		return
+	}
+	n++
+	value, _ := fromRESP([]byte(strconv.FormatInt(n, 10)))
+	if s.store(w, args[0], value, e.ExpireAt) {
+		w.integer(n)
+	}
+}
+
+// 一次SCAN默认访问的key数量
+const defaultScanCount = 10
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+// 游标对应上一次遍历停止的key，遍历期间一直存在的key一定会被返回
+func scanCommand(s *Server, w respWriter, args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		w.error("ERR invalid cursor")
+		return
+	}
+	pattern := ""
+	count := defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = string(args[i+1])
+		case "count":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				w.error("ERR value is not an integer or out of range")
+				return
+			}
+			if n < 1 {
+				w.error("ERR syntax error")
+				return
+			}
+			count = n
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	//模式中第一个通配符之前的部分是所有结果的公共前缀
+	prefix := pattern
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		prefix = pattern[:i]
+	}
+	start := prefix
+	if cursor != 0 {
+		key, ok := s.cursors.load(cursor)
+		if !ok {
+			w.error("ERR invalid cursor")
+			return
+		}
+		start = key
+	}
+
+	it := s.db.NewIterator(start, "")
+	defer it.Close()
+	now := time.Now()
+	keys := make([][]byte, 0)
+	for visited := 0; visited < count && it.Valid() && strings.HasPrefix(it.Key(), prefix); it.Next() {
+		visited++
+		if pattern != "" && !matchGlob(pattern, it.Key()) {
+			continue
+		}
+		if decodeEntry(it.Value()).expired(now) {
+			continue
+		}
+		keys = append(keys, []byte(it.Key()))
+	}
+	if err := it.Err(); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+
+	next := uint64(0)
+	if it.Valid() && strings.HasPrefix(it.Key(), prefix) {
+		next = s.cursors.save(it.Key())
+	}
+	w.array(2)
+	w.bulk([]byte(strconv.FormatUint(next, 10)))
+	w.array(len(keys))
+	for _, key := range keys {
+		w.bulk(key)
+	}
+}
+
+// PING [message]
+func pingCommand(s *Server, w respWriter, args [][]byte) {
+	switch len(args) {
+	case 0:
+		w.simpleString("PONG")
+	case 1:
+		w.bulk(args[0])
+	default:
+		w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+// ECHO message
+func echoCommand(s *Server, w respWriter, args [][]byte) {
+	w.bulk(args[0])
+}
+
+// SELECT index，只有一个数据库
+func selectCommand(s *Server, w respWriter, args [][]byte) {
+	if string(args[0]) != "0" {
+		w.error("ERR DB index is out of range")
+		return
+	}
+	w.simpleString("OK")
+}
+
+// COMMAND，redis-cli启动时会调用，返回空的命令列表
+func commandCommand(s *Server, w respWriter, args [][]byte) {
+	w.array(0)
+}
+
+// INFO [section]
+func infoCommand(s *Server, w respWriter, args [][]byte) {
+	section := "default"
+	if len(args) > 0 {
+		section = strings.ToLower(string(args[0]))
+	}
+	all := section == "default" || section == "all" || section == "everything"
+
+	var b strings.Builder
+	if all || section == "server" {
+		b.WriteString("# Server\r\n")
+		//客户端根据版本号判断支持的功能，这里声明兼容的Redis版本
+		b.WriteString("redis_version:7.0.0\r\n")
+		b.WriteString("redis_mode:standalone\r\n")
+		fmt.Fprintf(&b, "process_id:%d\r\n", os.Getpid())
+		fmt.Fprintf(&b, "uptime_in_seconds:%d\r\n", int64(time.Since(s.started).Seconds()))
+		b.WriteString("\r\n")
+	}
+	if all || section == "clients" {
+		b.WriteString("# Clients\r\n")
+		fmt.Fprintf(&b, "connected_clients:%d\r\n", s.activeConns.Load())
+		b.WriteString("\r\n")
+	}
+	if all || section == "stats" {
+		b.WriteString("# Stats\r\n")
+		fmt.Fprintf(&b, "total_connections_received:%d\r\n", s.totalConns.Load())
+		fmt.Fprintf(&b, "total_commands_processed:%d\r\n", s.totalCmds.Load())
+		b.WriteString("\r\n")
+	}
+	if all || section == "keyspace" {
+		b.WriteString("# Keyspace\r\n")
+		fmt.Fprintf(&b, "memtable_keys:%d\r\n", s.db.MemoryTree.Getcount())
+		for level := 0; level < s.db.TableTree.LevelCount(); level++ {
+			tables := s.db.TableTree.LevelTables(level)
+			if len(tables) == 0 {
+				continue
+			}
+			keys := 0
+			for _, table := range tables {
+				keys += table.Stats().Keys
+			}
+			fmt.Fprintf(&b, "level%d:files=%d,keys=%d,bytes=%d\r\n",
+				level, len(tables), keys, s.db.TableTree.GetLevelsize(level))
+		}
+	}
+	w.bulk([]byte(b.String()))
+}
+
+// 保存的游标数量上限，超出之后最早的游标失效
+const maxCursors = 4096
+
+// SCAN游标到下一次开始遍历的key的映射
+type cursorTable struct {
+	lock  sync.Mutex
+	next  uint64
+	keys  map[uint64]string
+	order []uint64
+}
+
+func newCursorTable() *cursorTable {
+	return &cursorTable{keys: make(map[uint64]string)}
+}
+
+// 保存下一次开始遍历的key，返回新的游标，游标从1开始
+func (c *cursorTable) save(key string) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.next++
+	c.keys[c.next] = key
+	c.order = append(c.order, c.next)
+	if len(c.order) > maxCursors {
+		delete(c.keys, c.order[0])
+		c.order = c.order[1:]
+	}
+	return c.next
+}
+
+func (c *cursorTable) load(cursor uint64) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key, ok := c.keys[cursor]
+	return key, ok
+}
+
+// 按照Redis的规则匹配通配符，支持*、?、[abc]、[^a]、[a-z]以及\转义
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			ok, rest := matchClass(pattern[1:], s[0])
+			if !ok {
+				return false
+			}
+			pattern, s = rest, s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// 匹配[]中的字符集合，pattern为[之后的部分，返回是否匹配以及]之后的模式
+func matchClass(pattern string, c byte) (bool, string) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			matched = matched || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (lo <= c && c <= hi)
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	//缺少]时到模式结尾为止
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return matched != negate, pattern
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+	"tinydb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// gRPC服务使用json编码消息，不依赖protobuf生成的代码
+// 客户端需要使用content-subtype为json的调用，NewGRPCClient已经设置好
+const grpcCodecName = "json"
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return grpcCodecName }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// gRPC服务的消息
+type GetRequest struct {
+	Key string `json:"key"`
+}
+
+type GetResponse struct {
+	Found bool            `json:"found"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type PutRequest struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type PutResponse struct{}
+
+type DeleteRequest struct {
+	Key string `json:"key"`
+}
+
+type DeleteResponse struct {
+	Found bool `json:"found"`
+}
+
+// Limit为0时返回所有数据
+type ScanRequest struct {
+	Prefix string `json:"prefix"`
+	Start  string `json:"start"`
+	Limit  int    `json:"limit"`
+}
+
+// tinydb.KV服务，每个方法直接调用tinydb的接口
+type kvService struct {
+	db *tinydb.Database
+}
+
+// 服务的名称
+const grpcServiceName = "tinydb.KV"
+
+// 手写的服务描述，等价于以下的proto定义：
+//
+//	service KV {
+//	  rpc Get(GetRequest) returns (GetResponse);
+//	  rpc Put(PutRequest) returns (PutResponse);
+//	  rpc Delete(DeleteRequest) returns (DeleteResponse);
+//	  rpc Scan(ScanRequest) returns (stream Item);
+//	}
+var kvServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Get", Handler: unaryHandler(func(s *kvService, ctx context.Context, req *GetRequest) (*GetResponse, error) {
+			value, ok, err := GetValue(ctx, s.db, req.Key)
+			if err != nil {
+				return nil, status.FromContextError(err).Err()
+			}
+			return &GetResponse{Found: ok, Value: value}, nil
+		})},
+		{MethodName: "Put", Handler: unaryHandler(func(s *kvService, ctx context.Context, req *PutRequest) (*PutResponse, error) {
+			if !json.Valid(req.Value) {
+				return nil, status.Error(codes.InvalidArgument, "value is not valid json")
+			}
+			if s.db.ReadOnly() {
+				return nil, status.Error(codes.FailedPrecondition, "database is read only")
+			}
+			if err := SetValue(ctx, s.db, req.Key, req.Value); err != nil {
+				return nil, status.FromContextError(err).Err()
+			}
+			return &PutResponse{}, nil
+		})},
+		{MethodName: "Delete", Handler: unaryHandler(func(s *kvService, ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+			if s.db.ReadOnly() {
+				return nil, status.Error(codes.FailedPrecondition, "database is read only")
+			}
+			found, err := DeleteValue(ctx, s.db, req.Key)
+			if err != nil {
+				return nil, status.FromContextError(err).Err()
+			}
+			return &DeleteResponse{Found: found}, nil
+		})},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Scan", Handler: scanHandler, ServerStreams: true},
+	},
+}
+
+// 将一个普通的函数包装成gRPC的一元方法处理函数
+func unaryHandler[Req, Resp any](fn func(*kvService, context.Context, *Req) (*Resp, error)) grpc.MethodHandler {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		handler := func(ctx context.Context, req any) (any, error) {
+			return fn(srv.(*kvService), ctx, req.(*Req))
+		}
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv}, handler)
+	}
+}
+
+// Scan方法，按照key的顺序把元素逐个发送给客户端
+func scanHandler(srv any, stream grpc.ServerStream) error {
+	var req ScanRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	var sendErr error
+	_, err := scanItems(srv.(*kvService).db, req.Prefix, req.Start, limit, func(item Item) bool {
+		if sendErr = stream.Context().Err(); sendErr != nil {
+			return false
+		}
+		sendErr = stream.SendMsg(&item)
+		return sendErr == nil
+	})
+	if sendErr != nil {
+		return status.FromContextError(sendErr).Err()
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// 在gRPC服务器上注册tinydb.KV服务
+func RegisterGRPC(s *grpc.Server, db *tinydb.Database) {
+	s.RegisterService(&kvServiceDesc, &kvService{db: db})
+}
+
+// 为没有截止时间的请求设置默认的超时时间，并在超时之后返回DeadlineExceeded
+func TimeoutInterceptor(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if _, ok := ctx.Deadline(); !ok && timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		resp, err := handler(ctx, req)
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		return resp, err
+	}
+}
+
+// tinydb.KV服务的客户端
+type GRPCClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGRPCClient(cc grpc.ClientConnInterface) *GRPCClient {
+	return &GRPCClient{cc: cc}
+}
+
+// 调用方法时使用json编码
+var jsonCallOption = grpc.CallContentSubtype(grpcCodecName)
+
+func (c *GRPCClient) Get(ctx context.Context, key string) (json.RawMessage, bool, error) {
+	var resp GetResponse
+	err := c.cc.Invoke(ctx, "/"+grpcServiceName+"/Get", &GetRequest{Key: key}, &resp, jsonCallOption)
+	return resp.Value, resp.Found, err
+}
+
+func (c *GRPCClient) Put(ctx context.Context, key string, value json.RawMessage) error {
+	return c.cc.Invoke(ctx, "/"+grpcServiceName+"/Put", &PutRequest{Key: key, Value: value}, &PutResponse{}, jsonCallOption)
+}
+
+func (c *GRPCClient) Delete(ctx context.Context, key string) (bool, error) {
+	var resp DeleteResponse
+	err := c.cc.Invoke(ctx, "/"+grpcServiceName+"/Delete", &DeleteRequest{Key: key}, &resp, jsonCallOption)
+	return resp.Found, err
+}
+
+// 遍历数据，fn返回false时停止
+func (c *GRPCClient) Scan(ctx context.Context, req ScanRequest, fn func(Item) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.cc.NewStream(ctx, &kvServiceDesc.Streams[0], "/"+grpcServiceName+"/Scan", jsonCallOption)
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&req); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		var item Item
+		if err := stream.RecvMsg(&item); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if !fn(item) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"tinydb"
+)
+
+// 一次遍历默认以及最多返回的元素数量
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 10000
+)
+
+// 请求体的大小上限
+const maxBodySize = 32 * 1024 * 1024
+
+// 遍历结果中的一个元素
+type Item struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// 一页遍历结果，Next不为空时表示还有更多的数据，作为下一次请求的start
+type ScanResult struct {
+	Items []Item `json:"items"`
+	Next  string `json:"next,omitempty"`
+}
+
+// 批量请求中的一个操作，Op为get、put或者delete
+type BatchOp struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// 批量请求中一个操作的结果
+// get返回是否存在以及对应的值，delete返回删除之前是否存在，put没有返回值
+type BatchResult struct {
+	Key   string          `json:"key"`
+	Found bool            `json:"found"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// POST /batch的请求体和回复
+type BatchRequest struct {
+	Ops []BatchOp `json:"ops"`
+}
+
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// 按照key的顺序遍历以prefix开头并且大于等于start的元素，最多返回limit个，跳过已经过期的元素
+func scanItems(db *tinydb.Database, prefix, start string, limit int, fn func(Item) bool) (string, error) {
+	if start < prefix {
+		start = prefix
+	}
+	it := db.NewIterator(start, "")
+	defer it.Close()
+
+	for count := 0; it.Valid() && strings.HasPrefix(it.Key(), prefix); it.Next() {
+		if count == limit {
+			return it.Key(), it.Err()
+		}
+		value, live := LiveValue(it.Value())
+		if !live {
+			continue
+		}
+		if !fn(Item{Key: it.Key(), Value: value}) {
+			return "", it.Err()
+		}
+		count++
+	}
+	return "", it.Err()
+}
+
+// 使用json对外提供tinydb接口的http处理器
+//
+//	GET    /kv/{key}                        获取值
+//	PUT    /kv/{key}                        写入值，请求体必须是json
+//	DELETE /kv/{key}                        删除值，不存在时返回404
+//	GET    /kv?prefix=&start=&limit=        按照key的顺序遍历
+//	POST   /batch                           按照顺序执行一组操作，写入原子地生效
+//
+// 每个请求的处理时间超过timeout时返回503，timeout为0表示不限制
+func NewHTTPHandler(db *tinydb.Database, timeout time.Duration) http.Handler {
+	h := &httpHandler{db: db}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /kv/{key}", h.get)
+	mux.HandleFunc("PUT /kv/{key}", h.put)
+	mux.HandleFunc("DELETE /kv/{key}", h.delete)
+	mux.HandleFunc("GET /kv", h.scan)
+	mux.HandleFunc("POST /batch", h.batch)
+	if timeout <= 0 {
+		return mux
+	}
+	return http.TimeoutHandler(mux, timeout, `{"error":"request timeout"}`)
+}
+
+type httpHandler struct {
+	db *tinydb.Database
+}
+
+func (h *httpHandler) get(w http.ResponseWriter, r *http.Request) {
+	value, ok, err := GetValue(r.Context(), h.db, r.PathValue("key"))
+	if err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(value)
+}
+
+func (h *httpHandler) put(w http.ResponseWriter, r *http.Request) {
+	if h.readOnly(w) {
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	if !json.Valid(body) {
+		writeError(w, http.StatusBadRequest, "body is not valid json")
+		return
+	}
+	if err := SetValue(r.Context(), h.db, r.PathValue("key"), body); err != nil {
+		writeError(w, errorStatus(err), "failed to set value: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *httpHandler) delete(w http.ResponseWriter, r *http.Request) {
+	if h.readOnly(w) {
+		return
+	}
+	found, err := DeleteValue(r.Context(), h.db, r.PathValue("key"))
+	if err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *httpHandler) scan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultScanLimit
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxScanLimit {
+			writeError(w, http.StatusBadRequest, "limit must be in [1,"+strconv.Itoa(maxScanLimit)+"]")
+			return
+		}
+		limit = n
+	}
+	result := ScanResult{Items: make([]Item, 0)}
+	next, err := scanItems(h.db, query.Get("prefix"), query.Get("start"), limit, func(item Item) bool {
+		//请求超时之后停止遍历
+		if r.Context().Err() != nil {
+			return false
+		}
+		result.Items = append(result.Items, item)
+		return true
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	result.Next = next
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (h *httpHandler) batch(w http.ResponseWriter, r *http.Request) {
+	var req BatchRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	//先检查所有操作，避免执行到一半才发现错误
+	for _, op := range req.Ops {
+		if err := op.Check(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if op.Op != "get" && h.readOnly(w) {
+			return
+		}
+	}
+	results, err := ApplyBatch(r.Context(), h.db, req.Ops)
+	if err != nil {
+		writeError(w, errorStatus(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, BatchResponse{Results: results})
+}
+
+// 检查操作是否合法
+func (op *BatchOp) Check() error {
+	switch op.Op {
+	case "get", "delete":
+	case "put":
+		if !json.Valid(op.Value) {
+			return errors.New("put " + strconv.Quote(op.Key) + ": value is not valid json")
+		}
+	default:
+		return errors.New("unknown op " + strconv.Quote(op.Op))
+	}
+	return nil
+}
+
+// 在数据库db的默认列族上按照顺序执行一组已经检查过的操作
+// 所有的写入最后作为一个WriteBatch原子地写入，任何一步出错或者ctx结束时不会写入任何操作
+// 读取可以看到同一批中之前的写入，delete返回的是否存在也包含之前的写入
+// 执行期间持有所有前端共用的写锁，其他前端的写入不会插入到这一批操作之间
+func ApplyBatch(ctx context.Context, db *tinydb.Database, ops []BatchOp) ([]BatchResult, error) {
+	lock := db.UpdateLock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	batch := &tinydb.WriteBatch{}
+	//这一批中已经写入的值，nil表示已经被删除
+	pending := make(map[string]json.RawMessage)
+	results := make([]BatchResult, 0, len(ops))
+	for _, op := range ops {
+		result := BatchResult{Key: op.Key}
+		switch op.Op {
+		case "get", "delete":
+			value, ok := pending[op.Key]
+			if ok {
+				ok = value != nil
+			} else {
+				var err error
+				value, ok, err = GetValue(ctx, db, op.Key)
+				if err != nil {
+					return nil, err
+				}
+			}
+			result.Found = ok
+			if op.Op == "get" {
+				result.Value = value
+			} else {
+				batch.Delete(db.ColumnFamily, op.Key)
+				pending[op.Key] = nil
+			}
+		case "put":
+			if err := batch.Set(db.ColumnFamily, op.Key, entry{Value: op.Value}.encode()); err != nil {
+				return nil, err
+			}
+			pending[op.Key] = op.Value
+		}
+		results = append(results, result)
+	}
+	if err := db.WriteContext(ctx, batch); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// 请求被取消或者超时时返回503，其他错误返回500
+func errorStatus(err error) int {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// 数据库只读时拒绝修改数据的请求
+func (h *httpHandler) readOnly(w http.ResponseWriter) bool {
+	if !h.db.ReadOnly() {
+		return false
+	}
+	writeError(w, http.StatusForbidden, "database is read only")
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
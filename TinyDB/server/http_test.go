@@ -0,0 +1,101 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"tinydb/server"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	ts := httptest.NewServer(server.NewHTTPHandler(openDB(t), time.Second))
+	defer ts.Close()
+
+	do := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(data))
+	}
+
+	cases := []struct {
+		method, path, body string
+		status             int
+		reply              string
+	}{
+		{"PUT", "/kv/http:a", `{"n":1}`, 204, ""},
+		{"PUT", "/kv/http:b", `"two"`, 204, ""},
+		{"PUT", "/kv/http:c", `not json`, 400, `{"error":"body is not valid json"}`},
+		{"GET", "/kv/http:a", "", 200, `{"n":1}`},
+		{"GET", "/kv/http:c", "", 404, `{"error":"key not found"}`},
+		{"GET", "/kv?prefix=http:&limit=1", "", 200, `{"items":[{"key":"http:a","value":{"n":1}}],"next":"http:b"}`},
+		{"GET", "/kv?prefix=http:&start=http:b", "", 200, `{"items":[{"key":"http:b","value":"two"}]}`},
+		{"POST", "/batch", `{"ops":[{"op":"put","key":"http:c","value":3},{"op":"delete","key":"http:a"},{"op":"get","key":"http:a"}]}`,
+			200, `{"results":[{"key":"http:c","found":false},{"key":"http:a","found":true},{"key":"http:a","found":false}]}`},
+		{"DELETE", "/kv/http:a", "", 404, `{"error":"key not found"}`},
+		{"GET", "/kv/http:c", "", 200, `3`},
+	}
+	for _, c := range cases {
+		status, reply := do(c.method, c.path, c.body)
+		if status != c.status || reply != c.reply {
+			t.Fatalf("%s %s: got %d %s, want %d %s", c.method, c.path, status, reply, c.status, c.reply)
+		}
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(server.TimeoutInterceptor(time.Second)))
+	server.RegisterGRPC(srv, openDB(t))
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	client := server.NewGRPCClient(cc)
+	ctx := context.Background()
+
+	for _, key := range []string{"grpc:1", "grpc:2", "grpc:3"} {
+		if err := client.Put(ctx, key, json.RawMessage(`"`+key+`"`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Put(ctx, "grpc:4", json.RawMessage(`{`)); err == nil {
+		t.Fatal("invalid json should be rejected")
+	}
+	value, found, err := client.Get(ctx, "grpc:2")
+	if err != nil || !found || string(value) != `"grpc:2"` {
+		t.Fatalf("get: %s %v %v", value, found, err)
+	}
+	if found, err := client.Delete(ctx, "grpc:2"); err != nil || !found {
+		t.Fatalf("delete: %v %v", found, err)
+	}
+
+	keys := make([]string, 0)
+	err = client.Scan(ctx, server.ScanRequest{Prefix: "grpc:"}, func(item server.Item) bool {
+		keys = append(keys, item.Key)
+		return true
+	})
+	if err != nil || strings.Join(keys, ",") != "grpc:1,grpc:3" {
+		t.Fatalf("scan: %v %v", keys, err)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// 协议中单个参数以及参数数量的上限，防止恶意的请求占用过多内存
+const (
+	maxBulkLen = 512 * 1024 * 1024
+	maxArgs    = 1024 * 1024
+	//内联命令一行的最大长度
+	maxInlineLen = 64 * 1024
+)
+
+// 客户端发送的数据不符合RESP协议，需要断开连接
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// 读取一条命令，支持RESP数组格式以及telnet使用的内联格式
+// 空行返回长度为0的命令
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		//内联命令，按照空白切分
+		if len(line) > maxInlineLen {
+			return nil, protocolError("too big inline request")
+		}
+		return bytes.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+	args := make([][]byte, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%s'", line[:min(len(line), 1)]))
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, protocolError("invalid bulk length")
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, protocolError("bulk string is not terminated by CRLF")
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// 读取一行，去掉结尾的\r\n
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, protocolError("line too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+	//ReadSlice返回的切片在下一次读取时会被覆盖
+	return append([]byte(nil), line...), nil
+}
+
+// 按照RESP2协议写入回复
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w respWriter) simpleString(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w respWriter) error(s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func (w respWriter) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+// 写入二进制安全的字符串，nil表示不存在
+func (w respWriter) bulk(b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+// 写入数组的长度，之后需要依次写入n个元素
+func (w respWriter) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
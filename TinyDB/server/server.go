@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tinydb"
+	"tinydb/config"
+)
+
+// 使用Redis RESP2协议对外提供tinydb的服务器
+// redis-cli以及其他Redis客户端可以直接连接
+type Server struct {
+	db *tinydb.Database
+	//读取之后再写入的命令需要串行执行，例如SET NX、INCR，与其他前端共用数据库的UpdateLock
+	writeLock *sync.Mutex
+	//SCAN命令的游标
+	cursors *cursorTable
+
+	lock      sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+
+	//统计信息
+	started     time.Time
+	totalConns  atomic.Int64
+	totalCmds   atomic.Int64
+	activeConns atomic.Int64
+}
+
+// 服务器已经被关闭
+var ErrServerClosed = errors.New("tinydb: server closed")
+
+// 创建一个基于数据库db的服务器
+func New(db *tinydb.Database) *Server {
+	return &Server{
+		db:        db,
+		writeLock: db.UpdateLock(),
+		cursors:   newCursorTable(),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		started:   time.Now(),
+	}
+}
+
+// 监听addr并处理连接，直到服务器被关闭
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// 在l上接收连接，每一个连接使用一个goroutine处理
+// 服务器关闭之后返回ErrServerClosed
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.lock.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// 记录新的连接，服务器已经关闭时返回false
+func (s *Server) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.totalConns.Add(1)
+	s.activeConns.Add(1)
+	return true
+}
+
+// 关闭所有监听和连接，等待正在执行的命令完成之后返回
+func (s *Server) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// 处理一个连接上的所有命令
+// 客户端可以连续发送多条命令（pipeline），所有已经读取到的命令执行完之后再一次性发送回复
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+		s.activeConns.Add(-1)
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := respWriter{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				w.error("ERR " + perr.Error())
+				w.Flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				config.GetConfig().GetLogger().Warn("failed to read the command", "remote", conn.RemoteAddr().String(), "error", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		s.totalCmds.Add(1)
+		quit := s.execute(w, args)
+		//缓冲区中没有更多的命令时才发送回复
+		if quit || r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// 执行一条命令，返回是否需要关闭连接
+func (s *Server) execute(w respWriter, args [][]byte) bool {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		w.error("ERR unknown command '" + string(args[0]) + "', with args beginning with: " + formatArgs(args[1:]))
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		w.error("ERR wrong number of arguments for '" + name + "' command")
+		return false
+	}
+	if name == "quit" {
+		w.simpleString("OK")
+		return true
+	}
+	if writeCommands[name] && s.db.ReadOnly() {
+		w.error("READONLY You can't write against a read only replica.")
+		return false
+	}
+	cmd.handler(s, w, args[1:])
+	return false
+}
+
+// 按照Redis的格式打印参数，用于错误信息
+func formatArgs(args [][]byte) string {
+	var b strings.Builder
+	for _, arg := range args {
+		b.WriteString("'" + string(arg) + "' ")
+	}
+	return b.String()
+}
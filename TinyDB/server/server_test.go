@@ -0,0 +1,275 @@
+package server_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"tinydb"
+	"tinydb/config"
+	"tinydb/server"
+)
+
+// 读取一条回复，数组展开为用空格分隔的字符串，不存在的值为(nil)
+func readReply(t *testing.T, r *bufio.Reader) string {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', '-', ':':
+		return line
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]string, n)
+		for i := range items {
+			items[i] = readReply(t, r)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	t.Fatalf("unexpected reply %q", line)
+	return ""
+}
+
+// 将命令编码成RESP数组
+func encode(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// 每个测试使用一个新的数据库，测试结束时关闭
+func openDB(t *testing.T) *tinydb.Database {
+	db, err := tinydb.Open(config.Config{
+		DataDir:    t.TempDir(),
+		Level0Size: 10,
+		PerSize:    10,
+		Threshold:  10000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestServer(t *testing.T) {
+	srv := server.New(openDB(t))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// 一次发送所有命令，回复按照顺序返回
+	cases := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"SET", "user:1", "a\r\nb"}, "+OK"},
+		{[]string{"GET", "user:1"}, "a\r\nb"},
+		{[]string{"SET", "user:1", "x", "NX"}, "(nil)"},
+		{[]string{"SET", "user:9", "x", "XX"}, "(nil)"},
+		{[]string{"MSET", "user:2", "b", "user:3", "c", "other", "d"}, "+OK"},
+		{[]string{"MGET", "user:1", "nothere", "user:3"}, "[a\r\nb (nil) c]"},
+		{[]string{"INCR", "counter"}, ":1"},
+		{[]string{"INCR", "counter"}, ":2"},
+		{[]string{"INCR", "user:2"}, "-ERR value is not an integer or out of range"},
+		{[]string{"EXISTS", "user:1", "user:2", "nothere"}, ":2"},
+		{[]string{"DEL", "user:2", "nothere"}, ":1"},
+		{[]string{"SCAN", "0", "MATCH", "user:*", "COUNT", "100"}, "[0 [user:1 user:3]]"},
+		{[]string{"SET", "temp", "v", "PX", "50"}, "+OK"},
+		{[]string{"GET", "temp"}, "v"},
+		{[]string{"FOO"}, "-ERR unknown command 'FOO', with args beginning with: "},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+	}
+	var batch strings.Builder
+	for _, c := range cases {
+		batch.WriteString(encode(c.args...))
+	}
+	if _, err := conn.Write([]byte(batch.String())); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		if reply := readReply(t, r); reply != c.reply {
+			t.Fatalf("%v: got %q, want %q", c.args, reply, c.reply)
+		}
+	}
+
+	// 过期之后的值不可见
+	time.Sleep(100 * time.Millisecond)
+	conn.Write([]byte(encode("GET", "temp")))
+	if reply := readReply(t, r); reply != "(nil)" {
+		t.Fatalf("expired key: got %q", reply)
+	}
+
+	// 使用游标分多次遍历
+	keys := make([]string, 0)
+	cursor := "0"
+	for {
+		conn.Write([]byte(encode("SCAN", cursor, "MATCH", "user:*", "COUNT", "1")))
+		reply := strings.Trim(readReply(t, r), "[]")
+		fields := strings.Fields(strings.ReplaceAll(reply, "[", ""))
+		cursor = fields[0]
+		keys = append(keys, fields[1:]...)
+		if cursor == "0" {
+			break
+		}
+	}
+	if strings.Join(keys, " ") != "user:1 user:3" {
+		t.Fatalf("scan with cursor: got %v", keys)
+	}
+
+	// 内联命令
+	conn.Write([]byte("ECHO hello\r\n"))
+	if reply := readReply(t, r); reply != "hello" {
+		t.Fatalf("inline command: got %q", reply)
+	}
+}
+
+// RESP和http前端读写同一种编码的值
+func TestSharedEncoding(t *testing.T) {
+	db := openDB(t)
+	srv := server.New(db)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	ts := httptest.NewServer(server.NewHTTPHandler(db, 0))
+	defer ts.Close()
+
+	resp := func(args ...string) string {
+		conn.Write([]byte(encode(args...)))
+		return readReply(t, r)
+	}
+	get := func(key string) string {
+		res, err := http.Get(ts.URL + "/kv/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		return strings.TrimSpace(string(data))
+	}
+	put := func(key, body string) {
+		req, _ := http.NewRequest("PUT", ts.URL+"/kv/"+key, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	resp("SET", "s", "hello")
+	if value := get("s"); value != `"hello"` {
+		t.Errorf("http get of a RESP value: got %s", value)
+	}
+	put("n", `41`)
+	if reply := resp("INCR", "n"); reply != ":42" {
+		t.Errorf("INCR of an http value: got %q", reply)
+	}
+	put("j", `{"a":1}`)
+	if reply := resp("GET", "j"); reply != `{"a":1}` {
+		t.Errorf("RESP get of an http value: got %q", reply)
+	}
+	//与过期时间的包装形式相同的json按照原样读回，不会被当作已经过期的值
+	for _, value := range []string{`{"v":1,"e":1}`, `{"v":1,"e":0}`} {
+		put("w", value)
+		if got := get("w"); got != value {
+			t.Errorf("http get of %s: got %s", value, got)
+		}
+		if reply := resp("GET", "w"); reply != value {
+			t.Errorf("RESP get of %s: got %q", value, reply)
+		}
+	}
+	resp("SET", "temp", "v", "PX", "50")
+	if value := get("temp"); value != `"v"` {
+		t.Errorf("http get of a value with ttl: got %s", value)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if value := get("temp"); value != `{"error":"key not found"}` {
+		t.Errorf("http get of an expired value: got %s", value)
+	}
+	if reply := resp("SET", "bin", "\xff"); !strings.HasPrefix(reply, "-ERR") {
+		t.Errorf("SET of invalid UTF-8: got %q", reply)
+	}
+}
+
+// MSET的所有值作为一次批量写入，有一个值不能写入时都不写入
+func TestMSetIsOneBatch(t *testing.T) {
+	db := openDB(t)
+	srv := server.New(db)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	resp := func(args ...string) string {
+		conn.Write([]byte(encode(args...)))
+		return readReply(t, r)
+	}
+
+	if reply := resp("MSET", "a", "1", "b", "2", "c", "3"); reply != "+OK" {
+		t.Fatalf("MSET: got %q", reply)
+	}
+	if stats := db.Stats(); stats.Batches != 1 || stats.Sets != 3 {
+		t.Errorf("MSET wrote %d batches and %d sets, want 1 batch of 3", stats.Batches, stats.Sets)
+	}
+	if reply := resp("MSET", "a", "x", "bin", "\xff"); !strings.HasPrefix(reply, "-ERR") {
+		t.Errorf("MSET of invalid UTF-8: got %q", reply)
+	}
+	if reply := resp("MGET", "a", "b", "c", "bin"); reply != "[1 2 3 (nil)]" {
+		t.Errorf("MGET after a failed MSET: got %q", reply)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+	"tinydb"
+	"unicode/utf8"
+)
+
+// 所有前端共用同一种值的编码，tinydb中保存的值总是json：
+// http、gRPC以及嵌入式客户端写入的json按照原样保存，RESP写入的字节串保存为json字符串，
+// 设置了过期时间的值保存为{"v":值,"e":过期时间}，读取时所有前端都会跳过已经过期的值
+// 用户写入的json本身可以被解析为这种包装时也会被包装，e为0，读取时不会与过期时间混淆
+type entry struct {
+	Value json.RawMessage `json:"v"`
+	//过期时间，为Unix毫秒时间戳，0表示不过期
+	ExpireAt int64 `json:"e"`
+}
+
+// RESP写入的值不是合法的UTF-8，无法保存为json字符串
+var errInvalidUTF8 = errors.New("value is not valid UTF-8")
+
+// 将raw解析为包装，只有v和e两个字段并且都存在时才是包装
+func unwrap(raw []byte) (entry, bool) {
+	var w struct {
+		Value    json.RawMessage `json:"v"`
+		ExpireAt *int64          `json:"e"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&w); err != nil || w.Value == nil || w.ExpireAt == nil {
+		return entry{}, false
+	}
+	return entry{Value: w.Value, ExpireAt: *w.ExpireAt}, true
+}
+
+// 解析tinydb中保存的值，没有包装的值按照原样返回
+func decodeEntry(raw []byte) entry {
+	if e, ok := unwrap(raw); ok {
+		return e
+	}
+	return entry{Value: raw}
+}
+
+// 编码成tinydb中保存的值，设置了过期时间的值以及看起来像包装的值需要包装
+func (e entry) encode() json.RawMessage {
+	if _, ok := unwrap(e.Value); e.ExpireAt == 0 && !ok {
+		return e.Value
+	}
+	data, _ := json.Marshal(e)
+	return data
+}
+
+// 是否已经过期
+func (e entry) expired(now time.Time) bool {
+	return e.ExpireAt != 0 && e.ExpireAt <= now.UnixMilli()
+}
+
+// 将RESP的字节串转换为json字符串
+func fromRESP(value []byte) (json.RawMessage, error) {
+	if !utf8.Valid(value) {
+		return nil, errInvalidUTF8
+	}
+	return json.Marshal(string(value))
+}
+
+// 将json转换为RESP的字节串，json字符串返回其内容，其他的json按照原样返回
+func toRESP(value json.RawMessage) []byte {
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		return []byte(s)
+	}
+	return value
+}
+
+// 解析tinydb中保存的值，返回其中的json以及是否没有过期
+func LiveValue(raw []byte) (json.RawMessage, bool) {
+	e := decodeEntry(raw)
+	if e.expired(time.Now()) {
+		return nil, false
+	}
+	return e.Value, true
+}
+
+// 读取key对应的json值，已经过期的值不存在
+func GetValue(ctx context.Context, db *tinydb.Database, key string) (json.RawMessage, bool, error) {
+	raw, ok, err := tinydb.GetCFContext[json.RawMessage](ctx, db.ColumnFamily, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	value, ok := LiveValue(raw)
+	return value, ok, nil
+}
+
+// 写入json值，之前的过期时间被清除
+func SetValue(ctx context.Context, db *tinydb.Database, key string, value json.RawMessage) error {
+	lock := db.UpdateLock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	return tinydb.SetCFContext(ctx, db.ColumnFamily, key, entry{Value: value}.encode())
+}
+
+// 删除key，返回删除之前是否存在并且没有过期
+func DeleteValue(ctx context.Context, db *tinydb.Database, key string) (bool, error) {
+	lock := db.UpdateLock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	raw, found, err := tinydb.GetCFContext[json.RawMessage](ctx, db.ColumnFamily, key)
+	if err != nil || !found {
+		return false, err
+	}
+	if _, err := tinydb.DeleteCFContext[json.RawMessage](ctx, db.ColumnFamily, key); err != nil {
+		return false, err
+	}
+	_, live := LiveValue(raw)
+	return live, nil
+}
@@ -0,0 +1,85 @@
+package shard
+
+import (
+	"context"
+	"encoding/json"
+	"tinydb"
+	"tinydb/config"
+	"tinydb/kv"
+)
+
+// 内存表中kv的默认最大数量
+const defaultThreshold = 1000
+
+// 后台检查内存表和sstable的默认时间间隔，为秒
+const defaultCheckInterval = 1
+
+// 一个key范围对应的存储实例，是一个拥有独立数据目录的tinydb数据库
+// 写入先记录日志再写入内存表，数据库的后台任务负责持久化和压缩
+type instance struct {
+	dir string
+	con config.Config
+	db  *tinydb.Database
+}
+
+// 打开目录dir中的实例，回放日志并将内存表持久化
+func openInstance(dir string, con config.Config) (*instance, error) {
+	if con.Threshold <= 0 {
+		con.Threshold = defaultThreshold
+	}
+	if con.CheckInterval <= 0 {
+		con.CheckInterval = defaultCheckInterval
+	}
+	con.DataDir = dir
+	db, err := tinydb.Open(con)
+	if err != nil {
+		return nil, err
+	}
+	return &instance{dir: dir, con: con, db: db}, nil
+}
+
+// 读取key对应的值
+func (in *instance) get(key string) (json.RawMessage, bool) {
+	return tinydb.GetCF[json.RawMessage](in.db.ColumnFamily, key)
+}
+
+// 将一组修改作为一条日志写入，再写入内存表
+func (in *instance) write(values ...kv.Value) error {
+	batch := &tinydb.WriteBatch{}
+	for _, value := range values {
+		if value.Delete {
+			batch.Delete(in.db.ColumnFamily, value.Key)
+		} else if err := batch.Set(in.db.ColumnFamily, value.Key, json.RawMessage(value.Value)); err != nil {
+			return err
+		}
+	}
+	return in.db.Write(batch)
+}
+
+// 删除key，返回删除之前是否存在
+func (in *instance) delete(key string) (bool, error) {
+	return tinydb.DeleteCFContext[json.RawMessage](context.Background(), in.db.ColumnFamily, key)
+}
+
+// 创建一个遍历[start,end)的迭代器，end为空表示没有上界
+func (in *instance) iterator(start, end string) *tinydb.Iterator {
+	return in.db.NewIterator(start, end)
+}
+
+// 开始迁移，先将内存表持久化并暂停后台任务，之后的写入只保存在内存表和日志中
+func (in *instance) beginMove() {
+	in.db.PauseBackgroundWork()
+	in.db.Flush()
+}
+
+// 迁移失败，恢复内存表的持久化
+func (in *instance) abortMove() {
+	in.db.ContinueBackgroundWork()
+}
+
+// 关闭日志和所有sstable文件
+func (in *instance) close() {
+	if err := in.db.Close(); err != nil {
+		in.con.GetLogger().Error("shard: failed to close the instance", "file", in.dir, "error", err)
+	}
+}
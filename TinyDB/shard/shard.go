@@ -0,0 +1,287 @@
+package shard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"tinydb/config"
+	"tinydb/kv"
+)
+
+// 记录所有范围的清单文件，以及实例目录的前缀
+const (
+	manifestName = "ranges.json"
+	rangePrefix  = "range-"
+)
+
+// 每次遍历时在持有读锁的情况下最多读取的数据量
+const scanBatch = 1000
+
+var (
+	//Store已经关闭
+	ErrClosed = errors.New("shard: store closed")
+	//拆分的位置已经是范围的边界
+	ErrBoundaryExists = errors.New("shard: the key is already a range boundary")
+	//合并的位置不是范围的边界
+	ErrNotBoundary = errors.New("shard: the key is not a range boundary")
+)
+
+// 一个key范围，包含Start但不包含End，End为空表示没有上界
+type Range struct {
+	Start string
+	End   string
+	//实例的数据目录，相对于Store的目录
+	Dir string
+}
+
+// 是否包含key
+func (r Range) Contains(key string) bool {
+	return key >= r.Start && (r.End == "" || key < r.End)
+}
+
+// 清单文件的内容
+type manifest struct {
+	//下一个实例目录的编号
+	NextID int
+	Ranges []Range
+}
+
+// 一个范围以及对应的实例
+type shard struct {
+	Range
+	inst *instance
+}
+
+// 按照key范围分区的存储，每个范围由一个独立的实例保存在自己的目录中
+// 范围之间没有空隙也没有重叠，第一个范围从空字符串开始，最后一个范围没有上界
+// 读写操作持有读锁，拆分和合并只在最后切换范围时持有写锁，期间其他范围和被迁移的范围都可以正常读写
+type Store struct {
+	dir string
+	con config.Config
+	//保护ranges和closed
+	lock   sync.RWMutex
+	ranges []*shard
+	closed bool
+	//同一时间只能有一个拆分或者合并，持有时可以读取ranges
+	changeLock sync.Mutex
+	nextID     int
+}
+
+// 打开目录dir中的存储，第一次打开时只有一个包含所有key的范围
+// 每个实例是一个独立的数据库，使用con作为配置，DataDir会被忽略，Threshold为0时使用1000，CheckInterval为0时使用1秒
+// 没有被清单引用的实例目录来自中断的拆分或者合并，打开时会被删除
+func Open(dir string, con config.Config) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, con: con}
+	m, err := readManifest(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		m = manifest{NextID: 2, Ranges: []Range{{Dir: rangePrefix + "1"}}}
+		err = writeManifest(dir, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.nextID = m.NextID
+	if err := s.removeOrphans(m); err != nil {
+		return nil, err
+	}
+	for _, r := range m.Ranges {
+		inst, err := openInstance(filepath.Join(dir, r.Dir), con)
+		if err != nil {
+			s.closeAll()
+			return nil, err
+		}
+		s.ranges = append(s.ranges, &shard{Range: r, inst: inst})
+	}
+	return s, nil
+}
+
+// 读取清单文件
+func readManifest(dir string) (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("shard: read %s: %w", manifestName, err)
+	}
+	if len(m.Ranges) == 0 || m.Ranges[0].Start != "" || m.Ranges[len(m.Ranges)-1].End != "" {
+		return m, fmt.Errorf("shard: %s does not cover all keys", manifestName)
+	}
+	for i := 1; i < len(m.Ranges); i++ {
+		if m.Ranges[i].Start != m.Ranges[i-1].End {
+			return m, fmt.Errorf("shard: %s has a gap at %q", manifestName, m.Ranges[i-1].End)
+		}
+	}
+	return m, nil
+}
+
+// 先写入临时文件再替换，清单文件的替换是拆分和合并生效的时刻
+func writeManifest(dir string, m manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, manifestName)
+	if err := os.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// 删除没有被清单引用的实例目录
+func (s *Store) removeOrphans(m manifest) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	for _, r := range m.Ranges {
+		live[r.Dir] = true
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), rangePrefix) && !live[entry.Name()] {
+			s.con.GetLogger().Info("shard: removing the unused directory", "file", entry.Name())
+			if err := os.RemoveAll(filepath.Join(s.dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 查找包含key的范围的下标，调用者需要持有锁
+func (s *Store) find(key string) int {
+	return sort.Search(len(s.ranges), func(i int) bool {
+		return s.ranges[i].End == "" || key < s.ranges[i].End
+	})
+}
+
+// 当前所有的范围，按照key的顺序排列
+func (s *Store) Ranges() []Range {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ranges := make([]Range, 0, len(s.ranges))
+	for _, sh := range s.ranges {
+		ranges = append(ranges, sh.Range)
+	}
+	return ranges
+}
+
+// 读取key对应的值
+func (s *Store) Get(key string) (json.RawMessage, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return nil, false
+	}
+	return s.ranges[s.find(key)].inst.get(key)
+}
+
+// 写入key，value必须是合法的json
+func (s *Store) Set(key string, value json.RawMessage) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return s.ranges[s.find(key)].inst.write(kv.Value{Key: key, Value: value})
+}
+
+// 删除key，返回删除之前是否存在
+func (s *Store) Delete(key string) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return false, ErrClosed
+	}
+	return s.ranges[s.find(key)].inst.delete(key)
+}
+
+// 按照key的顺序遍历[start,end)中的所有数据，end为空表示没有上界，fn返回false时停止遍历
+// 每次在持有读锁的时候从一个范围中读取一批数据，调用fn时不持有锁，因此fn中可以读写、拆分或者合并，
+// 遍历不是一个快照，只保证同一批中的数据来自同一时刻
+func (s *Store) Scan(start, end string, fn func(key string, value json.RawMessage) bool) error {
+	cursor := start
+	for end == "" || cursor < end {
+		batch, next, err := s.scanBatch(cursor, end)
+		if err != nil {
+			return err
+		}
+		for _, value := range batch {
+			if !fn(value.Key, value.Value) {
+				return nil
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+	return nil
+}
+
+// 从包含cursor的范围中读取一批数据，返回下一批的起点，为空表示遍历结束
+func (s *Store) scanBatch(cursor, end string) ([]kv.Value, string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return nil, "", ErrClosed
+	}
+	sh := s.ranges[s.find(cursor)]
+	upper := end
+	if sh.End != "" && (upper == "" || sh.End < upper) {
+		upper = sh.End
+	}
+	it := sh.inst.iterator(cursor, upper)
+	defer it.Close()
+
+	batch := make([]kv.Value, 0)
+	for ; it.Valid(); it.Next() {
+		if len(batch) == scanBatch {
+			//下一批从当前key开始
+			return batch, it.Key(), nil
+		}
+		batch = append(batch, kv.Value{Key: it.Key(), Value: it.Value()})
+	}
+	if err := it.Err(); err != nil {
+		return nil, "", err
+	}
+	if upper == end {
+		return batch, "", nil
+	}
+	return batch, upper, nil
+}
+
+// 关闭所有实例，正在进行的拆分或者合并完成之后才会关闭
+func (s *Store) Close() {
+	s.changeLock.Lock()
+	defer s.changeLock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.closeAll()
+}
+
+func (s *Store) closeAll() {
+	for _, sh := range s.ranges {
+		sh.inst.close()
+	}
+}
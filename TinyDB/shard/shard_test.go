@@ -0,0 +1,157 @@
+package shard_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"tinydb/config"
+	"tinydb/shard"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func open(t *testing.T, dir string) *shard.Store {
+	s, err := shard.Open(dir, config.Config{Level0Size: 10, PerSize: 10, Threshold: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func set(t *testing.T, s *shard.Store, key string, value int) {
+	if err := s.Set(key, json.RawMessage(strconv.Itoa(value))); err != nil {
+		t.Fatalf("set %s: %v", key, err)
+	}
+}
+
+// 检查key的值，value为-1表示不存在
+func expect(t *testing.T, s *shard.Store, key string, value int) {
+	t.Helper()
+	data, ok := s.Get(key)
+	if value < 0 {
+		if ok {
+			t.Fatalf("%s: expected missing, got %s", key, data)
+		}
+		return
+	}
+	if !ok || string(data) != strconv.Itoa(value) {
+		t.Fatalf("%s: expected %d, got %s %v", key, value, data, ok)
+	}
+}
+
+func keys(t *testing.T, s *shard.Store, start, end string) []string {
+	var keys []string
+	err := s.Scan(start, end, func(key string, value json.RawMessage) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestSplitAndMerge(t *testing.T) {
+	dir := t.TempDir()
+	s := open(t, dir)
+	for i := 0; i < 300; i++ {
+		set(t, s, fmt.Sprintf("k%03d", i), i)
+	}
+	if found, err := s.Delete("k150"); err != nil || !found {
+		t.Fatalf("delete k150: %v %v", found, err)
+	}
+
+	// 拆分期间被迁移的范围仍然可以写入
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	//第一次写入完成之后再开始拆分
+	started := make(chan struct{})
+	last := 0
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			if last == 0 {
+				close(started)
+			}
+		}()
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := s.Set("k120", json.RawMessage(strconv.Itoa(1000+i))); err != nil {
+				t.Error(err)
+				return
+			}
+			last = 1000 + i
+			if i == 1 {
+				close(started)
+			}
+		}
+	}()
+	<-started
+	for _, key := range []string{"k100", "k200"} {
+		if err := s.Split(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if err := s.Split("k200"); !errors.Is(err, shard.ErrBoundaryExists) {
+		t.Fatalf("split at a boundary: %v", err)
+	}
+	ranges := s.Ranges()
+	if len(ranges) != 3 || ranges[0].End != "k100" || ranges[1].End != "k200" || ranges[2].Start != "k200" {
+		t.Fatalf("unexpected ranges %+v", ranges)
+	}
+	expect(t, s, "k000", 0)
+	expect(t, s, "k120", last)
+	expect(t, s, "k150", -1)
+	expect(t, s, "k299", 299)
+	if got := keys(t, s, "k090", "k210"); len(got) != 119 || got[0] != "k090" || got[118] != "k209" {
+		t.Fatalf("scan across ranges returned %d keys: %v", len(got), got)
+	}
+	if got := keys(t, s, "", ""); len(got) != 299 {
+		t.Fatalf("full scan returned %d keys", len(got))
+	}
+
+	if err := s.Merge("k150"); !errors.Is(err, shard.ErrNotBoundary) {
+		t.Fatalf("merge at a non-boundary: %v", err)
+	}
+	if err := s.Merge("k100"); err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "k050", 5000)
+	ranges = s.Ranges()
+	if len(ranges) != 2 || ranges[0].End != "k200" {
+		t.Fatalf("unexpected ranges after merge %+v", ranges)
+	}
+
+	// 重新打开之后范围和数据保持不变，旧的实例目录已经被删除
+	s.Close()
+	s = open(t, dir)
+	defer s.Close()
+	if got := s.Ranges(); len(got) != 2 || got[0] != ranges[0] || got[1] != ranges[1] {
+		t.Fatalf("ranges after reopen %+v, expected %+v", got, ranges)
+	}
+	expect(t, s, "k050", 5000)
+	expect(t, s, "k120", last)
+	expect(t, s, "k150", -1)
+	expect(t, s, "k250", 250)
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Fatalf("expected the manifest and two instances, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,176 @@
+package shard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"tinydb/kv"
+)
+
+// 在key处拆分包含它的范围，key成为新的边界
+// 原来的实例中的数据按照范围迁移到两个新的实例，迁移完成之后删除原来的实例
+func (s *Store) Split(key string) error {
+	s.changeLock.Lock()
+	defer s.changeLock.Unlock()
+
+	s.lock.RLock()
+	if s.closed {
+		s.lock.RUnlock()
+		return ErrClosed
+	}
+	i := s.find(key)
+	src := s.ranges[i]
+	s.lock.RUnlock()
+	if key == src.Start {
+		return ErrBoundaryExists
+	}
+	return s.rebuild(i, i+1, []Range{
+		{Start: src.Start, End: key, Dir: s.newDir()},
+		{Start: key, End: src.End, Dir: s.newDir()},
+	})
+}
+
+// 删除边界key，将它两侧的范围合并为一个新的实例
+func (s *Store) Merge(key string) error {
+	s.changeLock.Lock()
+	defer s.changeLock.Unlock()
+
+	s.lock.RLock()
+	if s.closed {
+		s.lock.RUnlock()
+		return ErrClosed
+	}
+	i := s.find(key)
+	right := s.ranges[i]
+	var left *shard
+	if i > 0 {
+		left = s.ranges[i-1]
+	}
+	s.lock.RUnlock()
+	if left == nil || key != right.Start {
+		return ErrNotBoundary
+	}
+	return s.rebuild(i-1, i+1, []Range{{Start: left.Start, End: right.End, Dir: s.newDir()}})
+}
+
+// 分配一个新的实例目录，调用者需要持有changeLock
+func (s *Store) newDir() string {
+	dir := fmt.Sprintf("%s%d", rangePrefix, s.nextID)
+	s.nextID++
+	return dir
+}
+
+// 用targets中的新实例替换ranges[from:to]，targets正好覆盖被替换的范围，调用者需要持有changeLock
+// 1.原来的实例持久化内存表并停止持久化，之后的写入只保存在内存表中
+// 2.不持有锁，将原来实例的sstable中的数据按照范围写入新实例的sstable
+// 3.持有写锁，将原来实例的内存表写入新实例，更新清单文件并切换范围
+// 清单文件替换之前失败时删除新的实例，原来的实例不受影响
+func (s *Store) rebuild(from, to int, targets []Range) error {
+	sources := s.ranges[from:to]
+	dsts := make([]*shard, 0, len(targets))
+	abort := func(err error) error {
+		for _, dst := range dsts {
+			dst.inst.close()
+			os.RemoveAll(dst.inst.dir)
+		}
+		for _, src := range sources {
+			src.inst.abortMove()
+		}
+		return err
+	}
+	for _, r := range targets {
+		dir := filepath.Join(s.dir, r.Dir)
+		os.RemoveAll(dir)
+		inst, err := openInstance(dir, s.con)
+		if err != nil {
+			return abort(err)
+		}
+		dsts = append(dsts, &shard{Range: r, inst: inst})
+	}
+
+	for _, src := range sources {
+		src.inst.beginMove()
+	}
+	for _, src := range sources {
+		for _, dst := range dsts {
+			if err := streamTables(src, dst); err != nil {
+				return abort(err)
+			}
+		}
+	}
+	for _, dst := range dsts {
+		dst.inst.db.TableTree.Check()
+	}
+
+	s.lock.Lock()
+	//持有写锁时没有正在进行的写入，内存表中是开始迁移之后的所有修改，删除标记也需要写入
+	for _, src := range sources {
+		for _, value := range src.inst.db.MemoryTree.GetValue() {
+			for _, dst := range dsts {
+				if !dst.Contains(value.Key) {
+					continue
+				}
+				if err := dst.inst.write(value); err != nil {
+					s.lock.Unlock()
+					return abort(err)
+				}
+			}
+		}
+	}
+	ranges := make([]*shard, 0, len(s.ranges)-len(sources)+len(dsts))
+	ranges = append(ranges, s.ranges[:from]...)
+	ranges = append(ranges, dsts...)
+	ranges = append(ranges, s.ranges[to:]...)
+	m := manifest{NextID: s.nextID}
+	for _, sh := range ranges {
+		m.Ranges = append(m.Ranges, sh.Range)
+	}
+	if err := writeManifest(s.dir, m); err != nil {
+		s.lock.Unlock()
+		return abort(err)
+	}
+	s.ranges = ranges
+	s.lock.Unlock()
+
+	for _, src := range sources {
+		src.inst.close()
+		if err := os.RemoveAll(src.inst.dir); err != nil {
+			s.con.GetLogger().Error("shard: failed to remove the old instance", "file", src.inst.dir, "error", err)
+		}
+	}
+	return nil
+}
+
+// 将src的sstable中属于dst范围的数据写入dst的sstable，每Threshold条数据写入一个文件
+// 目标实例是空的，删除标记不需要写入
+func streamTables(src, dst *shard) error {
+	start := max(src.Start, dst.Start)
+	end := dst.End
+	if end == "" || (src.End != "" && src.End < end) {
+		end = src.End
+	}
+	if end != "" && start >= end {
+		return nil
+	}
+	iters, release := src.inst.db.TableTree.Iterators(start)
+	defer release()
+
+	it := kv.NewMergeIterator(iters)
+	batch := make([]kv.Value, 0, dst.inst.con.Threshold)
+	for ; it.Valid() && (end == "" || it.Value().Key < end); it.Next() {
+		if value := it.Value(); !value.Delete {
+			batch = append(batch, value)
+		}
+		if len(batch) == dst.inst.con.Threshold {
+			dst.inst.db.TableTree.CreateNewTable(batch)
+			batch = make([]kv.Value, 0, dst.inst.con.Threshold)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		dst.inst.db.TableTree.CreateNewTable(batch)
+	}
+	return nil
+}
@@ -177,11 +177,9 @@ func (list *SkipList) GetValues() []kv.Value {
 
 	//将遍历结果存放在切片中
 	values := make([]kv.Value, 0)
-	node := list.header
-	for node != nil {
-		tmp := node.Value
-		values = append(values, tmp)
-		node = node.next[0]
+	//头节点不保存数据
+	for node := list.header.next[0]; node != nil; node = node.next[0] {
+		values = append(values, kv.Value{Key: node.Key, Value: []byte(node.Value)})
 	}
 	return values
 }
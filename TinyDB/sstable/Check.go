@@ -0,0 +1,158 @@
+package sstable
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"tinydb/config"
+	"tinydb/kv"
+)
+
+// 一个sstable文件的检查结果
+type TableCheck struct {
+	//文件路径
+	Path string
+	//索引区中记录的元素数量
+	Keys int
+	//可以正常读取的元素数量
+	Readable int
+	//无法读取的元素的key
+	LostKeys []string
+	//发现的所有问题
+	Errors []string
+}
+
+// 文件是否完好
+func (c *TableCheck) OK() bool {
+	return len(c.Errors) == 0
+}
+
+func (c *TableCheck) addError(format string, args ...any) {
+	c.Errors = append(c.Errors, fmt.Sprintf(format, args...))
+}
+
+// 离线检查一个sstable文件
+// 依次检查文件尾、索引区、数据区的范围、每一个数据块的校验和，
+// 以及数据区中元素的顺序和内容是否与索引区一致
+func CheckTable(path string) TableCheck {
+	_, check := SalvageTable(path)
+	return check
+}
+
+// 读取一个sstable文件中所有可以正常读取的元素，按照key的顺序返回
+// 文件尾或者索引区损坏时无法定位任何元素，返回空的结果
+func SalvageTable(path string) ([]kv.Value, TableCheck) {
+	check := TableCheck{Path: path}
+	values := make([]kv.Value, 0)
+
+	file, err := os.Open(path)
+	if err != nil {
+		check.addError("open: %v", err)
+		return values, check
+	}
+	defer file.Close()
+
+	table := &SSTable{file: file, filepath: path}
+	if err := table.loadMeta(); err != nil {
+		check.addError("%v", err)
+		return values, check
+	}
+	if err := table.loadSparseIndex(); err != nil {
+		check.addError("%v", err)
+		return values, check
+	}
+	check.Keys = len(table.sortIndex)
+
+	//数据区中的元素应该按照key的顺序依次存放
+	var lastStart, lastOffset int64 = -1, -1
+	var block []byte
+	blockStart := int64(-1)
+	for _, key := range table.sortIndex {
+		pos := table.sparseIndex[key]
+		if pos.Start < lastStart || (pos.Start == lastStart && pos.Offset < lastOffset) {
+			check.addError("key %q is out of order in data area", key)
+		}
+		lastStart, lastOffset = pos.Start, pos.Offset
+
+		//同一个数据块只读取一次，损坏的数据块也只报告一次
+		if pos.Start != blockStart {
+			block, err = table.readBlock(pos)
+			blockStart = pos.Start
+			if err != nil {
+				check.addError("block at %d: %v", pos.Start, err)
+				block = nil
+			}
+		}
+		if block == nil {
+			check.LostKeys = append(check.LostKeys, key)
+			continue
+		}
+		data, err := recordInBlock(table, block, pos)
+		if err != nil {
+			check.addError("key %q: %v", key, err)
+			check.LostKeys = append(check.LostKeys, key)
+			continue
+		}
+		value, err := kv.Decode(data)
+		if err != nil {
+			check.addError("key %q: %v", key, err)
+			check.LostKeys = append(check.LostKeys, key)
+			continue
+		}
+		if value.Key != key || value.Delete != pos.Deleted {
+			check.addError("key %q does not match the record %q in data area", key, value.Key)
+			check.LostKeys = append(check.LostKeys, key)
+			continue
+		}
+		check.Readable++
+		values = append(values, value)
+	}
+	return values, check
+}
+
+// 修复一个损坏的sstable文件
+// 将可以读取的元素写入一个新的同名文件，原文件保留为.corrupt
+// path可以是.db文件，也可以是已经被隔离的.db.corrupt文件
+func RepairTable(path string) (TableCheck, error) {
+	values, check := SalvageTable(path)
+	if check.OK() {
+		return check, nil
+	}
+	dbPath := strings.TrimSuffix(path, ".corrupt")
+	level, _, err := getLevel(filepath.Base(dbPath))
+	if err != nil {
+		return check, err
+	}
+	if dbPath != path {
+		//同名的新文件已经存在时，不覆盖
+		if _, err := os.Stat(dbPath); err == nil {
+			return check, fmt.Errorf("%s already exists", dbPath)
+		}
+	} else if err := os.Rename(path, path+".corrupt"); err != nil {
+		return check, err
+	}
+	if len(values) == 0 {
+		return check, nil
+	}
+	return check, WriteTable(dbPath, level, values)
+}
+
+// 将有序的数据写入到一个新的sstable文件中，使用全局配置中的压缩算法
+func WriteTable(path string, level int, values []kv.Value) error {
+	writer, err := newTableWriter(path, config.GetConfig(), level)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		if err := writer.add(v); err != nil {
+			writer.abort()
+			return err
+		}
+	}
+	table, err := writer.finish()
+	if err != nil {
+		return err
+	}
+	return table.file.Close()
+}
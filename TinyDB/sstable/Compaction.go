@@ -1,138 +1,350 @@
 package sstable
 
 import (
-	"fmt"
-	"log"
+	"context"
 	"os"
+	"sync"
 	"time"
 	"tinydb/config"
 	"tinydb/kv"
-	"tinydb/memtable"
 )
 
 //开始合并相应level的sstable文件
 
 // 检查是否需要压缩数据库文件
+// 不同层的压缩任务会交给多个后台任务并发执行，所有任务完成之后返回
 func (t *TableTree) Check() {
 	t.compaction()
 }
 
+// 手动压缩key范围[start,end]内的所有文件，直到最后一层
+// 压缩到最后一层的删除标记会被清理，end为空表示没有上界
+func (t *TableTree) CompactRange(start, end string) {
+	t.CompactRangeContext(context.Background(), start, end)
+}
+
+// 与CompactRange相同，ctx结束时停止压缩并返回ctx.Err()
+// 等待其他压缩任务释放层的时候以及写入输出文件的过程中都会检查ctx，
+// 被取消的压缩任务删除已经写入的输出文件，已经完成的层保持压缩之后的结果
+func (t *TableTree) CompactRangeContext(ctx context.Context, start, end string) error {
+	for levelIndex := range t.levels {
+		outputLevel := t.outputLevel(levelIndex)
+		if err := t.acquireLevels(ctx, levelIndex, outputLevel); err != nil {
+			return err
+		}
+		c := t.strategy.PickRange(t, levelIndex, start, end)
+		var err error
+		if c != nil {
+			err = t.compactionToNextLevel(ctx, c)
+		}
+		t.releaseLevels(levelIndex, outputLevel)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 手动将指定层的所有文件压缩到下一层
+func (t *TableTree) CompactLevel(level int) {
+	t.CompactLevelContext(context.Background(), level)
+}
+
+// 与CompactLevel相同，ctx结束时停止压缩并返回ctx.Err()
+func (t *TableTree) CompactLevelContext(ctx context.Context, level int) error {
+	if level < 0 || level >= t.LevelCount() {
+		return nil
+	}
+	outputLevel := t.outputLevel(level)
+	if err := t.acquireLevels(ctx, level, outputLevel); err != nil {
+		return err
+	}
+	defer t.releaseLevels(level, outputLevel)
+
+	c := t.strategy.PickRange(t, level, "", "")
+	if c != nil {
+		return t.compactionToNextLevel(ctx, c)
+	}
+	return nil
+}
+
 // 开始压缩文件
 func (t *TableTree) compaction() {
-	con := config.GetConfig()
+	wg := sync.WaitGroup{}
+	for levelIndex := range t.levels {
+		//正在被其他压缩任务使用的层跳过，留到下一次检查
+		outputLevel := t.outputLevel(levelIndex)
+		if !t.tryAcquireLevels(levelIndex, outputLevel) {
+			continue
+		}
+		//由压缩策略决定本层是否需要压缩，以及参与压缩的sstable文件
+		c := t.strategy.PickCompaction(t, levelIndex)
+		if c == nil {
+			t.releaseLevels(levelIndex, outputLevel)
+			continue
+		}
+		t.workers <- struct{}{}
+		wg.Add(1)
+		go func(level int, outputLevel int) {
+			defer func() {
+				t.releaseLevels(level, outputLevel)
+				<-t.workers
+				wg.Done()
+			}()
+			t.compactionToNextLevel(context.Background(), c)
+		}(levelIndex, outputLevel)
+	}
+	wg.Wait()
+}
+
+// 获取指定层压缩之后输出的层，最后一层压缩之后仍然写回最后一层
+func (t *TableTree) outputLevel(level int) int {
+	if level+1 == t.LevelCount() {
+		return level
+	}
+	return level + 1
+}
+
+// 尝试占用压缩任务涉及的层，已经被占用时返回false
+func (t *TableTree) tryAcquireLevels(level int, outputLevel int) bool {
+	t.compactLock.Lock()
+	defer t.compactLock.Unlock()
+
+	if t.busyLevels[level] || t.busyLevels[outputLevel] {
+		return false
+	}
+	t.busyLevels[level] = true
+	t.busyLevels[outputLevel] = true
+	return true
+}
+
+// 占用压缩任务涉及的层，已经被占用时等待其他压缩任务完成
+// ctx结束时唤醒等待并返回ctx.Err()
+func (t *TableTree) acquireLevels(ctx context.Context, level int, outputLevel int) error {
+	stop := context.AfterFunc(ctx, func() {
+		t.compactLock.Lock()
+		defer t.compactLock.Unlock()
+		t.compactCond.Broadcast()
+	})
+	defer stop()
+	t.compactLock.Lock()
+	defer t.compactLock.Unlock()
 
-	for levelIndex, _ := range t.levels {
-		//获取当前层数中的总字节大小,转化为MB
-		allTableSize := int(t.GetLevelsize(levelIndex) / 1024 / 1024)
-		//如果sstable文件的数量和容量任何一个超过阈值大小
-		//合并本层的sstable文件
-		if t.getCount(levelIndex) > con.PerSize || allTableSize > levelSize[levelIndex] {
-			t.compactionToNextLevel(levelIndex)
+	for t.busyLevels[level] || t.busyLevels[outputLevel] {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
+		t.compactCond.Wait()
 	}
-	fmt.Println("This peroid had completed compaction")
+	t.busyLevels[level] = true
+	t.busyLevels[outputLevel] = true
+	return nil
 }
 
-// 压缩当前层的文件到下一层
-func (t *TableTree) compactionToNextLevel(level int) {
-	log.Println("Compressing layer ", level, " files")
-	start := time.Now()
-	defer func() {
-		elapse := time.Since(start)
-		log.Println("Completed compression,consumption of time : ", elapse)
-	}()
+// 释放压缩任务涉及的层
+func (t *TableTree) releaseLevels(level int, outputLevel int) {
+	t.compactLock.Lock()
+	defer t.compactLock.Unlock()
 
-	log.Printf("Compressing layer %d.db files\r\n", level)
+	t.busyLevels[level] = false
+	t.busyLevels[outputLevel] = false
+	t.compactCond.Broadcast()
+}
 
-	//将当前层数的所有sstable合并到一个有序二叉树中
-	memTree := &memtable.Tree{}
-	memTree.Init()
+// 执行一次压缩任务，将输入的sstable合并之后写入到输出层
+// 失败或者ctx结束时删除已经写入的输出文件，输入文件保持不变
+func (t *TableTree) compactionToNextLevel(ctx context.Context, c *Compaction) error {
+	start := time.Now()
+	t.logger().Debug("compacting", "level", c.Level, "output", c.OutputLevel, "files", len(c.Inputs))
+	info := config.CompactionInfo{Dir: t.dir, Level: c.Level, OutputLevel: c.OutputLevel}
+	for _, table := range c.Inputs {
+		info.Inputs = append(info.Inputs, tableInfo(table, config.CompactionReason))
+	}
+	t.listener().OnCompactionBegin(info)
 
-	currentNode := t.levels[level]
-	//数据缓冲
-	dataCache := make([]byte, levelSize[level])
+	//按照key的顺序同时遍历所有输入的sstable，多路归并之后增量写入新文件
+	//输入文件按照从旧到新的顺序排列，相同的key以最新的数据为准
+	iters := make([]kv.Iterator, 0, len(c.Inputs))
+	for _, table := range c.Inputs {
+		iters = append(iters, table.NewIterator())
+	}
+	//合并记录与输入文件中更旧的数据合并，连续的合并记录被连接成一条
+	iter := kv.NewMergeIteratorWithOperator(iters, t.mergeOperator())
+	//输出层及更深的层中可能还保存着旧数据的文件
+	//只有当一个key不可能再存在于这些文件中时，才可以丢弃它的删除标记
+	deeper := t.deeperTables(c)
 
-	t.lock.Lock()
-	for currentNode != nil {
-		currentTable := currentNode.table
-		dataBlock := dataCache[0:currentTable.tableMeta.dataLen]
-
-		//将文件指针偏移到文件开头处,并且开始读取数据区的所有数据
-		if _, err := currentTable.file.Seek(0, 0); err != nil {
-			log.Println(" error open file ", currentTable.filepath)
-			panic(err)
-		}
-		//这里明显还可以优化，这里设计的每一次读取都是从disk中读取
-		//应该先从cache中读取，然后才从磁盘中读取
-		if _, err := currentTable.file.Read(dataBlock); err != nil {
-			log.Println(" error read file ", currentTable.filepath)
-			panic(err)
-		}
-
-		//现在默认索引区的数据和数据区的数据是一致的
-		//根据索引区信息开始读取每一个元素
-		for k, pos := range currentTable.sparseIndex {
-			if pos.Deleted {
-				//该元素是待删除的,插入到二叉树中
-				//此时这里的节点如果不存在的话会返回nil值，后面需要看看
-				memTree.Delete(k)
-			} else {
-				value, err := kv.Decode(dataBlock[pos.Start:(pos.Start + pos.Len)])
-				if err != nil {
-					log.Fatal(err)
-				}
-				memTree.Set(k, value.Value)
+	outputs := make([]*tableNode, 0)
+	var writer *tableWriter
+	var index int
+	var err error
+	for ; iter.Valid(); iter.Next() {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		value := iter.Value()
+		//更深的层中没有这个key时，合并记录中的操作数可以直接在没有旧值的情况下合并
+		if value.Merge && isBaseLevelForKey(deeper, value.Key) {
+			value = kv.Fold(t.mergeOperator(), value, nil)
+		}
+		if value.Delete && isBaseLevelForKey(deeper, value.Key) {
+			//删除标记以及被它覆盖的旧数据都不需要再保留
+			continue
+		}
+		if writer == nil {
+			index = t.reserveIndex(c.OutputLevel)
+			if writer, err = newTableWriter(t.tablePath(c.OutputLevel, index), t.con, c.OutputLevel); err != nil {
+				break
 			}
+			writer.limiter = t.limiter
+		}
+		if err = writer.add(value); err != nil {
+			break
+		}
+		//输出文件达到目标大小之后切分为新的文件
+		if c.TargetFileSize > 0 && writer.size >= c.TargetFileSize {
+			if err = t.finishOutput(writer, index, &outputs); err != nil {
+				break
+			}
+			writer = nil
 		}
-		currentNode = currentNode.next
 	}
-	t.lock.Unlock()
+	if err == nil {
+		err = iter.Err()
+	}
+	if err == nil && writer != nil {
+		err = t.finishOutput(writer, index, &outputs)
+		writer = nil
+	}
+	if err != nil {
+		//压缩失败，输入文件保持不变，删除已经生成的新文件
+		t.logger().Error("compaction failed", "level", c.Level, "output", c.OutputLevel, "error", err)
+		if writer != nil {
+			writer.abort()
+		}
+		for _, node := range outputs {
+			t.clearTables([]*SSTable{node.table})
+		}
+		info.Duration, info.Err = time.Since(start), err
+		t.listener().OnCompactionEnd(info)
+		//被调用者取消的压缩不是后台错误
+		if ctx.Err() == nil {
+			t.listener().OnBackgroundError(config.BackgroundErrorInfo{Job: config.CompactionReason, Dir: t.dir, Err: err})
+		}
+		return err
+	}
 
-	//将memTree中的数据压缩并且合并成一个sstable文件
-	allValues := memTree.GetValue()
-	newLevel := level + 1
-	//可以设置一个最大支持层数
-	//后续可以设计定期删除相应的数据
-	if newLevel == 10 {
-		//如果合并的文件是最后一层的，直接将这一层原来的所有数据全部删除
-		//新构造这一层相应的文件
-		oldNode := t.levels[9]
-		t.clearLevel(oldNode)
-		t.creatTable(allValues, 9)
-		return
-	}
-	//开始创建新的sstable,并插入到相应的层
-	t.creatTable(allValues, newLevel)
-	//清理该level的所有文件
-	oldNode := t.levels[level]
-	t.levels[level] = nil
-	t.clearLevel(oldNode)
-}
-
-// 清除压缩完之后的当前层
-func (t *TableTree) clearLevel(oldNode *tableNode) {
+	//新文件全部写入成功之后，再替换树中的输入文件
+	var read int64
+	for _, table := range c.Inputs {
+		read += table.GetDbsize()
+	}
 	t.lock.Lock()
-	defer t.lock.Unlock()
+	for _, table := range c.Inputs {
+		t.removeNode(table)
+	}
+	for _, node := range outputs {
+		t.insertNode(c.OutputLevel, node)
+		written := t.recordWrite(c.OutputLevel, node.table)
+		t.metrics.compactionWritten.Add(written)
+		info.BytesWritten += written
+	}
+	t.lock.Unlock()
+	t.metrics.compactions.Add(1)
+	t.metrics.compactionRead.Add(read)
+	t.metrics.compactionLatency.Since(start)
+	t.logger().Info("compacted", "level", c.Level, "output", c.OutputLevel,
+		"files", len(c.Inputs), "outputs", len(outputs), "bytes", read, "duration", time.Since(start))
 
-	for oldNode != nil {
-		//关闭文件描述符
-		err := oldNode.table.file.Close()
-		if err != nil {
-			log.Println(" error close file,", oldNode.table.filepath)
-			panic(err)
+	//清理所有参与压缩的旧文件
+	t.clearTables(c.Inputs)
+	for _, node := range outputs {
+		info.Outputs = append(info.Outputs, tableInfo(node.table, config.CompactionReason))
+	}
+	info.BytesRead, info.Duration = read, time.Since(start)
+	t.listener().OnCompactionEnd(info)
+	return nil
+}
+
+// 获取输出层及更深的层中，不参与本次压缩并且与输入文件key范围重叠的文件
+func (t *TableTree) deeperTables(c *Compaction) []*SSTable {
+	inputs := make(map[*SSTable]bool)
+	for _, table := range c.Inputs {
+		inputs[table] = true
+	}
+	start, end := keyRange(c.Inputs)
+
+	tables := make([]*SSTable, 0)
+	for level := c.OutputLevel; level < t.LevelCount(); level++ {
+		for _, table := range t.LevelTables(level) {
+			if !inputs[table] && table.overlaps(start, end) {
+				tables = append(tables, table)
+			}
 		}
-		//删除table对应的物理文件，释放磁盘空间
-		err = os.Remove(oldNode.table.filepath)
-		if err != nil {
-			log.Println(" error delete file,", oldNode.table.filepath)
-			panic(err)
-		}
-		//将对象设置为nil，垃圾回收会自动回收这一部分内存
-		//但是像File这个文件描述符，并没有主动关闭，也就是还存在引用关系
-		//设置为nil的话OS并不会主动关闭文件描述符更不会释放此描述符对应的内存
-		//将对象引用置为 nil 只是失去了对该对象的引用
-		oldNode.table.file = nil
-		oldNode.table = nil
-		oldNode = oldNode.next
+	}
+	return tables
+}
+
+// 判断更深的层中是否不可能存在这个key
+func isBaseLevelForKey(deeper []*SSTable, key string) bool {
+	for _, table := range deeper {
+		if table.overlaps(key, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// 完成一个输出文件的写入
+func (t *TableTree) finishOutput(writer *tableWriter, index int, outputs *[]*tableNode) error {
+	table, err := writer.finish()
+	if err != nil {
+		return err
+	}
+	*outputs = append(*outputs, &tableNode{
+		index: index,
+		table: table,
+	})
+	t.listener().OnTableCreated(tableInfo(table, config.CompactionReason))
+	return nil
+}
+
+// 清除已经从树中移除的sstable文件
+// 仍然被迭代器引用的文件会在引用释放之后再删除
+func (t *TableTree) clearTables(tables []*SSTable) {
+	for _, table := range tables {
+		table.lock.Lock()
+		table.listener = t.listener()
+		if table.refs > 0 {
+			table.obsolete = true
+		} else {
+			table.remove()
+		}
+		table.lock.Unlock()
+	}
+}
+
+// 关闭并删除sstable对应的文件，调用者需要持有sstable的锁
+func (s *SSTable) remove() {
+	info := tableInfo(s, config.CompactionReason)
+	//关闭文件描述符
+	err := s.file.Close()
+	if err != nil {
+		logger().Error("failed to close the sstable", "file", s.filepath, "error", err)
+		panic(err)
+	}
+	//删除table对应的物理文件，释放磁盘空间
+	err = os.Remove(s.filepath)
+	if err != nil {
+		logger().Error("failed to delete the sstable", "file", s.filepath, "error", err)
+		panic(err)
+	}
+	//将对象设置为nil，垃圾回收会自动回收这一部分内存
+	//但是像File这个文件描述符，并没有主动关闭，也就是还存在引用关系
+	//设置为nil的话OS并不会主动关闭文件描述符更不会释放此描述符对应的内存
+	//将对象引用置为 nil 只是失去了对该对象的引用
+	s.file = nil
+	if s.listener != nil {
+		s.listener.OnTableDeleted(info)
 	}
 }
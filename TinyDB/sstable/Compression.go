@@ -0,0 +1,131 @@
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"tinydb/config"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 数据块使用的压缩算法编号，记录在每一个数据块的尾部
+const (
+	noCompression     byte = 0
+	snappyCompression byte = 1
+	zstdCompression   byte = 2
+	flateCompression  byte = 3
+)
+
+// 数据块尾部的大小：1字节的压缩算法编号 + 4字节的压缩前长度
+// 版本2开始再加上4字节的校验和，校验范围为数据块中校验和之前的所有数据
+const (
+	blockTrailerSizeV1 = 5
+	blockTrailerSize   = 9
+)
+
+// zstd的编码器和解码器可以被多个协程共享
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// 获取指定层使用的压缩算法
+func levelCompression(con config.Config, level int) byte {
+	name := con.Compression
+	if level < len(con.LevelCompression) && con.LevelCompression[level] != "" {
+		name = con.LevelCompression[level]
+	}
+	switch name {
+	case config.SnappyCompression:
+		return snappyCompression
+	case config.ZstdCompression:
+		return zstdCompression
+	case config.FlateCompression:
+		return flateCompression
+	default:
+		return noCompression
+	}
+}
+
+// 压缩一个数据块，并在结尾追加数据块尾部
+// 压缩之后节省的空间不足1/8时，直接保存原始数据
+func compressBlock(codec byte, raw []byte) ([]byte, error) {
+	var data []byte
+	switch codec {
+	case snappyCompression:
+		data = snappy.Encode(nil, raw)
+	case zstdCompression:
+		data = zstdEncoder.EncodeAll(raw, nil)
+	case flateCompression:
+		buf := &bytes.Buffer{}
+		w, err := flate.NewWriter(buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(raw); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+	if codec == noCompression || len(data) >= len(raw)-len(raw)/8 {
+		codec = noCompression
+		data = append(make([]byte, 0, len(raw)+blockTrailerSize), raw...)
+	}
+	data = append(data, codec)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(raw)))
+	data = binary.LittleEndian.AppendUint32(data, crc32.Checksum(data, crcTable))
+	return data, nil
+}
+
+// 校验并根据数据块尾部记录的压缩算法解压一个数据块
+func decompressBlock(block []byte, version int64) ([]byte, error) {
+	trailerSize := blockTrailerSizeV1
+	if version >= formatVersionChecksum {
+		trailerSize = blockTrailerSize
+	}
+	if len(block) < trailerSize {
+		return nil, fmt.Errorf("block too short: %d bytes", len(block))
+	}
+	if version >= formatVersionChecksum {
+		n := len(block) - 4
+		if crc32.Checksum(block[:n], crcTable) != binary.LittleEndian.Uint32(block[n:]) {
+			return nil, fmt.Errorf("block checksum mismatch")
+		}
+	}
+	trailer := block[len(block)-trailerSize:]
+	data := block[:len(block)-trailerSize]
+	rawLen := int(binary.LittleEndian.Uint32(trailer[1:]))
+
+	var raw []byte
+	var err error
+	switch trailer[0] {
+	case noCompression:
+		raw = data
+	case snappyCompression:
+		raw, err = snappy.Decode(nil, data)
+	case zstdCompression:
+		raw, err = zstdDecoder.DecodeAll(data, make([]byte, 0, rawLen))
+	case flateCompression:
+		r := flate.NewReader(bytes.NewReader(data))
+		raw = make([]byte, rawLen)
+		_, err = io.ReadFull(r, raw)
+		_ = r.Close()
+	default:
+		return nil, fmt.Errorf("unknown block compression %d", trailer[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != rawLen {
+		return nil, fmt.Errorf("block length mismatch: expect %d, got %d", rawLen, len(raw))
+	}
+	return raw, nil
+}
@@ -0,0 +1,155 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"tinydb/kv"
+)
+
+// 文件尾中的元数据，用于检查和打印
+type MetaInfo struct {
+	Version    int64
+	DataStart  int64
+	DataLen    int64
+	IndexStart int64
+	IndexLen   int64
+	RawDataLen int64
+	IndexCRC   uint32
+}
+
+// 索引区中的一个元素以及它在数据区中对应的记录
+type IndexEntry struct {
+	Key      string
+	Position Position
+	//数据区中的记录，无法读取时为nil
+	Record *kv.Value
+}
+
+// 一个sstable文件的详细内容
+type TableInfo struct {
+	Path     string
+	FileSize int64
+	Meta     MetaInfo
+	//按照key的顺序排列的索引
+	Entries []IndexEntry
+	//数据块的数量，版本0的文件没有数据块
+	Blocks int
+	//删除标记的数量
+	Tombstones int
+	MinKey     string
+	MaxKey     string
+	//读取记录时发现的问题
+	Errors []string
+}
+
+// 读取一个sstable文件的文件尾、索引区以及每一条记录
+// 文件尾或者索引区无法读取时返回已经读取到的部分和错误
+func InspectTable(path string) (TableInfo, error) {
+	info := TableInfo{Path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+	if stat, err := file.Stat(); err == nil {
+		info.FileSize = stat.Size()
+	}
+
+	table := &SSTable{file: file, filepath: path}
+	if err := table.loadMeta(); err != nil {
+		return info, err
+	}
+	meta := table.tableMeta
+	info.Meta = MetaInfo{
+		Version:    meta.version,
+		DataStart:  meta.dataStart,
+		DataLen:    meta.dataLen,
+		IndexStart: meta.indexStart,
+		IndexLen:   meta.indexLen,
+		RawDataLen: meta.rawDataLen,
+		IndexCRC:   meta.indexCRC,
+	}
+	if err := table.loadSparseIndex(); err != nil {
+		return info, err
+	}
+
+	values, check := SalvageTable(path)
+	records := make(map[string]kv.Value, len(values))
+	for _, value := range values {
+		records[value.Key] = value
+	}
+	info.Errors = check.Errors
+
+	lastStart := int64(-1)
+	for _, key := range table.sortIndex {
+		entry := IndexEntry{Key: key, Position: table.sparseIndex[key]}
+		if record, ok := records[key]; ok {
+			entry.Record = &record
+		}
+		if entry.Position.Deleted {
+			info.Tombstones++
+		}
+		if meta.version >= formatVersionBlock && entry.Position.Start != lastStart {
+			info.Blocks++
+			lastStart = entry.Position.Start
+		}
+		info.Entries = append(info.Entries, entry)
+	}
+	info.MinKey = table.MinKey()
+	info.MaxKey = table.MaxKey()
+	return info, nil
+}
+
+// 打印文件的元数据和统计信息，records为true时打印每一个索引和记录
+func (info *TableInfo) Dump(w io.Writer, records bool) {
+	meta := info.Meta
+	fmt.Fprintf(w, "file:        %s (%d bytes)\n", info.Path, info.FileSize)
+	fmt.Fprintf(w, "version:     %d\n", meta.Version)
+	fmt.Fprintf(w, "data:        start %d, len %d, raw len %d\n", meta.DataStart, meta.DataLen, meta.RawDataLen)
+	fmt.Fprintf(w, "index:       start %d, len %d, crc %08x\n", meta.IndexStart, meta.IndexLen, meta.IndexCRC)
+	fmt.Fprintf(w, "keys:        %d (%d tombstones)\n", len(info.Entries), info.Tombstones)
+	fmt.Fprintf(w, "blocks:      %d\n", info.Blocks)
+	if len(info.Entries) > 0 {
+		fmt.Fprintf(w, "key range:   [%s, %s]\n", info.MinKey, info.MaxKey)
+	}
+	if meta.RawDataLen > 0 {
+		fmt.Fprintf(w, "compression: %.2f (%d / %d bytes)\n",
+			float64(meta.DataLen)/float64(meta.RawDataLen), meta.DataLen, meta.RawDataLen)
+	}
+	if len(info.Entries) > 0 {
+		fmt.Fprintf(w, "avg record:  %d bytes\n", meta.RawDataLen/int64(len(info.Entries)))
+	}
+	for _, msg := range info.Errors {
+		fmt.Fprintln(w, "error:      ", msg)
+	}
+	if !records {
+		return
+	}
+
+	fmt.Fprintf(w, "\n%-10s %-8s %-8s %-8s %-8s %-7s %s\n", "start", "len", "offset", "size", "deleted", "key", "value")
+	for _, entry := range info.Entries {
+		pos := entry.Position
+		value := "<unreadable>"
+		if entry.Record != nil && entry.Record.Delete {
+			value = "<tombstone>"
+		} else if entry.Record != nil && entry.Record.Merge {
+			value = "<merge> " + string(bytes.Join(entry.Record.Operands, []byte(" ")))
+		} else if entry.Record != nil {
+			value = string(entry.Record.Value)
+		}
+		fmt.Fprintf(w, "%-10d %-8d %-8d %-8d %-8t %-7s %s\n",
+			pos.Start, pos.Len, pos.Offset, pos.Size, pos.Deleted, entry.Key, value)
+	}
+}
+
+// 打印一个sstable文件的全部内容
+func DumpTable(path string, w io.Writer) error {
+	info, err := InspectTable(path)
+	if err != nil {
+		return err
+	}
+	info.Dump(w, true)
+	return nil
+}
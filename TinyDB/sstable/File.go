@@ -1,8 +1,7 @@
 package sstable
 
 import (
-	"encoding/binary"
-	"log"
+	"fmt"
 	"os"
 )
 
@@ -12,58 +11,41 @@ import (
 func (table *SSTable) GetDbsize() int64 {
 	info, err := os.Stat(table.filepath)
 	if err != nil {
-		log.Fatal(err)
+		logger().Error("failed to stat the sstable", "file", table.filepath, "error", err)
+		panic(err)
 	}
 	return info.Size()
 }
 
-// 将数据写入到文件当中
-func writeDataToFile(filepath string, dataArea []byte, indexArea []byte, meta Meta) {
-	//此时以只写的方式打开相应文件
-	file, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE, 0666)
-	defer file.Close()
-
-	if err != nil {
-		log.Fatal(" error create file,", err)
-	}
-	//先写所有的数据
-	_, err = file.Write(dataArea)
-	if err != nil {
-		log.Fatal(" error write file,", err)
-	}
-	//写稀疏索引区的数据
-	_, err = file.Write(indexArea)
-	if err != nil {
-		log.Fatal(" error write file,", err)
-	}
-	//写入元数据到数据末尾
-	err = binary.Write(file, binary.LittleEndian, &meta.version)
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = binary.Write(file, binary.LittleEndian, &meta.dataStart)
+// 读取一个元素对应的数据
+func (table *SSTable) readRecord(pos Position) ([]byte, error) {
+	block, err := table.readBlock(pos)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	err = binary.Write(file, binary.LittleEndian, &meta.dataLen)
-	if err != nil {
-		log.Fatal(err)
+	return recordInBlock(table, block, pos)
+}
+
+// 读取元素所在的数据块，版本1的文件会将数据块解压
+// 版本0的文件没有数据块，直接返回元素本身
+func (table *SSTable) readBlock(pos Position) ([]byte, error) {
+	data := make([]byte, pos.Len)
+	if _, err := table.file.ReadAt(data, table.tableMeta.dataStart+pos.Start); err != nil {
+		return nil, err
 	}
-	err = binary.Write(file, binary.LittleEndian, &meta.indexStart)
-	if err != nil {
-		log.Fatal(err)
+	if table.tableMeta.version == formatVersionRaw {
+		return data, nil
 	}
-	err = binary.Write(file, binary.LittleEndian, &meta.indexLen)
-	if err != nil {
-		log.Fatal(err)
+	return decompressBlock(data, table.tableMeta.version)
+}
+
+// 从readBlock返回的数据块中截取元素的数据
+func recordInBlock(table *SSTable, block []byte, pos Position) ([]byte, error) {
+	if table.tableMeta.version == formatVersionRaw {
+		return block, nil
 	}
-	//上述所有的write都只是把数据暂时写入到文件缓冲区中，并没有立即刷盘
-	//sync函数将文件缓冲区中的数据强制刷新/写入到磁盘中
-	//每一次将sstable中的内容写入disk中的时候，都立即刷盘
-	//如果此时并发量很大，有很多数据产生，会有大量的sstable对象生成，
-	//这样立即刷盘的操作会不会造成性能问题？？？这个也是一个需要考虑的问题
-	err = file.Sync()
-	if err != nil {
-		log.Fatal(" error write file from file's buffer,", err)
+	if pos.Offset < 0 || pos.Offset+pos.Size > int64(len(block)) {
+		return nil, fmt.Errorf("record out of block range in %s", table.filepath)
 	}
+	return block[pos.Offset : pos.Offset+pos.Size], nil
 }
@@ -1,9 +1,9 @@
 package sstable
 
 import (
-	"encoding/binary"
 	"encoding/json"
-	"log"
+	"fmt"
+	"hash/crc32"
 	"os"
 	"path"
 	"path/filepath"
@@ -11,36 +11,49 @@ import (
 	"sync"
 	"time"
 	"tinydb/config"
+	"tinydb/ratelimit"
 )
 
-var levelSize []int
-
 // 初始化tableTree
 // 1.读取目录dir中的所有level.index.db文件
 // 2.将db文件的元数据和稀疏索引区数据读取到内存，并同时为每一个sstable构造一个keys数组
 // 3.根据db文件名称构建tableTree
 func (t *TableTree) Init(dir string) {
-	log.Println("The SSTable list are being loaded")
+	t.Open(dir, config.GetConfig())
+}
+
+// 使用指定的配置初始化目录dir中的tableTree，每个列族的tableTree都有自己的目录和配置
+func (t *TableTree) Open(dir string, con config.Config) {
 	start := time.Now()
 	defer func() {
-		end := time.Since(start)
-		log.Println("Loading the ", dir, ",Consumption of time : ", end)
+		t.logger().Debug("loaded the sstables", "file", dir, "duration", time.Since(start))
 	}()
 
-	con := config.GetConfig()
-	levelSize = make([]int, 10)
-	levelSize[0] = con.Level0Size * 1024 * 1024
-	//初始化每一层的文件大小
-	for i := 1; i < 10; i++ {
-		levelSize[i] = levelSize[i-1] * 10
+	t.dir = dir
+	t.con = con
+	maxLevels := con.MaxLevels
+	if maxLevels <= 0 {
+		maxLevels = 10
 	}
+	t.levels = make([]*tableNode, 0, maxLevels)
+	t.nextIndex = make([]int, 0, maxLevels)
+	t.busyLevels = make([]bool, 0, maxLevels)
+	t.levelSize = make([]int64, 0, maxLevels)
+	t.addLevels(maxLevels)
 
-	t.levels = make([]*tableNode, 10)
 	t.lock = &sync.RWMutex{}
+	t.strategy = newCompactionStrategy(con.CompactionStrategy)
+	t.compactCond = sync.NewCond(&t.compactLock)
+	workers := con.CompactionWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	t.workers = make(chan struct{}, workers)
+	t.limiter = ratelimit.New(con.CompactionRateLimit * 1024 * 1024)
 
 	dirname, err := os.OpenFile(dir, os.O_RDONLY, 0666)
 	if err != nil {
-		log.Println("Open dir fail")
+		t.logger().Error("failed to open the sstable directory", "file", dir, "error", err)
 		panic(err)
 	}
 	defer dirname.Close()
@@ -49,7 +62,7 @@ func (t *TableTree) Init(dir string) {
 	//n<=0，Readdir函数返回目录中剩余所有文件对象的FileInfo构成的切片
 	infos, err := dirname.Readdir(-1)
 	if err != nil {
-		log.Println("Failed to read the database file")
+		t.logger().Error("failed to read the sstable directory", "file", dir, "error", err)
 		panic(err)
 	}
 	//忽略当前元素的值，所以不写
@@ -65,116 +78,148 @@ func (t *TableTree) Init(dir string) {
 
 // 加载一个db文件到tableTree中去
 func (t *TableTree) loadToTree(path string) {
-	log.Println("Loading the ", path)
 	start := time.Now()
-	defer func() {
-		end := time.Since(start)
-		log.Println("Loading the ", path, ",Consumption of time : ", end)
-	}()
 	//Base函数返回路径的最后一个元素，提取元素的时候会去掉末尾的'/'
 	level, index, err := getLevel(filepath.Base(path))
 	if err != nil {
-		log.Println("Loading the ", path, "error")
+		t.logger().Warn("ignoring the file with an invalid sstable name", "file", path, "error", err)
+		return
+	}
+
+	//配置的层数比之前减少时，保留更深层中已有的数据
+	if level >= len(t.levels) {
+		t.logger().Warn("the sstable exceeds the max levels, keeping it", "file", path, "level", level)
+		t.addLevels(level + 1)
 	}
 
-	log.Println("start to load the ", path, "to TableTree")
 	table := &SSTable{}
-	table.Init(path)
-	newNode := &tableNode{
-		index: index,
-		table: table,
+	err = table.Init(path)
+	//开启严格检查时，打开文件的时候就校验所有的数据块
+	if err == nil && t.con.ParanoidChecks {
+		err = table.verifyBlocks()
 	}
-	currentNode := t.levels[level]
-	if currentNode == nil {
-		t.levels[level] = newNode
+	if err != nil {
+		//损坏的文件不会导致整个数据库无法启动
+		t.logger().Error("the sstable is corrupted", "file", path, "error", err)
+		quarantine(table)
 		return
 	}
-	//链表节点的插入，将sstable文件插入到合适的位置
-	for currentNode != nil {
-		// if currentNode.next == nil {
-		// 	newNode.next = currentNode.next
-		// 	currentNode.next = newNode
-		// 	break
-		// }
-		if currentNode.next == nil || (newNode.index > currentNode.index && newNode.index < currentNode.next.index) {
-			newNode.next = currentNode.next
-			currentNode.next = newNode
-			break
+	t.logger().Debug("loaded the sstable", "file", path, "level", level, "duration", time.Since(start))
+	t.insertNode(level, &tableNode{
+		index: index,
+		table: table,
+	})
+}
+
+// 将树的层数扩充到n层，并初始化每一层的文件大小阈值
+func (t *TableTree) addLevels(n int) {
+	con := t.con
+	multiplier := int64(con.LevelSizeMultiplier)
+	if multiplier <= 0 {
+		multiplier = 10
+	}
+	for len(t.levels) < n {
+		size := int64(con.Level0Size) * 1024 * 1024
+		if last := len(t.levelSize) - 1; last >= 0 {
+			size = t.levelSize[last] * multiplier
 		}
-		currentNode = currentNode.next
+		t.levels = append(t.levels, nil)
+		t.nextIndex = append(t.nextIndex, 0)
+		t.busyLevels = append(t.busyLevels, false)
+		t.levelSize = append(t.levelSize, size)
+		t.metrics.levelWritten = append(t.metrics.levelWritten, 0)
 	}
 }
 
 // 加载文件句柄
-func (table *SSTable) loadFd() {
+func (table *SSTable) loadFd() error {
 	if table.file == nil {
 		//以读写的形式打开文件
 		f, err := os.OpenFile(table.filepath, os.O_RDWR, 0666)
 		if err != nil {
-			log.Println(" error open file ", table.filepath)
-			panic(err)
+			return err
 		}
 		table.file = f
 	}
 	//首先加载元数据
 	//然后根据文件的元数据加载稀疏索引区数据到内存中
-	table.loadMeta()
-	table.loadSparseIndex()
+	if err := table.loadMeta(); err != nil {
+		return err
+	}
+	return table.loadSparseIndex()
 }
 
 // 加载sstable文件的元数据到内存中
-func (table *SSTable) loadMeta() {
-	file := table.file
-	_, err := file.Seek(0, 0)
+func (table *SSTable) loadMeta() error {
+	meta, err := readFooter(table.file)
 	if err != nil {
-		log.Println(" error open file ", table.filepath)
-		panic(err)
-	}
-	info, _ := file.Stat()
-	//从结尾开始读Meta
-	_, err = file.Seek(info.Size()-8*5, 2)
-	if err != nil {
-		log.Println("Error reading metadata ", table.filepath)
-		panic(err)
+		return fmt.Errorf("error reading metadata: %w", err)
 	}
-	_ = binary.Read(file, binary.LittleEndian, &table.tableMeta.version)
-
-	_ = binary.Read(file, binary.LittleEndian, &table.tableMeta.dataStart)
-
-	_ = binary.Read(file, binary.LittleEndian, &table.tableMeta.dataLen)
-
-	_ = binary.Read(file, binary.LittleEndian, &table.tableMeta.indexStart)
-
-	_ = binary.Read(file, binary.LittleEndian, &table.tableMeta.indexLen)
+	table.tableMeta = meta
+	return nil
 }
 
 // 加载稀疏索引区到内存中
-func (table *SSTable) loadSparseIndex() {
+func (table *SSTable) loadSparseIndex() error {
 	//加载稀疏索引区
 	bytes := make([]byte, table.tableMeta.indexLen)
-	if _, err := table.file.Seek(table.tableMeta.indexStart, 0); err != nil {
-		log.Println(" error seek the file ", table.filepath)
-		panic(err)
+	if _, err := table.file.ReadAt(bytes, table.tableMeta.indexStart); err != nil {
+		return fmt.Errorf("error reading index: %w", err)
 	}
-	if _, err := table.file.Read(bytes); err != nil {
-		log.Println(" error read file ", table.filepath)
-		panic(err)
+	if table.tableMeta.version >= formatVersionChecksum &&
+		crc32.Checksum(bytes, crcTable) != table.tableMeta.indexCRC {
+		return fmt.Errorf("index checksum mismatch")
 	}
 
 	table.sparseIndex = make(map[string]Position)
 	//反序列至sstable结构中
-	err := json.Unmarshal(bytes, &table.sparseIndex)
-	if err != nil {
-		log.Println(" error open file ", table.filepath)
-		panic(err)
+	if err := json.Unmarshal(bytes, &table.sparseIndex); err != nil {
+		return fmt.Errorf("error decoding index: %w", err)
 	}
-	_, _ = table.file.Seek(0, 0)
 
 	//通过稀疏索引区的数据构造一个有序数组，便于后续快速查找
 	keys := make([]string, 0, len(table.sparseIndex))
-	for k := range table.sparseIndex {
+	for k, pos := range table.sparseIndex {
+		//索引区中的每一个位置都必须位于数据区之内
+		if pos.Start < 0 || pos.Len < 0 || pos.Start+pos.Len > table.tableMeta.dataLen {
+			return fmt.Errorf("index entry %q out of data range", k)
+		}
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
 	table.sortIndex = keys
+	return nil
+}
+
+// 读取并校验所有的数据块
+func (table *SSTable) verifyBlocks() error {
+	checked := make(map[int64]bool)
+	for _, key := range table.sortIndex {
+		pos := table.sparseIndex[key]
+		if pos.Deleted || checked[pos.Start] {
+			continue
+		}
+		checked[pos.Start] = true
+		block, err := table.readBlock(pos)
+		if err != nil {
+			return fmt.Errorf("error reading block at %d: %w", pos.Start, err)
+		}
+		if _, err := recordInBlock(table, block, pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将损坏的sstable文件重命名为.corrupt，不再加载
+func quarantine(table *SSTable) {
+	if table.file != nil {
+		_ = table.file.Close()
+		table.file = nil
+	}
+	if err := os.Rename(table.filepath, table.filepath+".corrupt"); err != nil {
+		logger().Error("failed to quarantine the sstable", "file", table.filepath, "error", err)
+		return
+	}
+	logger().Warn("the corrupted sstable has been renamed", "file", table.filepath+".corrupt")
 }
@@ -0,0 +1,84 @@
+package sstable
+
+import (
+	"sort"
+	"tinydb/kv"
+)
+
+// 按照key的顺序遍历一个sstable文件的迭代器
+// 每次只从磁盘中读取当前元素所在的数据块，不会把整个文件加载到内存中
+type tableIterator struct {
+	table *SSTable
+	//当前元素在sortIndex中的位置
+	index int
+	//最近一次读取的数据块以及它在数据区中的起始位置
+	block      []byte
+	blockStart int64
+	current    kv.Value
+	err        error
+}
+
+// 创建一个指向sstable第一个元素的迭代器
+func (s *SSTable) NewIterator() kv.Iterator {
+	return s.NewIteratorFrom("")
+}
+
+// 创建一个指向sstable中第一个大于等于start的元素的迭代器
+func (s *SSTable) NewIteratorFrom(start string) kv.Iterator {
+	it := &tableIterator{
+		table:      s,
+		index:      sort.SearchStrings(s.sortIndex, start) - 1,
+		blockStart: -1,
+	}
+	it.Next()
+	return it
+}
+
+func (it *tableIterator) Valid() bool {
+	return it.err == nil && it.index < len(it.table.sortIndex)
+}
+
+func (it *tableIterator) Value() kv.Value {
+	return it.current
+}
+
+func (it *tableIterator) Err() error {
+	return it.err
+}
+
+func (it *tableIterator) Next() {
+	it.index++
+	if !it.Valid() {
+		return
+	}
+	key := it.table.sortIndex[it.index]
+	pos := it.table.sparseIndex[key]
+	if pos.Deleted {
+		it.current = kv.Value{Key: key, Delete: true}
+		return
+	}
+	data, err := it.read(pos)
+	if err != nil {
+		it.err = err
+		return
+	}
+	value, err := kv.Decode(data)
+	if err != nil {
+		it.err = err
+		return
+	}
+	it.current = value
+}
+
+// 读取一个元素对应的数据，同一个数据块中的元素只需要读取一次数据块
+func (it *tableIterator) read(pos Position) ([]byte, error) {
+	if it.block == nil || pos.Start != it.blockStart {
+		block, err := it.table.readBlock(pos)
+		if err != nil {
+			return nil, err
+		}
+		it.block = block
+		it.blockStart = pos.Start
+	}
+	return recordInBlock(it.table, it.block, pos)
+}
@@ -1,5 +1,34 @@
 package sstable
 
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// sstable文件格式的版本号
+const (
+	//数据区直接存放每一个元素
+	formatVersionRaw = 0
+	//数据区按照数据块存放，每一个数据块可以单独压缩
+	formatVersionBlock = 1
+	//固定格式的文件尾，带有魔数以及索引区和每一个数据块的校验和
+	formatVersionChecksum = 2
+	//当前写入文件使用的版本
+	currentFormatVersion = formatVersionChecksum
+)
+
+// 版本2开始写在文件最后8个字节的魔数，用于识别tinydb的sstable文件
+const tableMagic uint64 = 0x73736264796e6974
+
+// 版本2的文件尾大小
+// 六个int64字段 + 索引区校验和 + 文件尾校验和 + 魔数
+const footerSize = 8*6 + 4 + 4 + 8
+
+// 计算校验和使用的crc32表
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // sstable文件的元数据
 // 在每一个文件的结尾
 type Meta struct {
@@ -13,4 +42,111 @@ type Meta struct {
 	indexStart int64
 	//索引区长度
 	indexLen int64
+	//数据区压缩之前的长度，版本1开始记录
+	rawDataLen int64
+	//索引区的校验和，版本2开始记录
+	indexCRC uint32
+}
+
+// 将元数据编码成版本2的文件尾
+func encodeFooter(meta Meta) []byte {
+	buf := make([]byte, footerSize)
+	fields := []int64{meta.version, meta.dataStart, meta.dataLen, meta.indexStart, meta.indexLen, meta.rawDataLen}
+	for i, field := range fields {
+		binary.LittleEndian.PutUint64(buf[i*8:], uint64(field))
+	}
+	binary.LittleEndian.PutUint32(buf[48:], meta.indexCRC)
+	binary.LittleEndian.PutUint32(buf[52:], crc32.Checksum(buf[:52], crcTable))
+	binary.LittleEndian.PutUint64(buf[56:], tableMagic)
+	return buf
+}
+
+// 从文件结尾读取并校验元数据
+// 没有魔数的文件按照版本0和版本1的格式读取，读取之后检查各个区域是否在文件范围内
+func readFooter(file *os.File) (Meta, error) {
+	var meta Meta
+	info, err := file.Stat()
+	if err != nil {
+		return meta, err
+	}
+	size := info.Size()
+	if size < 8*5 {
+		return meta, fmt.Errorf("file too short: %d bytes", size)
+	}
+
+	tail := make([]byte, 8*6)
+	if size < int64(len(tail)) {
+		tail = tail[8:]
+	}
+	if _, err := file.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return meta, err
+	}
+
+	if binary.LittleEndian.Uint64(tail[len(tail)-8:]) == tableMagic {
+		if size < footerSize {
+			return meta, fmt.Errorf("file too short for footer: %d bytes", size)
+		}
+		buf := make([]byte, footerSize)
+		if _, err := file.ReadAt(buf, size-footerSize); err != nil {
+			return meta, err
+		}
+		if crc32.Checksum(buf[:52], crcTable) != binary.LittleEndian.Uint32(buf[52:]) {
+			return meta, fmt.Errorf("footer checksum mismatch")
+		}
+		fields := make([]int64, 6)
+		for i := range fields {
+			fields[i] = int64(binary.LittleEndian.Uint64(buf[i*8:]))
+		}
+		meta = Meta{
+			version:    fields[0],
+			dataStart:  fields[1],
+			dataLen:    fields[2],
+			indexStart: fields[3],
+			indexLen:   fields[4],
+			rawDataLen: fields[5],
+			indexCRC:   binary.LittleEndian.Uint32(buf[48:]),
+		}
+		if meta.version < formatVersionChecksum || meta.version > currentFormatVersion {
+			return meta, fmt.Errorf("unsupported format version %d", meta.version)
+		}
+		return meta, meta.check(size - footerSize)
+	}
+
+	//旧版本的文件尾：版本1在五个字段之前额外记录数据区压缩之前的长度
+	fields := make([]int64, len(tail)/8)
+	for i := range fields {
+		fields[i] = int64(binary.LittleEndian.Uint64(tail[i*8:]))
+	}
+	last := fields[len(fields)-5:]
+	meta = Meta{
+		version:    last[0],
+		dataStart:  last[1],
+		dataLen:    last[2],
+		indexStart: last[3],
+		indexLen:   last[4],
+		rawDataLen: last[2],
+	}
+	end := size - 8*5
+	switch meta.version {
+	case formatVersionRaw:
+	case formatVersionBlock:
+		if len(fields) < 6 {
+			return meta, fmt.Errorf("file too short: %d bytes", size)
+		}
+		meta.rawDataLen = fields[0]
+		end = size - 8*6
+	default:
+		return meta, fmt.Errorf("not a tinydb sstable or unsupported format version %d", meta.version)
+	}
+	return meta, meta.check(end)
+}
+
+// 检查数据区和索引区是否都位于文件尾之前
+func (meta Meta) check(end int64) error {
+	if meta.dataStart < 0 || meta.dataLen < 0 || meta.indexLen < 0 ||
+		meta.dataStart+meta.dataLen > meta.indexStart || meta.indexStart+meta.indexLen > end {
+		return fmt.Errorf("invalid meta: data [%d,+%d) index [%d,+%d) in %d bytes",
+			meta.dataStart, meta.dataLen, meta.indexStart, meta.indexLen, end)
+	}
+	return nil
 }
@@ -1,6 +1,8 @@
 package sstable
 
 // 元素定位，存储在稀疏索引区中，表示一个元素的起始位置和长度
+// 版本0的文件中Start和Len直接指向元素本身
+// 版本1的文件中Start和Len指向元素所在的数据块，Offset和Size表示元素在解压之后的数据块中的位置
 type Position struct {
 	//数据部分的起始索引
 	Start int64
@@ -8,4 +10,8 @@ type Position struct {
 	Len int64
 	//是否已经被删除
 	Deleted bool
+	//元素在解压之后的数据块中的起始位置
+	Offset int64 `json:",omitempty"`
+	//元素在解压之后的数据块中的长度
+	Size int64 `json:",omitempty"`
 }
@@ -1,12 +1,18 @@
 package sstable
 
 import (
-	"log"
+	"errors"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"tinydb/config"
 	"tinydb/kv"
 )
 
+// 读取时发现sstable文件已经损坏，返回的错误中包含文件名
+var ErrCorruption = errors.New("sstable: corruption")
+
 // 一个sstable对象
 type SSTable struct {
 	//每一个sstable对象对应的文件fd
@@ -23,13 +29,19 @@ type SSTable struct {
 	//sstable使用排他锁（其实就是写独占锁），感觉这里其实也可以使用读写锁
 	lock sync.Locker
 	//在sortIndex中找到之后，使用sparseIndex迅速定位文件中的内容
+	//正在使用此sstable的迭代器数量，以及是否已经被压缩移出了树
+	//被引用的sstable在压缩之后不会立即删除，而是等最后一个引用释放之后再删除
+	refs     int
+	obsolete bool
+	//被压缩移出树时设置，文件删除之后通知
+	listener config.EventListener
 }
 
-// 初始化sstable对象对应的文件信息
-func (s *SSTable) Init(path string) {
+// 初始化sstable对象对应的文件信息，文件格式不正确或者校验失败时返回错误
+func (s *SSTable) Init(path string) error {
 	s.filepath = path
 	s.lock = &sync.Mutex{}
-	s.loadFd()
+	return s.loadFd()
 }
 
 // 从内存中查找元素,二分查找
@@ -66,17 +78,130 @@ func (s *SSTable) SearchMem(key string) (kv.Value, kv.SearchResult) {
 	}
 
 	//从磁盘文件中查找对应的内容
-	bytes := make([]byte, p.Len)
-	if _, err := s.file.Seek(p.Start, 0); err != nil {
-		log.Println(err)
-	}
-	if _, err := s.file.Read(bytes); err != nil {
-		log.Println(err)
+	bytes, err := s.readRecord(p)
+	if err != nil {
+		//数据块损坏时不能继续从更旧的文件中查找，否则会返回过期的数据
+		logger().Error("failed to read the sstable", "file", s.filepath, "error", err)
+		return kv.Value{}, kv.Corrupted
 	}
 	value, err := kv.Decode(bytes)
 	if err != nil {
-		log.Println(err)
+		logger().Error("failed to decode the sstable record", "file", s.filepath, "error", err)
+		return kv.Value{}, kv.Corrupted
 	}
 	return value, kv.Success
 
 }
+
+// 增加一个引用
+func (s *SSTable) ref() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.refs++
+}
+
+// 释放一个引用，已经被压缩移出树的sstable在最后一个引用释放之后删除
+func (s *SSTable) unref() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.refs--
+	if s.refs == 0 && s.obsolete {
+		s.remove()
+	}
+}
+
+// 获取sstable中最小的key
+func (s *SSTable) MinKey() string {
+	if len(s.sortIndex) == 0 {
+		return ""
+	}
+	return s.sortIndex[0]
+}
+
+// 获取sstable中最大的key
+func (s *SSTable) MaxKey() string {
+	if len(s.sortIndex) == 0 {
+		return ""
+	}
+	return s.sortIndex[len(s.sortIndex)-1]
+}
+
+// 判断sstable的key范围是否与[start,end]有交集
+func (s *SSTable) overlaps(start, end string) bool {
+	if len(s.sortIndex) == 0 {
+		return false
+	}
+	return s.MinKey() <= end && s.MaxKey() >= start
+}
+
+// sstable的统计信息
+type TableStats struct {
+	//文件路径、所在的层以及文件大小
+	Path  string
+	Level int
+	Size  int64
+	//key的数量，以及其中删除标记的数量
+	Keys       int
+	Tombstones int
+	//最小和最大的key
+	MinKey string
+	MaxKey string
+	//数据区压缩之前的大小
+	RawDataSize int64
+	//数据区在磁盘中的大小
+	DataSize int64
+	//压缩率，磁盘中的大小 / 压缩之前的大小
+	CompressionRatio float64
+}
+
+// 获取sstable的统计信息
+func (s *SSTable) Stats() TableStats {
+	level, _, _ := getLevel(filepath.Base(s.filepath))
+	stats := TableStats{
+		Path:             s.filepath,
+		Level:            level,
+		Size:             s.GetDbsize(),
+		Keys:             len(s.sortIndex),
+		MinKey:           s.MinKey(),
+		MaxKey:           s.MaxKey(),
+		RawDataSize:      s.tableMeta.rawDataLen,
+		DataSize:         s.tableMeta.dataLen,
+		Tombstones:       s.tombstones(),
+		CompressionRatio: 1,
+	}
+	if stats.RawDataSize > 0 {
+		stats.CompressionRatio = float64(stats.DataSize) / float64(stats.RawDataSize)
+	}
+	return stats
+}
+
+// 获取sstable中删除标记的数量
+func (s *SSTable) tombstones() int {
+	n := 0
+	for _, p := range s.sparseIndex {
+		if p.Deleted {
+			n++
+		}
+	}
+	return n
+}
+
+// 估算sstable中key范围[start,end)的数据在磁盘中占用的字节数，end为空表示没有上界
+// 根据范围内第一个key和范围之后第一个key在数据区中的位置计算，精度为一个数据块
+func (s *SSTable) approximateSize(start, end string) int64 {
+	lo := sort.SearchStrings(s.sortIndex, start)
+	hi := len(s.sortIndex)
+	if end != "" {
+		hi = sort.SearchStrings(s.sortIndex, end)
+	}
+	if lo >= hi {
+		return 0
+	}
+	to := s.tableMeta.dataLen
+	if hi < len(s.sortIndex) {
+		to = s.sparseIndex[s.sortIndex[hi]].Start
+	}
+	return to - s.sparseIndex[s.sortIndex[lo]].Start
+}
@@ -0,0 +1,143 @@
+package sstable
+
+import (
+	"sync/atomic"
+	"tinydb/metrics"
+)
+
+// 一棵树运行期间累计的统计数据，重新打开之后从0开始
+type treeMetrics struct {
+	//每一层写入的字节数，下标为层数，持有树的锁时修改
+	levelWritten []int64
+	//内存表持久化写入第0层的字节数
+	flushBytes atomic.Int64
+	//压缩任务的次数、耗时以及读写的字节数
+	compactions       atomic.Uint64
+	compactionRead    atomic.Int64
+	compactionWritten atomic.Int64
+	compactionLatency metrics.Histogram
+	//查找时检查的sstable数量，以及在sstable的key索引中找到的次数
+	//每个sstable的key索引都在内存中，没有找到的检查不会读取磁盘，作用与布隆过滤器相同
+	indexProbes atomic.Uint64
+	indexHits   atomic.Uint64
+}
+
+// 一层sstable的统计信息
+type LevelStats struct {
+	//文件的数量以及总大小
+	Files int
+	Size  int64
+	//持久化和压缩累计写入这一层的字节数
+	BytesWritten int64
+}
+
+// 整棵树的统计信息
+type TreeStats struct {
+	Levels []LevelStats
+	//内存表持久化写入的字节数
+	FlushBytes int64
+	//压缩任务的次数、耗时以及读写的字节数
+	Compactions            uint64
+	CompactionBytesRead    int64
+	CompactionBytesWritten int64
+	CompactionLatency      metrics.HistogramSnapshot
+	//查找时检查的sstable数量，以及在key索引中找到的次数
+	IndexProbes uint64
+	IndexHits   uint64
+}
+
+// 获取树的统计信息
+func (t *TableTree) Stats() TreeStats {
+	stats := TreeStats{
+		FlushBytes:             t.metrics.flushBytes.Load(),
+		Compactions:            t.metrics.compactions.Load(),
+		CompactionBytesRead:    t.metrics.compactionRead.Load(),
+		CompactionBytesWritten: t.metrics.compactionWritten.Load(),
+		CompactionLatency:      t.metrics.compactionLatency.Snapshot(),
+		IndexProbes:            t.metrics.indexProbes.Load(),
+		IndexHits:              t.metrics.indexHits.Load(),
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	stats.Levels = make([]LevelStats, len(t.levels))
+	for level, node := range t.levels {
+		for ; node != nil; node = node.next {
+			stats.Levels[level].Files++
+			stats.Levels[level].Size += node.table.GetDbsize()
+		}
+		stats.Levels[level].BytesWritten = t.metrics.levelWritten[level]
+	}
+	return stats
+}
+
+// 一层sstable的详细信息
+type LevelInfo struct {
+	Level int
+	//文件的数量以及总大小
+	Files int
+	Size  int64
+	//所有文件中key的数量，以及其中删除标记的数量，不同文件中相同的key分别计入
+	Keys       int
+	Tombstones int
+	//这一层中最小和最大的key，没有文件时为空
+	MinKey string
+	MaxKey string
+	//这一层的所有文件，按照文件标号从小到大排列
+	Tables []TableStats
+}
+
+// 获取每一层的详细信息，下标为层数
+func (t *TableTree) Levels() []LevelInfo {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	levels := make([]LevelInfo, len(t.levels))
+	for level, node := range t.levels {
+		info := &levels[level]
+		info.Level = level
+		for ; node != nil; node = node.next {
+			table := node.table.Stats()
+			if table.Keys > 0 {
+				//空字符串也是合法的key，第一个非空的文件直接作为初始范围
+				if info.Keys == 0 || table.MinKey < info.MinKey {
+					info.MinKey = table.MinKey
+				}
+				if info.Keys == 0 || table.MaxKey > info.MaxKey {
+					info.MaxKey = table.MaxKey
+				}
+			}
+			info.Files++
+			info.Size += table.Size
+			info.Keys += table.Keys
+			info.Tombstones += table.Tombstones
+			info.Tables = append(info.Tables, table)
+		}
+	}
+	return levels
+}
+
+// 估算key范围[start,end)的数据在所有sstable中占用的字节数，end为空表示没有上界
+// 只统计数据区，不同层中相同key的旧数据同样计入
+func (t *TableTree) ApproximateSize(start, end string) int64 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var size int64
+	for _, node := range t.levels {
+		for ; node != nil; node = node.next {
+			size += node.table.approximateSize(start, end)
+		}
+	}
+	return size
+}
+
+// 记录写入level层的文件，调用者需要持有写锁
+func (t *TableTree) recordWrite(level int, tables ...*SSTable) int64 {
+	var size int64
+	for _, table := range tables {
+		size += table.GetDbsize()
+	}
+	t.metrics.levelWritten[level] += size
+	return size
+}
@@ -0,0 +1,210 @@
+package sstable
+
+import (
+	"sort"
+	"sync"
+	"tinydb/config"
+)
+
+// 一次压缩任务，由压缩策略选出，交给compactionToNextLevel执行
+type Compaction struct {
+	//输入文件所在的层
+	Level int
+	//输出文件写入的层
+	OutputLevel int
+	//参与压缩的sstable，按照从旧到新的顺序排列
+	//合并时相同的key以排在后面的sstable中的数据为准
+	Inputs []*SSTable
+	//输出文件的目标大小，超过之后切分为新的文件，0表示不切分
+	TargetFileSize int64
+}
+
+// 压缩策略，决定每一层是否需要压缩以及参与压缩的文件
+type CompactionStrategy interface {
+	//检查指定层，返回需要执行的压缩任务，不需要压缩时返回nil
+	PickCompaction(t *TableTree, level int) *Compaction
+	//手动压缩时，选出指定层中与[start,end]重叠的文件，没有重叠的文件时返回nil
+	PickRange(t *TableTree, level int, start, end string) *Compaction
+}
+
+// 根据配置创建压缩策略
+func newCompactionStrategy(name string) CompactionStrategy {
+	switch name {
+	case config.LeveledCompaction:
+		return &leveledStrategy{}
+	default:
+		return &tieringStrategy{}
+	}
+}
+
+// 判断某一层的文件数量或者总大小是否超过阈值
+// 最后一层没有大小的阈值，否则tiering策略会不断地重写已经合并好的最后一层，
+// 只在文件数量超过阈值或者还有删除标记的时候原地合并，合并之后删除标记都会被清理
+func needCompaction(t *TableTree, level int) bool {
+	if t.getCount(level) > t.con.PerSize {
+		return true
+	}
+	if level == t.LevelCount()-1 {
+		return t.levelTombstones(level) > 0
+	}
+	return t.GetLevelsize(level) > t.LevelTarget(level)
+}
+
+// Tiering策略：将一层的所有文件合并成一个新文件，追加到下一层
+// 最后一层的文件会被合并之后重新写回最后一层
+type tieringStrategy struct{}
+
+func (s *tieringStrategy) PickCompaction(t *TableTree, level int) *Compaction {
+	tables := t.LevelTables(level)
+	if len(tables) == 0 || !needCompaction(t, level) {
+		return nil
+	}
+	return &Compaction{
+		Level:       level,
+		OutputLevel: t.outputLevel(level),
+		Inputs:      tables,
+	}
+}
+
+func (s *tieringStrategy) PickRange(t *TableTree, level int, start, end string) *Compaction {
+	//tiering策略下同一层的文件可能相互重叠，需要整层一起压缩
+	return rangeCompaction(t, level, start, end, true, 0)
+}
+
+// Leveled策略：第1层及以下每一层中文件的key范围互不重叠
+// 每次从本层选出一个文件（第0层为所有文件），与下一层中key范围重叠的文件一起合并
+// 合并的结果按照目标文件大小切分之后写入下一层
+type leveledStrategy struct {
+	//每一层上一次被压缩文件的最大key，下一次从这个位置之后继续选择文件
+	pointers map[int]string
+	lock     sync.Mutex
+}
+
+func (s *leveledStrategy) PickCompaction(t *TableTree, level int) *Compaction {
+	//最后一层不再向下压缩
+	if level >= t.LevelCount()-1 {
+		return nil
+	}
+	tables := t.LevelTables(level)
+	if len(tables) == 0 || !needCompaction(t, level) {
+		return nil
+	}
+
+	var inputs []*SSTable
+	if level == 0 {
+		//第0层的文件之间可能相互重叠，全部参与压缩
+		inputs = tables
+	} else {
+		inputs = []*SSTable{s.pickFile(level, tables)}
+	}
+	start, end := keyRange(inputs)
+
+	//下一层中与输入文件重叠的文件比输入文件更旧，排在前面
+	overlapped := make([]*SSTable, 0)
+	for _, table := range t.LevelTables(level + 1) {
+		if table.overlaps(start, end) {
+			overlapped = append(overlapped, table)
+		}
+	}
+
+	return &Compaction{
+		Level:          level,
+		OutputLevel:    level + 1,
+		Inputs:         append(overlapped, inputs...),
+		TargetFileSize: t.targetFileSize(level + 1),
+	}
+}
+
+func (s *leveledStrategy) PickRange(t *TableTree, level int, start, end string) *Compaction {
+	return rangeCompaction(t, level, start, end, level == 0, t.targetFileSize(t.outputLevel(level)))
+}
+
+// 获取leveled策略下指定层输出文件的目标大小
+func (t *TableTree) targetFileSize(level int) int64 {
+	con := t.con
+	size := con.TargetFileSize
+	if level < len(con.TargetFileSizes) && con.TargetFileSizes[level] > 0 {
+		size = con.TargetFileSizes[level]
+	}
+	targetSize := int64(size) * 1024 * 1024
+	if targetSize <= 0 {
+		targetSize = 2 * 1024 * 1024
+	}
+	return targetSize
+}
+
+// 选出指定层中与[start,end]重叠的文件，连同下一层中与之重叠的文件一起压缩到下一层
+// 最后一层的重叠文件原地合并，end为空表示没有上界
+// wholeLevel表示本层的文件之间可能相互重叠，只要有重叠的文件就将整层文件一起压缩，
+// 否则较旧的文件留在上层会覆盖被压缩到下层的较新数据
+func rangeCompaction(t *TableTree, level int, start, end string, wholeLevel bool, targetSize int64) *Compaction {
+	tables := t.LevelTables(level)
+	inputs := make([]*SSTable, 0)
+	for _, table := range tables {
+		if table.MaxKey() >= start && (end == "" || table.MinKey() <= end) {
+			inputs = append(inputs, table)
+		}
+	}
+	if len(inputs) == 0 {
+		return nil
+	}
+	if wholeLevel {
+		inputs = tables
+	}
+	outputLevel := t.outputLevel(level)
+	overlapped := make([]*SSTable, 0)
+	if outputLevel != level {
+		minKey, maxKey := keyRange(inputs)
+		for _, table := range t.LevelTables(outputLevel) {
+			if table.overlaps(minKey, maxKey) {
+				overlapped = append(overlapped, table)
+			}
+		}
+	}
+	return &Compaction{
+		Level:          level,
+		OutputLevel:    outputLevel,
+		Inputs:         append(overlapped, inputs...),
+		TargetFileSize: targetSize,
+	}
+}
+
+// 按照key的顺序轮流选择本层中的文件，保证每个文件都有机会被压缩
+func (s *leveledStrategy) pickFile(level int, tables []*SSTable) *SSTable {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.pointers == nil {
+		s.pointers = make(map[int]string)
+	}
+	sorted := make([]*SSTable, len(tables))
+	copy(sorted, tables)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].MinKey() < sorted[j].MinKey()
+	})
+
+	pick := sorted[0]
+	if pointer, ok := s.pointers[level]; ok {
+		for _, table := range sorted {
+			if table.MinKey() > pointer {
+				pick = table
+				break
+			}
+		}
+	}
+	s.pointers[level] = pick.MaxKey()
+	return pick
+}
+
+// 获取一组sstable覆盖的key范围
+func keyRange(tables []*SSTable) (start string, end string) {
+	for i, table := range tables {
+		if i == 0 || table.MinKey() < start {
+			start = table.MinKey()
+		}
+		if i == 0 || table.MaxKey() > end {
+			end = table.MaxKey()
+		}
+	}
+	return start, end
+}
@@ -1,15 +1,14 @@
 package sstable
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
-	"os"
-	"sort"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"tinydb/config"
 	"tinydb/kv"
+	"tinydb/ratelimit"
 )
 
 // 表示每一层的sstable,使用链表进行组织
@@ -28,115 +27,260 @@ type TableTree struct {
 	levels []*tableNode
 	//读写锁
 	lock *sync.RWMutex
+	//每一层下一个可用的文件标号，保证新文件的标号总是最大的
+	nextIndex []int
+	//每一层文件总大小的阈值，为字节
+	levelSize []int64
+	//压缩策略
+	strategy CompactionStrategy
+	//正在参与压缩任务的层，同一层同一时间只能参与一个压缩任务
+	busyLevels  []bool
+	compactLock sync.Mutex
+	compactCond *sync.Cond
+	//限制同时执行的后台压缩任务数量
+	workers chan struct{}
+	//压缩写入磁盘的限速器
+	limiter *ratelimit.Limiter
+	//sstable文件所在的目录以及这棵树使用的配置
+	dir string
+	con config.Config
+	//运行期间的统计数据
+	metrics treeMetrics
 }
 
 // 创建新的sstable
 func (t *TableTree) CreateNewTable(value []kv.Value) {
-	t.creatTable(value, 0)
+	t.PrepareTable(value)()
 }
 
-// 创建新的sstable并且插入到合适的level层
-func (t *TableTree) creatTable(value []kv.Value, level int) *SSTable {
-	//构造数据区，分别是有序的key列表，pos区，所有的k-v数据区
-	keys := make([]string, 0, len(value))
-	pos := make(map[string]Position)
-	//所有的二进制数据
-	dataArea := make([]byte, 0)
+// 将value写入一个新的第0层sstable文件，但是先不插入到树中，调用返回的函数之后才能被读取
+// 调用者可以在插入的同时清空对应的内存表，读取时不会同时看到内存表和sstable中的同一份数据
+func (t *TableTree) PrepareTable(value []kv.Value) (install func()) {
+	return t.prepareTable(value, 0)
+}
+
+// 构造sstable文件，返回将其插入到level层的函数
+func (t *TableTree) prepareTable(value []kv.Value, level int) func() {
+	index := t.reserveIndex(level)
+	table := t.buildTable(value, level, index)
+
+	//文件写入完成之后，再将构造好的sstable插入到整个管理的树中
+	return func() {
+		t.lock.Lock()
+		t.insertNode(level, &tableNode{
+			index: index,
+			table: table,
+		})
+		t.metrics.flushBytes.Add(t.recordWrite(level, table))
+		t.lock.Unlock()
+		t.listener().OnTableCreated(tableInfo(table, config.FlushReason))
+	}
+}
+
+// 根据有序的value切片构造sstable文件，此时并不插入到树中
+func (t *TableTree) buildTable(value []kv.Value, level int, index int) *SSTable {
+	writer, err := newTableWriter(t.tablePath(level, index), t.con, level)
+	if err != nil {
+		t.logger().Error("failed to create the sstable", "level", level, "error", err)
+		panic(err)
+	}
 	//遍历value切片中每一个value值
 	for _, v := range value {
-		data, err := kv.Encode(v)
-		if err != nil {
-			log.Println("Failed to encode kv: ", v.Key, err)
-			continue
+		if err := writer.add(v); err != nil {
+			t.logger().Error("failed to encode the record", "key", v.Key, "error", err)
 		}
-		keys = append(keys, v.Key)
-		//文件定位区
-		pos[v.Key] = Position{
-			Start:   int64(len(dataArea)),
-			Len:     int64(len(data)),
-			Deleted: v.Delete,
-		}
-		//编成二进制之后的数据进行添加
-		dataArea = append(dataArea, data...)
 	}
-	sort.Strings(keys)
-
-	//构造稀疏索引区
-	indexArea, err := json.Marshal(pos)
-	if err != nil {
-		log.Fatal("An SSTable file cannot be created,", err)
-	}
-	//构造元数据区
-	meta := Meta{
-		version:    0,
-		dataStart:  0,
-		dataLen:    int64(len(dataArea)),
-		indexStart: int64(0 + len(dataArea)),
-		indexLen:   int64(len(indexArea)),
-	}
-	//生成sstable，此时的sstable对象中存储了索引区的数据
-	//也就保证了所有的索引区数据全部存储在内存中存储
-	table := &SSTable{
-		tableMeta:   meta,
-		sparseIndex: pos,
-		sortIndex:   keys,
-		lock:        &sync.RWMutex{},
-	}
-	//将构造好的sstable插入到整个管理的树中
-	index := t.insert(table, level)
-	log.Printf("Create a new SSTable,level: %d ,index: %d\r\n", level, index)
-
-	//通过配置文件得到数据文件所在的目录
-	//构造相应的文件名，之后将数据写入到数据文件中
-	con := config.GetConfig()
-	filepath := con.DataDir + "/" + strconv.Itoa(level) + "." + strconv.Itoa(index) + ".db"
-	table.filepath = filepath
-	writeDataToFile(filepath, dataArea, indexArea, meta)
-
-	//数据写入之后，将所有的sstable文件都打开,方便后续对文件操作
-	file, err := os.OpenFile(table.filepath, os.O_RDWR, 0666)
+	table, err := writer.finish()
 	if err != nil {
-		log.Println(" error open file ", table.filepath)
+		t.logger().Error("failed to create the sstable", "level", level, "error", err)
 		panic(err)
 	}
-	table.file = file
+	stats := table.Stats()
+	t.logger().Debug("created the sstable", "file", stats.Path, "level", level, "keys", stats.Keys, "ratio", stats.CompressionRatio)
 	return table
 }
 
-// 插入一个sstable到指定的层,返回最新的位置
-func (t *TableTree) insert(table *SSTable, level int) int {
+// 根据树所在的目录构造相应的文件名
+func (t *TableTree) tablePath(level int, index int) string {
+	return t.dir + "/" + strconv.Itoa(level) + "." + strconv.Itoa(index) + ".db"
+}
+
+// 为指定层分配一个新的文件标号
+func (t *TableTree) reserveIndex(level int) int {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	//每次插入的sstable都必须插入到相应层的最后面
-	node := t.levels[level]
-	newNode := &tableNode{
-		table: table,
-		next:  nil,
-		index: 0,
-	}
+	index := t.nextIndex[level]
+	t.nextIndex[level]++
+	return index
+}
 
-	if node == nil {
+// 将节点按照index从小到大的顺序插入到指定层的链表中
+// 调用者需要持有写锁
+func (t *TableTree) insertNode(level int, newNode *tableNode) {
+	if newNode.index >= t.nextIndex[level] {
+		t.nextIndex[level] = newNode.index + 1
+	}
+	currentNode := t.levels[level]
+	if currentNode == nil || newNode.index < currentNode.index {
+		newNode.next = currentNode
 		t.levels[level] = newNode
-	} else {
+		return
+	}
+	//链表节点的插入，将sstable文件插入到合适的位置
+	for currentNode != nil {
+		if currentNode.next == nil || newNode.index < currentNode.next.index {
+			newNode.next = currentNode.next
+			currentNode.next = newNode
+			return
+		}
+		currentNode = currentNode.next
+	}
+}
+
+// 从树中移除指定的sstable，调用者需要持有写锁
+func (t *TableTree) removeNode(table *SSTable) bool {
+	for level, node := range t.levels {
+		var prev *tableNode
 		for node != nil {
-			if node.next == nil {
-				newNode.index = node.index + 1
-				node.next = newNode
-				break
-			} else {
-				node = node.next
+			if node.table == table {
+				if prev == nil {
+					t.levels[level] = node.next
+				} else {
+					prev.next = node.next
+				}
+				return true
 			}
+			prev = node
+			node = node.next
 		}
 	}
-	return newNode.index
+	return false
+}
+
+// 获取指定层的所有sstable，按照从旧到新的顺序排列
+func (t *TableTree) LevelTables(level int) []*SSTable {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	tables := make([]*SSTable, 0)
+	for node := t.levels[level]; node != nil; node = node.next {
+		tables = append(tables, node.table)
+	}
+	return tables
+}
+
+// 为当前所有的sstable创建从start开始的迭代器，按照从旧到新的顺序排列
+// 迭代期间这些sstable即使被压缩也不会被删除，遍历结束之后需要调用返回的release函数
+func (t *TableTree) Iterators(start string) ([]kv.Iterator, func()) {
+	t.lock.RLock()
+	tables := make([]*SSTable, 0)
+	//越深的层数据越旧，同一层中标号越大的文件越新
+	for level := len(t.levels) - 1; level >= 0; level-- {
+		for node := t.levels[level]; node != nil; node = node.next {
+			node.table.ref()
+			tables = append(tables, node.table)
+		}
+	}
+	t.lock.RUnlock()
+
+	iters := make([]kv.Iterator, 0, len(tables))
+	for _, table := range tables {
+		iters = append(iters, table.NewIteratorFrom(start))
+	}
+	release := func() {
+		for _, table := range tables {
+			table.unref()
+		}
+	}
+	return iters, release
+}
+
+// 获取当前所有sstable文件的路径，用于备份
+// 返回的文件在调用release之前不会被压缩任务删除
+func (t *TableTree) LiveFiles() ([]string, func()) {
+	t.lock.RLock()
+	tables := make([]*SSTable, 0)
+	for level := range t.levels {
+		for node := t.levels[level]; node != nil; node = node.next {
+			node.table.ref()
+			tables = append(tables, node.table)
+		}
+	}
+	t.lock.RUnlock()
+
+	files := make([]string, 0, len(tables))
+	for _, table := range tables {
+		files = append(files, table.filepath)
+	}
+	release := func() {
+		for _, table := range tables {
+			table.unref()
+		}
+	}
+	return files, release
+}
+
+// 获取指定层文件总大小的阈值，最后一层没有阈值，返回0
+// 开启动态阈值时，以最后一层的实际大小为基准，往上每一层依次除以倍数，
+// 但不会小于静态配置中第1层的阈值
+func (t *TableTree) LevelTarget(level int) int64 {
+	con := t.con
+	last := t.LevelCount() - 1
+	if level == last {
+		return 0
+	}
+	if !con.DynamicLevelSize || level == 0 {
+		return t.levelSize[level]
+	}
+	multiplier := int64(con.LevelSizeMultiplier)
+	if multiplier <= 0 {
+		multiplier = 10
+	}
+	target := t.GetLevelsize(last)
+	for i := last; i > level; i-- {
+		target /= multiplier
+	}
+	if base := t.levelSize[1]; target < base {
+		return base
+	}
+	return target
+}
+
+// 关闭树中所有sstable的文件，之后不能再使用这棵树
+func (t *TableTree) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for level, node := range t.levels {
+		for ; node != nil; node = node.next {
+			if err := node.table.file.Close(); err != nil {
+				t.logger().Error("failed to close the sstable", "file", node.table.filepath, "error", err)
+			}
+		}
+		t.levels[level] = nil
+	}
+}
+
+// 获取树的层数
+func (t *TableTree) LevelCount() int {
+	return len(t.levels)
 }
 
 // 从所有的sstable表中进行查询
 func (t *TableTree) SearchTree(key string) (kv.Value, kv.SearchResult) {
+	value, res, _ := t.SearchTreeContext(context.Background(), key)
+	return value, res
+}
+
+// 从所有的sstable表中进行查询，每检查一个sstable之前检查ctx，ctx结束时返回ctx.Err()
+// 读取到损坏的数据时返回ErrCorruption
+func (t *TableTree) SearchTreeContext(ctx context.Context, key string) (kv.Value, kv.SearchResult, error) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
+	//找到合并记录时需要继续在更旧的文件中查找基础值
+	var pending *kv.Value
 	//遍历每一层的sstable文件
 	for _, node := range t.levels {
 		//获取每一层的所有sstable文件列表
@@ -147,22 +291,57 @@ func (t *TableTree) SearchTree(key string) (kv.Value, kv.SearchResult) {
 		}
 		//从最后一个sstable文件开始查找相关数据
 		for i := len(tables) - 1; i >= 0; i-- {
+			if err := ctx.Err(); err != nil {
+				return kv.Value{}, kv.None, err
+			}
 			value, res := tables[i].SearchMem(key)
+			t.metrics.indexProbes.Add(1)
 			//如果在此sstable中没有找到数据，换下一个sstable文件找
 			if res == kv.None {
 				continue
-			} else {
+			}
+			//文件损坏时不能当作不存在，返回包含文件名的错误
+			if res == kv.Corrupted {
+				return kv.Value{}, kv.Corrupted, fmt.Errorf("%w: %s", ErrCorruption, tables[i].filepath)
+			}
+			t.metrics.indexHits.Add(1)
+			if pending == nil && !value.Merge {
 				//找到或已经删除，直接返回结果
-				return value, res
+				return value, res, nil
 			}
+			if res == kv.Deleted {
+				value = kv.Value{Key: key, Delete: true}
+			}
+			if pending != nil {
+				value = kv.Fold(t.mergeOperator(), *pending, &value)
+			}
+			if !value.Merge {
+				if value.Delete {
+					return kv.Value{}, kv.Deleted, nil
+				}
+				return value, kv.Success, nil
+			}
+			pending = &value
 		}
 	}
+	//只找到合并记录，由调用者在没有旧值的情况下合并
+	if pending != nil {
+		return *pending, kv.Success, nil
+	}
 	//所有的sstable文件中都不包含此值
-	return kv.Value{}, kv.None
+	return kv.Value{}, kv.None, nil
+}
+
+// 配置中的合并算子
+func (t *TableTree) mergeOperator() kv.MergeOperator {
+	return kv.GetMergeOperator(t.con.MergeOperator)
 }
 
 // 获取指定level的sstable总大小
 func (t *TableTree) GetLevelsize(level int) int64 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
 	var size int64
 	node := t.levels[level]
 	for node != nil {
@@ -172,6 +351,18 @@ func (t *TableTree) GetLevelsize(level int) int64 {
 	return size
 }
 
+// 获取指定层所有文件中删除标记的数量
+func (t *TableTree) levelTombstones(level int) int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	tombstones := 0
+	for node := t.levels[level]; node != nil; node = node.next {
+		tombstones += node.table.tombstones()
+	}
+	return tombstones
+}
+
 // 获取每一层中最大的索引值，也就是最新的文件标号
 func (t *TableTree) getMaxIndex(level int) int {
 	node := t.levels[level]
@@ -202,3 +393,24 @@ func getLevel(name string) (level int, index int, err error) {
 	}
 	return level, index, nil
 }
+
+// sstable文件的信息，用于通知EventListener
+func tableInfo(table *SSTable, reason string) config.TableInfo {
+	level, _, _ := getLevel(filepath.Base(table.filepath))
+	return config.TableInfo{Path: table.filepath, Level: level, Size: table.GetDbsize(), Reason: reason}
+}
+
+// 树的配置中的Logger
+func (t *TableTree) logger() config.Logger {
+	return t.con.GetLogger()
+}
+
+// 树的配置中的EventListener
+func (t *TableTree) listener() config.EventListener {
+	return t.con.GetEventListener()
+}
+
+// 没有所属的树时使用数据库配置中的Logger
+func logger() config.Logger {
+	return config.GetConfig().GetLogger()
+}
@@ -0,0 +1,169 @@
+package sstable
+
+import (
+	"bufio"
+	"encoding/json"
+	"hash/crc32"
+	"os"
+	"sync"
+	"tinydb/config"
+	"tinydb/kv"
+	"tinydb/ratelimit"
+)
+
+// 数据块压缩之前的默认大小
+const defaultBlockSize = 4096
+
+// 按照key的顺序增量写入一个sstable文件
+// 元素先追加到当前的数据块中，数据块写满之后压缩并写入磁盘，内存中只保留索引区的数据
+// 写入过程中使用临时文件，完成之后才重命名为最终的文件名
+type tableWriter struct {
+	file   *os.File
+	writer *bufio.Writer
+	//最终的文件路径
+	filepath string
+	keys     []string
+	pos      map[string]Position
+	//已经写入的数据区大小
+	size int64
+	//数据区压缩之前的大小
+	rawSize int64
+	//当前正在构造的数据块，以及其中的元素
+	block     []byte
+	blockKeys []string
+	blockSize int
+	//数据块使用的压缩算法
+	codec byte
+	//写入限速器，为nil表示不限速
+	limiter *ratelimit.Limiter
+}
+
+// 创建一个sstable文件写入器，根据配置和层数选择数据块的大小和压缩算法
+func newTableWriter(filepath string, con config.Config, level int) (*tableWriter, error) {
+	file, err := os.OpenFile(filepath+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := con.BlockSize
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+	return &tableWriter{
+		file:      file,
+		writer:    bufio.NewWriter(file),
+		filepath:  filepath,
+		keys:      make([]string, 0),
+		pos:       make(map[string]Position),
+		block:     make([]byte, 0, blockSize),
+		blockSize: blockSize,
+		codec:     levelCompression(con, level),
+	}, nil
+}
+
+// 追加一个元素，元素必须按照key从小到大的顺序写入
+func (w *tableWriter) add(v kv.Value) error {
+	data, err := kv.Encode(v)
+	if err != nil {
+		return err
+	}
+	w.keys = append(w.keys, v.Key)
+	w.blockKeys = append(w.blockKeys, v.Key)
+	//文件定位区，数据块的长度在数据块写入之后才能确定
+	w.pos[v.Key] = Position{
+		Start:   w.size,
+		Deleted: v.Delete,
+		Offset:  int64(len(w.block)),
+		Size:    int64(len(data)),
+	}
+	w.block = append(w.block, data...)
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// 压缩当前的数据块并写入文件
+func (w *tableWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	data, err := compressBlock(w.codec, w.block)
+	if err != nil {
+		return err
+	}
+	w.limiter.Wait(len(data))
+	if _, err := w.writer.Write(data); err != nil {
+		return err
+	}
+	for _, key := range w.blockKeys {
+		pos := w.pos[key]
+		pos.Len = int64(len(data))
+		w.pos[key] = pos
+	}
+	w.size += int64(len(data))
+	w.rawSize += int64(len(w.block))
+	w.block = w.block[:0]
+	w.blockKeys = w.blockKeys[:0]
+	return nil
+}
+
+// 写入索引区和元数据，刷盘之后返回可以直接查询的sstable对象
+func (w *tableWriter) finish() (*SSTable, error) {
+	if err := w.flushBlock(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	//构造稀疏索引区
+	indexArea, err := json.Marshal(w.pos)
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	//构造元数据区
+	meta := Meta{
+		version:    currentFormatVersion,
+		dataStart:  0,
+		dataLen:    w.size,
+		indexStart: w.size,
+		indexLen:   int64(len(indexArea)),
+		rawDataLen: w.rawSize,
+		indexCRC:   crc32.Checksum(indexArea, crcTable),
+	}
+	if _, err := w.writer.Write(indexArea); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if _, err := w.writer.Write(encodeFooter(meta)); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := w.writer.Flush(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	//每一次将sstable中的内容写入disk中的时候，都立即刷盘
+	if err := w.file.Sync(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := os.Rename(w.file.Name(), w.filepath); err != nil {
+		w.abort()
+		return nil, err
+	}
+	//生成sstable，此时的sstable对象中存储了索引区的数据
+	//文件句柄继续保留，方便后续对文件操作
+	return &SSTable{
+		file:        w.file,
+		filepath:    w.filepath,
+		tableMeta:   meta,
+		sparseIndex: w.pos,
+		sortIndex:   w.keys,
+		lock:        &sync.Mutex{},
+	}, nil
+}
+
+// 放弃写入，删除临时文件
+func (w *tableWriter) abort() {
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}
@@ -0,0 +1,255 @@
+package sstable_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"tinydb/config"
+	"tinydb/kv"
+	"tinydb/sstable"
+)
+
+// 包中的测试共用一份配置和数据目录，config.Init只会生效一次
+var dataDir string
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	dir, err := os.MkdirTemp("", "tinydb-sstable")
+	if err != nil {
+		panic(err)
+	}
+	dataDir = dir
+	config.Init(config.Config{
+		DataDir:            dataDir,
+		Level0Size:         100,
+		PerSize:            2,
+		CompactionStrategy: config.LeveledCompaction,
+		TargetFileSize:     1,
+		LevelCompression:   levelCodecs,
+		BlockSize:          512,
+		ParanoidChecks:     true,
+	})
+	code := m.Run()
+	os.RemoveAll(dataDir)
+	os.Exit(code)
+}
+
+// 清空数据目录，打开一个新的tableTree
+func newTree(t *testing.T) *sstable.TableTree {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		os.RemoveAll(filepath.Join(dataDir, entry.Name()))
+	}
+	return openTree()
+}
+
+// 重新打开数据目录中的tableTree
+func openTree() *sstable.TableTree {
+	tree := &sstable.TableTree{}
+	tree.Init(dataDir)
+	return tree
+}
+
+// 按照key的顺序生成n个kv，值为size字节的随机数据，压缩之后的大小与原始数据接近
+func makeValues(prefix string, n int, size int) []kv.Value {
+	r := rand.New(rand.NewSource(1))
+	values := make([]kv.Value, 0, n)
+	for i := 0; i < n; i++ {
+		value := make([]byte, size)
+		r.Read(value)
+		values = append(values, kv.Value{Key: fmt.Sprintf("%s%06d", prefix, i), Value: value})
+	}
+	return values
+}
+
+// leveled策略下，第1层以及更深的层中的文件的key范围互不重叠
+func TestLeveledCompactionNonOverlapping(t *testing.T) {
+	tree := newTree(t)
+
+	//第0层的文件数量超过PerSize之后被压缩，多个文件的key范围互相重叠，总大小超过目标文件大小
+	values := makeValues("k", 1500, 1024)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 3; i++ {
+			tree.CreateNewTable(values[i*300 : i*300+900])
+		}
+		tree.Check()
+	}
+
+	split := false
+	for level := 1; level < tree.LevelCount(); level++ {
+		tables := tree.LevelTables(level)
+		if len(tables) > 1 {
+			split = true
+		}
+		sort.Slice(tables, func(i, j int) bool {
+			return tables[i].MinKey() < tables[j].MinKey()
+		})
+		for i := 1; i < len(tables); i++ {
+			if tables[i-1].MaxKey() >= tables[i].MinKey() {
+				t.Errorf("level %d: [%s, %s] overlaps [%s, %s]", level,
+					tables[i-1].MinKey(), tables[i-1].MaxKey(), tables[i].MinKey(), tables[i].MaxKey())
+			}
+		}
+	}
+	if !split {
+		t.Errorf("no level was split into multiple tables")
+	}
+	for _, want := range values {
+		got, result := tree.SearchTree(want.Key)
+		if result != kv.Success || !bytes.Equal(got.Value, want.Value) {
+			t.Fatalf("SearchTree(%s) = %v, want the latest value", want.Key, result)
+		}
+	}
+}
+
+// 删除标记只有在输出层是这个key的最底层时才能被丢弃
+func TestTombstoneDroppedAtBaseLevel(t *testing.T) {
+	tree := newTree(t)
+	tree.CreateNewTable([]kv.Value{{Key: "a", Value: []byte("1")}, {Key: "b", Value: []byte("2")}})
+	tree.CompactRange("", "")
+
+	//第0层的文件数量超过PerSize之后，删除标记被压缩到第1层
+	//更深的层中还有a，必须保留删除标记，否则会读到旧的值
+	tree.CreateNewTable([]kv.Value{{Key: "a", Delete: true}})
+	tree.CreateNewTable([]kv.Value{{Key: "x", Value: []byte("3")}})
+	tree.CreateNewTable([]kv.Value{{Key: "y", Value: []byte("4")}})
+	tree.Check()
+	if n := len(tree.LevelTables(0)); n != 0 {
+		t.Fatalf("level 0 still has %d tables", n)
+	}
+	if _, result := tree.SearchTree("a"); result != kv.Deleted {
+		t.Errorf("SearchTree(a) = %v, want Deleted", result)
+	}
+
+	//压缩到最后一层之后，删除标记和旧的值一起被丢弃
+	tree.CompactRange("", "")
+	if _, result := tree.SearchTree("a"); result != kv.None {
+		t.Errorf("SearchTree(a) = %v, want None", result)
+	}
+	if value, result := tree.SearchTree("b"); result != kv.Success || string(value.Value) != "2" {
+		t.Errorf("SearchTree(b) = %q, %v, want 2", value.Value, result)
+	}
+}
+
+// 测试中每一层使用的压缩算法
+var levelCodecs = []string{
+	config.NoCompression,
+	config.SnappyCompression,
+	config.ZstdCompression,
+	config.FlateCompression,
+}
+
+// 同一份数据依次压缩到使用不同压缩算法的每一层，重新打开之后都可以完整地读回
+func TestCompressionRoundTrip(t *testing.T) {
+	values := makeValues("k", 500, 100)
+	tree := newTree(t)
+	tree.CreateNewTable(values)
+	for level, codec := range levelCodecs {
+		if level > 0 {
+			tree.CompactLevel(level - 1)
+		}
+		tree = openTree()
+		if n := len(tree.LevelTables(level)); n != 1 {
+			t.Fatalf("%s: level %d has %d tables, want 1", codec, level, n)
+		}
+		for _, want := range values {
+			got, result := tree.SearchTree(want.Key)
+			if result != kv.Success || !bytes.Equal(got.Value, want.Value) {
+				t.Fatalf("%s: SearchTree(%s) = %q, %v, want %q", codec, want.Key, got.Value, result, want.Value)
+			}
+		}
+	}
+}
+
+// 开启严格检查时，数据块中被修改的字节会被发现，文件被隔离为.corrupt
+func TestCorruptedBlockQuarantined(t *testing.T) {
+	tree := newTree(t)
+	tree.CreateNewTable(makeValues("k", 100, 16))
+
+	name := filepath.Join(dataDir, "0.0.db")
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//数据区从文件开头开始，修改第一个数据块中的一个字节
+	data[10] ^= 0xff
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tree = openTree()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("the corrupted table was not moved: %v", err)
+	}
+	if _, err := os.Stat(name + ".corrupt"); err != nil {
+		t.Errorf("the corrupted table was not quarantined: %v", err)
+	}
+	if _, result := tree.SearchTree("k000000"); result != kv.None {
+		t.Errorf("SearchTree(k000000) = %v, want None", result)
+	}
+}
+
+// 记录压缩任务的次数
+type compactionCounter struct {
+	config.NopEventListener
+	compactions atomic.Int64
+}
+
+func (c *compactionCounter) OnCompactionBegin(config.CompactionInfo) {
+	c.compactions.Add(1)
+}
+
+// tiering策略下最后一层没有大小的阈值，已经合并好的最后一层不会在每次检查时被重写
+func TestBottomLevelNotRecompacted(t *testing.T) {
+	counter := &compactionCounter{}
+	tree := &sstable.TableTree{}
+	tree.Open(t.TempDir(), config.Config{
+		MaxLevels:          2,
+		PerSize:            4,
+		CompactionStrategy: config.TieringCompaction,
+		DynamicLevelSize:   true,
+		EventListener:      counter,
+	})
+	defer tree.Close()
+
+	//最后一层远大于第1层的静态阈值
+	tree.CreateNewTable(makeValues("k", 100, 1024))
+	tree.Check()
+	if n := tree.Levels()[1].Files; n != 1 || counter.compactions.Load() != 1 {
+		t.Fatalf("level 1 has %d files after %d compactions, want 1 file after 1", n, counter.compactions.Load())
+	}
+	for i := 0; i < 3; i++ {
+		tree.Check()
+	}
+	if counter.compactions.Load() != 1 {
+		t.Errorf("the bottom level was compacted %d more times", counter.compactions.Load()-1)
+	}
+
+	//最后一层中的删除标记在下一次检查时被清理，之后不再压缩
+	tree.CreateNewTable([]kv.Value{{Key: "k000000", Delete: true}})
+	tree.Check()
+	tree.Check()
+	if n := tree.Levels()[1].Tombstones; n != 0 {
+		t.Errorf("level 1 has %d tombstones, want 0", n)
+	}
+	if _, result := tree.SearchTree("k000000"); result != kv.None {
+		t.Errorf("SearchTree(k000000) = %v, want None", result)
+	}
+	compactions := counter.compactions.Load()
+	for i := 0; i < 3; i++ {
+		tree.Check()
+	}
+	if counter.compactions.Load() != compactions {
+		t.Errorf("the bottom level was compacted %d more times", counter.compactions.Load()-compactions)
+	}
+}
@@ -1,100 +1,255 @@
 package tinydb
 
 import (
-	"log"
+	"errors"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 	"tinydb/config"
-	"tinydb/sstable"
 	"tinydb/wal"
 )
 
-// 启动kv数据库
-func Start(con config.Config) {
+// 启动kv数据库，返回全局唯一的数据库
+func Start(con config.Config) *Database {
 	if database != nil {
-		return
+		return database
 	}
 	//初始化配置
-	log.SetFlags(log.Lshortfile | log.Lmicroseconds | log.Ldate)
-	log.Println("Loading a Configuration File")
 	config.Init(con)
-	//初始化数据库
-	log.Println("Initializing the database")
-	initDatabase(con.DataDir)
+	db, err := Open(config.GetConfig())
+	if err != nil {
+		config.GetConfig().GetLogger().Error("failed to open the database", "file", con.DataDir, "error", err)
+		panic(err)
+	}
+	database = db
+	return database
+}
+
+// 打开目录con.DataDir中的数据库，并启动它自己的后台任务
+// 与Start不同，同一个进程中可以打开多个数据目录不同的数据库，包级别的Get、Set等函数只会使用Start返回的数据库
+// 不再使用时调用Close关闭
+func Open(con config.Config) (*Database, error) {
+	if con.DataDir == "" {
+		return nil, errors.New("tinydb: DataDir is required")
+	}
+	start := time.Now()
+	db, err := openDatabase(con)
+	if err != nil {
+		return nil, err
+	}
+	db.logger().Info("opened the database", "file", con.DataDir, "duration", time.Since(start))
 
 	//数据库启动之前进行一次数据压缩
-	log.Println("Performing background checks...")
 	//检查压缩数据库文件,这里有必要吗？？？？
-	database.TableTree.Check()
+	for _, cf := range db.allFamilies() {
+		cf.TableTree.Check()
+	}
 	//启动后台线程
-	go Check()
+	db.bgWait.Add(1)
+	go func() {
+		defer db.bgWait.Done()
+		db.check()
+	}()
+	return db, nil
 }
 
-// 初始化数据库,从磁盘中根据wal文件还原memtable
-// 并根据当前的sstable构建tableTree
-func initDatabase(dir string) {
-	database = &Database{
-		MemoryTree:   nil,
-		ImmutableMem: nil,
-		TableTree:    &sstable.TableTree{},
-		Wal:          nil,
-		Wal1:         &wal.Wal{},
-		Wal2:         &wal.Wal{},
+// 初始化数据库,从磁盘中根据wal文件还原每个列族的memtable
+// 并根据当前的sstable构建每个列族的tableTree
+func openDatabase(con config.Config) (*Database, error) {
+	dir := con.DataDir
+	db := &Database{
+		Wal:     nil,
+		Wal1:    &wal.Wal{Logger: con.Logger},
+		Wal2:    &wal.Wal{Logger: con.Logger},
+		dir:     dir,
+		con:     con,
+		closing: make(chan struct{}),
 	}
+	db.bgCond = sync.NewCond(&db.bgLock)
 
 	//从磁盘中开始恢复数据
 	if _, err := os.Stat(dir); err != nil {
 		//刚开始的数据目录不存在
-		log.Printf("The %s directory doesn't exist", dir)
-		err = os.Mkdir(dir, 0666)
-		if err != nil {
-			log.Println("Failed to create the database data directory")
-			panic(err)
+		db.logger().Info("creating the data directory", "file", dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
 		}
 	}
-	database.Wal = database.Wal1
-	//从WAL文件中生成BST树
-	database.MemoryTree = database.Wal1.Init(dir, 1)
-	//初始化辅助日志
-	database.Wal2.Init(dir, 2)
-	log.Println("All log has been created")
-	log.Println("Loading databases...")
-	database.TableTree.Init(dir)
+	db.ColumnFamily = db.openFamily(0, DefaultColumnFamily, config.Config{})
+	db.loadFamilies()
+
+	db.Wal1.Init(dir, 1)
+	db.Wal2.Init(dir, 2)
+	db.recover()
+	db.changes.init(db.seq.Load())
+	for _, w := range []*wal.Wal{db.Wal1, db.Wal2} {
+		w.Sequence = &db.seq
+		w.OnWrite = db.changes.append
+	}
+	db.Wal = db.Wal1
+	return db, nil
 }
 
-// 定期检查memtable中的数据是否超出阈值
-// 如果超出阈值，将memtable转化为immutable
+// 停止后台任务并关闭所有日志和sstable文件，内存表中的数据已经记录在日志中，下一次打开时回放
+// 之后不能再使用这个数据库，多次调用时返回第一次的结果
+func (db *Database) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.closing)
+		db.bgWait.Wait()
+		families := db.allFamilies()
+		//等待正在进行的持久化以及写入完成
+		db.flushLock.Lock()
+		defer db.flushLock.Unlock()
+		db.writeLock.Lock()
+		defer db.writeLock.Unlock()
+
+		db.closeErr = errors.Join(db.Wal1.Close(), db.Wal2.Close())
+		for _, cf := range families {
+			cf.TableTree.Close()
+		}
+		db.logger().Info("closed the database", "file", db.dir)
+	})
+	return db.closeErr
+}
+
+// 按照修改时间从旧到新回放两个日志文件，新的记录覆盖旧的记录
+// 回放完成之后将所有内存表持久化，再清空两个日志文件
+// 同时从日志、保留的日志以及sequence文件中恢复最后一个序列号
+func (db *Database) recover() {
+	db.seq.Store(max(db.loadSequence(), db.archivedSequence()))
+	logs := []*wal.Wal{db.Wal1, db.Wal2}
+	sort.SliceStable(logs, func(i, j int) bool {
+		a, _ := os.Stat(logs[i].Pathname)
+		b, _ := os.Stat(logs[j].Pathname)
+		return a.ModTime().Before(b.ModTime())
+	})
+	for _, w := range logs {
+		for _, record := range w.Load() {
+			db.seq.Store(max(db.seq.Load(), record.Seq))
+			//已经被删除的列族的记录直接忽略
+			cf := db.familyByID(record.Family)
+			if cf == nil {
+				continue
+			}
+			wal.Replay(cf.MemoryTree, record.Value, cf.mergeOperator())
+		}
+	}
+	for _, cf := range db.allFamilies() {
+		values := cf.MemoryTree.GetValue()
+		if len(values) > 0 {
+			cf.TableTree.CreateNewTable(values)
+			cf.MemoryTree.Swap()
+		}
+	}
+	for _, w := range logs {
+		db.resetWal(w)
+	}
+}
+
+// 定期检查全局数据库的memtable中的数据是否超出阈值
+// Start已经在后台执行了检查，不需要再调用
 func Check() {
-	con := config.GetConfig()
-	ticker := time.Tick(time.Duration(con.CheckInterval) * time.Second)
-	for _ = range ticker {
-		log.Println("Performing background checks...")
+	database.check()
+}
+
+// 定期检查memtable中的数据是否超出阈值，直到数据库被关闭
+// 如果超出阈值，将memtable转化为immutable
+func (db *Database) check() {
+	//CheckInterval为0时不做后台检查
+	if db.con.CheckInterval <= 0 {
+		<-db.closing
+		return
+	}
+	ticker := time.NewTicker(time.Duration(db.con.CheckInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-db.closing:
+			return
+		}
+		//后台任务被暂停的时候跳过本次检查
+		if !db.beginBackgroundWork() {
+			continue
+		}
+		db.logger().Debug("performing background checks")
 		//检查memtable内存数据部分
-		checkMem()
-		//检查数据库文件sstable是否需要压缩
-		database.TableTree.Check()
+		db.checkMem()
+		//检查每个列族的sstable是否需要压缩
+		for _, cf := range db.allFamilies() {
+			if !cf.dropped.Load() {
+				cf.TableTree.Check()
+			}
+		}
+		db.endBackgroundWork()
 	}
 }
 
-func checkMem() {
-	con := config.GetConfig()
-	count := database.MemoryTree.Getcount()
-	if count < con.Threshold {
-		return
+// 任意一个列族的memtable超出阈值时，所有列族一起持久化
+// 所有列族共用日志文件，只有全部持久化之后才能清空日志
+func (db *Database) checkMem() {
+	for _, cf := range db.allFamilies() {
+		if cf.MemoryTree.Getcount() >= cf.con.Threshold {
+			//内存中memtable的节点数量多于预期值
+			db.flushMem()
+			return
+		}
 	}
-	//内存中memtable的节点数量多于预期值
-	log.Println("Compressing memory")
-	database.ImmutableMem = database.MemoryTree.Swap()
+}
+
+// 将所有列族当前的memtable转化为immutable，并持久化到sstable中
+func (db *Database) flushMem() {
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+	start := time.Now()
+	defer db.stats.flushLatency.Since(start)
+	db.stats.flushes.Add(1)
+
+	//切换内存表和日志文件的时候不能有写入，保证旧日志中的记录都在immutable中
+	db.writeLock.Lock()
+	families := db.allFamilies()
+	info := config.FlushInfo{Families: len(families)}
+	for _, cf := range families {
+		info.Keys += cf.MemoryTree.Getcount()
+		cf.ImmutableMem = cf.MemoryTree.Swap()
+	}
+	old := db.Wal
 	//每次都交换wal文件指针
-	if filepath.Base(database.Wal.Pathname) == "wal1.log" {
-		database.Wal = database.Wal2
-		database.Wal1.Reset()
+	if filepath.Base(db.Wal.Pathname) == "wal1.log" {
+		db.Wal = db.Wal2
 	} else {
-		database.Wal = database.Wal1
-		database.Wal2.Reset()
+		db.Wal = db.Wal1
 	}
-	log.Println("Resetting the wal.log file success")
+	db.writeLock.Unlock()
+	listener := db.con.GetEventListener()
+	listener.OnFlushBegin(info)
+	listener.OnWALRotated(config.WALInfo{Path: old.Pathname, NewPath: db.Wal.Pathname})
+
 	//将immutableMem中的数据存入到sstable中
-	database.TableTree.CreateNewTable(database.ImmutableMem.GetValue())
+	installs := make([]func(), 0, len(families))
+	for _, cf := range families {
+		if cf.dropped.Load() {
+			continue
+		}
+		values := cf.ImmutableMem.GetValue()
+		if len(values) > 0 {
+			installs = append(installs, cf.TableTree.PrepareTable(values))
+		}
+	}
+	//插入新的sstable的同时清空immutableMem，读取时不会把同一条合并记录计算两次
+	db.writeLock.Lock()
+	for _, install := range installs {
+		install()
+	}
+	for _, cf := range families {
+		cf.ImmutableMem = nil
+	}
+	db.writeLock.Unlock()
+	//所有数据都已经写入sstable之后才能清空旧的日志
+	db.resetWal(old)
+	info.Duration = time.Since(start)
+	db.logger().Info("flushed the memtables", "families", len(families), "keys", info.Keys, "duration", info.Duration)
+	listener.OnFlushEnd(info)
 }
@@ -0,0 +1,104 @@
+package tinydb_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"tinydb"
+	"tinydb/config"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// 打开目录dir中的数据库，测试结束时关闭
+func openDB(t *testing.T, dir string, con config.Config) *tinydb.Database {
+	t.Helper()
+	con.DataDir = dir
+	if con.Threshold == 0 {
+		con.Threshold = 10000
+	}
+	db, err := tinydb.Open(con)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// 关闭数据库之后重新打开，内存表从日志中回放
+func reopen(t *testing.T, db *tinydb.Database, con config.Config) *tinydb.Database {
+	t.Helper()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return openDB(t, con.DataDir, con)
+}
+
+// 并发写入同一个key时，内存表中的顺序与日志中的顺序相同，重新打开之后得到相同的值
+func TestConcurrentWritesMatchWal(t *testing.T) {
+	con := config.Config{DataDir: t.TempDir(), MergeOperator: config.StringAppendOperator}
+	db := openDB(t, con.DataDir, con)
+
+	var wg sync.WaitGroup
+	for _, operand := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if !tinydb.MergeCF(db.ColumnFamily, "k", operand) {
+					t.Errorf("Merge(k, %s) failed", operand)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	live, ok := tinydb.GetCF[string](db.ColumnFamily, "k")
+	if !ok || len(live) != 8*200 {
+		t.Fatalf("Get(k) = %d bytes, %v, want %d bytes", len(live), ok, 8*200)
+	}
+	db = reopen(t, db, con)
+	if replayed, _ := tinydb.GetCF[string](db.ColumnFamily, "k"); replayed != live {
+		t.Errorf("the value replayed from the wal differs from the live value")
+	}
+}
+
+// 数据块损坏时读取返回ErrCorruption，而不是当作key不存在
+func TestGetCorruptedTable(t *testing.T) {
+	con := config.Config{DataDir: t.TempDir()}
+	db := openDB(t, con.DataDir, con)
+	for i := 0; i < 100; i++ {
+		tinydb.SetCF(db.ColumnFamily, fmt.Sprintf("k%03d", i), i)
+	}
+	db.Flush()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(con.DataDir, "0.0.db")
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//数据区从文件开头开始，修改第一个数据块中的一个字节
+	data[10] ^= 0xff
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openDB(t, con.DataDir, con)
+	_, ok, err := tinydb.GetCFContext[int](context.Background(), db.ColumnFamily, "k000")
+	if !errors.Is(err, tinydb.ErrCorruption) || ok {
+		t.Errorf("Get(k000) = %v, %v, want ErrCorruption", ok, err)
+	}
+}
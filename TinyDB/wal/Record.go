@@ -0,0 +1,167 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"tinydb/kv"
+)
+
+// 日志文件中的一条记录
+type Record struct {
+	//记录在文件中的起始位置
+	Offset int64
+	//记录占用的字节数，包括8字节的长度
+	Size int64
+	//记录所属的列族，0表示默认列族
+	Family int
+	//写入时分配的序列号，从1开始递增，没有序列号的旧记录为0
+	Seq   uint64
+	Value kv.Value
+}
+
+// 日志中一条记录的json格式，没有Family的旧记录属于默认列族
+// 批量写入的多个元素保存在同一条记录的Batch中，回放时要么全部生效要么全部丢弃
+type entry struct {
+	kv.Value
+	Family int     `json:",omitempty"`
+	Seq    uint64  `json:",omitempty"`
+	Batch  []entry `json:",omitempty"`
+}
+
+// 将一组记录编码成一条日志，包括8字节的长度
+func encodeRecords(records []Record) ([]byte, error) {
+	var e entry
+	if len(records) == 1 {
+		e = entry{Value: records[0].Value, Family: records[0].Family, Seq: records[0].Seq}
+	} else {
+		e.Batch = make([]entry, 0, len(records))
+		for _, record := range records {
+			e.Batch = append(e.Batch, entry{Value: record.Value, Family: record.Family, Seq: record.Seq})
+		}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint64(buf, uint64(len(data)))
+	return append(buf, data...), nil
+}
+
+// 依次解析日志文件中的记录，每条记录为8字节的长度加上json格式的数据
+// 批量写入的记录被展开成多条Offset相同的记录
+// 遇到无法解析的记录时停止，返回之前的所有记录、这些记录占用的字节数以及错误
+func decodeRecords(data []byte) ([]Record, int64, error) {
+	records := make([]Record, 0)
+	size := int64(len(data))
+	//当前索引
+	index := int64(0)
+	for index < size {
+		//首先读取前8个字节,读取该元素的长度
+		if index+8 > size {
+			return records, index, fmt.Errorf("truncated record length at offset %d", index)
+		}
+		datalen := int64(binary.LittleEndian.Uint64(data[index : index+8]))
+		if datalen < 0 || index+8+datalen > size {
+			return records, index, fmt.Errorf("truncated record at offset %d", index)
+		}
+		//将二进制内容反序列化成kv结构
+		var e entry
+		if err := json.Unmarshal(data[index+8:index+8+datalen], &e); err != nil {
+			return records, index, fmt.Errorf("invalid record at offset %d: %w", index, err)
+		}
+		if e.Batch == nil {
+			records = append(records, Record{Offset: index, Size: 8 + datalen, Family: e.Family, Seq: e.Seq, Value: e.Value})
+		}
+		for _, item := range e.Batch {
+			records = append(records, Record{Offset: index, Size: 8 + datalen, Family: item.Family, Seq: item.Seq, Value: item.Value})
+		}
+		index += 8 + datalen
+	}
+	return records, index, nil
+}
+
+// 一个日志文件的检查结果
+type LogCheck struct {
+	//文件路径
+	Path string
+	//可以正常读取的记录数量
+	Records int
+	//文件大小
+	Size int64
+	//可以正常读取的记录占用的字节数，之后的数据都无法读取
+	ValidSize int64
+	//发现的问题
+	Error string
+}
+
+// 文件是否完好
+func (c *LogCheck) OK() bool {
+	return c.Error == ""
+}
+
+// 离线检查一个日志文件
+func CheckFile(path string) LogCheck {
+	_, check := Salvage(path)
+	return check
+}
+
+// 读取一个日志文件中所有可以正常读取的记录
+func Salvage(path string) ([]Record, LogCheck) {
+	check := LogCheck{Path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		check.Error = err.Error()
+		return nil, check
+	}
+	records, validSize, err := decodeRecords(data)
+	check.Records = len(records)
+	check.Size = int64(len(data))
+	check.ValidSize = validSize
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return records, check
+}
+
+// 逐条打印一个日志文件中的记录以及它们在文件中的位置
+// 遇到无法解析的记录时打印错误并停止，返回值只表示文件无法打开
+func Dump(path string, w io.Writer) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	records, check := Salvage(path)
+	fmt.Fprintf(w, "%-10s %-8s %-8s %-4s %-7s %s\n", "offset", "size", "seq", "op", "key", "value")
+	sets, deletes, merges := 0, 0, 0
+	for _, record := range records {
+		//非默认列族的key前面加上列族的编号
+		key := record.Value.Key
+		if record.Family != 0 {
+			key = fmt.Sprintf("[%d]%s", record.Family, key)
+		}
+		if record.Value.Delete {
+			deletes++
+			fmt.Fprintf(w, "%-10d %-8d %-8d %-4s %s\n", record.Offset, record.Size, record.Seq, "DEL", key)
+			continue
+		}
+		if record.Value.Merge {
+			merges++
+			fmt.Fprintf(w, "%-10d %-8d %-8d %-4s %-7s %s\n", record.Offset, record.Size, record.Seq, "MRG", key,
+				bytes.Join(record.Value.Operands, []byte(" ")))
+			continue
+		}
+		sets++
+		fmt.Fprintf(w, "%-10d %-8d %-8d %-4s %-7s %s\n", record.Offset, record.Size, record.Seq, "SET", key, record.Value.Value)
+	}
+	fmt.Fprintf(w, "\n%s: %d records (%d sets, %d deletes, %d merges), %d bytes\n",
+		path, check.Records, sets, deletes, merges, check.Size)
+	if !check.OK() {
+		fmt.Fprintf(w, "error: %s, %d bytes after offset %d are unreadable\n",
+			check.Error, check.Size-check.ValidSize, check.ValidSize)
+	}
+	return nil
+}
@@ -1,13 +1,14 @@
 package wal
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"os"
 	"path"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"tinydb/config"
 	"tinydb/kv"
 	"tinydb/memtable"
 )
@@ -16,11 +17,27 @@ type Wal struct {
 	file     *os.File
 	Pathname string
 	lock     *sync.Mutex
+	//两个日志文件共用的序列号计数器，保存最后一个分配的序列号，为nil时不分配序列号
+	Sequence *atomic.Uint64
+	//记录写入成功之后在持有锁的时候调用，调用的顺序与序列号的顺序相同
+	OnWrite func(records []Record)
+	//文件中第一条和最后一条记录的序列号
+	first, last uint64
+	//打开之后累计写入的字节数，清空文件时不会归零
+	written atomic.Int64
+	//输出日志使用的Logger，为空时使用数据库配置中的Logger
+	Logger config.Logger
 }
 
-// 日志的初始化
-func (w *Wal) Init(dir string, index int) *memtable.Tree {
-	log.Println("loading wal.log...")
+func (w *Wal) logger() config.Logger {
+	if w.Logger != nil {
+		return w.Logger
+	}
+	return config.GetConfig().GetLogger()
+}
+
+// 日志的初始化，打开或者创建目录dir中的日志文件
+func (w *Wal) Init(dir string, index int) {
 	var walpath string
 	if index == 1 {
 		walpath = path.Join(dir, "wal1.log")
@@ -29,115 +46,218 @@ func (w *Wal) Init(dir string, index int) *memtable.Tree {
 	}
 	f, err := os.OpenFile(walpath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		log.Println("the wal.log cannot be create")
+		w.logger().Error("failed to open the wal", "file", walpath, "error", err)
 		panic(err)
 	}
-	log.Println("wal.log had been create")
+	w.logger().Debug("opened the wal", "file", walpath)
 	w.file = f
 	w.Pathname = walpath
 	w.lock = &sync.Mutex{}
-	return w.LoadtoMem()
 }
 
-// 记录日志
-func (w *Wal) Writer(value kv.Value) {
-	//首先转化成json格式的字符串，然后再转化成二进制格式的数据进行存储
-	data, _ := json.Marshal(value)
-	log.Println(data)
-	//首先以小端的方式写入8字节的数据长度
-	err := binary.Write(w.file, binary.LittleEndian, int64(len(data)))
-	if err != nil {
-		log.Println(err)
-	}
-	//然后以小端的方式写入数据
-	err = binary.Write(w.file, binary.LittleEndian, data)
-	if err != nil {
-		log.Println(err)
-	}
+// 记录默认列族的日志
+func (w *Wal) Writer(value kv.Value) error {
+	return w.Write([]Record{{Value: value}})
 }
 
-// 加载WAL文件中的数据到内存表memtable中
-func (w *Wal) LoadtoMem() *memtable.Tree {
+// 将一组记录作为一条日志写入，回放时这些记录要么全部生效要么全部丢弃
+// 每条记录依次分配一个序列号，写入到records中
+// 写入失败时返回错误，调用者不能再将这些记录写入内存表
+func (w *Wal) Write(records []Record) error {
+	return w.WriteFunc(records, nil)
+}
+
+// 与Write相同，写入成功之后在持有锁的时候先调用apply再调用OnWrite
+// 在apply中将记录写入内存表，并发写入同一个key时内存表中的顺序与日志中的顺序相同
+func (w *Wal) WriteFunc(records []Record, apply func(records []Record)) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	info, _ := os.Stat(w.Pathname)
-	size := info.Size()
-	tree := &memtable.Tree{}
-	tree.Init()
-	if size == 0 {
-		//空的wal文件
-		return tree
+	if w.Sequence != nil {
+		for i := range records {
+			records[i].Seq = w.Sequence.Add(1)
+		}
+	}
+	//首先转化成json格式的字符串，前面加上小端的8字节数据长度
+	data, err := encodeRecords(records)
+	if err == nil {
+		//长度和数据一次写入，避免并发写入的记录相互交错
+		_, err = w.file.Write(data)
 	}
-
-	_, err := w.file.Seek(0, 0)
 	if err != nil {
-		log.Println("failed to seek the wal.log")
-		panic(err)
+		w.logger().Error("failed to write the wal", "file", w.Pathname, "error", err)
+		//写入失败的记录不占用序列号，保证序列号是连续的
+		if w.Sequence != nil {
+			w.Sequence.Add(^uint64(len(records) - 1))
+		}
+		return err
 	}
-	//将文件指针移动到最后，方便之后操作
-	defer func(f *os.File, offset int64, whence int) {
-		_, err := f.Seek(offset, whence)
-		if err != nil {
-			log.Println("Failed to seek the wal.log")
-			panic(err)
+	w.written.Add(int64(len(data)))
+	w.track(records)
+	if apply != nil {
+		apply(records)
+	}
+	if w.OnWrite != nil {
+		w.OnWrite(records)
+	}
+	return nil
+}
+
+// 记录文件中第一条和最后一条记录的序列号，调用者需要持有锁
+func (w *Wal) track(records []Record) {
+	for _, record := range records {
+		if record.Seq == 0 {
+			continue
+		}
+		if w.first == 0 {
+			w.first = record.Seq
 		}
-	}(w.file, size-1, 0)
+		w.last = record.Seq
+	}
+}
+
+// 读取WAL文件中的所有记录，用于回放到各个列族的内存表memtable中
+func (w *Wal) Load() []Record {
+	w.lock.Lock()
+	defer w.lock.Unlock()
 
 	//首先将文件内容全部读取到字节切片中
-	data := make([]byte, size)
-	//读取len（data）字节写入data
-	_, err = w.file.Read(data)
+	data, err := os.ReadFile(w.Pathname)
 	if err != nil {
-		log.Println("failed to read the wal.log")
+		w.logger().Error("failed to read the wal", "file", w.Pathname, "error", err)
 		panic(err)
 	}
+	//开始根据文件中的具体元素构造记录
+	records, _, err := decodeRecords(data)
+	if err != nil {
+		w.logger().Error("the wal is corrupted, run `tinydb repair` to salvage the readable records", "file", w.Pathname, "error", err)
+		panic(err)
+	}
+	w.first, w.last = 0, 0
+	w.track(records)
+	return records
+}
 
-	//开始根据文件中的具体元素构造整颗树
-	//每一个元素的字节数量
-	datelen := int64(0)
-	//当前索引
-	index := int64(0)
-	for index < size {
-		//首先读取前8个字节,读取该元素的长度
-		indexData := data[index:(index + 8)]
-		//从一个切片构造一个Buffer
-		buf := bytes.NewBuffer(indexData)
-		err := binary.Read(buf, binary.LittleEndian, &datelen)
-		if err != nil {
-			log.Println("Failed to open the wal.log")
-			panic(err)
-		}
-
-		index += 8
-		//获取具体的数据
-		dataContent := data[index:(index + datelen)]
-		var value kv.Value
-		//将二进制内容反序列化成kv结构
-		err = json.Unmarshal(dataContent, &value)
-		if err != nil {
-			log.Println("Failed to open the wal.log")
-			panic(err)
-		}
-
-		if value.Delete {
-			tree.Delete(value.Key)
-		} else {
-			tree.Set(value.Key, value.Value)
+// 将记录回放到内存表中，合并记录使用合并算子op
+func Replay(tree *memtable.Tree, value kv.Value, op kv.MergeOperator) {
+	if value.Delete {
+		tree.Delete(value.Key)
+	} else if value.Merge {
+		for _, operand := range value.Operands {
+			tree.Merge(value.Key, operand, op)
 		}
-		index += datelen
+	} else {
+		tree.Set(value.Key, value.Value)
 	}
-	return tree
 }
 
 func (w *Wal) Reset() {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	log.Println("Clear the wal.log file")
+	w.logger().Debug("clearing the wal", "file", w.Pathname)
 	//将文件内容重新置0
 	err := w.file.Truncate(0)
 	if err != nil {
-		log.Println("Error to clear the wal.log file", w.Pathname)
+		w.logger().Error("failed to clear the wal", "file", w.Pathname, "error", err)
+	}
+	w.first, w.last = 0, 0
+}
+
+// 将已经写入的记录刷到磁盘上
+func (w *Wal) Sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.file.Sync()
+}
+
+// 关闭日志文件，之后不能再写入
+func (w *Wal) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.file.Close()
+}
+
+// 打开之后累计写入的字节数
+func (w *Wal) BytesWritten() int64 {
+	return w.written.Load()
+}
+
+// 最后一条记录的序列号，文件为空时返回0
+func (w *Wal) LastSeq() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.last
+}
+
+// 将日志文件移动到目录dir中保留，之后使用一个新的空文件
+// 保留的文件以其中第一条和最后一条记录的序列号命名，没有序列号的日志直接清空
+func (w *Wal) Archive(dir string) {
+	w.lock.Lock()
+	if w.first == 0 {
+		w.lock.Unlock()
+		w.Reset()
+		return
+	}
+	defer w.lock.Unlock()
+
+	name := path.Join(dir, fmt.Sprintf("%020d-%020d.log", w.first, w.last))
+	w.logger().Debug("archiving the wal", "file", w.Pathname, "archive", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		w.logger().Error("failed to create the wal archive directory", "file", dir, "error", err)
+		panic(err)
+	}
+	if err := w.file.Close(); err != nil {
+		w.logger().Error("failed to close the wal", "file", w.Pathname, "error", err)
+	}
+	if err := os.Rename(w.Pathname, name); err != nil {
+		w.logger().Error("failed to archive the wal", "file", w.Pathname, "error", err)
+		panic(err)
+	}
+	f, err := os.OpenFile(w.Pathname, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		w.logger().Error("failed to open the wal", "file", w.Pathname, "error", err)
+		panic(err)
+	}
+	w.file = f
+	w.first, w.last = 0, 0
+}
+
+// 保留的一个日志文件
+type Segment struct {
+	Path string
+	//文件中第一条和最后一条记录的序列号
+	First, Last uint64
+	Size        int64
+}
+
+// 获取目录dir中保留的所有日志文件，按照序列号从小到大排列
+func Segments(dir string) ([]Segment, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	segments := make([]Segment, 0, len(entries))
+	for _, entry := range entries {
+		var segment Segment
+		if n, _ := fmt.Sscanf(entry.Name(), "%d-%d.log", &segment.First, &segment.Last); n != 2 {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segment.Path = path.Join(dir, entry.Name())
+		segment.Size = info.Size()
+		segments = append(segments, segment)
 	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].First < segments[j].First
+	})
+	return segments, nil
 }